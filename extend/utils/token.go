@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Actions a signed url grants, a play url does not let its holder publish.
+const (
+	TOKEN_ACTION_PLAY    = "play"
+	TOKEN_ACTION_PUBLISH = "publish"
+)
+
+// URLToken signs action on path until expires (unix seconds), ip is optional
+// and binds the token to one client address.
+// token = hex(HMAC-SHA256(secret, action + "\n" + path + "\n" + expires + "\n" + ip))
+func URLToken(secret, action, path string, expires int64, ip string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(action))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(path))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(strconv.FormatInt(expires, 10)))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CheckURLToken accepts tokens of action bound to ip as well as unbound ones.
+// Without a secret every token is refused, anybody could sign one.
+func CheckURLToken(secret, action, path, token, expires, ip string) error {
+	if secret == "" {
+		return fmt.Errorf("token_secret not configured")
+	}
+	if token == "" || expires == "" {
+		return fmt.Errorf("token or expires not found")
+	}
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid expires[%s]", expires)
+	}
+	if time.Now().Unix() > exp {
+		return fmt.Errorf("token expired at %s", DateTime(time.Unix(exp, 0)))
+	}
+	sig, err := hex.DecodeString(token)
+	if err != nil {
+		return fmt.Errorf("invalid token")
+	}
+	for _, _ip := range []string{ip, ""} {
+		expect, _ := hex.DecodeString(URLToken(secret, action, path, exp, _ip))
+		if hmac.Equal(sig, expect) {
+			return nil
+		}
+	}
+	return fmt.Errorf("token mismatch")
+}
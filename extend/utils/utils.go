@@ -166,7 +166,9 @@ func SaveToConf(section string, kvmap map[string]string) error {
 	for k, v := range kvmap {
 		sec.Key(k).SetValue(v)
 	}
-	_conf.SaveTo(ConfFile())
+	if err = _conf.SaveTo(ConfFile()); err != nil {
+		return err
+	}
 	conf = _conf
 	return nil
 }
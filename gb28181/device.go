@@ -0,0 +1,372 @@
+package gb28181
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// Device is a GB28181 device registered to the server, a camera or a NVR
+// whose channels are the cameras.
+type Device struct {
+	ID          string         `json:"id"`
+	Addr        string         `json:"addr"` // where the device sends sip from
+	Online      bool           `json:"online"`
+	Expires     int            `json:"expires"` // of the registration, in seconds
+	RegisterAt  utils.DateTime `json:"registerAt"`
+	KeepaliveAt utils.DateTime `json:"keepaliveAt"`
+	Channels    []*Channel     `json:"channels"` // of the last catalog query
+
+	addr *net.UDPAddr
+}
+
+// Channel is a video source of a device, from its catalog.
+type Channel struct {
+	ID           string `json:"id" xml:"DeviceID"`
+	Name         string `json:"name" xml:"Name"`
+	Manufacturer string `json:"manufacturer" xml:"Manufacturer"`
+	Model        string `json:"model" xml:"Model"`
+	ParentID     string `json:"parentId" xml:"ParentID"`
+	Status       string `json:"status" xml:"Status"` // ON or OFF
+	Path         string `json:"path" xml:"-"`        // of the live view on the rtsp server
+}
+
+// manscdp is a MANSCDP message, GB/T 28181 Annex A, of the commands handled:
+// Keepalive notifies and Catalog responses.
+type manscdp struct {
+	XMLName  xml.Name
+	CmdType  string     `xml:"CmdType"`
+	SN       int        `xml:"SN"`
+	DeviceID string     `xml:"DeviceID"`
+	SumNum   int        `xml:"SumNum"`
+	Items    []*Channel `xml:"DeviceList>Item"`
+}
+
+// parseMANSCDP decodes the xml body of a MESSAGE, devices declare GB2312
+// mostly.
+func parseMANSCDP(body string) (*manscdp, error) {
+	decoder := xml.NewDecoder(strings.NewReader(body))
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		switch strings.ToLower(charset) {
+		case "gb2312", "gbk", "gb18030":
+			return simplifiedchinese.GB18030.NewDecoder().Reader(input), nil
+		case "utf-8", "utf8":
+			return input, nil
+		}
+		return nil, fmt.Errorf("unsupported charset %s", charset)
+	}
+	msg := &manscdp{}
+	if err := decoder.Decode(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// StreamPath returns the path the live view of the channel is published to.
+func StreamPath(deviceID, channelID string) string {
+	return fmt.Sprintf("/gb28181/%s/%s", deviceID, channelID)
+}
+
+// parseStreamPath returns the device and the channel of a StreamPath.
+func parseStreamPath(path string) (deviceID, channelID string, ok bool) {
+	items := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(items) != 3 || items[0] != "gb28181" || items[1] == "" || items[2] == "" {
+		return "", "", false
+	}
+	return items[1], items[2], true
+}
+
+// Devices returns the devices registered, and those gone offline since.
+func (server *Server) Devices() []Device {
+	server.devicesLock.RLock()
+	defer server.devicesLock.RUnlock()
+	devices := make([]Device, 0, len(server.devices))
+	for _, device := range server.devices {
+		devices = append(devices, device.copy())
+	}
+	return devices
+}
+
+// GetDevice returns the device of id, nil if it never registered.
+func (server *Server) GetDevice(id string) *Device {
+	server.devicesLock.RLock()
+	defer server.devicesLock.RUnlock()
+	device, ok := server.devices[id]
+	if !ok {
+		return nil
+	}
+	copied := device.copy()
+	return &copied
+}
+
+func (device *Device) copy() Device {
+	copied := *device
+	copied.Channels = make([]*Channel, 0, len(device.Channels))
+	for _, channel := range device.Channels {
+		c := *channel
+		copied.Channels = append(copied.Channels, &c)
+	}
+	return copied
+}
+
+// nonceTimeout is how long a device has to answer a challenge, maxNonces
+// how many challenges may be pending.
+const (
+	nonceTimeout = time.Minute
+	maxNonces    = 4096
+)
+
+// newNonce returns the nonce of a new challenge.
+func (server *Server) newNonce() string {
+	nonce := randomHex(16)
+	server.noncesLock.Lock()
+	if len(server.nonces) >= maxNonces {
+		// a flood of REGISTERs, the oldest challenges go first.
+		oldest, oldestExpires := "", time.Time{}
+		for n, expires := range server.nonces {
+			if oldest == "" || expires.Before(oldestExpires) {
+				oldest, oldestExpires = n, expires
+			}
+		}
+		delete(server.nonces, oldest)
+	}
+	server.nonces[nonce] = time.Now().Add(nonceTimeout)
+	server.noncesLock.Unlock()
+	return nonce
+}
+
+// takeNonce tells whether nonce is of a challenge not expired, and forgets
+// it so that an Authorization can not be replayed.
+func (server *Server) takeNonce(nonce string) bool {
+	server.noncesLock.Lock()
+	defer server.noncesLock.Unlock()
+	expires, ok := server.nonces[nonce]
+	delete(server.nonces, nonce)
+	return ok && time.Now().Before(expires)
+}
+
+// expireNonces forgets the challenges no device answered.
+func (server *Server) expireNonces(now time.Time) {
+	server.noncesLock.Lock()
+	defer server.noncesLock.Unlock()
+	for nonce, expires := range server.nonces {
+		if now.After(expires) {
+			delete(server.nonces, nonce)
+		}
+	}
+}
+
+var digestParamRex = regexp.MustCompile(`(\w+)="?([^",]*)"?`)
+
+// checkAuth verifies the digest Authorization of a REGISTER, RFC 2617,
+// against the password of the server. The username is the device and the
+// nonce one of an unexpired challenge, which it uses up.
+func (server *Server) checkAuth(req *Message) bool {
+	authLine := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authLine, "Digest") {
+		return false
+	}
+	params := make(map[string]string)
+	for _, match := range digestParamRex.FindAllStringSubmatch(strings.TrimPrefix(authLine, "Digest"), -1) {
+		params[strings.ToLower(match[1])] = match[2]
+	}
+	if params["username"] != uriUser(req.Header.Get("From")) || !server.takeNonce(params["nonce"]) {
+		return false
+	}
+	ha1 := utils.MD5(fmt.Sprintf("%s:%s:%s", params["username"], params["realm"], server.password))
+	ha2 := utils.MD5(fmt.Sprintf("%s:%s", req.Method, params["uri"]))
+	response := utils.MD5(fmt.Sprintf("%s:%s:%s", ha1, params["nonce"], ha2))
+	if qop := params["qop"]; qop != "" {
+		response = utils.MD5(fmt.Sprintf("%s:%s:%s:%s:%s:%s", ha1, params["nonce"], params["nc"], params["cnonce"], qop, ha2))
+	}
+	return strings.EqualFold(response, params["response"])
+}
+
+func (server *Server) handleRegister(req *Message, addr *net.UDPAddr) {
+	deviceID := uriUser(req.Header.Get("From"))
+	if !sipIDRex.MatchString(deviceID) {
+		server.logger.Printf("REGISTER of invalid device id[%s] from %v", deviceID, addr)
+		server.send(NewResponse(req, 400, "Bad Request"), addr)
+		return
+	}
+	if server.password != "" && !server.checkAuth(req) {
+		res := NewResponse(req, 401, "Unauthorized")
+		res.Header.Set("WWW-Authenticate", fmt.Sprintf(`Digest realm="%s",nonce="%s",algorithm=MD5`, server.Domain, server.newNonce()))
+		server.send(res, addr)
+		return
+	}
+	expires := 3600
+	if v, err := strconv.Atoi(req.Header.Get("Expires")); err == nil {
+		expires = v
+	} else if v, err := strconv.Atoi(headerParam(req.Header.Get("Contact"), "expires")); err == nil {
+		expires = v
+	}
+	res := NewResponse(req, 200, "OK")
+	res.Header.Set("Date", time.Now().Format("2006-01-02T15:04:05.000"))
+	res.Header.Set("Expires", strconv.Itoa(expires))
+	if contact := req.Header.Get("Contact"); contact != "" {
+		res.Header.Set("Contact", contact)
+	}
+	server.send(res, addr)
+	if expires == 0 {
+		server.devicesLock.Lock()
+		delete(server.devices, deviceID)
+		server.devicesLock.Unlock()
+		server.logger.Printf("device[%s] unregistered", deviceID)
+		server.stopLives(deviceID, fmt.Errorf("device %s unregistered", deviceID))
+		return
+	}
+	now := time.Now()
+	server.devicesLock.Lock()
+	device, ok := server.devices[deviceID]
+	if !ok {
+		device = &Device{ID: deviceID, Channels: make([]*Channel, 0)}
+		server.devices[deviceID] = device
+	}
+	online := device.Online
+	device.Online = true
+	device.Addr = addr.String()
+	device.addr = addr
+	device.Expires = expires
+	device.RegisterAt = utils.DateTime(now)
+	device.KeepaliveAt = utils.DateTime(now)
+	server.devicesLock.Unlock()
+	if !online {
+		server.logger.Printf("device[%s] registered from %v, expires %ds", deviceID, addr, expires)
+		go func() {
+			if err := server.QueryCatalog(deviceID); err != nil {
+				server.logger.Printf("query catalog of device[%s] err:%v", deviceID, err)
+			}
+		}()
+	}
+}
+
+func (server *Server) handleMessage(req *Message, addr *net.UDPAddr) {
+	deviceID := uriUser(req.Header.Get("From"))
+	server.devicesLock.Lock()
+	device, ok := server.devices[deviceID]
+	if !ok || !device.Online || device.Addr != addr.String() {
+		server.devicesLock.Unlock()
+		// the device registers again on it, only a REGISTER moves it to
+		// another address.
+		server.send(NewResponse(req, 403, "Forbidden"), addr)
+		return
+	}
+	device.KeepaliveAt = utils.DateTime(time.Now())
+	server.devicesLock.Unlock()
+	server.send(NewResponse(req, 200, "OK"), addr)
+
+	msg, err := parseMANSCDP(req.Body)
+	if err != nil {
+		server.logger.Printf("device[%s] sent invalid MANSCDP, %v", deviceID, err)
+		return
+	}
+	switch msg.CmdType {
+	case "Keepalive":
+	case "Catalog":
+		server.mergeCatalog(deviceID, msg.Items)
+	default:
+		server.logger.Printf("device[%s] sent %s %s, ignored", deviceID, msg.XMLName.Local, msg.CmdType)
+	}
+}
+
+// mergeCatalog updates the channels of the device by those of a catalog
+// response, a catalog may come in several messages.
+func (server *Server) mergeCatalog(deviceID string, items []*Channel) {
+	server.devicesLock.Lock()
+	defer server.devicesLock.Unlock()
+	device, ok := server.devices[deviceID]
+	if !ok {
+		return
+	}
+	for _, item := range items {
+		if item.ID == "" {
+			continue
+		}
+		item.Path = StreamPath(deviceID, item.ID)
+		merged := false
+		for i, channel := range device.Channels {
+			if channel.ID == item.ID {
+				device.Channels[i] = item
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			device.Channels = append(device.Channels, item)
+		}
+	}
+	server.logger.Printf("device[%s] catalog got %d channels, now %d", deviceID, len(items), len(device.Channels))
+}
+
+// QueryCatalog asks the device for its channels, the device sends them in
+// MESSAGEs of its own later.
+func (server *Server) QueryCatalog(deviceID string) error {
+	device := server.GetDevice(deviceID)
+	if device == nil || !device.Online {
+		return fmt.Errorf("device %s offline", deviceID)
+	}
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0" encoding="GB2312"?>` + "\r\n")
+	fmt.Fprintf(&body, "<Query>\r\n<CmdType>Catalog</CmdType>\r\n<SN>%d</SN>\r\n<DeviceID>%s</DeviceID>\r\n</Query>\r\n", atomic.AddInt32(&server.sn, 1), xmlEscape(deviceID))
+	req := server.newRequest(MESSAGE, deviceID, device.addr)
+	req.Header.Set("Content-Type", "Application/MANSCDP+xml")
+	req.Body = body.String()
+	res, err := server.request(req, device.addr, server.requestTimeout())
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != 200 {
+		return fmt.Errorf("catalog query got %d %s", res.StatusCode, res.Reason)
+	}
+	return nil
+}
+
+// checkDevices takes the devices offline which stop sending keepalives, or
+// do not register again before their registration expires.
+func (server *Server) checkDevices(stop chan struct{}) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			server.expireNonces(now)
+			timeout := time.Duration(utils.Conf().Section("gb28181").Key("keepalive_timeout").MustInt(180)) * time.Second
+			offline := make([]string, 0)
+			server.devicesLock.Lock()
+			for id, device := range server.devices {
+				if !device.Online {
+					continue
+				}
+				expired := now.After(time.Time(device.RegisterAt).Add(time.Duration(device.Expires) * time.Second))
+				if expired || (timeout > 0 && now.Sub(time.Time(device.KeepaliveAt)) > timeout) {
+					device.Online = false
+					offline = append(offline, id)
+				}
+			}
+			server.devicesLock.Unlock()
+			for _, id := range offline {
+				server.logger.Printf("device[%s] offline", id)
+				server.stopLives(id, fmt.Errorf("device %s offline", id))
+			}
+		}
+	}
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
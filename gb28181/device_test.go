@@ -0,0 +1,130 @@
+package gb28181
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+func TestParseMANSCDP(t *testing.T) {
+	name, err := simplifiedchinese.GB18030.NewEncoder().String("前门摄像机")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `<?xml version="1.0" encoding="GB2312"?>
+<Response>
+<CmdType>Catalog</CmdType>
+<SN>17</SN>
+<DeviceID>34020000001320000001</DeviceID>
+<SumNum>2</SumNum>
+<DeviceList Num="2">
+<Item><DeviceID>34020000001320000002</DeviceID><Name>` + name + `</Name><Status>ON</Status></Item>
+<Item><DeviceID>34020000001320000003</DeviceID><Name>back</Name><Status>OFF</Status></Item>
+</DeviceList>
+</Response>`
+	msg, err := parseMANSCDP(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.XMLName.Local != "Response" || msg.CmdType != "Catalog" || msg.SN != 17 || msg.SumNum != 2 || len(msg.Items) != 2 {
+		t.Fatalf("msg = %+v", msg)
+	}
+	if msg.Items[0].Name != "前门摄像机" || msg.Items[0].ID != "34020000001320000002" || msg.Items[1].Status != "OFF" {
+		t.Errorf("items = %+v %+v", msg.Items[0], msg.Items[1])
+	}
+
+	if _, err := parseMANSCDP(`<?xml version="1.0" encoding="BIG5"?><Notify></Notify>`); err == nil {
+		t.Error("parseMANSCDP of an unsupported charset, no error")
+	}
+	if _, err := parseMANSCDP(`<Notify><CmdType>Keepalive`); err == nil {
+		t.Error("parseMANSCDP of a truncated body, no error")
+	}
+}
+
+func TestParseStreamPath(t *testing.T) {
+	tests := []struct {
+		path            string
+		device, channel string
+		ok              bool
+	}{
+		{StreamPath("34020000001320000001", "34020000001320000002"), "34020000001320000001", "34020000001320000002", true},
+		{"gb28181/a/b", "a", "b", true},
+		{"/gb28181/a", "", "", false},
+		{"/gb28181/a/b/c", "", "", false},
+		{"/gb28181//b", "", "", false},
+		{"/live/a/b", "", "", false},
+	}
+	for _, tt := range tests {
+		device, channel, ok := parseStreamPath(tt.path)
+		if device != tt.device || channel != tt.channel || ok != tt.ok {
+			t.Errorf("parseStreamPath(%q) = %q, %q, %v", tt.path, device, channel, ok)
+		}
+	}
+}
+
+func TestRegisterDeviceID(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server := &Server{
+		logger:       log.New(ioutil.Discard, "", 0),
+		ID:           "34020000002000000001",
+		Domain:       "3402000000",
+		conn:         conn,
+		devices:      make(map[string]*Device),
+		transactions: make(map[string]chan *Message),
+	}
+	register := func(from string) *Message {
+		t.Helper()
+		req := &Message{Method: REGISTER, URI: "sip:34020000002000000001@3402000000", Header: make(Header)}
+		req.Header.Set("Via", "SIP/2.0/UDP 127.0.0.1:5060;branch="+newBranch())
+		req.Header.Set("From", from+";tag="+newTag())
+		req.Header.Set("To", from)
+		req.Header.Set("Call-ID", randomHex(16))
+		req.Header.Set("CSeq", "1 REGISTER")
+		req.Header.Set("Expires", "3600")
+		server.handleRegister(req, client.LocalAddr().(*net.UDPAddr))
+		buf := make([]byte, 65536)
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := ParseMessage(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	for _, from := range []string{
+		"<sip:3402000000@3402000000>",
+		"<sip:@3402000000>",
+		"<sip:3402000000132000000a@3402000000>",
+		"<sip:34020000/0132000001@3402000000>",
+		"<sip:340200000013200000011@3402000000>",
+	} {
+		if res := register(from); res.StatusCode != 400 {
+			t.Errorf("REGISTER from %s got %d %s", from, res.StatusCode, res.Reason)
+		}
+	}
+	if devices := server.Devices(); len(devices) != 0 {
+		t.Errorf("invalid devices stored: %v", devices)
+	}
+	if res := register("<sip:34020000001320000001@3402000000>"); res.StatusCode != 200 {
+		t.Errorf("REGISTER got %d %s", res.StatusCode, res.Reason)
+	}
+	if device := server.GetDevice("34020000001320000001"); device == nil || !device.Online {
+		t.Errorf("device %v not registered", device)
+	}
+}
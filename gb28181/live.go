@@ -0,0 +1,624 @@
+package gb28181
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+	"github.com/snowlyg/EasyDarwin/rtsp"
+)
+
+// ssrcRex finds the ssrc of a GB28181 sdp, GB/T 28181 Annex G.
+var ssrcRex = regexp.MustCompile(`(?m)^y=([0-9]+)\s*$`)
+
+// live is the live view of a channel, the INVITE dialog and the ps over rtp
+// it brings, published as a pusher from the first key frame.
+type live struct {
+	server      *Server
+	deviceID    string
+	channelID   string
+	path        string
+	addr        *net.UDPAddr // of the device
+	transType   rtsp.TransType
+	callID      string
+	ssrc        string
+	ssrcValue   uint32 // of the rtp, the y= of the answer or else of the offer
+	port        int
+	timeout     time.Duration
+	idleTimeout time.Duration
+
+	// the dialog, once the INVITE succeeded.
+	invite   *Message
+	response *Message
+
+	udpConn     *net.UDPConn
+	tcpListener *net.TCPListener
+	tcpConn     net.Conn
+
+	demuxer  *psDemuxer
+	tracks   map[byte]*rtpTrack // stream_type <-> track
+	sprops   map[byte][]byte    // nal type <-> parameter set
+	aac      *esFrame           // the first aac frame, for the config
+	pending  []*esFrame         // from the key frame, until published
+	client   *rtsp.RTSPClient
+	pusher   *rtsp.Pusher
+	idleFrom time.Time
+
+	ready     chan struct{} // closed when published or failed
+	readyOnce sync.Once
+	err       error
+	stoped    bool
+	lock      sync.Mutex
+}
+
+// Play starts the live view of the channel of the device, and returns the
+// pusher of it once the device sends the first key frame.
+func (server *Server) Play(deviceID, channelID string) (*rtsp.Pusher, error) {
+	if server.Stoped {
+		return nil, fmt.Errorf("gb28181 not enabled")
+	}
+	path := StreamPath(deviceID, channelID)
+	if pusher := server.rtspServer.GetPusher(path); pusher != nil {
+		return pusher, nil
+	}
+	server.livesLock.Lock()
+	l, ok := server.lives[path]
+	if !ok {
+		device := server.GetDevice(deviceID)
+		if device == nil || !device.Online {
+			server.livesLock.Unlock()
+			return nil, fmt.Errorf("device %s offline", deviceID)
+		}
+		l = server.newLive(device, channelID)
+		server.lives[path] = l
+		go l.start()
+	}
+	server.livesLock.Unlock()
+	<-l.ready
+	if l.err != nil {
+		return nil, l.err
+	}
+	return l.pusher, nil
+}
+
+// demandLive is the rtsp.PusherSource of the StreamPath of channels.
+func (server *Server) demandLive(path string) (*rtsp.Pusher, error) {
+	deviceID, channelID, ok := parseStreamPath(path)
+	if !ok || server.Stoped {
+		return nil, nil
+	}
+	return server.Play(deviceID, channelID)
+}
+
+// stopLives stops the live views of the device.
+func (server *Server) stopLives(deviceID string, err error) {
+	server.livesLock.Lock()
+	lives := make([]*live, 0)
+	for _, l := range server.lives {
+		if l.deviceID == deviceID {
+			lives = append(lives, l)
+		}
+	}
+	server.livesLock.Unlock()
+	for _, l := range lives {
+		l.stop(err, true)
+	}
+}
+
+func (server *Server) liveOfCall(callID string) *live {
+	server.livesLock.Lock()
+	defer server.livesLock.Unlock()
+	for _, l := range server.lives {
+		if l.callID == callID {
+			return l
+		}
+	}
+	return nil
+}
+
+func (server *Server) handleBye(req *Message, addr *net.UDPAddr) {
+	l := server.liveOfCall(req.Header.Get("Call-ID"))
+	if l == nil || l.addr.String() != addr.String() {
+		server.send(NewResponse(req, 481, "Call/Transaction Does Not Exist"), addr)
+		return
+	}
+	server.send(NewResponse(req, 200, "OK"), addr)
+	l.stop(fmt.Errorf("device %s sent BYE", l.deviceID), false)
+}
+
+func (server *Server) newLive(device *Device, channelID string) *live {
+	sec := utils.Conf().Section("gb28181")
+	transType := rtsp.TRANS_TYPE_UDP
+	if strings.EqualFold(sec.Key("media_transport").MustString("UDP"), "TCP") {
+		transType = rtsp.TRANS_TYPE_TCP
+	}
+	// 0 for live view, 5 digits of the domain and a sequence, GB/T 28181
+	// Annex F.
+	domain := server.Domain + "00000000"
+	ssrc := fmt.Sprintf("0%s%04d", domain[3:8], atomic.AddInt32(&server.ssrcSeq, 1)%10000)
+	l := &live{
+		server:      server,
+		deviceID:    device.ID,
+		channelID:   channelID,
+		path:        StreamPath(device.ID, channelID),
+		addr:        device.addr,
+		transType:   transType,
+		callID:      randomHex(16),
+		ssrc:        ssrc,
+		timeout:     server.requestTimeout(),
+		idleTimeout: time.Duration(sec.Key("idle_timeout").MustInt(30)) * time.Second,
+		tracks:      make(map[byte]*rtpTrack),
+		sprops:      make(map[byte][]byte),
+		ready:       make(chan struct{}),
+	}
+	l.demuxer = newPSDemuxer(l.onFrame)
+	return l
+}
+
+func (l *live) String() string {
+	return fmt.Sprintf("live[%s]", l.path)
+}
+
+func (l *live) start() {
+	logger := l.server.logger
+	if err := l.listen(); err != nil {
+		l.stop(err, false)
+		return
+	}
+	invite := l.server.newRequest(INVITE, l.channelID, l.addr)
+	invite.Header.Set("Call-ID", l.callID)
+	invite.Header.Set("Contact", fmt.Sprintf("<sip:%s@%s:%d>", l.server.ID, l.server.IP, l.server.Port))
+	invite.Header.Set("Subject", fmt.Sprintf("%s:%s,%s:0", l.channelID, l.ssrc, l.server.ID))
+	invite.Header.Set("Content-Type", "APPLICATION/SDP")
+	invite.Body = l.offer()
+	l.lock.Lock()
+	l.invite = invite
+	l.lock.Unlock()
+	res, err := l.server.request(invite, l.addr, l.timeout)
+	if err == nil && res.StatusCode != 200 {
+		err = fmt.Errorf("INVITE %s got %d %s", l.channelID, res.StatusCode, res.Reason)
+	}
+	if err != nil {
+		l.stop(err, false)
+		return
+	}
+	l.lock.Lock()
+	l.response = res
+	l.lock.Unlock()
+	l.ack()
+	ssrc := l.ssrc
+	if match := ssrcRex.FindStringSubmatch(res.Body); match != nil {
+		ssrc = match[1]
+	}
+	ssrcValue, err := strconv.ParseUint(ssrc, 10, 32)
+	if err != nil {
+		l.stop(fmt.Errorf("invalid ssrc %s", ssrc), true)
+		return
+	}
+	l.ssrcValue = uint32(ssrcValue)
+	logger.Printf("%v invited, media %s port %d, ssrc %s", l, l.transType, l.port, ssrc)
+	go l.receive()
+	select {
+	case <-l.ready:
+	case <-time.After(l.timeout):
+		l.stop(fmt.Errorf("no key frame from %s in %v", l.channelID, l.timeout), true)
+	}
+}
+
+// listen opens the port the device sends the media to.
+func (l *live) listen() error {
+	sec := utils.Conf().Section("gb28181")
+	min := sec.Key("media_port_min").MustInt(30000)
+	max := sec.Key("media_port_max").MustInt(30500)
+	server := l.server
+	server.mediaPortsLock.Lock()
+	defer server.mediaPortsLock.Unlock()
+	for port := min; port <= max; port++ {
+		if server.mediaPorts[port] {
+			continue
+		}
+		var err error
+		if l.transType == rtsp.TRANS_TYPE_TCP {
+			l.tcpListener, err = net.ListenTCP("tcp", &net.TCPAddr{Port: port})
+		} else {
+			l.udpConn, err = net.ListenUDP("udp", &net.UDPAddr{Port: port})
+			if err == nil {
+				l.udpConn.SetReadBuffer(4 << 20)
+			}
+		}
+		if err != nil {
+			continue
+		}
+		server.mediaPorts[port] = true
+		l.port = port
+		return nil
+	}
+	return fmt.Errorf("no media port free in %d-%d", min, max)
+}
+
+// offer returns the sdp of the INVITE, GB/T 28181 Annex G.
+func (l *live) offer() string {
+	ip := l.server.IP
+	proto := "RTP/AVP"
+	if l.transType == rtsp.TRANS_TYPE_TCP {
+		proto = "TCP/RTP/AVP"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "v=0\r\no=%s 0 0 IN IP4 %s\r\ns=Play\r\nc=IN IP4 %s\r\nt=0 0\r\n", l.channelID, ip, ip)
+	fmt.Fprintf(&b, "m=video %d %s 96 97 98\r\na=recvonly\r\na=rtpmap:96 PS/90000\r\na=rtpmap:97 MPEG4/90000\r\na=rtpmap:98 H264/90000\r\n", l.port, proto)
+	if l.transType == rtsp.TRANS_TYPE_TCP {
+		// the device connects to us.
+		b.WriteString("a=setup:passive\r\na=connection:new\r\n")
+	}
+	fmt.Fprintf(&b, "y=%s\r\n", l.ssrc)
+	return b.String()
+}
+
+// inDialog returns a request in the dialog of the INVITE.
+func (l *live) inDialog(method string, cseq int) *Message {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	uri := l.invite.URI
+	if contact := l.response.Header.Get("Contact"); contact != "" {
+		contact = strings.TrimSpace(contact)
+		if i := strings.Index(contact, "<"); i >= 0 {
+			contact = contact[i+1:]
+			if j := strings.Index(contact, ">"); j >= 0 {
+				uri = contact[:j]
+			}
+		}
+	}
+	req := &Message{Method: method, URI: uri, Header: make(Header)}
+	req.Header.Set("From", l.invite.Header.Get("From"))
+	req.Header.Set("To", l.response.Header.Get("To"))
+	req.Header.Set("Call-ID", l.invite.Header.Get("Call-ID"))
+	req.Header.Set("CSeq", fmt.Sprintf("%d %s", cseq, method))
+	return req
+}
+
+// ack acknowledges the 200 of the INVITE, again when the device sends it
+// again.
+func (l *live) ack() {
+	cseq, _ := l.invite.CSeq()
+	req := l.inDialog(ACK, cseq)
+	req.Header.Set("Via", fmt.Sprintf("SIP/2.0/UDP %s:%d;rport;branch=%s", l.server.IP, l.server.Port, newBranch()))
+	req.Header.Set("Max-Forwards", "70")
+	req.Header.Set("User-Agent", l.server.Agent)
+	l.server.send(req, l.addr)
+}
+
+func (l *live) bye() {
+	cseq, _ := l.invite.CSeq()
+	req := l.inDialog(BYE, cseq+1)
+	res, err := l.server.request(req, l.addr, 2*time.Second)
+	if err != nil {
+		l.server.logger.Printf("%v BYE err:%v", l, err)
+	} else if res.StatusCode != 200 {
+		l.server.logger.Printf("%v BYE got %d %s", l, res.StatusCode, res.Reason)
+	}
+}
+
+// receive reads the rtp of the device until the live stops, or no rtp comes
+// within the timeout.
+func (l *live) receive() {
+	var err error
+	if l.transType == rtsp.TRANS_TYPE_TCP {
+		err = l.receiveTCP()
+	} else {
+		err = l.receiveUDP()
+	}
+	l.stop(fmt.Errorf("media %v", err), true)
+}
+
+func (l *live) receiveUDP() error {
+	buf := make([]byte, 65536)
+	for {
+		l.udpConn.SetReadDeadline(time.Now().Add(l.timeout))
+		n, _, err := l.udpConn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		l.handleRTP(buf[:n])
+	}
+}
+
+// receiveTCP reads the rtp framed by RFC 4571 from the connection of the
+// device.
+func (l *live) receiveTCP() error {
+	l.tcpListener.SetDeadline(time.Now().Add(l.timeout))
+	conn, err := l.tcpListener.AcceptTCP()
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	l.tcpConn = conn
+	stoped := l.stoped
+	l.lock.Unlock()
+	if stoped {
+		conn.Close()
+		return fmt.Errorf("stoped")
+	}
+	r := bufio.NewReaderSize(conn, 65536)
+	buf := make([]byte, 65536)
+	for {
+		conn.SetReadDeadline(time.Now().Add(l.timeout))
+		if _, err := io.ReadFull(r, buf[:2]); err != nil {
+			return err
+		}
+		n := int(binary.BigEndian.Uint16(buf[:2]))
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return err
+		}
+		l.handleRTP(buf[:n])
+	}
+}
+
+func (l *live) handleRTP(b []byte) {
+	rtp := rtsp.ParseRTP(b)
+	if rtp == nil || uint32(rtp.SSRC) != l.ssrcValue {
+		// not of the device.
+		return
+	}
+	if l.client != nil {
+		l.client.InBytes += len(b)
+	}
+	if err := l.demuxer.Write(rtp.Payload); err != nil {
+		l.server.logger.Printf("%v %v", l, err)
+	}
+	if rtp.Marker {
+		l.demuxer.Flush()
+	}
+	if l.client != nil {
+		l.checkIdle()
+	}
+}
+
+// onFrame publishes the frames of the demuxer, gathering the codecs of the
+// stream until the first key frame.
+func (l *live) onFrame(frame *esFrame) {
+	if l.client != nil {
+		if track := l.tracks[frame.StreamType]; track != nil {
+			l.publish(track, frame)
+		}
+		return
+	}
+	switch frame.StreamType {
+	case STREAM_TYPE_H264, STREAM_TYPE_H265:
+		key := l.gatherSprops(frame)
+		if key {
+			l.pending = l.pending[:0]
+		}
+		if key || len(l.pending) > 0 {
+			l.pending = append(l.pending, frame)
+		}
+	case STREAM_TYPE_AAC:
+		if l.aac == nil {
+			if _, _, _, ok := parseADTS(frame.Data); ok {
+				l.aac = frame
+			}
+		}
+		if len(l.pending) > 0 {
+			l.pending = append(l.pending, frame)
+		}
+	case STREAM_TYPE_G711A, STREAM_TYPE_G711U:
+		if len(l.pending) > 0 {
+			l.pending = append(l.pending, frame)
+		}
+	}
+	if len(l.pending) == 0 || !l.streamReady() {
+		return
+	}
+	if err := l.startPusher(); err != nil {
+		l.stop(err, true)
+	}
+}
+
+// gatherSprops keeps the parameter sets of the video, and tells whether the
+// frame is a key frame with all of them known.
+func (l *live) gatherSprops(frame *esFrame) bool {
+	key := false
+	for _, nalu := range splitNALUs(frame.Data) {
+		if len(nalu) == 0 {
+			continue
+		}
+		if frame.StreamType == STREAM_TYPE_H264 {
+			switch typ := nalu[0] & 0x1f; typ {
+			case 7, 8:
+				l.sprops[typ] = append([]byte(nil), nalu...)
+			case 5:
+				key = true
+			}
+		} else {
+			switch typ := nalu[0] >> 1 & 0x3f; {
+			case typ >= 32 && typ <= 34:
+				l.sprops[typ] = append([]byte(nil), nalu...)
+			case typ >= 16 && typ <= 21:
+				key = true
+			}
+		}
+	}
+	if frame.StreamType == STREAM_TYPE_H264 {
+		return key && l.sprops[7] != nil && l.sprops[8] != nil
+	}
+	return key && l.sprops[32] != nil && l.sprops[33] != nil && l.sprops[34] != nil
+}
+
+// streamReady tells whether the codecs of the stream are known, aac needs a
+// frame for its config which is waited for up to a second.
+func (l *live) streamReady() bool {
+	if l.aac != nil {
+		return true
+	}
+	for _, streamType := range l.demuxer.streamTypes {
+		if streamType == STREAM_TYPE_AAC {
+			return l.pending[len(l.pending)-1].PTS-l.pending[0].PTS >= 90000
+		}
+	}
+	return true
+}
+
+// startPusher publishes the stream with the tracks of the stream map it
+// supports, video first.
+func (l *live) startPusher() error {
+	var video, audio byte
+	for id, streamType := range l.demuxer.streamTypes {
+		switch streamType {
+		case STREAM_TYPE_H264, STREAM_TYPE_H265:
+			if id >= 0xe0 && video == 0 {
+				video = streamType
+			}
+		case STREAM_TYPE_AAC, STREAM_TYPE_G711A, STREAM_TYPE_G711U:
+			if id < 0xe0 && audio == 0 && (streamType != STREAM_TYPE_AAC || l.aac != nil) {
+				audio = streamType
+			}
+		}
+	}
+	medias := ""
+	for _, streamType := range []byte{video, audio} {
+		if streamType == 0 {
+			continue
+		}
+		track := newRTPTrack(len(l.tracks), streamType)
+		var sprops [][]byte
+		switch streamType {
+		case STREAM_TYPE_H264:
+			sprops = [][]byte{l.sprops[7], l.sprops[8]}
+		case STREAM_TYPE_H265:
+			sprops = [][]byte{l.sprops[32], l.sprops[33], l.sprops[34]}
+		case STREAM_TYPE_AAC:
+			track.config, track.clockRate, track.channels, _ = parseADTS(l.aac.Data)
+		}
+		l.tracks[streamType] = track
+		medias += track.media(sprops)
+	}
+	sdp := fmt.Sprintf("v=0\r\no=- 0 0 IN IP4 %s\r\ns=GB28181 %s\r\nc=IN IP4 0.0.0.0\r\nt=0 0\r\na=control:*\r\n%s", l.server.IP, l.channelID, medias)
+	client, err := rtsp.NewRTSPClient(l.server.rtspServer, fmt.Sprintf("gb28181://%s/%s", l.deviceID, l.channelID), 0, l.server.Agent, l.path)
+	if err != nil {
+		return err
+	}
+	client.SDPRaw = sdp
+	client.Tracks = rtsp.NewTracks(sdp)
+	client.TransType = l.transType
+	client.Status = "OK"
+	pusher := rtsp.NewClientPusher(client)
+	client.StopHandles = append(client.StopHandles, func() {
+		l.stop(fmt.Errorf("pusher stoped"), true)
+	})
+	if !l.server.rtspServer.AddPusher(pusher) {
+		client.Stoped = true
+		return fmt.Errorf("path %s published already", l.path)
+	}
+	l.lock.Lock()
+	stoped := l.stoped
+	if !stoped {
+		l.client = client
+		l.pusher = pusher
+		l.idleFrom = time.Now()
+	}
+	l.lock.Unlock()
+	if stoped {
+		// timed out meanwhile.
+		client.Stop()
+		return nil
+	}
+	l.server.logger.Printf("%v published, %s", l, strings.Join(strings.Fields(strings.ReplaceAll(medias, "\r\n", " ")), " "))
+	pending := l.pending
+	l.pending = nil
+	for _, frame := range pending {
+		if track := l.tracks[frame.StreamType]; track != nil {
+			l.publish(track, frame)
+		}
+	}
+	l.finish(nil)
+	return nil
+}
+
+// finish tells Play the live view is published, or why not.
+func (l *live) finish(err error) {
+	l.readyOnce.Do(func() {
+		l.err = err
+		close(l.ready)
+	})
+}
+
+func (l *live) publish(track *rtpTrack, frame *esFrame) {
+	for _, pack := range track.packFrame(frame) {
+		for _, h := range l.client.RTPHandles {
+			h(pack)
+		}
+	}
+}
+
+// checkIdle stops the live view which has no player for idle_timeout.
+func (l *live) checkIdle() {
+	if l.idleTimeout <= 0 {
+		return
+	}
+	if len(l.pusher.GetPlayers()) > 0 {
+		l.idleFrom = time.Now()
+		return
+	}
+	if time.Since(l.idleFrom) > l.idleTimeout {
+		l.stop(fmt.Errorf("no player in %v", l.idleTimeout), true)
+	}
+}
+
+// stop ends the live view, the dialog too if bye, and tells Play why it
+// did not start if err is not nil.
+func (l *live) stop(err error, bye bool) {
+	l.lock.Lock()
+	if l.stoped {
+		l.lock.Unlock()
+		return
+	}
+	l.stoped = true
+	invited := l.response != nil
+	client := l.client
+	tcpConn := l.tcpConn
+	l.lock.Unlock()
+	server := l.server
+	server.livesLock.Lock()
+	if server.lives[l.path] == l {
+		delete(server.lives, l.path)
+	}
+	server.livesLock.Unlock()
+	if l.udpConn != nil {
+		l.udpConn.Close()
+	}
+	if l.tcpListener != nil {
+		l.tcpListener.Close()
+	}
+	if tcpConn != nil {
+		tcpConn.Close()
+	}
+	if l.port != 0 {
+		server.mediaPortsLock.Lock()
+		delete(server.mediaPorts, l.port)
+		server.mediaPortsLock.Unlock()
+	}
+	if invited && bye {
+		l.bye()
+	}
+	if client != nil {
+		client.Stop()
+	} else {
+		l.finish(err)
+	}
+	server.logger.Printf("%v stoped, %v", l, err)
+}
+
+// invited tells whether the device accepted the INVITE.
+func (l *live) invited() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.response != nil
+}
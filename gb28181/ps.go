@@ -0,0 +1,228 @@
+package gb28181
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// stream_type of the program stream map, ISO/IEC 13818-1 2.4.4.10 and
+// GB/T 28181 Annex C.
+const (
+	STREAM_TYPE_H264  = 0x1b
+	STREAM_TYPE_H265  = 0x24
+	STREAM_TYPE_AAC   = 0x0f
+	STREAM_TYPE_G711A = 0x90
+	STREAM_TYPE_G711U = 0x91
+)
+
+// start codes of the program stream, ISO/IEC 13818-1 2.5.3.
+const (
+	psPackHeader   = 0xba
+	psSystemHeader = 0xbb
+	psStreamMap    = 0xbc
+	psEndCode      = 0xb9
+)
+
+// maxPSBuffer is where a stream not making sense is dropped.
+const maxPSBuffer = 4 << 20
+
+// esFrame is an elementary stream frame of a program stream, an access unit
+// of video or a pes of audio.
+type esFrame struct {
+	StreamType byte
+	Video      bool
+	PTS        uint64 // 90kHz
+	Data       []byte
+}
+
+// psDemuxer splits a MPEG program stream, as GB28181 devices send it over
+// rtp, into the frames of its elementary streams. Streams of a type not in
+// the stream map are dropped.
+type psDemuxer struct {
+	buf         []byte
+	streamTypes map[byte]byte // stream_id <-> stream_type, from the stream map
+
+	video   *esFrame // the access unit being gathered
+	onFrame func(*esFrame)
+}
+
+func newPSDemuxer(onFrame func(*esFrame)) *psDemuxer {
+	return &psDemuxer{streamTypes: make(map[byte]byte), onFrame: onFrame}
+}
+
+// Write demuxes b, which continues the stream, as far as it is complete.
+func (d *psDemuxer) Write(b []byte) error {
+	d.buf = append(d.buf, b...)
+	if len(d.buf) > maxPSBuffer {
+		d.buf = d.buf[:0]
+		d.video = nil
+		return fmt.Errorf("ps stream buffer over %d bytes, dropped", maxPSBuffer)
+	}
+	for {
+		n, err := d.parse(d.buf)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		d.buf = d.buf[n:]
+	}
+	// keep the rest in a buffer of its own, b may be reused.
+	d.buf = append([]byte(nil), d.buf...)
+	return nil
+}
+
+// Flush ends the access unit being gathered, when the rtp marker tells the
+// frame is complete.
+func (d *psDemuxer) Flush() {
+	if len(d.buf) == 0 {
+		d.flushVideo()
+	}
+}
+
+func (d *psDemuxer) flushVideo() {
+	if d.video != nil && len(d.video.Data) > 0 {
+		d.onFrame(d.video)
+	}
+	d.video = nil
+}
+
+// parse parses the unit at the start of b and returns its size, 0 if b is
+// not complete.
+func (d *psDemuxer) parse(b []byte) (int, error) {
+	if len(b) < 4 {
+		return 0, nil
+	}
+	if b[0] != 0 || b[1] != 0 || b[2] != 1 || b[3] < psEndCode {
+		// resync to the next start code.
+		i := bytes.Index(b[1:], []byte{0, 0, 1})
+		if i < 0 {
+			return len(b) - 3, nil
+		}
+		return i + 1, nil
+	}
+	switch b[3] {
+	case psEndCode:
+		return 4, nil
+	case psPackHeader:
+		if len(b) < 14 {
+			return 0, nil
+		}
+		if b[4]&0xc0 != 0x40 {
+			// MPEG-1 pack header.
+			return 12, nil
+		}
+		return 14 + int(b[13]&0x07), nil
+	}
+	if len(b) < 6 {
+		return 0, nil
+	}
+	size := 6 + int(binary.BigEndian.Uint16(b[4:6]))
+	if len(b) < size {
+		return 0, nil
+	}
+	switch id := b[3]; {
+	case id == psStreamMap:
+		d.parseStreamMap(b[6:size])
+	case id >= 0xc0 && id <= 0xef:
+		d.parsePES(id, b[6:size])
+	}
+	return size, nil
+}
+
+// parseStreamMap reads the stream types of the program stream map, ISO/IEC
+// 13818-1 2.5.4.
+func (d *psDemuxer) parseStreamMap(b []byte) {
+	if len(b) < 4 {
+		return
+	}
+	infoLength := int(binary.BigEndian.Uint16(b[2:4]))
+	b = b[4:]
+	if len(b) < infoLength+2 {
+		return
+	}
+	b = b[infoLength:]
+	mapLength := int(binary.BigEndian.Uint16(b[0:2]))
+	b = b[2:]
+	if len(b) < mapLength {
+		return
+	}
+	b = b[:mapLength]
+	for len(b) >= 4 {
+		streamType, streamID := b[0], b[1]
+		d.streamTypes[streamID] = streamType
+		n := 4 + int(binary.BigEndian.Uint16(b[2:4]))
+		if len(b) < n {
+			break
+		}
+		b = b[n:]
+	}
+}
+
+// parsePES reads the payload of a pes, ISO/IEC 13818-1 2.4.3.6. The pes of
+// an access unit of video share the pts of its first one, or have none.
+func (d *psDemuxer) parsePES(id byte, b []byte) {
+	if len(b) < 3 {
+		return
+	}
+	hasPTS := b[1]&0x80 != 0
+	headerLength := 3 + int(b[2])
+	if len(b) < headerLength {
+		return
+	}
+	var pts uint64
+	if hasPTS && len(b) >= 8 {
+		p := b[3:8]
+		pts = uint64(p[0]>>1&0x07)<<30 | uint64(p[1])<<22 | uint64(p[2]>>1)<<15 | uint64(p[3])<<7 | uint64(p[4]>>1)
+	}
+	payload := b[headerLength:]
+	streamType, ok := d.streamTypes[id]
+	if !ok || len(payload) == 0 {
+		return
+	}
+	if id >= 0xe0 {
+		if d.video != nil && hasPTS && pts != d.video.PTS {
+			d.flushVideo()
+		}
+		if d.video == nil {
+			d.video = &esFrame{StreamType: streamType, Video: true, PTS: pts}
+		}
+		d.video.Data = append(d.video.Data, payload...)
+		return
+	}
+	if !hasPTS && d.video != nil {
+		pts = d.video.PTS
+	}
+	d.onFrame(&esFrame{StreamType: streamType, PTS: pts, Data: append([]byte(nil), payload...)})
+}
+
+// splitNALUs returns the nal units of an annex b access unit.
+func splitNALUs(b []byte) [][]byte {
+	nalus := make([][]byte, 0, 4)
+	start := -1
+	for i := 0; i+3 <= len(b); i++ {
+		if b[i] != 0 || b[i+1] != 0 || b[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			for end > start && b[end-1] == 0 {
+				// 4 bytes start code, or trailing_zero_8bits.
+				end--
+			}
+			if end > start {
+				nalus = append(nalus, b[start:end])
+			}
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(b) {
+		nalus = append(nalus, b[start:])
+	} else if start < 0 && len(b) > 0 {
+		nalus = append(nalus, b)
+	}
+	return nalus
+}
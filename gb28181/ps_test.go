@@ -0,0 +1,221 @@
+package gb28181
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// psPack returns a pack header of scr with stuffing bytes.
+func psPack(scr uint64, stuffing int) []byte {
+	b := []byte{0, 0, 1, psPackHeader,
+		0x44 | byte(scr>>27&0x38) | byte(scr>>28&0x03), byte(scr >> 20), byte(scr>>12&0xf8) | 0x04 | byte(scr>>13&0x03),
+		byte(scr >> 5), byte(scr<<3&0xf8) | 0x04, 0x01,
+		0x01, 0x89, 0xc3, 0xf8 | byte(stuffing)}
+	return append(b, bytes.Repeat([]byte{0xff}, stuffing)...)
+}
+
+// psMap returns a program stream map of the stream_type and stream_id pairs.
+func psMap(streams ...byte) []byte {
+	es := make([]byte, 0, len(streams)*2)
+	for i := 0; i+1 < len(streams); i += 2 {
+		es = append(es, streams[i], streams[i+1], 0, 0)
+	}
+	body := []byte{0xe0, 0xff, 0, 0}
+	body = append(body, byte(len(es)>>8), byte(len(es)))
+	body = append(body, es...)
+	body = append(body, 0, 0, 0, 0) // CRC_32
+	return psUnit(psStreamMap, body)
+}
+
+// psPES returns a pes of stream id with pts, none if pts is 0.
+func psPES(id byte, pts uint64, payload []byte) []byte {
+	body := []byte{0x80, 0x00, 0x00}
+	if pts != 0 {
+		body = []byte{0x80, 0x80, 0x05,
+			0x21 | byte(pts>>29&0x0e), byte(pts >> 22), byte(pts>>14&0xfe) | 1, byte(pts >> 7), byte(pts<<1&0xfe) | 1}
+	}
+	return psUnit(id, append(body, payload...))
+}
+
+func psUnit(id byte, body []byte) []byte {
+	b := []byte{0, 0, 1, id, 0, 0}
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(body)))
+	return append(b, body...)
+}
+
+func concat(bs ...[]byte) []byte {
+	return bytes.Join(bs, nil)
+}
+
+// demux writes the chunks of a stream and flushes after each as the rtp
+// marker of the last pack of a frame would.
+func demux(t *testing.T, chunks [][]byte, flush bool) []*esFrame {
+	frames := make([]*esFrame, 0)
+	d := newPSDemuxer(func(frame *esFrame) {
+		frames = append(frames, frame)
+	})
+	for _, chunk := range chunks {
+		if err := d.Write(chunk); err != nil {
+			t.Fatalf("Write err: %v", err)
+		}
+		if flush {
+			d.Flush()
+		}
+	}
+	return frames
+}
+
+var (
+	testIDR   = concat([]byte{0, 0, 0, 1, 0x67, 0x42, 0, 0x1e}, []byte{0, 0, 0, 1, 0x68, 0xce}, []byte{0, 0, 0, 1, 0x65}, bytes.Repeat([]byte{0x88}, 3000))
+	testP     = concat([]byte{0, 0, 0, 1, 0x41}, bytes.Repeat([]byte{0x9a}, 500))
+	testAudio = []byte{0xff, 0xf1, 0x50, 0x80, 0x01, 0x1f, 0xfc, 0x21}
+)
+
+func TestPSDemuxer(t *testing.T) {
+	stream := concat(
+		psPack(90000, 0), psMap(STREAM_TYPE_H264, 0xe0, STREAM_TYPE_AAC, 0xc0),
+		psPES(0xe0, 90000, testIDR), psPES(0xc0, 90000, testAudio),
+		psPack(93600, 0), psPES(0xe0, 93600, testP),
+	)
+	want := []*esFrame{
+		{StreamType: STREAM_TYPE_AAC, PTS: 90000, Data: testAudio},
+		{StreamType: STREAM_TYPE_H264, Video: true, PTS: 90000, Data: testIDR},
+		{StreamType: STREAM_TYPE_H264, Video: true, PTS: 93600, Data: testP},
+	}
+	frames := demux(t, [][]byte{stream}, true)
+	if !reflect.DeepEqual(frames, want) {
+		t.Errorf("frames = %v, want %v", frames, want)
+	}
+
+	// as rtp packs of 1400 bytes, and of every size up to a pes.
+	for _, size := range []int{1, 2, 3, 5, 13, 1400, len(stream) - 1} {
+		chunks := make([][]byte, 0)
+		for b := stream; len(b) > 0; {
+			n := size
+			if n > len(b) {
+				n = len(b)
+			}
+			chunks = append(chunks, b[:n])
+			b = b[n:]
+		}
+		if frames := demux(t, chunks, false); !reflect.DeepEqual(frames, want[:2]) {
+			t.Errorf("in chunks of %d: %d frames, want the video of 90000 and the audio", size, len(frames))
+		}
+	}
+}
+
+func TestPSDemuxerVideoAcrossPES(t *testing.T) {
+	// an access unit over pes of the same pts, or with no pts at all.
+	half := len(testIDR) / 2
+	stream := concat(
+		psPack(90000, 0), psMap(STREAM_TYPE_H265, 0xe0),
+		psPES(0xe0, 90000, testIDR[:half]), psPES(0xe0, 0, testIDR[half:2*half]), psPES(0xe0, 90000, testIDR[2*half:]),
+		psPES(0xe0, 93600, testP),
+	)
+	frames := demux(t, [][]byte{stream}, false)
+	want := []*esFrame{{StreamType: STREAM_TYPE_H265, Video: true, PTS: 90000, Data: testIDR}}
+	if !reflect.DeepEqual(frames, want) {
+		t.Errorf("frames = %v, want %v", frames, want)
+	}
+}
+
+func TestPSDemuxerPackStuffing(t *testing.T) {
+	for stuffing := 0; stuffing <= 7; stuffing++ {
+		stream := concat(psPack(90000, stuffing), psMap(STREAM_TYPE_H264, 0xe0), psPES(0xe0, 90000, testP))
+		frames := demux(t, [][]byte{stream}, true)
+		if len(frames) != 1 || !bytes.Equal(frames[0].Data, testP) {
+			t.Errorf("%d stuffing bytes: frames = %v", stuffing, frames)
+		}
+	}
+	// a MPEG-1 pack header is 12 bytes.
+	mpeg1 := []byte{0, 0, 1, psPackHeader, 0x21, 0, 1, 0, 1, 0x80, 0, 1}
+	stream := concat(mpeg1, psMap(STREAM_TYPE_H264, 0xe0), psPES(0xe0, 90000, testP))
+	if frames := demux(t, [][]byte{stream}, true); len(frames) != 1 {
+		t.Errorf("after a MPEG-1 pack header: %d frames", len(frames))
+	}
+}
+
+func TestPSDemuxerStreamMap(t *testing.T) {
+	truncated := psMap(STREAM_TYPE_H264, 0xe0, STREAM_TYPE_AAC, 0xc0)
+	// es_map_length over the end of the map.
+	overMap := append([]byte(nil), truncated...)
+	overMap[11] = 0xff
+	// elementary_stream_info_length of the audio over the end of the map.
+	overInfo := append([]byte(nil), truncated...)
+	overInfo[18+2] = 0x10
+	tests := []struct {
+		name    string
+		psm     []byte
+		streams map[byte]byte
+	}{
+		{"complete", truncated, map[byte]byte{0xe0: STREAM_TYPE_H264, 0xc0: STREAM_TYPE_AAC}},
+		{"es map over the end", overMap, map[byte]byte{}},
+		{"es info over the end", overInfo, map[byte]byte{0xe0: STREAM_TYPE_H264, 0xc0: STREAM_TYPE_AAC}},
+		{"too short", psUnit(psStreamMap, []byte{0xe0, 0xff}), map[byte]byte{}},
+		{"program info over the end", psUnit(psStreamMap, []byte{0xe0, 0xff, 0x10, 0}), map[byte]byte{}},
+		{"empty", psUnit(psStreamMap, nil), map[byte]byte{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames := make([]*esFrame, 0)
+			d := newPSDemuxer(func(frame *esFrame) {
+				frames = append(frames, frame)
+			})
+			if err := d.Write(concat(psPack(0, 0), tt.psm, psPES(0xe0, 90000, testP), psPES(0xc0, 90000, testAudio))); err != nil {
+				t.Fatal(err)
+			}
+			d.Flush()
+			if !reflect.DeepEqual(d.streamTypes, tt.streams) {
+				t.Errorf("stream types = %v, want %v", d.streamTypes, tt.streams)
+			}
+			if len(frames) != len(tt.streams) {
+				t.Errorf("%d frames, want those of the streams mapped only", len(frames))
+			}
+		})
+	}
+}
+
+func TestPSDemuxerResync(t *testing.T) {
+	// junk, and a start code of no unit known.
+	stream := concat(
+		[]byte{0x12, 0x00, 0x00, 0x00, 0x01},
+		psMap(STREAM_TYPE_H264, 0xe0),
+		[]byte{0x00, 0x00, 0x01, 0x00, 0x33},
+		psPack(90000, 0), psPES(0xe0, 90000, testP),
+	)
+	frames := demux(t, [][]byte{stream}, true)
+	if len(frames) != 1 || frames[0].PTS != 90000 {
+		t.Errorf("frames = %v", frames)
+	}
+
+	d := newPSDemuxer(func(*esFrame) {})
+	if err := d.Write(make([]byte, maxPSBuffer+1)); err == nil {
+		t.Error("Write of a buffer over the limit, no error")
+	}
+	if len(d.buf) != 0 {
+		t.Errorf("buffer of %d bytes kept", len(d.buf))
+	}
+}
+
+func TestSplitNALUs(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		want [][]byte
+	}{
+		{"4 bytes start codes", []byte{0, 0, 0, 1, 0x67, 1, 0, 0, 0, 1, 0x68, 2}, [][]byte{{0x67, 1}, {0x68, 2}}},
+		{"3 bytes start codes", []byte{0, 0, 1, 0x67, 1, 0, 0, 1, 0x65, 3}, [][]byte{{0x67, 1}, {0x65, 3}}},
+		{"mixed", []byte{0, 0, 0, 1, 0x09, 0xf0, 0, 0, 1, 0x41, 0, 0, 0, 0, 1, 0x41}, [][]byte{{0x09, 0xf0}, {0x41}, {0x41}}},
+		{"no start code", []byte{0x41, 1, 2}, [][]byte{{0x41, 1, 2}}},
+		{"empty nal units", []byte{0, 0, 1, 0, 0, 1, 0x41}, [][]byte{{0x41}}},
+		{"start code only", []byte{0, 0, 0, 1}, [][]byte{}},
+		{"empty", nil, [][]byte{}},
+	}
+	for _, tt := range tests {
+		if got := splitNALUs(tt.b); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: splitNALUs = %x, want %x", tt.name, got, tt.want)
+		}
+	}
+}
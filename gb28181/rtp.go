@@ -0,0 +1,235 @@
+package gb28181
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/snowlyg/EasyDarwin/rtsp"
+)
+
+// maxRTPPayload keeps the packs under the mtu.
+const maxRTPPayload = 1400
+
+// rtpTrack packs the frames of an elementary stream into rtp for the track
+// of the stream published, see RFC 6184 for h264, RFC 7798 for h265 and
+// RFC 3640 for aac.
+type rtpTrack struct {
+	index       int
+	streamType  byte
+	payloadType byte
+	clockRate   int
+	channels    int
+	config      []byte // AudioSpecificConfig of aac
+	ssrc        uint32
+	seq         uint16
+}
+
+func newRTPTrack(index int, streamType byte) *rtpTrack {
+	track := &rtpTrack{index: index, streamType: streamType, clockRate: 90000, ssrc: rand.Uint32(), seq: uint16(rand.Uint32())}
+	switch streamType {
+	case STREAM_TYPE_H264, STREAM_TYPE_H265:
+		track.payloadType = byte(96 + index)
+	case STREAM_TYPE_AAC:
+		track.payloadType = byte(96 + index)
+	case STREAM_TYPE_G711A:
+		track.payloadType, track.clockRate, track.channels = 8, 8000, 1
+	case STREAM_TYPE_G711U:
+		track.payloadType, track.clockRate, track.channels = 0, 8000, 1
+	}
+	return track
+}
+
+func (track *rtpTrack) video() bool {
+	return track.streamType == STREAM_TYPE_H264 || track.streamType == STREAM_TYPE_H265
+}
+
+// media returns the m= section of the track in the sdp of the stream,
+// sprops are the parameter sets of the video.
+func (track *rtpTrack) media(sprops [][]byte) string {
+	var b strings.Builder
+	avType := "audio"
+	if track.video() {
+		avType = "video"
+	}
+	fmt.Fprintf(&b, "m=%s 0 RTP/AVP %d\r\n", avType, track.payloadType)
+	switch track.streamType {
+	case STREAM_TYPE_H264:
+		fmt.Fprintf(&b, "a=rtpmap:%d H264/90000\r\n", track.payloadType)
+		fmtp := "packetization-mode=1"
+		if len(sprops) > 0 {
+			sets := make([]string, 0, len(sprops))
+			for _, sprop := range sprops {
+				sets = append(sets, base64.StdEncoding.EncodeToString(sprop))
+			}
+			fmtp += ";sprop-parameter-sets=" + strings.Join(sets, ",")
+		}
+		fmt.Fprintf(&b, "a=fmtp:%d %s\r\n", track.payloadType, fmtp)
+	case STREAM_TYPE_H265:
+		fmt.Fprintf(&b, "a=rtpmap:%d H265/90000\r\n", track.payloadType)
+		params := make([]string, 0, len(sprops))
+		for _, sprop := range sprops {
+			name := map[byte]string{32: "sprop-vps", 33: "sprop-sps", 34: "sprop-pps"}[sprop[0]>>1&0x3f]
+			params = append(params, name+"="+base64.StdEncoding.EncodeToString(sprop))
+		}
+		if len(params) > 0 {
+			fmt.Fprintf(&b, "a=fmtp:%d %s\r\n", track.payloadType, strings.Join(params, ";"))
+		}
+	case STREAM_TYPE_AAC:
+		fmt.Fprintf(&b, "a=rtpmap:%d MPEG4-GENERIC/%d/%d\r\n", track.payloadType, track.clockRate, track.channels)
+		fmt.Fprintf(&b, "a=fmtp:%d streamtype=5;profile-level-id=1;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3;config=%x\r\n", track.payloadType, track.config)
+	case STREAM_TYPE_G711A:
+		fmt.Fprintf(&b, "a=rtpmap:%d PCMA/8000\r\n", track.payloadType)
+	case STREAM_TYPE_G711U:
+		fmt.Fprintf(&b, "a=rtpmap:%d PCMU/8000\r\n", track.payloadType)
+	}
+	fmt.Fprintf(&b, "a=control:trackID=%d\r\n", track.index)
+	return b.String()
+}
+
+// packFrame returns the rtp packs of the frame.
+func (track *rtpTrack) packFrame(frame *esFrame) []*rtsp.RTPPack {
+	timestamp := uint32(frame.PTS * uint64(track.clockRate) / 90000)
+	payloads := make([][]byte, 0, 4)
+	switch track.streamType {
+	case STREAM_TYPE_H264:
+		for _, nalu := range splitNALUs(frame.Data) {
+			if len(nalu) == 0 || nalu[0]&0x1f == 9 {
+				// access unit delimiter.
+				continue
+			}
+			payloads = append(payloads, fragment(nalu, 1, func(start, end bool) []byte {
+				header := []byte{nalu[0]&0xe0 | 28, nalu[0] & 0x1f}
+				return fuFlags(header, 1, start, end)
+			})...)
+		}
+	case STREAM_TYPE_H265:
+		for _, nalu := range splitNALUs(frame.Data) {
+			if len(nalu) < 2 || nalu[0]>>1&0x3f == 35 {
+				continue
+			}
+			payloads = append(payloads, fragment(nalu, 2, func(start, end bool) []byte {
+				header := []byte{nalu[0]&0x81 | 49<<1, nalu[1], nalu[0] >> 1 & 0x3f}
+				return fuFlags(header, 2, start, end)
+			})...)
+		}
+	case STREAM_TYPE_AAC:
+		packs := make([]*rtsp.RTPPack, 0, 2)
+		for i, au := range splitADTS(frame.Data) {
+			// one access unit of 1024 samples a pack, AU-headers-length is
+			// 16 bits, the AU-header size 13 and index 3.
+			payload := make([]byte, 4, 4+len(au))
+			binary.BigEndian.PutUint16(payload[0:2], 16)
+			binary.BigEndian.PutUint16(payload[2:4], uint16(len(au)<<3))
+			payload = append(payload, au...)
+			packs = append(packs, track.pack(payload, timestamp+uint32(i*1024), true))
+		}
+		return packs
+	default:
+		for data := frame.Data; len(data) > 0; {
+			n := len(data)
+			if n > maxRTPPayload {
+				n = maxRTPPayload
+			}
+			payloads = append(payloads, data[:n])
+			data = data[n:]
+		}
+	}
+	packs := make([]*rtsp.RTPPack, 0, len(payloads))
+	for i, payload := range payloads {
+		packs = append(packs, track.pack(payload, timestamp, i == len(payloads)-1))
+	}
+	return packs
+}
+
+func (track *rtpTrack) pack(payload []byte, timestamp uint32, marker bool) *rtsp.RTPPack {
+	buf := make([]byte, rtsp.RTP_FIXED_HEADER_LENGTH, rtsp.RTP_FIXED_HEADER_LENGTH+len(payload))
+	buf[0] = 0x80
+	buf[1] = track.payloadType
+	if marker {
+		buf[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(buf[2:4], track.seq)
+	binary.BigEndian.PutUint32(buf[4:8], timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], track.ssrc)
+	track.seq++
+	typ := rtsp.RTP_TYPE_AUDIO
+	if track.video() {
+		typ = rtsp.RTP_TYPE_VIDEO
+	}
+	return &rtsp.RTPPack{Type: typ, Track: track.index, Buffer: bytes.NewBuffer(append(buf, payload...))}
+}
+
+// fragment returns the nal unit as it is if it fits a pack, or the fragmentation
+// units of it, whose header of the nal unit of headerSize bytes is replaced by
+// fuHeader(start, end).
+func fragment(nalu []byte, headerSize int, fuHeader func(start, end bool) []byte) [][]byte {
+	if len(nalu) <= maxRTPPayload {
+		return [][]byte{nalu}
+	}
+	payloads := make([][]byte, 0, len(nalu)/maxRTPPayload+1)
+	data := nalu[headerSize:]
+	for start := true; len(data) > 0; start = false {
+		n := maxRTPPayload - headerSize - 1
+		if n > len(data) {
+			n = len(data)
+		}
+		payload := append(fuHeader(start, n == len(data)), data[:n]...)
+		payloads = append(payloads, payload)
+		data = data[n:]
+	}
+	return payloads
+}
+
+// fuFlags sets the start and end bits of the FU header at index i.
+func fuFlags(header []byte, i int, start, end bool) []byte {
+	if start {
+		header[i] |= 0x80
+	}
+	if end {
+		header[i] |= 0x40
+	}
+	return header
+}
+
+// aacSampleRates are the sampling_frequency_index values of ADTS.
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// splitADTS returns the raw access units of the ADTS frames.
+func splitADTS(b []byte) [][]byte {
+	aus := make([][]byte, 0, 1)
+	for len(b) >= 7 && b[0] == 0xff && b[1]&0xf0 == 0xf0 {
+		size := int(b[3]&0x03)<<11 | int(b[4])<<3 | int(b[5]>>5)
+		headerSize := 7
+		if b[1]&0x01 == 0 {
+			// crc
+			headerSize = 9
+		}
+		if size < headerSize || size > len(b) {
+			break
+		}
+		aus = append(aus, b[headerSize:size])
+		b = b[size:]
+	}
+	return aus
+}
+
+// parseADTS returns the AudioSpecificConfig, sample rate and channels of the
+// first ADTS header of b.
+func parseADTS(b []byte) (config []byte, sampleRate, channels int, ok bool) {
+	if len(b) < 7 || b[0] != 0xff || b[1]&0xf0 != 0xf0 {
+		return
+	}
+	objectType := int(b[2]>>6) + 1
+	rateIndex := int(b[2] >> 2 & 0x0f)
+	channels = int(b[2]&0x01)<<2 | int(b[3]>>6)
+	if rateIndex >= len(aacSampleRates) {
+		return
+	}
+	sampleRate = aacSampleRates[rateIndex]
+	config = []byte{byte(objectType<<3 | rateIndex>>1), byte(rateIndex&0x01<<7 | channels<<3)}
+	return config, sampleRate, channels, true
+}
@@ -0,0 +1,207 @@
+package gb28181
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/snowlyg/EasyDarwin/rtsp"
+)
+
+type testPack struct {
+	marker    bool
+	timestamp uint32
+	payload   []byte
+}
+
+func unpack(t *testing.T, packs []*rtsp.RTPPack) []testPack {
+	got := make([]testPack, 0, len(packs))
+	for _, pack := range packs {
+		b := pack.Buffer.Bytes()
+		if len(b) < rtsp.RTP_FIXED_HEADER_LENGTH {
+			t.Fatalf("pack of %d bytes", len(b))
+		}
+		if len(b)-rtsp.RTP_FIXED_HEADER_LENGTH > maxRTPPayload {
+			t.Errorf("payload of %d bytes over %d", len(b)-rtsp.RTP_FIXED_HEADER_LENGTH, maxRTPPayload)
+		}
+		got = append(got, testPack{marker: b[1]&0x80 != 0, timestamp: binary.BigEndian.Uint32(b[4:8]), payload: b[rtsp.RTP_FIXED_HEADER_LENGTH:]})
+	}
+	return got
+}
+
+// reassemble returns the nal unit of fragmentation units of headerSize
+// bytes of nal unit header, checking their start and end bits.
+func reassemble(t *testing.T, packs []testPack, headerSize int, header func(fu []byte) []byte) []byte {
+	var nalu []byte
+	for i, pack := range packs {
+		fuHeader := pack.payload[headerSize]
+		if start := fuHeader&0x80 != 0; start != (i == 0) {
+			t.Errorf("fu %d of %d, start bit %v", i, len(packs), start)
+		}
+		if end := fuHeader&0x40 != 0; end != (i == len(packs)-1) {
+			t.Errorf("fu %d of %d, end bit %v", i, len(packs), end)
+		}
+		if pack.marker != (i == len(packs)-1) {
+			t.Errorf("fu %d of %d, marker %v", i, len(packs), pack.marker)
+		}
+		if i == 0 {
+			nalu = header(pack.payload)
+		}
+		nalu = append(nalu, pack.payload[headerSize+1:]...)
+	}
+	return nalu
+}
+
+func TestPackH264(t *testing.T) {
+	track := newRTPTrack(0, STREAM_TYPE_H264)
+	for _, size := range []int{1, maxRTPPayload - 1, maxRTPPayload, maxRTPPayload + 1, 2*(maxRTPPayload-2) + 1, 2 * (maxRTPPayload - 2), 5000} {
+		nalu := append([]byte{0x65}, bytes.Repeat([]byte{0x88}, size-1)...)
+		frame := &esFrame{StreamType: STREAM_TYPE_H264, Video: true, PTS: 180000, Data: append([]byte{0, 0, 0, 1, 0x09, 0xf0, 0, 0, 0, 1}, nalu...)}
+		packs := unpack(t, track.packFrame(frame))
+		for _, pack := range packs {
+			if pack.timestamp != 180000 {
+				t.Errorf("timestamp %d", pack.timestamp)
+			}
+		}
+		if size <= maxRTPPayload {
+			if len(packs) != 1 || !bytes.Equal(packs[0].payload, nalu) || !packs[0].marker {
+				t.Errorf("nal unit of %d bytes in %d packs, want a single one without the AUD", size, len(packs))
+			}
+			continue
+		}
+		want := (size - 1 + maxRTPPayload - 3) / (maxRTPPayload - 2)
+		if len(packs) != want {
+			t.Errorf("nal unit of %d bytes in %d fu, want %d", size, len(packs), want)
+		}
+		got := reassemble(t, packs, 1, func(fu []byte) []byte {
+			if fu[0]&0x1f != 28 || fu[0]&0xe0 != nalu[0]&0xe0 {
+				t.Errorf("FU indicator %02x", fu[0])
+			}
+			return []byte{fu[0]&0xe0 | fu[1]&0x1f}
+		})
+		if !bytes.Equal(got, nalu) {
+			t.Errorf("nal unit of %d bytes reassembled to %d bytes", size, len(got))
+		}
+	}
+}
+
+func TestPackH265(t *testing.T) {
+	track := newRTPTrack(0, STREAM_TYPE_H265)
+	for _, size := range []int{2, maxRTPPayload, maxRTPPayload + 1, 2*(maxRTPPayload-3) + 2, 2*(maxRTPPayload-3) + 3, 5000} {
+		// IDR_W_RADL, layer 0, tid 1.
+		nalu := append([]byte{19 << 1, 0x01}, bytes.Repeat([]byte{0x88}, size-2)...)
+		aud := []byte{35 << 1, 0x01, 0x50}
+		frame := &esFrame{StreamType: STREAM_TYPE_H265, Video: true, PTS: 90000, Data: concat([]byte{0, 0, 0, 1}, aud, []byte{0, 0, 0, 1}, nalu)}
+		packs := unpack(t, track.packFrame(frame))
+		if size <= maxRTPPayload {
+			if len(packs) != 1 || !bytes.Equal(packs[0].payload, nalu) {
+				t.Errorf("nal unit of %d bytes in %d packs, want a single one without the AUD", size, len(packs))
+			}
+			continue
+		}
+		want := (size - 2 + maxRTPPayload - 4) / (maxRTPPayload - 3)
+		if len(packs) != want {
+			t.Errorf("nal unit of %d bytes in %d fu, want %d", size, len(packs), want)
+		}
+		got := reassemble(t, packs, 2, func(fu []byte) []byte {
+			if fu[0]>>1&0x3f != 49 || fu[1] != nalu[1] {
+				t.Errorf("payload header %02x%02x", fu[0], fu[1])
+			}
+			return []byte{fu[0]&0x81 | fu[2]&0x3f<<1, fu[1]}
+		})
+		if !bytes.Equal(got, nalu) {
+			t.Errorf("nal unit of %d bytes reassembled to %d bytes", size, len(got))
+		}
+	}
+}
+
+// adts returns an ADTS frame of AAC LC, 44100Hz stereo.
+func adts(payload []byte) []byte {
+	size := len(payload) + 7
+	header := []byte{0xff, 0xf1, 0x50, 0x80 | byte(size>>11&0x03), byte(size >> 3), byte(size&0x07)<<5 | 0x1f, 0xfc}
+	return append(header, payload...)
+}
+
+func TestPackAAC(t *testing.T) {
+	config, sampleRate, channels, ok := parseADTS(adts([]byte{1}))
+	if !ok || !bytes.Equal(config, []byte{0x12, 0x10}) || sampleRate != 44100 || channels != 2 {
+		t.Fatalf("parseADTS = %x %d %d %v", config, sampleRate, channels, ok)
+	}
+	track := newRTPTrack(1, STREAM_TYPE_AAC)
+	track.config, track.clockRate, track.channels = config, sampleRate, channels
+	aus := [][]byte{bytes.Repeat([]byte{1}, 300), bytes.Repeat([]byte{2}, 10)}
+	// 90000 in the 90kHz of the pts is 44100 in the clock of the track.
+	packs := unpack(t, track.packFrame(&esFrame{StreamType: STREAM_TYPE_AAC, PTS: 90000, Data: concat(adts(aus[0]), adts(aus[1]), []byte{0xff})}))
+	if len(packs) != 2 {
+		t.Fatalf("%d packs of 2 access units", len(packs))
+	}
+	for i, pack := range packs {
+		if pack.timestamp != uint32(44100+i*1024) || !pack.marker {
+			t.Errorf("pack %d timestamp %d marker %v", i, pack.timestamp, pack.marker)
+		}
+		if headers := binary.BigEndian.Uint16(pack.payload[0:2]); headers != 16 {
+			t.Errorf("AU-headers-length %d", headers)
+		}
+		if size := int(binary.BigEndian.Uint16(pack.payload[2:4]) >> 3); size != len(aus[i]) {
+			t.Errorf("AU-size %d, want %d", size, len(aus[i]))
+		}
+		if !bytes.Equal(pack.payload[4:], aus[i]) {
+			t.Errorf("access unit %d of %d bytes", i, len(pack.payload[4:]))
+		}
+	}
+	if media := track.media(nil); !strings.Contains(media, "MPEG4-GENERIC/44100/2") || !strings.Contains(media, "config=1210") {
+		t.Errorf("media = %q", media)
+	}
+}
+
+func TestSplitADTS(t *testing.T) {
+	crc := adts([]byte{0, 0, 7})
+	crc[1] &^= 0x01
+	tests := []struct {
+		name string
+		b    []byte
+		want [][]byte
+	}{
+		{"frames", concat(adts([]byte{1}), adts([]byte{2, 3})), [][]byte{{1}, {2, 3}}},
+		{"crc", crc, [][]byte{{7}}},
+		{"truncated", adts([]byte{1, 2, 3})[:8], [][]byte{}},
+		{"size under the header", []byte{0xff, 0xf1, 0x50, 0x80, 0x00, 0x1f, 0xfc}, [][]byte{}},
+		{"no sync word", []byte{0x00, 0xf1, 0x50, 0x80, 0x01, 0x1f, 0xfc, 1}, [][]byte{}},
+		{"short", []byte{0xff, 0xf1}, [][]byte{}},
+	}
+	for _, tt := range tests {
+		got := splitADTS(tt.b)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: splitADTS = %x, want %x", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if !bytes.Equal(got[i], tt.want[i]) {
+				t.Errorf("%s: splitADTS = %x, want %x", tt.name, got, tt.want)
+			}
+		}
+	}
+	if _, _, _, ok := parseADTS([]byte{0xff, 0xf1, 0x7c, 0x80, 0x01, 0x1f, 0xfc}); ok {
+		t.Error("parseADTS of a sampling frequency index 15")
+	}
+}
+
+func TestTrackMedia(t *testing.T) {
+	h264 := newRTPTrack(0, STREAM_TYPE_H264).media([][]byte{{0x67, 0x42}, {0x68, 0xce}})
+	if !strings.Contains(h264, "a=rtpmap:96 H264/90000") || !strings.Contains(h264, "sprop-parameter-sets=Z0I=,aM4=") || !strings.HasSuffix(h264, "a=control:trackID=0\r\n") {
+		t.Errorf("h264 media = %q", h264)
+	}
+	h265 := newRTPTrack(0, STREAM_TYPE_H265).media([][]byte{{32 << 1, 1}, {33 << 1, 1}, {34 << 1, 1}})
+	if !strings.Contains(h265, "a=fmtp:96 sprop-vps=QAE=;sprop-sps=QgE=;sprop-pps=RAE=") {
+		t.Errorf("h265 media = %q", h265)
+	}
+	pcma := newRTPTrack(1, STREAM_TYPE_G711A).media(nil)
+	if !strings.HasPrefix(pcma, "m=audio 0 RTP/AVP 8\r\na=rtpmap:8 PCMA/8000\r\n") {
+		t.Errorf("pcma media = %q", pcma)
+	}
+	packs := unpack(t, newRTPTrack(1, STREAM_TYPE_G711U).packFrame(&esFrame{StreamType: STREAM_TYPE_G711U, PTS: 90000, Data: make([]byte, maxRTPPayload+10)}))
+	if len(packs) != 2 || len(packs[1].payload) != 10 || packs[0].timestamp != 8000 {
+		t.Errorf("g711 packs = %d", len(packs))
+	}
+}
@@ -0,0 +1,265 @@
+package gb28181
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+	"github.com/snowlyg/EasyDarwin/rtsp"
+)
+
+// Server is the SIP server of GB/T 28181, devices register to it and send
+// keepalives, their catalog on query, and the live view of a channel over
+// rtp on INVITE. Live views are published to the rtsp server at
+// StreamPath, started when a player asks for it or by Play.
+type Server struct {
+	logger *log.Logger
+	Stoped bool
+
+	ID     string // sip id of the server, 20 digits
+	Domain string // sip domain, the first 10 digits of the id
+	IP     string // where devices reach the server, for sip and media
+	Port   int
+	Agent  string
+
+	password   string
+	conn       *net.UDPConn
+	rtspServer *rtsp.Server
+
+	devices          map[string]*Device // ID <-> Device
+	devicesLock      sync.RWMutex
+	nonces           map[string]time.Time // nonce of a challenge <-> its expiry
+	noncesLock       sync.Mutex
+	transactions     map[string]chan *Message // branch <-> responses
+	transactionsLock sync.Mutex
+	lives            map[string]*live // path <-> live
+	livesLock        sync.Mutex
+	mediaPorts       map[int]bool // in use
+	mediaPortsLock   sync.Mutex
+
+	sn           int32 // of MANSCDP queries
+	cseq         int32
+	ssrcSeq      int32
+	removeSource func()
+	stopCh       chan struct{}
+}
+
+// sipIDRex matches the ids of GB/T 28181 Annex D, 20 digits.
+var sipIDRex = regexp.MustCompile(`^[0-9]{20}$`)
+
+var Instance *Server = &Server{
+	logger: log.New(os.Stdout, "[GB28181]", log.LstdFlags|log.Lshortfile),
+	Stoped: true,
+}
+
+func GetServer() *Server {
+	return Instance
+}
+
+// Start listens for the devices if gb28181 is enabled, the live views are
+// published to rtspServer.
+func (server *Server) Start(rtspServer *rtsp.Server, agent string) (err error) {
+	sec := utils.Conf().Section("gb28181")
+	if !sec.Key("enable").MustBool(false) {
+		return
+	}
+	if !utils.Debug {
+		server.logger.SetOutput(utils.GetLogWriter())
+	}
+	server.ID = sec.Key("sip_id").MustString("34020000002000000001")
+	if !sipIDRex.MatchString(server.ID) {
+		return fmt.Errorf("sip_id[%s] should be 20 digits", server.ID)
+	}
+	server.Domain = sec.Key("sip_domain").MustString("")
+	if server.Domain == "" {
+		server.Domain = server.ID[:10]
+	}
+	server.Port = sec.Key("sip_port").MustInt(5060)
+	server.IP = sec.Key("ip").MustString("")
+	if server.IP == "" {
+		server.IP = utils.LocalIP()
+	}
+	server.Agent = agent
+	server.password = sec.Key("password").MustString("")
+	if server.password == "" {
+		server.logger.Printf("warning: password is empty, any host may register as a device and take over its live views")
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: server.Port})
+	if err != nil {
+		return
+	}
+	server.conn = conn
+	server.rtspServer = rtspServer
+	server.devices = make(map[string]*Device)
+	server.nonces = make(map[string]time.Time)
+	server.transactions = make(map[string]chan *Message)
+	server.lives = make(map[string]*live)
+	server.mediaPorts = make(map[int]bool)
+	server.stopCh = make(chan struct{})
+	server.Stoped = false
+	server.removeSource = rtspServer.AddPusherSource(server.demandLive)
+	server.logger.Printf("sip server[%s@%s] listen on %s:%d", server.ID, server.Domain, server.IP, server.Port)
+	go server.checkDevices(server.stopCh)
+	go server.serve(conn)
+	return
+}
+
+func (server *Server) Stop() {
+	if server.Stoped {
+		return
+	}
+	server.Stoped = true
+	server.removeSource()
+	server.livesLock.Lock()
+	lives := make([]*live, 0, len(server.lives))
+	for _, l := range server.lives {
+		lives = append(lives, l)
+	}
+	server.livesLock.Unlock()
+	for _, l := range lives {
+		// BYE the devices before the socket closes.
+		l.stop(fmt.Errorf("server stopped"), true)
+	}
+	close(server.stopCh)
+	server.conn.Close()
+	server.logger.Printf("sip server stopped")
+}
+
+func (server *Server) serve(conn *net.UDPConn) {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if server.Stoped {
+				return
+			}
+			server.logger.Printf("sip read err:%v", err)
+			continue
+		}
+		msg, err := ParseMessage(buf[:n])
+		if err != nil {
+			server.logger.Printf("sip message from %v invalid, %v", addr, err)
+			continue
+		}
+		if msg.StatusCode != 0 {
+			server.deliver(msg)
+			continue
+		}
+		server.handleRequest(msg, addr)
+	}
+}
+
+func (server *Server) handleRequest(req *Message, addr *net.UDPAddr) {
+	switch req.Method {
+	case REGISTER:
+		server.handleRegister(req, addr)
+	case MESSAGE:
+		server.handleMessage(req, addr)
+	case BYE:
+		server.handleBye(req, addr)
+	case ACK:
+	case OPTIONS:
+		server.send(NewResponse(req, 200, "OK"), addr)
+	default:
+		res := NewResponse(req, 405, "Method Not Allowed")
+		res.Header.Set("Allow", "REGISTER, MESSAGE, BYE, ACK, OPTIONS")
+		server.send(res, addr)
+	}
+}
+
+func (server *Server) send(msg *Message, addr *net.UDPAddr) error {
+	if msg.StatusCode != 0 {
+		msg.Header.Set("User-Agent", server.Agent)
+	}
+	_, err := server.conn.WriteToUDP(msg.Bytes(), addr)
+	return err
+}
+
+// newRequest returns a request to the device out of a dialog, the caller
+// sets the body.
+func (server *Server) newRequest(method, to string, addr *net.UDPAddr) *Message {
+	req := &Message{Method: method, URI: fmt.Sprintf("sip:%s@%s", to, addr), Header: make(Header)}
+	req.Header.Set("From", fmt.Sprintf("<sip:%s@%s>;tag=%s", server.ID, server.Domain, newTag()))
+	req.Header.Set("To", fmt.Sprintf("<sip:%s@%s>", to, addr))
+	req.Header.Set("Call-ID", randomHex(16))
+	req.Header.Set("CSeq", fmt.Sprintf("%d %s", atomic.AddInt32(&server.cseq, 1), method))
+	return req
+}
+
+// request sends req to addr and returns its final response, the request is
+// sent again until a response comes as udp may lose it, RFC 3261 17.1.
+func (server *Server) request(req *Message, addr *net.UDPAddr, timeout time.Duration) (*Message, error) {
+	branch := newBranch()
+	req.Header.Set("Via", fmt.Sprintf("SIP/2.0/UDP %s;rport;branch=%s", net.JoinHostPort(server.IP, strconv.Itoa(server.Port)), branch))
+	req.Header.Set("Max-Forwards", "70")
+	req.Header.Set("User-Agent", server.Agent)
+	ch := make(chan *Message, 8)
+	server.transactionsLock.Lock()
+	server.transactions[branch] = ch
+	server.transactionsLock.Unlock()
+	defer func() {
+		server.transactionsLock.Lock()
+		delete(server.transactions, branch)
+		server.transactionsLock.Unlock()
+	}()
+	if err := server.send(req, addr); err != nil {
+		return nil, err
+	}
+	interval := 500 * time.Millisecond
+	retransmit := time.NewTimer(interval)
+	defer retransmit.Stop()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		select {
+		case res := <-ch:
+			if res.StatusCode < 200 {
+				// the device is at it.
+				retransmit.Stop()
+				continue
+			}
+			return res, nil
+		case <-retransmit.C:
+			server.send(req, addr)
+			if interval < 4*time.Second {
+				interval *= 2
+			}
+			retransmit.Reset(interval)
+		case <-deadline.C:
+			return nil, fmt.Errorf("%s timeout", req)
+		case <-server.stopCh:
+			return nil, fmt.Errorf("%s canceled, server stopped", req)
+		}
+	}
+}
+
+// deliver passes the response to the transaction waiting for it.
+func (server *Server) deliver(res *Message) {
+	server.transactionsLock.Lock()
+	ch, ok := server.transactions[res.Branch()]
+	server.transactionsLock.Unlock()
+	if !ok {
+		// the 200 of an INVITE comes again until acknowledged.
+		if _, method := res.CSeq(); method == INVITE && res.StatusCode == 200 {
+			if l := server.liveOfCall(res.Header.Get("Call-ID")); l != nil && l.invited() {
+				l.ack()
+			}
+		}
+		return
+	}
+	select {
+	case ch <- res:
+	default:
+	}
+}
+
+func (server *Server) requestTimeout() time.Duration {
+	return time.Duration(utils.Conf().Section("gb28181").Key("invite_timeout").MustInt(10)) * time.Second
+}
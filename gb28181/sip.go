@@ -0,0 +1,264 @@
+package gb28181
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const SIP_VERSION = "SIP/2.0"
+
+// SIP methods used by GB28181.
+const (
+	REGISTER = "REGISTER"
+	MESSAGE  = "MESSAGE"
+	INVITE   = "INVITE"
+	ACK      = "ACK"
+	BYE      = "BYE"
+	CANCEL   = "CANCEL"
+	OPTIONS  = "OPTIONS"
+)
+
+// compactHeaders are the compact forms of headers, RFC 3261 7.3.3.
+var compactHeaders = map[string]string{
+	"V": "Via",
+	"F": "From",
+	"T": "To",
+	"I": "Call-ID",
+	"M": "Contact",
+	"L": "Content-Length",
+	"C": "Content-Type",
+	"S": "Subject",
+	"K": "Supported",
+}
+
+// headerKeys are the keys textproto.CanonicalMIMEHeaderKey gets wrong.
+var headerKeys = map[string]string{
+	"Call-Id":          "Call-ID",
+	"Cseq":             "CSeq",
+	"Www-Authenticate": "WWW-Authenticate",
+}
+
+func canonicalHeaderKey(key string) string {
+	key = textproto.CanonicalMIMEHeaderKey(key)
+	if k, ok := compactHeaders[key]; ok {
+		return k
+	}
+	if k, ok := headerKeys[key]; ok {
+		return k
+	}
+	return key
+}
+
+// Header is the header of a SIP message, keys are canonical and a key may
+// have several values, Via mostly.
+type Header map[string][]string
+
+// Get returns the first value of key, empty if there is none.
+func (h Header) Get(key string) string {
+	if values := h[canonicalHeaderKey(key)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Set replaces the values of key.
+func (h Header) Set(key, value string) {
+	h[canonicalHeaderKey(key)] = []string{value}
+}
+
+// Add appends a value to key.
+func (h Header) Add(key, value string) {
+	key = canonicalHeaderKey(key)
+	h[key] = append(h[key], value)
+}
+
+// headerOrder is the order headers are written in, the others follow sorted
+// and Content-Length is the last.
+var headerOrder = []string{"Via", "From", "To", "Call-ID", "CSeq"}
+
+// Message is a SIP request, or a response if StatusCode is not 0.
+type Message struct {
+	Method     string
+	URI        string
+	StatusCode int
+	Reason     string
+	Header     Header
+	Body       string
+}
+
+func (msg *Message) String() string {
+	if msg.StatusCode != 0 {
+		return fmt.Sprintf("%d %s[%s]", msg.StatusCode, msg.Reason, msg.Header.Get("CSeq"))
+	}
+	return fmt.Sprintf("%s %s", msg.Method, msg.URI)
+}
+
+// ParseMessage parses a SIP message of a udp packet.
+func ParseMessage(b []byte) (*Message, error) {
+	head := b
+	body := []byte(nil)
+	if i := bytes.Index(b, []byte("\r\n\r\n")); i >= 0 {
+		head, body = b[:i], b[i+4:]
+	}
+	lines := strings.Split(strings.ReplaceAll(string(head), "\r\n", "\n"), "\n")
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("empty sip message")
+	}
+	msg := &Message{Header: make(Header)}
+	line := strings.TrimSpace(lines[0])
+	if strings.HasPrefix(line, SIP_VERSION+" ") {
+		// Status-Line = SIP-Version SP Status-Code SP Reason-Phrase
+		items := strings.SplitN(line, " ", 3)
+		code, err := strconv.Atoi(items[1])
+		if err != nil || code < 100 || code > 699 {
+			return nil, fmt.Errorf("invalid sip status line: %q", line)
+		}
+		msg.StatusCode = code
+		if len(items) == 3 {
+			msg.Reason = items[2]
+		}
+	} else {
+		// Request-Line = Method SP Request-URI SP SIP-Version
+		items := strings.Fields(line)
+		if len(items) != 3 || items[2] != SIP_VERSION {
+			return nil, fmt.Errorf("invalid sip request line: %q", line)
+		}
+		msg.Method, msg.URI = items[0], items[1]
+	}
+	lastKey := ""
+	for _, line := range lines[1:] {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && lastKey != "" {
+			values := msg.Header[lastKey]
+			values[len(values)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		items := strings.SplitN(line, ":", 2)
+		if len(items) < 2 {
+			continue
+		}
+		lastKey = canonicalHeaderKey(strings.TrimSpace(items[0]))
+		msg.Header.Add(lastKey, strings.TrimSpace(items[1]))
+	}
+	if n, err := strconv.Atoi(msg.Header.Get("Content-Length")); err == nil && n >= 0 && n < len(body) {
+		body = body[:n]
+	}
+	msg.Body = string(body)
+	return msg, nil
+}
+
+// Bytes returns the message to send, with its Content-Length.
+func (msg *Message) Bytes() []byte {
+	var b bytes.Buffer
+	if msg.StatusCode != 0 {
+		fmt.Fprintf(&b, "%s %d %s\r\n", SIP_VERSION, msg.StatusCode, msg.Reason)
+	} else {
+		fmt.Fprintf(&b, "%s %s %s\r\n", msg.Method, msg.URI, SIP_VERSION)
+	}
+	keys := make([]string, 0, len(msg.Header))
+	for key := range msg.Header {
+		ordered := key == "Content-Length"
+		for _, k := range headerOrder {
+			ordered = ordered || key == k
+		}
+		if !ordered {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	keys = append(append([]string{}, headerOrder...), keys...)
+	for _, key := range keys {
+		for _, value := range msg.Header[key] {
+			value = strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+			fmt.Fprintf(&b, "%s: %s\r\n", key, value)
+		}
+	}
+	fmt.Fprintf(&b, "Content-Length: %d\r\n\r\n%s", len(msg.Body), msg.Body)
+	return b.Bytes()
+}
+
+// CSeq returns the number and the method of the CSeq header.
+func (msg *Message) CSeq() (int, string) {
+	items := strings.Fields(msg.Header.Get("CSeq"))
+	if len(items) != 2 {
+		return 0, ""
+	}
+	n, _ := strconv.Atoi(items[0])
+	return n, items[1]
+}
+
+// Branch returns the branch of the top Via, which identifies the transaction.
+func (msg *Message) Branch() string {
+	return headerParam(msg.Header.Get("Via"), "branch")
+}
+
+// NewResponse returns the response to req, the To gets a tag unless it has
+// one.
+func NewResponse(req *Message, code int, reason string) *Message {
+	res := &Message{StatusCode: code, Reason: reason, Header: make(Header)}
+	for _, key := range []string{"Via", "From", "To", "Call-ID", "CSeq"} {
+		for _, value := range req.Header[key] {
+			res.Header.Add(key, value)
+		}
+	}
+	if to := res.Header.Get("To"); to != "" && headerParam(to, "tag") == "" && code > 100 {
+		res.Header.Set("To", to+";tag="+newTag())
+	}
+	return res
+}
+
+// headerParam returns the parameter of a header value like
+// <sip:34020000001320000001@3402000000>;tag=123 or
+// SIP/2.0/UDP 192.168.1.64:5060;rport;branch=z9hG4bK123, empty if it has none.
+func headerParam(value, name string) string {
+	if i := strings.LastIndex(value, ">"); i >= 0 {
+		value = value[i+1:]
+	}
+	for _, param := range strings.Split(value, ";")[1:] {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if strings.EqualFold(kv[0], name) {
+			if len(kv) == 2 {
+				return strings.Trim(kv[1], `"`)
+			}
+			return ""
+		}
+	}
+	return ""
+}
+
+// uriUser returns the user of the sip uri of a header value, the device id
+// of <sip:34020000001320000001@3402000000>;tag=123.
+func uriUser(value string) string {
+	if i := strings.Index(value, "sip:"); i >= 0 {
+		value = value[i+4:]
+	}
+	if i := strings.IndexAny(value, "@>;"); i >= 0 {
+		value = value[:i]
+	}
+	return value
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+func newTag() string {
+	return randomHex(6)
+}
+
+// newBranch returns a branch of RFC 3261, starting with the magic cookie.
+func newBranch() string {
+	return "z9hG4bK" + randomHex(8)
+}
@@ -0,0 +1,239 @@
+package gb28181
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want *Message
+	}{
+		{
+			name: "register",
+			raw: "REGISTER sip:34020000002000000001@3402000000 SIP/2.0\r\n" +
+				"Via: SIP/2.0/UDP 192.168.1.64:5060;rport;branch=z9hG4bK1\r\n" +
+				"From: <sip:34020000001320000001@3402000000>;tag=1\r\n" +
+				"To: <sip:34020000001320000001@3402000000>\r\n" +
+				"Call-ID: 1@192.168.1.64\r\n" +
+				"CSeq: 1 REGISTER\r\n" +
+				"Expires: 3600\r\n" +
+				"Content-Length: 0\r\n\r\n",
+			want: &Message{Method: REGISTER, URI: "sip:34020000002000000001@3402000000", Header: Header{
+				"Via":            {"SIP/2.0/UDP 192.168.1.64:5060;rport;branch=z9hG4bK1"},
+				"From":           {"<sip:34020000001320000001@3402000000>;tag=1"},
+				"To":             {"<sip:34020000001320000001@3402000000>"},
+				"Call-ID":        {"1@192.168.1.64"},
+				"CSeq":           {"1 REGISTER"},
+				"Expires":        {"3600"},
+				"Content-Length": {"0"},
+			}},
+		},
+		{
+			name: "compact and lower case headers",
+			raw: "MESSAGE sip:34020000002000000001@3402000000 SIP/2.0\r\n" +
+				"v: SIP/2.0/UDP 192.168.1.64:5060;branch=z9hG4bK2\r\n" +
+				"f: <sip:34020000001320000001@3402000000>;tag=2\r\n" +
+				"t: <sip:34020000002000000001@3402000000>\r\n" +
+				"i: 2@192.168.1.64\r\n" +
+				"cseq: 2 MESSAGE\r\n" +
+				"m: <sip:34020000001320000001@192.168.1.64:5060>\r\n" +
+				"c: Application/MANSCDP+xml\r\n" +
+				"l: 5\r\n\r\n" +
+				"<xml>",
+			want: &Message{Method: MESSAGE, URI: "sip:34020000002000000001@3402000000", Header: Header{
+				"Via":            {"SIP/2.0/UDP 192.168.1.64:5060;branch=z9hG4bK2"},
+				"From":           {"<sip:34020000001320000001@3402000000>;tag=2"},
+				"To":             {"<sip:34020000002000000001@3402000000>"},
+				"Call-ID":        {"2@192.168.1.64"},
+				"CSeq":           {"2 MESSAGE"},
+				"Contact":        {"<sip:34020000001320000001@192.168.1.64:5060>"},
+				"Content-Type":   {"Application/MANSCDP+xml"},
+				"Content-Length": {"5"},
+			}, Body: "<xml>"},
+		},
+		{
+			name: "folded and repeated headers",
+			raw: "SIP/2.0 200 OK\r\n" +
+				"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK3\r\n" +
+				"Via: SIP/2.0/UDP 10.0.0.2:5060\r\n" +
+				"  ;branch=z9hG4bK4\r\n" +
+				"WWW-Authenticate: Digest realm=\"3402000000\",\r\n" +
+				"\tnonce=\"abc\"\r\n" +
+				"CSeq: 3 INVITE\r\n\r\n",
+			want: &Message{StatusCode: 200, Reason: "OK", Header: Header{
+				"Via":              {"SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK3", "SIP/2.0/UDP 10.0.0.2:5060 ;branch=z9hG4bK4"},
+				"WWW-Authenticate": {`Digest realm="3402000000", nonce="abc"`},
+				"CSeq":             {"3 INVITE"},
+			}},
+		},
+		{
+			name: "body cut at content length, lf line endings",
+			raw:  "SIP/2.0 401 Unauthorized\nCSeq: 4 REGISTER\nContent-Length: 3\n\r\n\r\nv=0 and more",
+			want: &Message{StatusCode: 401, Reason: "Unauthorized", Header: Header{
+				"CSeq":           {"4 REGISTER"},
+				"Content-Length": {"3"},
+			}, Body: "v=0"},
+		},
+		{
+			name: "status without reason, junk lines",
+			raw:  "\r\nSIP/2.0 100\r\nno colon here\r\nCSeq: 5 INVITE\r\n\r\n",
+			want: &Message{StatusCode: 100, Header: Header{
+				"CSeq": {"5 INVITE"},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := ParseMessage([]byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseMessage err: %v", err)
+			}
+			if !reflect.DeepEqual(msg, tt.want) {
+				t.Errorf("ParseMessage = %+v, want %+v", msg, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMessageErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"\r\n\r\n",
+		"REGISTER sip:x SIP/3.0\r\n\r\n",
+		"REGISTER sip:x\r\n\r\n",
+		"GET / HTTP/1.1\r\n\r\n",
+		"SIP/2.0 OK\r\n\r\n",
+		"SIP/2.0 99 Too Small\r\n\r\n",
+		"SIP/2.0 700 Too Big\r\n\r\n",
+	}
+	for _, raw := range tests {
+		if msg, err := ParseMessage([]byte(raw)); err == nil {
+			t.Errorf("ParseMessage(%q) = %+v, want an error", raw, msg)
+		}
+	}
+}
+
+func TestMessageBytes(t *testing.T) {
+	msg := &Message{Method: INVITE, URI: "sip:34020000001320000002@192.168.1.64:5060", Header: make(Header)}
+	msg.Header.Set("Subject", "34020000001320000002:0200000001,34020000002000000001:0")
+	msg.Header.Set("CSeq", "1 INVITE")
+	msg.Header.Set("Call-ID", "abc")
+	msg.Header.Set("To", "<sip:34020000001320000002@192.168.1.64:5060>")
+	msg.Header.Set("From", "<sip:34020000002000000001@3402000000>;tag=1")
+	msg.Header.Set("Via", "SIP/2.0/UDP 192.168.1.2:5060;branch=z9hG4bK1")
+	msg.Header.Set("Content-Type", "APPLICATION/SDP")
+	msg.Header.Set("User-Agent", "test\r\nInjected: x")
+	msg.Header.Set("Content-Length", "999")
+	msg.Body = "v=0\r\n"
+	want := "INVITE sip:34020000001320000002@192.168.1.64:5060 SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 192.168.1.2:5060;branch=z9hG4bK1\r\n" +
+		"From: <sip:34020000002000000001@3402000000>;tag=1\r\n" +
+		"To: <sip:34020000001320000002@192.168.1.64:5060>\r\n" +
+		"Call-ID: abc\r\n" +
+		"CSeq: 1 INVITE\r\n" +
+		"Content-Type: APPLICATION/SDP\r\n" +
+		"Subject: 34020000001320000002:0200000001,34020000002000000001:0\r\n" +
+		"User-Agent: test  Injected: x\r\n" +
+		"Content-Length: 5\r\n\r\n" +
+		"v=0\r\n"
+	if got := string(msg.Bytes()); got != want {
+		t.Errorf("Bytes =\n%q\nwant\n%q", got, want)
+	}
+	parsed, err := ParseMessage(msg.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Method != msg.Method || parsed.URI != msg.URI || parsed.Body != msg.Body || parsed.Header.Get("Content-Length") != "5" {
+		t.Errorf("ParseMessage(Bytes) = %+v", parsed)
+	}
+
+	res := &Message{StatusCode: 200, Reason: "OK", Header: make(Header)}
+	if got := string(res.Bytes()); got != "SIP/2.0 200 OK\r\nContent-Length: 0\r\n\r\n" {
+		t.Errorf("Bytes of a response = %q", got)
+	}
+}
+
+func TestNewResponse(t *testing.T) {
+	req, err := ParseMessage([]byte("BYE sip:34020000002000000001@3402000000 SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK1\r\n" +
+		"Via: SIP/2.0/UDP 10.0.0.2:5060;branch=z9hG4bK2\r\n" +
+		"From: <sip:34020000001320000001@3402000000>;tag=1\r\n" +
+		"To: <sip:34020000002000000001@3402000000>\r\n" +
+		"Call-ID: abc\r\n" +
+		"CSeq: 7 BYE\r\n" +
+		"Subject: dropped\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := NewResponse(req, 200, "OK")
+	if !reflect.DeepEqual(res.Header["Via"], req.Header["Via"]) {
+		t.Errorf("Via = %q", res.Header["Via"])
+	}
+	if res.Header.Get("Subject") != "" || res.Header.Get("Call-ID") != "abc" || res.Header.Get("From") != req.Header.Get("From") {
+		t.Errorf("header = %v", res.Header)
+	}
+	if tag := headerParam(res.Header.Get("To"), "tag"); tag == "" {
+		t.Errorf("To %q has no tag", res.Header.Get("To"))
+	}
+	if n, method := res.CSeq(); n != 7 || method != BYE {
+		t.Errorf("CSeq = %d %s", n, method)
+	}
+	if branch := res.Branch(); branch != "z9hG4bK1" {
+		t.Errorf("Branch = %q", branch)
+	}
+	if to := NewResponse(req, 100, "Trying").Header.Get("To"); to != req.Header.Get("To") {
+		t.Errorf("To of 100 = %q, want no tag", to)
+	}
+	req.Header.Set("To", "<sip:34020000002000000001@3402000000>;tag=9")
+	if to := NewResponse(req, 200, "OK").Header.Get("To"); to != req.Header.Get("To") {
+		t.Errorf("To = %q, want the tag kept", to)
+	}
+}
+
+func TestHeaderParam(t *testing.T) {
+	tests := []struct {
+		value, name, want string
+	}{
+		{"<sip:34020000001320000001@3402000000>;tag=123", "tag", "123"},
+		{"<sip:34020000001320000001@3402000000;transport=udp>;tag=123", "transport", ""},
+		{"SIP/2.0/UDP 192.168.1.64:5060;rport;branch=z9hG4bK123", "branch", "z9hG4bK123"},
+		{"SIP/2.0/UDP 192.168.1.64:5060;rport;branch=z9hG4bK123", "rport", ""},
+		{"SIP/2.0/UDP 192.168.1.64:5060;RPORT=5061", "rport", "5061"},
+		{`<sip:34020000001320000001@192.168.1.64>;expires="600"`, "expires", "600"},
+		{"<sip:34020000001320000001@192.168.1.64>", "tag", ""},
+		{"", "tag", ""},
+	}
+	for _, tt := range tests {
+		if got := headerParam(tt.value, tt.name); got != tt.want {
+			t.Errorf("headerParam(%q, %q) = %q, want %q", tt.value, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestURIUser(t *testing.T) {
+	tests := []struct {
+		value, want string
+	}{
+		{"<sip:34020000001320000001@3402000000>;tag=123", "34020000001320000001"},
+		{"\"camera\" <sip:34020000001320000001@192.168.1.64:5060>", "34020000001320000001"},
+		{"sip:34020000001320000001@3402000000", "34020000001320000001"},
+		{"<sip:34020000001320000001>;tag=1", "34020000001320000001"},
+		{"34020000001320000001", "34020000001320000001"},
+	}
+	for _, tt := range tests {
+		if got := uriUser(tt.value); got != tt.want {
+			t.Errorf("uriUser(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestNewBranch(t *testing.T) {
+	a, b := newBranch(), newBranch()
+	if !strings.HasPrefix(a, "z9hG4bK") || a == b {
+		t.Errorf("newBranch = %q, %q", a, b)
+	}
+}
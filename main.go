@@ -8,6 +8,7 @@ import (
 	"github.com/kardianos/service"
 	"github.com/snowlyg/EasyDarwin/extend/db"
 	"github.com/snowlyg/EasyDarwin/extend/utils"
+	"github.com/snowlyg/EasyDarwin/gb28181"
 	"github.com/snowlyg/EasyDarwin/models"
 	"github.com/snowlyg/EasyDarwin/routers"
 	"github.com/snowlyg/EasyDarwin/rtsp"
@@ -102,6 +103,25 @@ func (p *program) StopRTSP() (err error) {
 	return
 }
 
+func (p *program) StartGB28181() (err error) {
+	if err = gb28181.GetServer().Start(p.rtspServer, agent()); err != nil {
+		err = fmt.Errorf("start gb28181 server error, %v", err)
+	}
+	return
+}
+
+func (p *program) StopGB28181() {
+	gb28181.GetServer().Stop()
+}
+
+func agent() string {
+	agent := fmt.Sprintf("EasyDarwinGo/%s", routers.BuildVersion)
+	if routers.BuildDateTime != "" {
+		agent = fmt.Sprintf("%s(%s)", agent, routers.BuildDateTime)
+	}
+	return agent
+}
+
 func (p *program) Start(s service.Service) (err error) {
 	log.Println("********** START **********")
 
@@ -127,6 +147,10 @@ func (p *program) Start(s service.Service) (err error) {
 	if err != nil {
 		return
 	}
+	err = p.StartGB28181()
+	if err != nil {
+		return
+	}
 	err = p.StartHTTP()
 	if err != nil {
 		return
@@ -141,15 +165,23 @@ func (p *program) Start(s service.Service) (err error) {
 	go func() {
 		for range routers.API.RestartChan {
 			p.StopHTTP()
+			p.StopGB28181()
+			routers.StopHistory()
 			p.StopRTSP()
 			utils.ReloadConf()
 			p.StartRTSP()
+			if err := p.StartGB28181(); err != nil {
+				log.Println(err)
+			}
+			routers.StartHistory()
 			p.StartHTTP()
 		}
 	}()
 
 	go func() {
 		log.Printf("demon pull streams")
+		// streams dialed before, dialing them again is a reconnect.
+		dialed := make(map[uint]bool)
 		for {
 			var streams []models.Stream
 			db.SQLite.Find(&streams)
@@ -165,20 +197,20 @@ func (p *program) Start(s service.Service) (err error) {
 				}
 
 				if rtsp.GetServer().GetPusher(v.CustomPath) != nil {
+					dialed[v.ID] = true
 					continue
 				}
 
-				agent := fmt.Sprintf("EasyDarwinGo/%s", routers.BuildVersion)
-				if routers.BuildDateTime != "" {
-					agent = fmt.Sprintf("%s(%s)", agent, routers.BuildDateTime)
-				}
-
-				client, err := rtsp.NewRTSPClient(rtsp.GetServer(), v.URL, int64(v.HeartbeatInterval)*1000, agent, v.CustomPath)
+				client, err := rtsp.NewRTSPClient(rtsp.GetServer(), v.URL, int64(v.HeartbeatInterval)*1000, agent(), v.CustomPath)
 				if err != nil {
 					continue
 				}
 
 				pusher := rtsp.NewClientPusher(client)
+				if dialed[v.ID] {
+					rtsp.GetServer().CountReconnect(pusher.Path())
+				}
+				dialed[v.ID] = true
 
 				err = client.Start(time.Duration(v.IdleTimeout) * time.Second)
 				if err != nil {
@@ -207,6 +239,8 @@ func (p *program) Stop(s service.Service) (err error) {
 	defer log.Println("********** STOP **********")
 	defer utils.CloseLogWriter()
 	p.StopHTTP()
+	p.StopGB28181()
+	routers.StopHistory()
 	p.StopRTSP()
 	models.Close()
 	return
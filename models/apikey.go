@@ -0,0 +1,102 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/snowlyg/EasyDarwin/extend/db"
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+)
+
+const (
+	// keys of APIKEY_SCOPE_READONLY may only call GET apis which need no admin permission.
+	APIKEY_SCOPE_READONLY = "readonly"
+	// keys of APIKEY_SCOPE_ADMIN act with every permission of their user.
+	APIKEY_SCOPE_ADMIN = "admin"
+
+	APIKEY_PREFIX = "ed_"
+)
+
+// APIKey is a long-lived bearer token of a user. Only the sha256 of the key
+// is stored, the key itself is shown once on creation.
+type APIKey struct {
+	ID         string         `structs:"id" gorm:"primary_key;type:TEXT;not null" json:"id"`
+	Name       string         `gorm:"type:TEXT" json:"name"`
+	UserID     string         `gorm:"type:TEXT;index" json:"userId"`
+	Prefix     string         `gorm:"type:TEXT" json:"prefix"`
+	Hash       string         `gorm:"type:TEXT;unique_index" json:"-"`
+	Scope      string         `gorm:"type:TEXT" json:"scope"`
+	Revoked    bool           `json:"revoked"`
+	LastUsedAt utils.DateTime `gorm:"type:datetime" json:"lastUsedAt"`
+	LastUsedIP string         `gorm:"type:TEXT" json:"lastUsedIP"`
+	CreatedAt  utils.DateTime `gorm:"type:datetime" json:"createdAt"`
+}
+
+func (key *APIKey) BeforeCreate(scope *gorm.Scope) error {
+	scope.SetColumn("ID", utils.ShortID())
+	return nil
+}
+
+func IsValidAPIKeyScope(scope string) bool {
+	return scope == APIKEY_SCOPE_READONLY || scope == APIKEY_SCOPE_ADMIN
+}
+
+func hashAPIKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewAPIKey creates a key for user, the returned token is the only copy of
+// the key in plain text.
+func NewAPIKey(userID, name, scope string) (key *APIKey, token string, err error) {
+	if !IsValidAPIKeyScope(scope) {
+		err = fmt.Errorf("invalid scope[%s]", scope)
+		return
+	}
+	buf := make([]byte, 24)
+	if _, err = rand.Read(buf); err != nil {
+		return
+	}
+	token = APIKEY_PREFIX + hex.EncodeToString(buf)
+	key = &APIKey{
+		Name:   name,
+		UserID: userID,
+		Prefix: token[:len(APIKEY_PREFIX)+8],
+		Hash:   hashAPIKey(token),
+		Scope:  scope,
+	}
+	if err = db.SQLite.Create(key).Error; err != nil {
+		key, token = nil, ""
+	}
+	return
+}
+
+// FindAPIKey returns the unrevoked key of token.
+func FindAPIKey(token string) (*APIKey, error) {
+	if !strings.HasPrefix(token, APIKEY_PREFIX) {
+		return nil, fmt.Errorf("invalid api key")
+	}
+	var key APIKey
+	if db.SQLite.First(&key, "hash = ?", hashAPIKey(token)).RecordNotFound() {
+		return nil, fmt.Errorf("api key not found")
+	}
+	if key.Revoked {
+		return nil, fmt.Errorf("api key revoked")
+	}
+	return &key, nil
+}
+
+func (key *APIKey) Touch(ip string) {
+	now := utils.DateTime(time.Now())
+	key.LastUsedAt = now
+	key.LastUsedIP = ip
+	db.SQLite.Model(key).UpdateColumns(map[string]interface{}{
+		"last_used_at": now,
+		"last_used_ip": ip,
+	})
+}
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/snowlyg/EasyDarwin/extend/db"
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+)
+
+const (
+	AUDIT_LOGIN            = "login"
+	AUDIT_MODIFY_PASSWORD  = "password.modify"
+	AUDIT_RESTART          = "server.restart"
+	AUDIT_CONFIG_UPDATE    = "config.update"
+	AUDIT_STREAM_ADD       = "stream.add"
+	AUDIT_STREAM_UPDATE    = "stream.update"
+	AUDIT_STREAM_START     = "stream.start"
+	AUDIT_STREAM_STOP      = "stream.stop"
+	AUDIT_STREAM_DEL       = "stream.del"
+	AUDIT_STREAM_SIGN      = "stream.sign"
+	AUDIT_PLAYERS_REDIRECT = "players.redirect"
+	AUDIT_ONVIF_IMPORT     = "onvif.import"
+)
+
+// AuditLog records who did an administrative action, Before and After are
+// the json of the target before and after the action, if any.
+type AuditLog struct {
+	ID        uint           `gorm:"primary_key" json:"id"`
+	UserID    string         `gorm:"type:TEXT;index" json:"userId"`
+	Username  string         `gorm:"type:TEXT" json:"username"`
+	IP        string         `gorm:"type:TEXT" json:"ip"`
+	Action    string         `gorm:"type:TEXT;index" json:"action"`
+	Target    string         `gorm:"type:TEXT" json:"target"`
+	Before    string         `gorm:"type:TEXT" json:"before"`
+	After     string         `gorm:"type:TEXT" json:"after"`
+	CreatedAt utils.DateTime `gorm:"type:datetime;index" json:"createdAt"`
+}
+
+func auditJSON(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// AddAuditLog saves an audit log, user may be nil for anonymous actions.
+func AddAuditLog(user *User, ip, action, target string, before, after interface{}) {
+	auditLog := AuditLog{
+		IP:        ip,
+		Action:    action,
+		Target:    target,
+		Before:    auditJSON(before),
+		After:     auditJSON(after),
+		CreatedAt: utils.DateTime(time.Now()),
+	}
+	if user != nil {
+		auditLog.UserID = user.ID
+		auditLog.Username = user.Username
+	}
+	if err := db.SQLite.Create(&auditLog).Error; err != nil {
+		log.Printf("save audit log[%s %s] error:%v", action, target, err)
+	}
+}
@@ -10,17 +10,26 @@ func Init() (err error) {
 	if err != nil {
 		return
 	}
-	db.SQLite.AutoMigrate(User{}, Stream{})
+	db.SQLite.AutoMigrate(User{}, Stream{}, Role{}, Grant{}, APIKey{}, AuditLog{}, Stat{})
+	initRoles()
 	count := 0
 	sec := utils.Conf().Section("http")
 	defUser := sec.Key("default_username").MustString("admin")
 	defPass := sec.Key("default_password").MustString("admin")
 	db.SQLite.Model(User{}).Where("username = ?", defUser).Count(&count)
+	upgradePasswords()
 	if count == 0 {
-		db.SQLite.Create(&User{
+		user := User{
 			Username: defUser,
-			Password: utils.MD5(defPass),
-		})
+			Role:     ROLE_ADMIN,
+		}
+		if err = user.SetPassword(utils.MD5(defPass)); err != nil {
+			return
+		}
+		db.SQLite.Create(&user)
+	} else {
+		// users created before roles existed.
+		db.SQLite.Model(User{}).Where("username = ? and (role is null or role = '')", defUser).Update("role", ROLE_ADMIN)
 	}
 	return
 }
@@ -0,0 +1,93 @@
+package models
+
+import (
+	"path"
+	"strings"
+
+	"github.com/snowlyg/EasyDarwin/extend/db"
+)
+
+const (
+	PERMISSION_PUBLISH = "publish"
+	PERMISSION_PLAY    = "play"
+	PERMISSION_ADMIN   = "admin" // implies publish and play
+
+	// users of ROLE_ADMIN are granted everything and the role can not be deleted.
+	ROLE_ADMIN = "admin"
+)
+
+// PATH_ALL passed to HasPermission only matches grants covering every path.
+const PATH_ALL = "*"
+
+type Role struct {
+	Name        string `gorm:"primary_key;type:TEXT;not null" form:"name" json:"name"`
+	Description string `gorm:"type:TEXT" form:"description" json:"description"`
+}
+
+// Grant gives a role a permission on the paths matching Pattern.
+// Pattern uses path.Match syntax, "**" matches every path and a trailing
+// "/**" matches everything below a prefix, e.g. "/live/**".
+type Grant struct {
+	ID         uint   `gorm:"primary_key" json:"id"`
+	Role       string `gorm:"type:TEXT;index" json:"role"`
+	Pattern    string `gorm:"type:TEXT" json:"pattern"`
+	Permission string `gorm:"type:TEXT" json:"permission"`
+}
+
+func IsValidPermission(permission string) bool {
+	switch permission {
+	case PERMISSION_PUBLISH, PERMISSION_PLAY, PERMISSION_ADMIN:
+		return true
+	}
+	return false
+}
+
+func MatchPattern(pattern, p string) bool {
+	switch {
+	case pattern == "*" || pattern == "**" || pattern == "/**":
+		return true
+	case p == PATH_ALL:
+		return false
+	case strings.HasSuffix(pattern, "/**"):
+		prefix := strings.TrimSuffix(pattern, "**")
+		return strings.HasPrefix(p, prefix) || p == strings.TrimSuffix(prefix, "/")
+	}
+	ok, _ := path.Match(pattern, p)
+	return ok
+}
+
+// HasPermission reports whether role may perform permission on path p.
+func HasPermission(role, permission, p string) bool {
+	if role == ROLE_ADMIN {
+		return true
+	}
+	if role == "" {
+		return false
+	}
+	var grants []Grant
+	if err := db.SQLite.Where("role = ?", role).Find(&grants).Error; err != nil {
+		return false
+	}
+	for _, grant := range grants {
+		if grant.Permission != permission && grant.Permission != PERMISSION_ADMIN {
+			continue
+		}
+		if MatchPattern(grant.Pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func initRoles() {
+	count := 0
+	db.SQLite.Model(Role{}).Count(&count)
+	if count > 0 {
+		return
+	}
+	db.SQLite.Create(&Role{Name: ROLE_ADMIN, Description: "管理员"})
+	db.SQLite.Create(&Role{Name: "publisher", Description: "推流"})
+	db.SQLite.Create(&Grant{Role: "publisher", Pattern: "**", Permission: PERMISSION_PUBLISH})
+	db.SQLite.Create(&Role{Name: "viewer", Description: "播放"})
+	db.SQLite.Create(&Grant{Role: "viewer", Pattern: "**", Permission: PERMISSION_PLAY})
+}
@@ -0,0 +1,102 @@
+package models
+
+import (
+	"time"
+
+	"github.com/snowlyg/EasyDarwin/extend/db"
+)
+
+const (
+	STAT_STEP_MINUTE = 60
+	STAT_STEP_HOUR   = 3600
+)
+
+// Stat aggregates the traffic of a path in the period [Timestamp, Timestamp+Step).
+// Path is empty for the whole server, whose CPU and Mem are averages and
+// PeakPushers is set.
+// Minute stats older than the retention are merged into hour stats by
+// DownsampleStats, so periods never overlap.
+type Stat struct {
+	ID          uint    `gorm:"primary_key" json:"-"`
+	Path        string  `gorm:"type:TEXT;index:idx_stat_path_ts" json:"path"`
+	Timestamp   int64   `gorm:"index:idx_stat_path_ts" json:"timestamp"` // unix seconds
+	Step        int     `json:"step"`
+	InBytes     int64   `json:"inBytes"`
+	OutBytes    int64   `json:"outBytes"`
+	PeakPlayers int     `json:"peakPlayers"`
+	PeakPushers int     `json:"peakPushers"`
+	Uptime      int     `json:"uptime"` // seconds the pusher of Path, or the server, was online
+	CPU         float64 `json:"cpu"`
+	Mem         float64 `json:"mem"`
+}
+
+// SaveStat saves s, merged into the stat of the same period saved before,
+// a minute cut in two by a restart.
+func SaveStat(s *Stat) error {
+	var old Stat
+	query := db.SQLite.Where("path = ? and timestamp = ? and step = ?", s.Path, s.Timestamp, s.Step).First(&old)
+	if query.RecordNotFound() {
+		return db.SQLite.Create(s).Error
+	}
+	if query.Error != nil {
+		return query.Error
+	}
+	MergeStat(&old, s, 1)
+	return db.SQLite.Save(&old).Error
+}
+
+// FindStats returns stats of path in [from, to) ordered by time.
+func FindStats(path string, from, to time.Time) (stats []Stat, err error) {
+	err = db.SQLite.Where("path = ? and timestamp >= ? and timestamp < ?", path, from.Unix(), to.Unix()).
+		Order("timestamp").Find(&stats).Error
+	return
+}
+
+// DownsampleStats merges the minute stats before minuteBefore into hour
+// stats, and deletes the stats before hourBefore.
+func DownsampleStats(minuteBefore, hourBefore time.Time) (err error) {
+	cutoff := minuteBefore.Truncate(time.Hour).Unix()
+	var minutes []Stat
+	if err = db.SQLite.Where("step = ? and timestamp < ?", STAT_STEP_MINUTE, cutoff).Order("timestamp").Find(&minutes).Error; err != nil {
+		return
+	}
+	type hourKey struct {
+		path string
+		ts   int64
+	}
+	hours := make(map[hourKey]*Stat)
+	samples := make(map[hourKey]int)
+	for _, m := range minutes {
+		key := hourKey{m.Path, m.Timestamp - m.Timestamp%STAT_STEP_HOUR}
+		h, ok := hours[key]
+		if !ok {
+			h = &Stat{Path: m.Path, Timestamp: key.ts, Step: STAT_STEP_HOUR}
+			hours[key] = h
+		}
+		MergeStat(h, &m, samples[key])
+		samples[key]++
+	}
+	tx := db.SQLite.Begin()
+	for _, h := range hours {
+		tx.Create(h)
+	}
+	tx.Where("step = ? and timestamp < ?", STAT_STEP_MINUTE, cutoff).Delete(Stat{})
+	tx.Where("timestamp < ?", hourBefore.Unix()).Delete(Stat{})
+	return tx.Commit().Error
+}
+
+// MergeStat adds s into dst, n is the count of stats merged into dst before,
+// used to average CPU and Mem.
+func MergeStat(dst, s *Stat, n int) {
+	dst.InBytes += s.InBytes
+	dst.OutBytes += s.OutBytes
+	dst.Uptime += s.Uptime
+	if s.PeakPlayers > dst.PeakPlayers {
+		dst.PeakPlayers = s.PeakPlayers
+	}
+	if s.PeakPushers > dst.PeakPushers {
+		dst.PeakPushers = s.PeakPushers
+	}
+	dst.CPU = (dst.CPU*float64(n) + s.CPU) / float64(n+1)
+	dst.Mem = (dst.Mem*float64(n) + s.Mem) / float64(n+1)
+}
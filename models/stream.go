@@ -16,6 +16,12 @@ type Stream struct {
 	TransType         string `gorm:"type:varchar(256)"`
 	IdleTimeout       int
 	HeartbeatInterval int
+
+	// ONVIF device of the stream, for ptz.
+	OnvifXAddr    string `gorm:"type:varchar(256)"`
+	OnvifUsername string `gorm:"type:varchar(256)"`
+	OnvifPassword string `gorm:"type:varchar(256)" json:"-"`
+	OnvifProfile  string `gorm:"type:varchar(256)"`
 }
 
 func GetStream(formId string) Stream {
@@ -1,20 +1,151 @@
 package models
 
 import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
 	"github.com/jinzhu/gorm"
+	"github.com/snowlyg/EasyDarwin/extend/db"
 	"github.com/snowlyg/EasyDarwin/extend/utils"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// DIGEST_REALM is the realm of RTSP digest authorization, DigestHA1 is
+// only valid for it.
+const DIGEST_REALM = "EasyDarwin"
+
+var md5Rex = regexp.MustCompile(`^[0-9a-fA-F]{32}$`)
+
+// Passwords never reach the server in plain text, clients send the hex of
+// md5(password). Password stores bcrypt of that md5. DigestHA1 keeps
+// md5(username:realm:md5(password)) for RTSP digest authorization, only when
+// [rtsp] authorization_enable is on: it is as good as the password for RTSP
+// and quick to brute-force, a trade-off of digest authorization.
 type User struct {
-	ID       string `structs:"id" gorm:"primary_key;type:TEXT;not null" form:"id" json:"id"`
-	Username string `gorm:"type:TEXT"`
-	Password string `gorm:"type:TEXT"`
-	Role     string `gorm:"type:TEXT"`
-	Reserve1 string `gorm:"type:TEXT"`
-	Reserve2 string `gorm:"type:TEXT"`
+	ID          string         `structs:"id" gorm:"primary_key;type:TEXT;not null" form:"id" json:"id"`
+	Username    string         `gorm:"type:TEXT" json:"username"`
+	Password    string         `gorm:"type:TEXT" json:"-"`
+	DigestHA1   string         `gorm:"type:TEXT" json:"-"`
+	Role        string         `gorm:"type:TEXT" json:"role"`
+	Disabled    bool           `json:"disabled"`
+	LastLoginAt utils.DateTime `gorm:"type:datetime" json:"lastLoginAt"`
+	LastLoginIP string         `gorm:"type:TEXT" json:"lastLoginIP"`
+	CreatedAt   utils.DateTime `gorm:"type:datetime" json:"createdAt"`
+	UpdatedAt   utils.DateTime `gorm:"type:datetime" json:"updatedAt"`
+	Reserve1    string         `gorm:"type:TEXT" json:"-"`
+	Reserve2    string         `gorm:"type:TEXT" json:"-"`
 }
 
 func (user *User) BeforeCreate(scope *gorm.Scope) error {
 	scope.SetColumn("ID", utils.ShortID())
 	return nil
 }
+
+func (user *User) HasPermission(permission, path string) bool {
+	return HasPermission(user.Role, permission, path)
+}
+
+func IsMD5Password(password string) bool {
+	return md5Rex.MatchString(password)
+}
+
+// SetPassword takes the hex of md5(password).
+func (user *User) SetPassword(md5Password string) error {
+	if !IsMD5Password(md5Password) {
+		return fmt.Errorf("password should be the hex of md5(password)")
+	}
+	md5Password = strings.ToLower(md5Password)
+	hash, err := bcrypt.GenerateFromPassword([]byte(md5Password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	user.Password = string(hash)
+	user.SetDigestHA1(md5Password)
+	return nil
+}
+
+// DigestEnabled reports whether DigestHA1 is stored, see User.
+func DigestEnabled() bool {
+	return utils.Conf().Section("rtsp").Key("authorization_enable").MustBool(false)
+}
+
+// SetDigestHA1 takes the hex of md5(password) checked before, DigestHA1 is
+// cleared if digest authorization is off. Users without it, created while it
+// was off, get it by logging in once.
+func (user *User) SetDigestHA1(md5Password string) {
+	user.DigestHA1 = ""
+	if DigestEnabled() {
+		user.DigestHA1 = utils.MD5(fmt.Sprintf("%s:%s:%s", user.Username, DIGEST_REALM, strings.ToLower(md5Password)))
+	}
+}
+
+// ErrLastAdmin is returned by UpdateUser when no enabled user of ROLE_ADMIN
+// would be left to manage the server.
+var ErrLastAdmin = errors.New("不能禁用、删除最后一个启用的管理员或修改其角色")
+
+// UpdateUser applies updates to user, or deletes user and its API keys if
+// updates is nil. If user is an enabled admin, the enabled admins are counted
+// after the change in the same transaction, which fails with ErrLastAdmin
+// when none is left.
+func UpdateUser(user *User, updates map[string]interface{}) error {
+	admin := user.Role == ROLE_ADMIN && !user.Disabled
+	return db.SQLite.Transaction(func(tx *gorm.DB) error {
+		if updates == nil {
+			if err := tx.Delete(user).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("user_id = ?", user.ID).Delete(APIKey{}).Error; err != nil {
+				return err
+			}
+		} else if err := tx.Model(user).Updates(updates).Error; err != nil {
+			return err
+		}
+		if !admin {
+			return nil
+		}
+		count := 0
+		if err := tx.Model(User{}).Where("role = ? and disabled = ?", ROLE_ADMIN, false).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrLastAdmin
+		}
+		return nil
+	})
+}
+
+func (user *User) CheckPassword(md5Password string) bool {
+	if !isBcryptHash(user.Password) {
+		// not upgraded yet, see upgradePasswords.
+		return user.Password != "" && strings.EqualFold(user.Password, md5Password)
+	}
+	return bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(strings.ToLower(md5Password))) == nil
+}
+
+func isBcryptHash(password string) bool {
+	return strings.HasPrefix(password, "$2")
+}
+
+// upgradePasswords replaces the md5 passwords stored by older versions, and
+// clears DigestHA1 if digest authorization is off.
+func upgradePasswords() {
+	if !DigestEnabled() {
+		db.SQLite.Model(User{}).Where("digest_ha1 <> ''").Update("digest_ha1", "")
+	}
+	var users []User
+	db.SQLite.Find(&users)
+	for _, user := range users {
+		if isBcryptHash(user.Password) || !IsMD5Password(user.Password) {
+			continue
+		}
+		if err := user.SetPassword(user.Password); err != nil {
+			continue
+		}
+		db.SQLite.Model(&user).Updates(map[string]interface{}{
+			"password":   user.Password,
+			"digest_ha1": user.DigestHA1,
+		})
+	}
+}
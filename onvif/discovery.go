@@ -0,0 +1,139 @@
+package onvif
+
+import (
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// MULTICAST_ADDR is the WS-Discovery multicast group the LAN devices listen
+// on, DISCOVERY_PORT the port they listen on for unicast probes too.
+const (
+	MULTICAST_ADDR = "239.255.255.250:3702"
+	DISCOVERY_PORT = "3702"
+)
+
+// Device is a ONVIF device answering the WS-Discovery probe.
+type Device struct {
+	UUID     string   `json:"uuid"`
+	IP       string   `json:"ip"`     // where the answer came from
+	XAddrs   []string `json:"xaddrs"` // urls of the device service
+	Name     string   `json:"name"`
+	Hardware string   `json:"hardware"`
+	Location string   `json:"location"`
+	Scopes   []string `json:"scopes"`
+}
+
+// XAddr returns the first url of the device service.
+func (device *Device) XAddr() string {
+	if len(device.XAddrs) == 0 {
+		return ""
+	}
+	return device.XAddrs[0]
+}
+
+const probeTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:d="http://schemas.xmlsoap.org/ws/2005/04/discovery" xmlns:dn="http://www.onvif.org/ver10/network/wsdl">
+<s:Header>
+<a:MessageID>%s</a:MessageID>
+<a:To s:mustUnderstand="true">urn:schemas-xmlsoap-org:ws:2005:04:discovery</a:To>
+<a:Action s:mustUnderstand="true">http://schemas.xmlsoap.org/ws/2005/04/discovery/Probe</a:Action>
+</s:Header>
+<s:Body><d:Probe><d:Types>dn:NetworkVideoTransmitter</d:Types></d:Probe></s:Body>
+</s:Envelope>`
+
+type probeMatches struct {
+	RelatesTo  string `xml:"Header>RelatesTo"`
+	ProbeMatch []struct {
+		Address string `xml:"EndpointReference>Address"`
+		Types   string `xml:"Types"`
+		Scopes  string `xml:"Scopes"`
+		XAddrs  string `xml:"XAddrs"`
+	} `xml:"Body>ProbeMatches>ProbeMatch"`
+}
+
+// Discover sends a WS-Discovery probe for video transmitters to addr, the
+// multicast group for the LAN or a host:port to probe a device on another
+// subnet, and returns the devices answering within timeout.
+func Discover(addr string, timeout time.Duration) ([]*Device, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	messageID := "uuid:" + newUUID()
+	if _, err := conn.WriteToUDP([]byte(fmt.Sprintf(probeTemplate, messageID)), raddr); err != nil {
+		return nil, fmt.Errorf("send probe to %s error, %v", addr, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	devices := make([]*Device, 0)
+	seen := make(map[string]bool)
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				break
+			}
+			return devices, err
+		}
+		for _, device := range parseProbeMatches(buf[:n], messageID) {
+			if seen[device.UUID] {
+				continue
+			}
+			seen[device.UUID] = true
+			device.IP = from.IP.String()
+			devices = append(devices, device)
+		}
+	}
+	return devices, nil
+}
+
+// parseProbeMatches returns the devices of a ProbeMatches answering the
+// probe of messageID, none if it is not one.
+func parseProbeMatches(b []byte, messageID string) (devices []*Device) {
+	var matches probeMatches
+	if err := xml.Unmarshal(b, &matches); err != nil {
+		return
+	}
+	if matches.RelatesTo != "" && strings.TrimSpace(matches.RelatesTo) != messageID {
+		return
+	}
+	for _, match := range matches.ProbeMatch {
+		device := &Device{
+			UUID:   strings.TrimSpace(match.Address),
+			XAddrs: strings.Fields(match.XAddrs),
+			Scopes: strings.Fields(match.Scopes),
+		}
+		if device.UUID == "" {
+			device.UUID = device.XAddr()
+		}
+		// e.g. onvif://www.onvif.org/name/IPC%20Camera
+		for _, scope := range device.Scopes {
+			for key, field := range map[string]*string{"name": &device.Name, "hardware": &device.Hardware, "location": &device.Location} {
+				prefix := "onvif://www.onvif.org/" + key + "/"
+				if *field == "" && strings.HasPrefix(scope, prefix) {
+					*field, _ = url.PathUnescape(strings.TrimPrefix(scope, prefix))
+				}
+			}
+		}
+		devices = append(devices, device)
+	}
+	return
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
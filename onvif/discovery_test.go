@@ -0,0 +1,60 @@
+package onvif
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testProbeMatch = `<?xml version="1.0" encoding="UTF-8"?>
+<SOAP-ENV:Envelope xmlns:SOAP-ENV="http://www.w3.org/2003/05/soap-envelope" xmlns:wsa="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:d="http://schemas.xmlsoap.org/ws/2005/04/discovery">
+<SOAP-ENV:Header><wsa:MessageID>uuid:answer</wsa:MessageID><wsa:RelatesTo> uuid:probe </wsa:RelatesTo></SOAP-ENV:Header>
+<SOAP-ENV:Body><d:ProbeMatches>
+<d:ProbeMatch>
+<wsa:EndpointReference><wsa:Address>urn:uuid:4419b2b4-1dd2-11b2-8000-a0ff0c1b2c3d</wsa:Address></wsa:EndpointReference>
+<d:Types>dn:NetworkVideoTransmitter tds:Device</d:Types>
+<d:Scopes>onvif://www.onvif.org/type/video_encoder onvif://www.onvif.org/name/IPC%20Camera onvif://www.onvif.org/hardware/DS-2CD2T47 onvif://www.onvif.org/location/city/hangzhou onvif://www.onvif.org/name/second</d:Scopes>
+<d:XAddrs>http://192.168.1.64/onvif/device_service http://[fe80::1]/onvif/device_service</d:XAddrs>
+</d:ProbeMatch>
+<d:ProbeMatch>
+<wsa:EndpointReference><wsa:Address></wsa:Address></wsa:EndpointReference>
+<d:XAddrs>http://192.168.1.65/onvif/device_service</d:XAddrs>
+</d:ProbeMatch>
+</d:ProbeMatches></SOAP-ENV:Body>
+</SOAP-ENV:Envelope>`
+
+func TestParseProbeMatches(t *testing.T) {
+	devices := []*Device{{
+		UUID:     "urn:uuid:4419b2b4-1dd2-11b2-8000-a0ff0c1b2c3d",
+		XAddrs:   []string{"http://192.168.1.64/onvif/device_service", "http://[fe80::1]/onvif/device_service"},
+		Name:     "IPC Camera",
+		Hardware: "DS-2CD2T47",
+		Location: "city/hangzhou",
+		Scopes: []string{"onvif://www.onvif.org/type/video_encoder", "onvif://www.onvif.org/name/IPC%20Camera", "onvif://www.onvif.org/hardware/DS-2CD2T47",
+			"onvif://www.onvif.org/location/city/hangzhou", "onvif://www.onvif.org/name/second"},
+	}, {
+		// no address, identified by its service url.
+		UUID:   "http://192.168.1.65/onvif/device_service",
+		XAddrs: []string{"http://192.168.1.65/onvif/device_service"},
+		Scopes: []string{},
+	}}
+	tests := []struct {
+		name      string
+		b         string
+		messageID string
+		want      []*Device
+	}{
+		{"answer", testProbeMatch, "uuid:probe", devices},
+		{"answer to another probe", testProbeMatch, "uuid:other", nil},
+		{"no RelatesTo", `<Envelope><Body><ProbeMatches><ProbeMatch><EndpointReference><Address>urn:uuid:1</Address></EndpointReference></ProbeMatch></ProbeMatches></Body></Envelope>`, "uuid:probe",
+			[]*Device{{UUID: "urn:uuid:1", XAddrs: []string{}, Scopes: []string{}}}},
+		{"a probe", `<Envelope><Header><MessageID>uuid:x</MessageID></Header><Body><Probe><Types>dn:NetworkVideoTransmitter</Types></Probe></Body></Envelope>`, "uuid:probe", nil},
+		{"hello", `<Envelope><Body><Hello><EndpointReference><Address>urn:uuid:2</Address></EndpointReference></Hello></Body></Envelope>`, "uuid:probe", nil},
+		{"not xml", "\x00\x01garbage", "uuid:probe", nil},
+		{"truncated", testProbeMatch[:len(testProbeMatch)/2], "uuid:probe", nil},
+	}
+	for _, tt := range tests {
+		if got := parseProbeMatches([]byte(tt.b), tt.messageID); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseProbeMatches = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
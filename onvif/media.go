@@ -0,0 +1,108 @@
+package onvif
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Profile is a media profile of the device and the rtsp uri of its stream.
+type Profile struct {
+	Token     string `json:"token"`
+	Name      string `json:"name"`
+	Encoding  string `json:"encoding"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	StreamURI string `json:"streamUri"`
+}
+
+type capabilitiesResponse struct {
+	MediaXAddr string `xml:"Body>GetCapabilitiesResponse>Capabilities>Media>XAddr"`
+	PTZXAddr   string `xml:"Body>GetCapabilitiesResponse>Capabilities>PTZ>XAddr"`
+}
+
+func (client *Client) capabilities(category string) (*capabilitiesResponse, error) {
+	var resp capabilitiesResponse
+	body := fmt.Sprintf(`<tds:GetCapabilities><tds:Category>%s</tds:Category></tds:GetCapabilities>`, category)
+	if err := client.call(client.XAddr, "http://www.onvif.org/ver10/device/wsdl/GetCapabilities", body, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// MediaXAddr returns the url of the media service, the device service url
+// if the device does not tell.
+func (client *Client) MediaXAddr() (string, error) {
+	resp, err := client.capabilities("Media")
+	if err != nil {
+		return "", err
+	}
+	if xaddr := strings.TrimSpace(resp.MediaXAddr); xaddr != "" {
+		return xaddr, nil
+	}
+	return client.XAddr, nil
+}
+
+type profilesResponse struct {
+	Profiles []struct {
+		Token    string `xml:"token,attr"`
+		Name     string `xml:"Name"`
+		Encoding string `xml:"VideoEncoderConfiguration>Encoding"`
+		Width    int    `xml:"VideoEncoderConfiguration>Resolution>Width"`
+		Height   int    `xml:"VideoEncoderConfiguration>Resolution>Height"`
+	} `xml:"Body>GetProfilesResponse>Profiles"`
+}
+
+// GetProfiles returns the media profiles, without their stream uris.
+func (client *Client) GetProfiles(mediaXAddr string) ([]*Profile, error) {
+	var resp profilesResponse
+	if err := client.call(mediaXAddr, "http://www.onvif.org/ver10/media/wsdl/GetProfiles", `<trt:GetProfiles/>`, &resp); err != nil {
+		return nil, err
+	}
+	profiles := make([]*Profile, 0, len(resp.Profiles))
+	for _, p := range resp.Profiles {
+		profiles = append(profiles, &Profile{
+			Token:    p.Token,
+			Name:     strings.TrimSpace(p.Name),
+			Encoding: strings.TrimSpace(p.Encoding),
+			Width:    p.Width,
+			Height:   p.Height,
+		})
+	}
+	return profiles, nil
+}
+
+type streamURIResponse struct {
+	URI string `xml:"Body>GetStreamUriResponse>MediaUri>Uri"`
+}
+
+// GetStreamURI returns the rtsp uri of the unicast stream of the profile.
+func (client *Client) GetStreamURI(mediaXAddr, token string) (string, error) {
+	var resp streamURIResponse
+	body := fmt.Sprintf(`<trt:GetStreamUri><trt:StreamSetup><tt:Stream>RTP-Unicast</tt:Stream><tt:Transport><tt:Protocol>RTSP</tt:Protocol></tt:Transport></trt:StreamSetup><trt:ProfileToken>%s</trt:ProfileToken></trt:GetStreamUri>`, xmlEscape(token))
+	if err := client.call(mediaXAddr, "http://www.onvif.org/ver10/media/wsdl/GetStreamUri", body, &resp); err != nil {
+		return "", err
+	}
+	uri := strings.TrimSpace(resp.URI)
+	if uri == "" {
+		return "", fmt.Errorf("profile %s got no stream uri", token)
+	}
+	return uri, nil
+}
+
+// Profiles returns the media profiles of the device with their stream uris.
+func (client *Client) Profiles() ([]*Profile, error) {
+	mediaXAddr, err := client.MediaXAddr()
+	if err != nil {
+		return nil, err
+	}
+	profiles, err := client.GetProfiles(mediaXAddr)
+	if err != nil {
+		return nil, err
+	}
+	for _, profile := range profiles {
+		if profile.StreamURI, err = client.GetStreamURI(mediaXAddr, profile.Token); err != nil {
+			return nil, err
+		}
+	}
+	return profiles, nil
+}
@@ -0,0 +1,83 @@
+package onvif
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type emptyResponse struct{}
+
+// PTZXAddr returns the url of the ptz service, an error if the device has
+// none.
+func (client *Client) PTZXAddr() (string, error) {
+	resp, err := client.capabilities("PTZ")
+	if err != nil {
+		return "", err
+	}
+	xaddr := strings.TrimSpace(resp.PTZXAddr)
+	if xaddr == "" {
+		return "", fmt.Errorf("%s has no ptz service", client.XAddr)
+	}
+	return xaddr, nil
+}
+
+// ContinuousMove moves the camera of the profile at the velocities, -1 to 1,
+// pan right, tilt up and zoom in when positive. The camera stops after
+// timeout, or on Stop if timeout is 0.
+func (client *Client) ContinuousMove(ptzXAddr, profile string, pan, tilt, zoom float64, timeout time.Duration) error {
+	var velocity string
+	if pan != 0 || tilt != 0 {
+		velocity += fmt.Sprintf(`<tt:PanTilt x="%s" y="%s"/>`, formatFloat(pan), formatFloat(tilt))
+	}
+	if zoom != 0 {
+		velocity += fmt.Sprintf(`<tt:Zoom x="%s"/>`, formatFloat(zoom))
+	}
+	body := fmt.Sprintf(`<tptz:ContinuousMove><tptz:ProfileToken>%s</tptz:ProfileToken><tptz:Velocity>%s</tptz:Velocity>`, xmlEscape(profile), velocity)
+	if timeout > 0 {
+		// xs:duration
+		body += fmt.Sprintf(`<tptz:Timeout>PT%sS</tptz:Timeout>`, formatFloat(timeout.Seconds()))
+	}
+	body += `</tptz:ContinuousMove>`
+	return client.call(ptzXAddr, "http://www.onvif.org/ver20/ptz/wsdl/ContinuousMove", body, &emptyResponse{})
+}
+
+// Stop stops the pan, tilt and zoom of the camera of the profile.
+func (client *Client) Stop(ptzXAddr, profile string) error {
+	body := fmt.Sprintf(`<tptz:Stop><tptz:ProfileToken>%s</tptz:ProfileToken><tptz:PanTilt>true</tptz:PanTilt><tptz:Zoom>true</tptz:Zoom></tptz:Stop>`, xmlEscape(profile))
+	return client.call(ptzXAddr, "http://www.onvif.org/ver20/ptz/wsdl/Stop", body, &emptyResponse{})
+}
+
+// Preset is a position saved on the camera.
+type Preset struct {
+	Token string `json:"token" xml:"token,attr"`
+	Name  string `json:"name" xml:"Name"`
+}
+
+type presetsResponse struct {
+	Presets []*Preset `xml:"Body>GetPresetsResponse>Preset"`
+}
+
+// GetPresets returns the presets of the camera of the profile.
+func (client *Client) GetPresets(ptzXAddr, profile string) ([]*Preset, error) {
+	var resp presetsResponse
+	body := fmt.Sprintf(`<tptz:GetPresets><tptz:ProfileToken>%s</tptz:ProfileToken></tptz:GetPresets>`, xmlEscape(profile))
+	if err := client.call(ptzXAddr, "http://www.onvif.org/ver20/ptz/wsdl/GetPresets", body, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Presets == nil {
+		resp.Presets = make([]*Preset, 0)
+	}
+	return resp.Presets, nil
+}
+
+// GotoPreset moves the camera of the profile to the preset.
+func (client *Client) GotoPreset(ptzXAddr, profile, preset string) error {
+	body := fmt.Sprintf(`<tptz:GotoPreset><tptz:ProfileToken>%s</tptz:ProfileToken><tptz:PresetToken>%s</tptz:PresetToken></tptz:GotoPreset>`, xmlEscape(profile), xmlEscape(preset))
+	return client.call(ptzXAddr, "http://www.onvif.org/ver20/ptz/wsdl/GotoPreset", body, &emptyResponse{})
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
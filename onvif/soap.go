@@ -0,0 +1,171 @@
+package onvif
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Client calls the services of a ONVIF device. Requests carry a
+// WS-UsernameToken, and http digest credentials too when the device asks
+// for them.
+type Client struct {
+	XAddr    string // url of the device service, e.g. http://192.168.1.64/onvif/device_service
+	Username string
+	Password string
+
+	httpClient *http.Client
+	digest     string // WWW-Authenticate digest challenge of the device
+}
+
+func NewClient(xaddr, username, password string, timeout time.Duration) *Client {
+	return &Client{
+		XAddr:      xaddr,
+		Username:   username,
+		Password:   password,
+		httpClient: &http.Client{Timeout: timeout},
+	}
+}
+
+const envelopeTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:tds="http://www.onvif.org/ver10/device/wsdl" xmlns:trt="http://www.onvif.org/ver10/media/wsdl" xmlns:tptz="http://www.onvif.org/ver20/ptz/wsdl" xmlns:tt="http://www.onvif.org/ver10/schema">
+<s:Header>%s</s:Header>
+<s:Body>%s</s:Body>
+</s:Envelope>`
+
+const securityTemplate = `<Security s:mustUnderstand="1" xmlns="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd">
+<UsernameToken>
+<Username>%s</Username>
+<Password Type="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-username-token-profile-1.0#PasswordDigest">%s</Password>
+<Nonce EncodingType="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-soap-message-security-1.0#Base64Binary">%s</Nonce>
+<Created xmlns="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd">%s</Created>
+</UsernameToken>
+</Security>`
+
+// usernameToken returns the WS-Security header,
+// PasswordDigest = base64(sha1(nonce + created + password)).
+func (client *Client) usernameToken() string {
+	if client.Username == "" {
+		return ""
+	}
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	created := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	h := sha1.New()
+	h.Write(nonce)
+	h.Write([]byte(created))
+	h.Write([]byte(client.Password))
+	digest := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	return fmt.Sprintf(securityTemplate, xmlEscape(client.Username), digest, base64.StdEncoding.EncodeToString(nonce), created)
+}
+
+type soapFault struct {
+	Code   string `xml:"Body>Fault>Code>Subcode>Value"`
+	Reason string `xml:"Body>Fault>Reason>Text"`
+}
+
+// maxResponseSize bounds the response envelopes read from a device.
+const maxResponseSize = 1 << 20
+
+// call posts the body to the service at endpoint and decodes the response
+// envelope into resp, whose fields are paths from the Envelope like
+// `xml:"Body>GetProfilesResponse>Profiles"`.
+func (client *Client) call(endpoint, action, body string, resp interface{}) error {
+	return client.callChallenged(endpoint, action, body, resp, false)
+}
+
+// callChallenged is call, challenged tells the request already answers a
+// digest challenge of this call.
+func (client *Client) callChallenged(endpoint, action, body string, resp interface{}, challenged bool) error {
+	envelope := fmt.Sprintf(envelopeTemplate, client.usernameToken(), body)
+	res, err := client.post(endpoint, action, envelope)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusUnauthorized && client.Username != "" && !challenged {
+		// the first challenge, or a new one when the nonce of the last is stale.
+		if challenge := res.Header.Get("WWW-Authenticate"); strings.HasPrefix(challenge, "Digest") {
+			client.digest = challenge
+			return client.callChallenged(endpoint, action, body, resp, true)
+		}
+	}
+	// e.g. GetProfiles of http://www.onvif.org/ver10/media/wsdl/GetProfiles
+	action = action[strings.LastIndex(action, "/")+1:]
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxResponseSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxResponseSize {
+		return fmt.Errorf("%s response over %d bytes", action, maxResponseSize)
+	}
+	if res.StatusCode != http.StatusOK {
+		var fault soapFault
+		if xml.Unmarshal(data, &fault) == nil && (fault.Reason != "" || fault.Code != "") {
+			return fmt.Errorf("%s fault, %s %s", action, strings.TrimSpace(fault.Code), strings.TrimSpace(fault.Reason))
+		}
+		return fmt.Errorf("%s response status %s", action, res.Status)
+	}
+	if err := xml.Unmarshal(data, resp); err != nil {
+		return fmt.Errorf("%s response invalid, %v", action, err)
+	}
+	return nil
+}
+
+func (client *Client) post(endpoint, action, envelope string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader([]byte(envelope)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", fmt.Sprintf(`application/soap+xml; charset=utf-8; action="%s"`, action))
+	if client.digest != "" {
+		req.Header.Set("Authorization", client.digestAuth(req))
+	}
+	return client.httpClient.Do(req)
+}
+
+var digestParamRex = regexp.MustCompile(`(\w+)="?([^",]*)"?`)
+
+// digestAuth answers the digest challenge of the device, see RFC 2617.
+func (client *Client) digestAuth(req *http.Request) string {
+	params := make(map[string]string)
+	for _, match := range digestParamRex.FindAllStringSubmatch(strings.TrimPrefix(client.digest, "Digest"), -1) {
+		params[strings.ToLower(match[1])] = match[2]
+	}
+	uri := req.URL.RequestURI()
+	ha1 := md5Hex(fmt.Sprintf("%s:%s:%s", client.Username, params["realm"], client.Password))
+	ha2 := md5Hex(fmt.Sprintf("%s:%s", req.Method, uri))
+	auth := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, client.Username, params["realm"], params["nonce"], uri)
+	if qop := params["qop"]; qop != "" {
+		// auth, or a list like auth,auth-int of which auth is picked.
+		cnonce := newUUID()
+		response := md5Hex(fmt.Sprintf("%s:%s:00000001:%s:auth:%s", ha1, params["nonce"], cnonce, ha2))
+		auth += fmt.Sprintf(`, qop=auth, nc=00000001, cnonce="%s", response="%s"`, cnonce, response)
+	} else {
+		auth += fmt.Sprintf(`, response="%s"`, md5Hex(fmt.Sprintf("%s:%s:%s", ha1, params["nonce"], ha2)))
+	}
+	if opaque := params["opaque"]; opaque != "" {
+		auth += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	return auth
+}
+
+func md5Hex(s string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(s)))
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,225 @@
+package onvif
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDevice is a ONVIF device checking the WS-UsernameToken of requests,
+// and the http digest credentials too when digest is set.
+type testDevice struct {
+	username, password string
+	digest             bool
+	// responses are the bodies of the response envelopes by action.
+	responses map[string]string
+
+	lock       sync.Mutex
+	nonce      int  // of the current digest challenge
+	stale      bool // the next request is challenged with a new nonce
+	challenges int
+	actions    []string
+}
+
+func (d *testDevice) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	if d.digest && (d.stale || !d.checkDigest(r)) {
+		d.stale = false
+		d.nonce++
+		d.challenges++
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Digest realm="test", qop="auth,auth-int", nonce="n%d", opaque="o"`, d.nonce))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	// action="http://www.onvif.org/ver10/media/wsdl/GetProfiles"
+	contentType := r.Header.Get("Content-Type")
+	action := contentType[strings.LastIndex(contentType, "/")+1 : len(contentType)-1]
+	d.actions = append(d.actions, action)
+	if !d.checkUsernameToken(body) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, envelopeTemplate, "", `<s:Fault><s:Code><s:Value>s:Sender</s:Value><s:Subcode><s:Value>ter:NotAuthorized</s:Value></s:Subcode></s:Code><s:Reason><s:Text xml:lang="en">Sender not Authorized</s:Text></s:Reason></s:Fault>`)
+		return
+	}
+	response, ok := d.responses[action]
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, envelopeTemplate, "", `<s:Fault><s:Code><s:Value>s:Receiver</s:Value><s:Subcode><s:Value>ter:ActionNotSupported</s:Value></s:Subcode></s:Code><s:Reason><s:Text xml:lang="en">Optional Action Not Implemented</s:Text></s:Reason></s:Fault>`)
+		return
+	}
+	fmt.Fprintf(w, envelopeTemplate, "", response)
+}
+
+func (d *testDevice) checkUsernameToken(body []byte) bool {
+	var envelope struct {
+		Username string `xml:"Header>Security>UsernameToken>Username"`
+		Password string `xml:"Header>Security>UsernameToken>Password"`
+		Nonce    string `xml:"Header>Security>UsernameToken>Nonce"`
+		Created  string `xml:"Header>Security>UsernameToken>Created"`
+	}
+	if err := xml.Unmarshal(body, &envelope); err != nil || envelope.Username != d.username {
+		return false
+	}
+	nonce, err := base64.StdEncoding.DecodeString(envelope.Nonce)
+	if err != nil || len(nonce) == 0 {
+		return false
+	}
+	if created, err := time.Parse(time.RFC3339, envelope.Created); err != nil || time.Since(created) > time.Minute {
+		return false
+	}
+	h := sha1.New()
+	h.Write(nonce)
+	h.Write([]byte(envelope.Created))
+	h.Write([]byte(d.password))
+	return envelope.Password == base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func (d *testDevice) checkDigest(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Digest ") {
+		return false
+	}
+	params := make(map[string]string)
+	for _, match := range digestParamRex.FindAllStringSubmatch(auth[7:], -1) {
+		params[match[1]] = match[2]
+	}
+	if params["username"] != d.username || params["nonce"] != fmt.Sprintf("n%d", d.nonce) || params["uri"] != r.URL.RequestURI() ||
+		params["qop"] != "auth" || params["opaque"] != "o" {
+		return false
+	}
+	ha1 := md5Hex(d.username + ":test:" + d.password)
+	ha2 := md5Hex(r.Method + ":" + params["uri"])
+	return params["response"] == md5Hex(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], "auth", ha2}, ":"))
+}
+
+const testProfilesResponse = `<trt:GetProfilesResponse>
+<trt:Profiles token="main" fixed="true"><tt:Name> mainStream </tt:Name>
+<tt:VideoEncoderConfiguration token="v1"><tt:Encoding>H264</tt:Encoding><tt:Resolution><tt:Width>1920</tt:Width><tt:Height>1080</tt:Height></tt:Resolution></tt:VideoEncoderConfiguration>
+</trt:Profiles>
+<trt:Profiles token="sub&amp;1"><tt:Name>subStream</tt:Name>
+<tt:VideoEncoderConfiguration token="v2"><tt:Encoding>H265</tt:Encoding><tt:Resolution><tt:Width>640</tt:Width><tt:Height>360</tt:Height></tt:Resolution></tt:VideoEncoderConfiguration>
+</trt:Profiles>
+</trt:GetProfilesResponse>`
+
+func newTestDevice(t *testing.T, digest bool) (*testDevice, *Client) {
+	device := &testDevice{username: "admin", password: "p&ss<word>", digest: digest, responses: map[string]string{
+		"GetCapabilities": `<tds:GetCapabilitiesResponse><tds:Capabilities><tt:Media><tt:XAddr> </tt:XAddr></tt:Media></tds:Capabilities></tds:GetCapabilitiesResponse>`,
+		"GetProfiles":     testProfilesResponse,
+		"GetStreamUri":    `<trt:GetStreamUriResponse><trt:MediaUri><tt:Uri> rtsp://192.168.1.64/Streaming/Channels/101 </tt:Uri></trt:MediaUri></trt:GetStreamUriResponse>`,
+	}}
+	server := httptest.NewServer(device)
+	t.Cleanup(server.Close)
+	return device, NewClient(server.URL+"/onvif/device_service", device.username, device.password, 5*time.Second)
+}
+
+func TestCallUsernameToken(t *testing.T) {
+	device, client := newTestDevice(t, false)
+	profiles, err := client.GetProfiles(client.XAddr)
+	if err != nil {
+		t.Fatalf("GetProfiles err: %v", err)
+	}
+	if len(profiles) != 2 {
+		t.Fatalf("%d profiles", len(profiles))
+	}
+	want := []Profile{
+		{Token: "main", Name: "mainStream", Encoding: "H264", Width: 1920, Height: 1080},
+		{Token: "sub&1", Name: "subStream", Encoding: "H265", Width: 640, Height: 360},
+	}
+	for i, profile := range profiles {
+		if *profile != want[i] {
+			t.Errorf("profile %d = %+v, want %+v", i, *profile, want[i])
+		}
+	}
+	if device.challenges != 0 || client.digest != "" {
+		t.Errorf("%d digest challenges without digest auth", device.challenges)
+	}
+
+	client.Password = "wrong"
+	_, err = client.GetProfiles(client.XAddr)
+	if err == nil || !strings.Contains(err.Error(), "GetProfiles fault") || !strings.Contains(err.Error(), "ter:NotAuthorized") || !strings.Contains(err.Error(), "Sender not Authorized") {
+		t.Errorf("GetProfiles of a wrong password err: %v", err)
+	}
+}
+
+func TestCallDigest(t *testing.T) {
+	device, client := newTestDevice(t, true)
+	profiles, err := client.Profiles()
+	if err != nil {
+		t.Fatalf("Profiles err: %v", err)
+	}
+	if len(profiles) != 2 || profiles[0].StreamURI != "rtsp://192.168.1.64/Streaming/Channels/101" {
+		t.Errorf("profiles = %+v", profiles)
+	}
+	// challenged once, the credentials are then sent with every request.
+	if device.challenges != 1 {
+		t.Errorf("%d challenges, want 1", device.challenges)
+	}
+	if got := strings.Join(device.actions, ","); got != "GetCapabilities,GetProfiles,GetStreamUri,GetStreamUri" {
+		t.Errorf("actions = %s", got)
+	}
+
+	// a nonce gone stale is challenged again.
+	device.stale = true
+	if _, err := client.GetStreamURI(client.XAddr, "main"); err != nil {
+		t.Errorf("GetStreamURI after the nonce went stale err: %v", err)
+	}
+	if device.challenges != 2 {
+		t.Errorf("%d challenges, want 2", device.challenges)
+	}
+
+	// wrong credentials are challenged once per call only.
+	client.Password = "wrong"
+	_, err = client.GetStreamURI(client.XAddr, "main")
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("GetStreamURI of a wrong password err: %v", err)
+	}
+	if device.challenges != 4 {
+		t.Errorf("%d challenges, want 4", device.challenges)
+	}
+}
+
+func TestCallErrors(t *testing.T) {
+	device, client := newTestDevice(t, false)
+	tests := []struct {
+		name     string
+		response string
+		want     string
+	}{
+		{"fault", "", "GetStreamUri fault, ter:ActionNotSupported Optional Action Not Implemented"},
+		{"no uri", `<trt:GetStreamUriResponse/>`, "profile main got no stream uri"},
+		{"invalid", `<trt:GetStreamUriResponse>`, "GetStreamUri response invalid"},
+		{"over the limit", `<trt:GetStreamUriResponse>` + strings.Repeat(" ", maxResponseSize) + `</trt:GetStreamUriResponse>`, "GetStreamUri response over"},
+	}
+	for _, tt := range tests {
+		device.lock.Lock()
+		if tt.response == "" {
+			delete(device.responses, "GetStreamUri")
+		} else {
+			device.responses["GetStreamUri"] = tt.response
+		}
+		device.lock.Unlock()
+		_, err := client.GetStreamURI(client.XAddr, "main")
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err %v, want %q", tt.name, err, tt.want)
+		}
+	}
+
+	// a status without a fault.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusNotFound)
+	}))
+	defer server.Close()
+	client = NewClient(server.URL, "", "", 5*time.Second)
+	if _, err := client.GetProfiles(server.URL); err == nil || !strings.Contains(err.Error(), "GetProfiles response status 404") {
+		t.Errorf("err %v, want the status", err)
+	}
+}
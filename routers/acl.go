@@ -0,0 +1,239 @@
+package routers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/snowlyg/EasyDarwin/extend/db"
+	"github.com/snowlyg/EasyDarwin/models"
+)
+
+/**
+ * @apiDefine acl 权限
+ */
+
+/**
+ * @api {get} /api/v1/roles 获取角色列表
+ * @apiGroup acl
+ * @apiName Roles
+ * @apiSuccess (200) {Array} rows 角色列表
+ * @apiSuccess (200) {String} rows.name 角色名称
+ * @apiSuccess (200) {String} rows.description 描述
+ * @apiSuccess (200) {Array} rows.grants 授权列表
+ */
+func (h *APIHandler) Roles(c *gin.Context) {
+	var roles []models.Role
+	if err := db.SQLite.Find(&roles).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	var grants []models.Grant
+	if err := db.SQLite.Find(&grants).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	rows := make([]interface{}, 0)
+	for _, role := range roles {
+		roleGrants := make([]models.Grant, 0)
+		for _, grant := range grants {
+			if grant.Role == role.Name {
+				roleGrants = append(roleGrants, grant)
+			}
+		}
+		rows = append(rows, map[string]interface{}{
+			"name":        role.Name,
+			"description": role.Description,
+			"grants":      roleGrants,
+		})
+	}
+	c.IndentedJSON(200, gin.H{
+		"total": len(rows),
+		"rows":  rows,
+	})
+}
+
+/**
+ * @api {get} /api/v1/role/save 新增或修改角色
+ * @apiGroup acl
+ * @apiName RoleSave
+ * @apiParam {String} name 角色名称
+ * @apiParam {String} [description] 描述
+ * @apiUse simpleSuccess
+ */
+func (h *APIHandler) RoleSave(c *gin.Context) {
+	var form models.Role
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	form.Name = strings.TrimSpace(form.Name)
+	if form.Name == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "角色名称不能为空")
+		return
+	}
+	if err := db.SQLite.Save(&form).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.IndentedJSON(200, "OK")
+}
+
+/**
+ * @api {get} /api/v1/role/del 删除角色
+ * @apiGroup acl
+ * @apiName RoleDel
+ * @apiParam {String} name 角色名称, 使用该角色的用户将失去所有权限
+ * @apiUse simpleSuccess
+ */
+func (h *APIHandler) RoleDel(c *gin.Context) {
+	type Form struct {
+		Name string `form:"name" binding:"required"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	if form.Name == models.ROLE_ADMIN {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "不能删除管理员角色")
+		return
+	}
+	tx := db.SQLite.Begin()
+	tx.Where("role = ?", form.Name).Delete(models.Grant{})
+	tx.Model(models.User{}).Where("role = ?", form.Name).Update("role", "")
+	tx.Where("name = ?", form.Name).Delete(models.Role{})
+	if err := tx.Commit().Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.IndentedJSON(200, "OK")
+}
+
+/**
+ * @api {get} /api/v1/grants 获取授权列表
+ * @apiGroup acl
+ * @apiName Grants
+ * @apiParam {String} [role] 角色名称
+ * @apiSuccess (200) {Array} rows 授权列表
+ * @apiSuccess (200) {Number} rows.id
+ * @apiSuccess (200) {String} rows.role 角色名称
+ * @apiSuccess (200) {String} rows.pattern 路径匹配规则, 如 /live/*, ** 表示所有路径, /live/** 表示 /live 下的所有路径
+ * @apiSuccess (200) {String=publish,play,admin} rows.permission 权限
+ */
+func (h *APIHandler) Grants(c *gin.Context) {
+	type Form struct {
+		Role string `form:"role"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	grants := make([]models.Grant, 0)
+	query := db.SQLite
+	if form.Role != "" {
+		query = query.Where("role = ?", form.Role)
+	}
+	if err := query.Find(&grants).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.IndentedJSON(200, gin.H{
+		"total": len(grants),
+		"rows":  grants,
+	})
+}
+
+/**
+ * @api {get} /api/v1/grant/save 新增或修改授权
+ * @apiGroup acl
+ * @apiName GrantSave
+ * @apiParam {Number} [id] 授权ID, 为空时新增
+ * @apiParam {String} role 角色名称
+ * @apiParam {String} pattern 路径匹配规则
+ * @apiParam {String=publish,play,admin} permission 权限
+ * @apiSuccess (200) {Number} id
+ */
+func (h *APIHandler) GrantSave(c *gin.Context) {
+	type Form struct {
+		ID         uint   `form:"id"`
+		Role       string `form:"role" binding:"required"`
+		Pattern    string `form:"pattern" binding:"required"`
+		Permission string `form:"permission" binding:"required"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	if !models.IsValidPermission(form.Permission) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("无效的权限[%s]", form.Permission))
+		return
+	}
+	if db.SQLite.First(&models.Role{}, "name = ?", form.Role).RecordNotFound() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("角色[%s]不存在", form.Role))
+		return
+	}
+	grant := models.Grant{
+		ID:         form.ID,
+		Role:       form.Role,
+		Pattern:    form.Pattern,
+		Permission: form.Permission,
+	}
+	if err := db.SQLite.Save(&grant).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.IndentedJSON(200, gin.H{
+		"id": grant.ID,
+	})
+}
+
+/**
+ * @api {get} /api/v1/grant/del 删除授权
+ * @apiGroup acl
+ * @apiName GrantDel
+ * @apiParam {Number} id 授权ID
+ * @apiUse simpleSuccess
+ */
+func (h *APIHandler) GrantDel(c *gin.Context) {
+	type Form struct {
+		ID uint `form:"id" binding:"required"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	if err := db.SQLite.Where("id = ?", form.ID).Delete(models.Grant{}).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.IndentedJSON(200, "OK")
+}
+
+/**
+ * @api {get} /api/v1/user/role 设置用户角色
+ * @apiGroup acl
+ * @apiName UserRole
+ * @apiParam {String} id 用户ID
+ * @apiParam {String} [role] 角色名称, 为空表示取消所有权限
+ * @apiUse simpleSuccess
+ */
+func (h *APIHandler) UserRole(c *gin.Context) {
+	type Form struct {
+		ID   string `form:"id" binding:"required"`
+		Role string `form:"role"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	if !checkRole(c, form.Role) {
+		return
+	}
+	var user models.User
+	if db.SQLite.First(&user, "id = ?", form.ID).RecordNotFound() {
+		c.AbortWithStatusJSON(http.StatusNotFound, "用户不存在")
+		return
+	}
+	db.SQLite.Model(&user).Update("role", form.Role)
+	c.IndentedJSON(200, "OK")
+}
@@ -0,0 +1,110 @@
+package routers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/snowlyg/EasyDarwin/extend/db"
+	"github.com/snowlyg/EasyDarwin/models"
+)
+
+/**
+ * @apiDefine apikey API密钥
+ */
+
+/**
+ * @api {get} /api/v1/apikeys 获取API密钥列表
+ * @apiGroup apikey
+ * @apiName APIKeys
+ * @apiDescription 管理员可查看所有用户的密钥, 其他用户只能查看自己的密钥
+ * @apiSuccess (200) {Number} total 总数
+ * @apiSuccess (200) {Array} rows 密钥列表
+ * @apiSuccess (200) {String} rows.id
+ * @apiSuccess (200) {String} rows.name 名称
+ * @apiSuccess (200) {String} rows.userId 用户ID
+ * @apiSuccess (200) {String} rows.prefix 密钥前缀
+ * @apiSuccess (200) {String=readonly,admin} rows.scope 权限范围
+ * @apiSuccess (200) {Boolean} rows.revoked 是否已吊销
+ * @apiSuccess (200) {String} rows.lastUsedAt 最后使用时间
+ * @apiSuccess (200) {String} rows.lastUsedIP 最后使用IP
+ * @apiSuccess (200) {String} rows.createdAt 创建时间
+ */
+func (h *APIHandler) APIKeys(c *gin.Context) {
+	user := CurrentUser(c)
+	keys := make([]models.APIKey, 0)
+	query := db.SQLite.Order("created_at desc")
+	if !user.HasPermission(models.PERMISSION_ADMIN, models.PATH_ALL) {
+		query = query.Where("user_id = ?", user.ID)
+	}
+	if err := query.Find(&keys).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.IndentedJSON(200, gin.H{
+		"total": len(keys),
+		"rows":  keys,
+	})
+}
+
+/**
+ * @api {post} /api/v1/apikeys 新增API密钥
+ * @apiGroup apikey
+ * @apiName APIKeyCreate
+ * @apiDescription 密钥只在创建时返回一次, 请求时通过 Authorization: Bearer {key} 携带
+ * @apiParam {String} [name] 名称
+ * @apiParam {String=readonly,admin} [scope=readonly] 权限范围, readonly 只能调用 GET 查询接口, admin 拥有所属用户的全部权限
+ * @apiSuccess (200) {String} id
+ * @apiSuccess (200) {String} key 密钥
+ * @apiSuccess (200) {String} scope 权限范围
+ */
+func (h *APIHandler) APIKeyCreate(c *gin.Context) {
+	type Form struct {
+		Name  string `form:"name"`
+		Scope string `form:"scope"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	if form.Scope == "" {
+		form.Scope = models.APIKEY_SCOPE_READONLY
+	}
+	if !models.IsValidAPIKeyScope(form.Scope) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "无效的权限范围")
+		return
+	}
+	key, token, err := models.NewAPIKey(CurrentUser(c).ID, strings.TrimSpace(form.Name), form.Scope)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.IndentedJSON(200, gin.H{
+		"id":    key.ID,
+		"name":  key.Name,
+		"key":   token,
+		"scope": key.Scope,
+	})
+}
+
+/**
+ * @api {delete} /api/v1/apikeys/:id 吊销API密钥
+ * @apiGroup apikey
+ * @apiName APIKeyRevoke
+ * @apiParam {String} id 密钥ID
+ * @apiUse simpleSuccess
+ */
+func (h *APIHandler) APIKeyRevoke(c *gin.Context) {
+	user := CurrentUser(c)
+	var key models.APIKey
+	if db.SQLite.First(&key, "id = ?", c.Param("id")).RecordNotFound() {
+		c.AbortWithStatusJSON(http.StatusNotFound, "密钥不存在")
+		return
+	}
+	if key.UserID != user.ID && !user.HasPermission(models.PERMISSION_ADMIN, models.PATH_ALL) {
+		c.AbortWithStatusJSON(http.StatusForbidden, "Forbidden")
+		return
+	}
+	db.SQLite.Model(&key).Update("revoked", true)
+	c.IndentedJSON(200, "OK")
+}
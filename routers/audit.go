@@ -0,0 +1,91 @@
+package routers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/snowlyg/EasyDarwin/extend/db"
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+	"github.com/snowlyg/EasyDarwin/models"
+)
+
+/**
+ * @apiDefine audit 审计日志
+ */
+
+// audit records an action of the current user, see models.AddAuditLog.
+func audit(c *gin.Context, action, target string, before, after interface{}) {
+	models.AddAuditLog(CurrentUser(c), c.ClientIP(), action, target, before, after)
+}
+
+var auditSortColumns = map[string]string{
+	"id":        "id",
+	"createdat": "created_at",
+	"username":  "username",
+	"action":    "action",
+	"ip":        "ip",
+}
+
+/**
+ * @api {get} /api/v1/audit 获取审计日志
+ * @apiGroup audit
+ * @apiName AuditLogs
+ * @apiUse pageParam
+ * @apiParam {String} [action] 操作类型, 如 stream.start
+ * @apiParam {String} [username] 用户名
+ * @apiSuccess (200) {Number} total 总数
+ * @apiSuccess (200) {Array} rows 分页数据
+ * @apiSuccess (200) {Number} rows.id
+ * @apiSuccess (200) {String} rows.userId 用户ID
+ * @apiSuccess (200) {String} rows.username 用户名
+ * @apiSuccess (200) {String} rows.ip 客户端IP
+ * @apiSuccess (200) {String} rows.action 操作类型
+ * @apiSuccess (200) {String} rows.target 操作对象
+ * @apiSuccess (200) {String} rows.before 操作前的数据(JSON)
+ * @apiSuccess (200) {String} rows.after 操作后的数据(JSON)
+ * @apiSuccess (200) {String} rows.createdAt 操作时间
+ */
+func (h *APIHandler) AuditLogs(c *gin.Context) {
+	type Form struct {
+		utils.PageForm
+		Action   string `form:"action"`
+		Username string `form:"username"`
+	}
+	form := Form{PageForm: *utils.NewPageForm()}
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	query := db.SQLite.Model(models.AuditLog{})
+	if form.Action != "" {
+		query = query.Where("action = ?", form.Action)
+	}
+	if form.Username != "" {
+		query = query.Where("username = ?", form.Username)
+	}
+	if form.Q != "" {
+		q := "%" + form.Q + "%"
+		query = query.Where("username like ? or action like ? or target like ? or ip like ?", q, q, q, q)
+	}
+	total := 0
+	if err := query.Count(&total).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	order := "id desc"
+	if column, ok := auditSortColumns[strings.ToLower(form.Sort)]; ok {
+		order = column + " asc"
+		if strings.HasPrefix(strings.ToLower(form.Order), "desc") {
+			order = column + " desc"
+		}
+	}
+	logs := make([]models.AuditLog, 0)
+	if err := query.Order(order).Offset(form.Start).Limit(form.Limit).Find(&logs).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.IndentedJSON(200, utils.PageResult{
+		Total: total,
+		Rows:  logs,
+	})
+}
@@ -0,0 +1,348 @@
+package routers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+	"github.com/snowlyg/EasyDarwin/models"
+	"github.com/snowlyg/EasyDarwin/rtsp"
+)
+
+/**
+ * @apiDefine config 配置
+ */
+
+const (
+	CONFIG_RELOAD_LIVE    = "live"    // applied to running streams at once
+	CONFIG_RELOAD_NEW     = "new"     // applied to new connections
+	CONFIG_RELOAD_RESTART = "restart" // applied after /restart
+)
+
+const configSecretMask = "******"
+
+// configField describes a key of easydarwin.ini that can be read and changed
+// by /api/v1/config.
+type configField struct {
+	Section string   `json:"section"`
+	Key     string   `json:"key"`
+	Type    string   `json:"type"` // int, bool or string
+	Min     *int     `json:"min,omitempty"`
+	Max     *int     `json:"max,omitempty"`
+	Options []string `json:"options,omitempty"`
+	Default string   `json:"default"`
+	Reload  string   `json:"reload"`
+	Secret  bool     `json:"secret,omitempty"`
+}
+
+func intField(section, key, def string, min, max int, reload string) configField {
+	return configField{Section: section, Key: key, Type: "int", Min: &min, Max: &max, Default: def, Reload: reload}
+}
+
+func boolField(section, key, def, reload string) configField {
+	return configField{Section: section, Key: key, Type: "bool", Default: def, Reload: reload}
+}
+
+func stringField(section, key, def, reload string) configField {
+	return configField{Section: section, Key: key, Type: "string", Default: def, Reload: reload}
+}
+
+func secretField(section, key, reload string) configField {
+	return configField{Section: section, Key: key, Type: "string", Reload: reload, Secret: true}
+}
+
+const maxInt32 = 1<<31 - 1
+
+var configSchema = []configField{
+	intField("http", "port", "10008", 1, 65535, CONFIG_RELOAD_RESTART),
+	boolField("http", "debug", "0", CONFIG_RELOAD_RESTART),
+	boolField("http", "metrics_auth", "0", CONFIG_RELOAD_RESTART),
+	intField("http", "feed_interval", "2", 1, 3600, CONFIG_RELOAD_RESTART),
+	intField("http", "token_timeout", "604800", 60, maxInt32, CONFIG_RELOAD_RESTART),
+
+	boolField("rtsp", "debug_log_enable", "0", CONFIG_RELOAD_LIVE),
+	intField("rtsp", "port", "554", 1, 65535, CONFIG_RELOAD_RESTART),
+	intField("rtsp", "timeout", "0", 0, maxInt32, CONFIG_RELOAD_NEW),
+	intField("rtsp", "session_timeout", "60", 0, 86400, CONFIG_RELOAD_NEW),
+	boolField("rtsp", "gop_cache_enable", "1", CONFIG_RELOAD_LIVE),
+	intField("rtsp", "player_queue_limit", "0", 0, maxInt32, CONFIG_RELOAD_LIVE),
+	boolField("rtsp", "drop_packet_when_paused", "0", CONFIG_RELOAD_NEW),
+	boolField("rtsp", "close_old", "0", CONFIG_RELOAD_NEW),
+	boolField("rtsp", "authorization_enable", "0", CONFIG_RELOAD_NEW),
+	boolField("rtsp", "token_auth_enable", "0", CONFIG_RELOAD_NEW),
+	secretField("rtsp", "token_secret", CONFIG_RELOAD_NEW),
+	stringField("rtsp", "on_publish", "", CONFIG_RELOAD_RESTART),
+	stringField("rtsp", "on_play", "", CONFIG_RELOAD_RESTART),
+	intField("rtsp", "auth_hook_timeout", "5", 1, 300, CONFIG_RELOAD_RESTART),
+	intField("rtsp", "auth_hook_cache", "60", 0, 86400, CONFIG_RELOAD_RESTART),
+	boolField("rtsp", "save_stream_to_local", "0", CONFIG_RELOAD_RESTART),
+	stringField("rtsp", "ffmpeg_path", "", CONFIG_RELOAD_RESTART),
+	stringField("rtsp", "m3u8_dir_path", "./EasyDarwinGoM3u8", CONFIG_RELOAD_RESTART),
+	intField("rtsp", "ts_duration_second", "6", 1, 3600, CONFIG_RELOAD_RESTART),
+	intField("rtsp", "stall_timeout", "10", 0, 3600, CONFIG_RELOAD_RESTART),
+	intField("rtsp", "keyframe_timeout", "0", 0, 3600, CONFIG_RELOAD_RESTART),
+	boolField("rtsp", "stall_restart_pull", "1", CONFIG_RELOAD_RESTART),
+	boolField("rtsp", "pull_backchannel", "0", CONFIG_RELOAD_NEW),
+	intField("rtsp", "snapshot_interval", "60", 0, 86400, CONFIG_RELOAD_RESTART),
+	intField("rtsp", "snapshot_width", "0", 0, 7680, CONFIG_RELOAD_NEW),
+
+	{Section: "cluster", Key: "registry", Type: "string", Options: []string{"local", "redis"}, Default: "local", Reload: CONFIG_RELOAD_RESTART},
+	stringField("cluster", "node_addr", "", CONFIG_RELOAD_RESTART),
+	stringField("cluster", "redis_addr", "127.0.0.1:6379", CONFIG_RELOAD_RESTART),
+	secretField("cluster", "redis_password", CONFIG_RELOAD_RESTART),
+	intField("cluster", "redis_db", "0", 0, 15, CONFIG_RELOAD_RESTART),
+	stringField("cluster", "redis_key_prefix", "easydarwin:pusher:", CONFIG_RELOAD_RESTART),
+	intField("cluster", "redis_ttl", "30", 1, 86400, CONFIG_RELOAD_RESTART),
+
+	stringField("webhook", "url", "", CONFIG_RELOAD_RESTART),
+	secretField("webhook", "secret", CONFIG_RELOAD_RESTART),
+	stringField("webhook", "events", "", CONFIG_RELOAD_RESTART),
+	intField("webhook", "timeout", "5", 1, 300, CONFIG_RELOAD_RESTART),
+	intField("webhook", "retries", "3", 0, 100, CONFIG_RELOAD_RESTART),
+	intField("webhook", "retry_interval", "1", 0, 3600, CONFIG_RELOAD_RESTART),
+
+	boolField("stats", "history_enable", "1", CONFIG_RELOAD_RESTART),
+	intField("stats", "minute_retention_days", "7", 1, 3650, CONFIG_RELOAD_RESTART),
+	intField("stats", "hour_retention_days", "365", 1, 36500, CONFIG_RELOAD_RESTART),
+
+	intField("onvif", "discover_timeout", "3", 1, 60, CONFIG_RELOAD_LIVE),
+	intField("onvif", "request_timeout", "10", 1, 300, CONFIG_RELOAD_LIVE),
+	intField("onvif", "ptz_interval", "200", 0, 60000, CONFIG_RELOAD_LIVE),
+
+	boolField("gb28181", "enable", "0", CONFIG_RELOAD_RESTART),
+	stringField("gb28181", "sip_id", "34020000002000000001", CONFIG_RELOAD_RESTART),
+	stringField("gb28181", "sip_domain", "3402000000", CONFIG_RELOAD_RESTART),
+	intField("gb28181", "sip_port", "5060", 1, 65535, CONFIG_RELOAD_RESTART),
+	secretField("gb28181", "password", CONFIG_RELOAD_RESTART),
+	stringField("gb28181", "ip", "", CONFIG_RELOAD_RESTART),
+	intField("gb28181", "media_port_min", "30000", 1, 65535, CONFIG_RELOAD_NEW),
+	intField("gb28181", "media_port_max", "30500", 1, 65535, CONFIG_RELOAD_NEW),
+	{Section: "gb28181", Key: "media_transport", Type: "string", Options: []string{"UDP", "TCP"}, Default: "UDP", Reload: CONFIG_RELOAD_NEW},
+	intField("gb28181", "keepalive_timeout", "180", 0, 86400, CONFIG_RELOAD_LIVE),
+	intField("gb28181", "invite_timeout", "10", 1, 300, CONFIG_RELOAD_NEW),
+	intField("gb28181", "idle_timeout", "30", 0, 86400, CONFIG_RELOAD_NEW),
+}
+
+func findConfigField(section, key string) *configField {
+	for i := range configSchema {
+		if configSchema[i].Section == section && configSchema[i].Key == key {
+			return &configSchema[i]
+		}
+	}
+	return nil
+}
+
+// value returns the current value of the field, secrets are masked.
+func (field *configField) value() string {
+	sec := utils.Conf().Section(field.Section)
+	if !sec.HasKey(field.Key) {
+		return field.Default
+	}
+	key := sec.Key(field.Key)
+	v := key.String()
+	if field.Secret && v != "" {
+		return configSecretMask
+	}
+	if field.Type == "bool" {
+		if key.MustBool(false) {
+			return "1"
+		}
+		return "0"
+	}
+	return v
+}
+
+// parse validates v, a json value, and returns it as saved in the ini file.
+func (field *configField) parse(v interface{}) (string, error) {
+	name := field.Section + "." + field.Key
+	switch field.Type {
+	case "int":
+		var n int64
+		switch v := v.(type) {
+		case float64:
+			if v != float64(int64(v)) {
+				return "", fmt.Errorf("%s must be an integer", name)
+			}
+			n = int64(v)
+		case string:
+			var err error
+			if n, err = strconv.ParseInt(strings.TrimSpace(v), 10, 64); err != nil {
+				return "", fmt.Errorf("%s must be an integer", name)
+			}
+		default:
+			return "", fmt.Errorf("%s must be an integer", name)
+		}
+		if (field.Min != nil && n < int64(*field.Min)) || (field.Max != nil && n > int64(*field.Max)) {
+			return "", fmt.Errorf("%s must be between %d and %d", name, *field.Min, *field.Max)
+		}
+		return strconv.FormatInt(n, 10), nil
+	case "bool":
+		b := false
+		switch v := v.(type) {
+		case bool:
+			b = v
+		case float64:
+			if v != 0 && v != 1 {
+				return "", fmt.Errorf("%s must be a boolean", name)
+			}
+			b = v == 1
+		case string:
+			var err error
+			if b, err = strconv.ParseBool(strings.TrimSpace(v)); err != nil {
+				return "", fmt.Errorf("%s must be a boolean", name)
+			}
+		default:
+			return "", fmt.Errorf("%s must be a boolean", name)
+		}
+		if b {
+			return "1", nil
+		}
+		return "0", nil
+	default:
+		s, ok := v.(string)
+		if !ok {
+			return "", fmt.Errorf("%s must be a string", name)
+		}
+		if strings.ContainsAny(s, "\r\n") {
+			return "", fmt.Errorf("%s must be a single line", name)
+		}
+		s = strings.TrimSpace(s)
+		if len(field.Options) == 0 {
+			return s, nil
+		}
+		for _, option := range field.Options {
+			if s == option {
+				return s, nil
+			}
+		}
+		return "", fmt.Errorf("%s must be one of %s", name, strings.Join(field.Options, ","))
+	}
+}
+
+/**
+ * @api {get} /api/v1/config 获取配置
+ * @apiGroup config
+ * @apiName Config
+ * @apiParam {String} [section] 配置分组, 如 rtsp, 为空时返回全部
+ * @apiSuccess (200) {Array} rows 配置列表
+ * @apiSuccess (200) {String} rows.section 配置分组
+ * @apiSuccess (200) {String} rows.key 配置项
+ * @apiSuccess (200) {String=int,bool,string} rows.type 类型, bool 类型的值为 1 或 0
+ * @apiSuccess (200) {String} rows.value 当前值, 密钥类配置非空时返回 ******
+ * @apiSuccess (200) {String} rows.default 默认值
+ * @apiSuccess (200) {Number} [rows.min] 最小值
+ * @apiSuccess (200) {Number} [rows.max] 最大值
+ * @apiSuccess (200) {Array} [rows.options] 可选值
+ * @apiSuccess (200) {String=live,new,restart} rows.reload 生效方式, live 立即生效, new 对新连接生效, restart 重启服务后生效
+ */
+func (h *APIHandler) Config(c *gin.Context) {
+	section := strings.ToLower(c.Query("section"))
+	rows := make([]interface{}, 0)
+	for i := range configSchema {
+		field := &configSchema[i]
+		if section != "" && field.Section != section {
+			continue
+		}
+		rows = append(rows, struct {
+			*configField
+			Value string `json:"value"`
+		}{field, field.value()})
+	}
+	c.IndentedJSON(200, gin.H{
+		"rows": rows,
+	})
+}
+
+/**
+ * @api {put} /api/v1/config 修改配置
+ * @apiGroup config
+ * @apiName ConfigUpdate
+ * @apiDescription 请求体为 JSON, 如 {"rtsp": {"gop_cache_enable": false, "player_queue_limit": 512}}。
+ * 所有配置项校验通过后才会保存到配置文件, 生效方式为 live 的配置项立即应用到正在运行的推流与播放, 不会断开连接
+ * @apiSuccess (200) {Array} changed 修改的配置项, 如 rtsp.player_queue_limit
+ * @apiSuccess (200) {Boolean} restartRequired 是否有配置项需要重启服务后生效
+ */
+func (h *APIHandler) ConfigUpdate(c *gin.Context) {
+	var form map[string]map[string]interface{}
+	if err := c.BindJSON(&form); err != nil {
+		return
+	}
+	updates := make(map[string]map[string]string)
+	before := make(map[string]string)
+	after := make(map[string]string)
+	changed := make([]string, 0)
+	live, restartRequired := false, false
+	for section, kvs := range form {
+		section = strings.ToLower(section)
+		for key, v := range kvs {
+			key = strings.ToLower(key)
+			field := findConfigField(section, key)
+			if field == nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("unknown config %s.%s", section, key))
+				return
+			}
+			if field.Secret && v == configSecretMask {
+				continue
+			}
+			value, err := field.parse(v)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
+				return
+			}
+			old := field.value()
+			if field.Secret {
+				if utils.Conf().Section(section).Key(key).String() == value {
+					continue
+				}
+			} else if old == value {
+				continue
+			}
+			if updates[section] == nil {
+				updates[section] = make(map[string]string)
+			}
+			updates[section][key] = value
+			name := section + "." + key
+			changed = append(changed, name)
+			before[name] = old
+			after[name] = value
+			if field.Secret {
+				after[name] = configSecretMask
+			}
+			switch field.Reload {
+			case CONFIG_RELOAD_LIVE:
+				live = true
+			case CONFIG_RELOAD_RESTART:
+				restartRequired = true
+			}
+		}
+	}
+	effective := func(section, key string) string {
+		if v, ok := updates[section][key]; ok {
+			return v
+		}
+		return utils.Conf().Section(section).Key(key).String()
+	}
+	if tokenAuth, _ := strconv.ParseBool(effective("rtsp", "token_auth_enable")); tokenAuth && effective("rtsp", "token_secret") == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "rtsp.token_secret is required by rtsp.token_auth_enable")
+		return
+	}
+	for section, kvs := range updates {
+		if err := utils.SaveToConf(section, kvs); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	if live {
+		rtsp.Instance.ApplyConfig()
+	}
+	if len(changed) > 0 {
+		audit(c, models.AUDIT_CONFIG_UPDATE, "", before, after)
+	}
+	c.IndentedJSON(200, gin.H{
+		"changed":         changed,
+		"restartRequired": restartRequired,
+	})
+}
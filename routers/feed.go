@@ -0,0 +1,166 @@
+package routers
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+	"github.com/snowlyg/EasyDarwin/rtsp"
+)
+
+type feedMessage struct {
+	Event string
+	Data  interface{}
+}
+
+// feedHub fans out rtsp server events and periodic stats samples to the
+// clients of /api/v1/feed.
+type feedHub struct {
+	clients map[chan feedMessage]bool
+	last    *feedMessage // latest stats, sent to new clients at once
+	lock    sync.Mutex
+	once    sync.Once
+}
+
+var feed = &feedHub{
+	clients: make(map[chan feedMessage]bool),
+}
+
+func (hub *feedHub) subscribe() chan feedMessage {
+	ch := make(chan feedMessage, 64)
+	hub.lock.Lock()
+	hub.clients[ch] = true
+	if hub.last != nil {
+		ch <- *hub.last
+	}
+	hub.lock.Unlock()
+	return ch
+}
+
+func (hub *feedHub) unsubscribe(ch chan feedMessage) {
+	hub.lock.Lock()
+	delete(hub.clients, ch)
+	hub.lock.Unlock()
+}
+
+// broadcast never blocks, slow clients miss messages.
+func (hub *feedHub) broadcast(msg feedMessage) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	if msg.Event == "stats" {
+		hub.last = &msg
+	}
+	for ch := range hub.clients {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+func (hub *feedHub) start() {
+	hub.once.Do(func() {
+		rtsp.Instance.AddEventHandle(func(event *rtsp.Event) {
+			hub.broadcast(feedMessage{Event: event.Type, Data: event})
+		})
+		go hub.sample()
+	})
+}
+
+type byteCounter struct {
+	in  int
+	out int
+}
+
+// sample computes the bitrate of every path from the byte counters of pushers
+// and players every feed_interval seconds.
+func (hub *feedHub) sample() {
+	interval := utils.Conf().Section("http").Key("feed_interval").MustInt(2)
+	if interval <= 0 {
+		interval = 2
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	lastAt := time.Now()
+	lastBytes := make(map[string]byteCounter)
+	for now := range ticker.C {
+		seconds := now.Sub(lastAt).Seconds()
+		lastAt = now
+		bytes := make(map[string]byteCounter)
+		streams := make([]interface{}, 0)
+		playerCnt := 0
+		for path, pusher := range rtsp.Instance.GetPushers() {
+			players := pusher.GetPlayers()
+			playerCnt += len(players)
+			counter := byteCounter{in: pusher.InBytes()}
+			for _, player := range players {
+				counter.out += player.OutBytes
+			}
+			bytes[path] = counter
+			inBitrate, outBitrate := 0, 0
+			if last, ok := lastBytes[path]; ok && seconds > 0 {
+				inBitrate = bitrate(counter.in-last.in, seconds)
+				outBitrate = bitrate(counter.out-last.out, seconds)
+			}
+			healthy, _ := pusher.Health()
+			streams = append(streams, map[string]interface{}{
+				"path":       path,
+				"id":         pusher.ID(),
+				"healthy":    healthy,
+				"players":    len(players),
+				"inBytes":    counter.in,
+				"inBitrate":  inBitrate,
+				"outBitrate": outBitrate,
+			})
+		}
+		lastBytes = bytes
+		stats := map[string]interface{}{
+			"time":    utils.DateTime(now),
+			"pushers": len(streams),
+			"players": playerCnt,
+			"streams": streams,
+		}
+		if len(cpuData) > 0 {
+			stats["cpu"] = cpuData[len(cpuData)-1].Used
+		}
+		if len(memData) > 0 {
+			stats["mem"] = memData[len(memData)-1].Used
+		}
+		hub.broadcast(feedMessage{Event: "stats", Data: stats})
+	}
+}
+
+// bitrate in bits per second, counters restart when players leave or pushers
+// reconnect, negative deltas are ignored.
+func bitrate(delta int, seconds float64) int {
+	if delta < 0 {
+		return 0
+	}
+	return int(float64(delta*8) / seconds)
+}
+
+/**
+ * @api {get} /api/v1/feed 实时推送(SSE)
+ * @apiGroup stats
+ * @apiName Feed
+ * @apiDescription 以 Server-Sent Events 推送实时数据, 事件类型包括:
+ * pusher.add, pusher.remove, pusher.stall, pusher.recover, player.add, player.remove, record.segment 以及每隔 feed_interval 秒的 stats。
+ * stats 数据包含 time, cpu, mem, pushers, players 以及 streams(path, id, healthy, players, inBytes, inBitrate, outBitrate), 码率单位为 bit/s
+ */
+func (h *APIHandler) Feed(c *gin.Context) {
+	ch := feed.subscribe()
+	defer feed.unsubscribe(ch)
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case msg := <-ch:
+			c.SSEvent(msg.Event, msg.Data)
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
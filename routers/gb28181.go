@@ -0,0 +1,143 @@
+package routers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+	"github.com/snowlyg/EasyDarwin/gb28181"
+	"github.com/snowlyg/EasyDarwin/rtsp"
+)
+
+/**
+ * @apiDefine gb28181 GB28181 设备
+ */
+
+/**
+ * @api {get} /api/v1/gb28181/devices 获取 GB28181 设备列表
+ * @apiGroup gb28181
+ * @apiName GB28181Devices
+ * @apiDescription 返回注册过的设备及其通道, 通道的实时视频地址为 rtsp://{本机}/gb28181/{设备ID}/{通道ID}, 播放时按需拉取
+ * @apiSuccess (200) {Array} devices 设备列表
+ * @apiSuccess (200) {String} devices.id 设备ID
+ * @apiSuccess (200) {String} devices.addr 设备地址
+ * @apiSuccess (200) {Boolean} devices.online 是否在线
+ * @apiSuccess (200) {Number} devices.expires 注册有效期, 单位秒
+ * @apiSuccess (200) {String} devices.registerAt 注册时间
+ * @apiSuccess (200) {String} devices.keepaliveAt 最后心跳时间
+ * @apiSuccess (200) {Array} devices.channels 通道列表
+ * @apiSuccess (200) {String} devices.channels.id 通道ID
+ * @apiSuccess (200) {String} devices.channels.name 名称
+ * @apiSuccess (200) {String} devices.channels.status 状态, ON 或 OFF
+ * @apiSuccess (200) {String} devices.channels.path 实时视频的播放路径
+ */
+func (h *APIHandler) GB28181Devices(c *gin.Context) {
+	server := gb28181.GetServer()
+	if server.Stoped {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "gb28181 not enabled")
+		return
+	}
+	c.IndentedJSON(200, gin.H{"devices": server.Devices()})
+}
+
+/**
+ * @api {post} /api/v1/gb28181/catalog 查询 GB28181 设备目录
+ * @apiGroup gb28181
+ * @apiName GB28181Catalog
+ * @apiDescription 向设备发送目录查询, 设备随后上报的通道更新到设备列表中
+ * @apiParam {String} deviceId 设备ID
+ * @apiUse simpleSuccess
+ */
+func (h *APIHandler) GB28181Catalog(c *gin.Context) {
+	type Form struct {
+		DeviceID string `form:"deviceId" binding:"required"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	server := gb28181.GetServer()
+	if server.Stoped {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "gb28181 not enabled")
+		return
+	}
+	if server.GetDevice(form.DeviceID) == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, "device not found")
+		return
+	}
+	if err := server.QueryCatalog(form.DeviceID); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadGateway, fmt.Sprintf("query catalog err:%v", err))
+		return
+	}
+	c.IndentedJSON(200, "OK")
+}
+
+/**
+ * @api {post} /api/v1/gb28181/play 开始 GB28181 实时视频
+ * @apiGroup gb28181
+ * @apiName GB28181Play
+ * @apiDescription 向设备发起通道的实时视频(INVITE), 收到首个关键帧后返回, 没有播放者超过 gb28181.idle_timeout 秒后停止
+ * @apiParam {String} deviceId 设备ID
+ * @apiParam {String} channelId 通道ID
+ * @apiSuccess (200) {String} path 播放路径
+ * @apiSuccess (200) {String} url RTSP 播放地址
+ */
+func (h *APIHandler) GB28181Play(c *gin.Context) {
+	type Form struct {
+		DeviceID  string `form:"deviceId" binding:"required"`
+		ChannelID string `form:"channelId" binding:"required"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	server := gb28181.GetServer()
+	if server.Stoped {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "gb28181 not enabled")
+		return
+	}
+	if server.GetDevice(form.DeviceID) == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, "device not found")
+		return
+	}
+	pusher, err := server.Play(form.DeviceID, form.ChannelID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadGateway, fmt.Sprintf("play err:%v", err))
+		return
+	}
+	hostname := utils.GetRequestHostname(c.Request)
+	port := pusher.Server().TCPPort
+	url := fmt.Sprintf("rtsp://%s:%d%s", hostname, port, pusher.Path())
+	if port == 554 {
+		url = fmt.Sprintf("rtsp://%s%s", hostname, pusher.Path())
+	}
+	c.IndentedJSON(200, gin.H{"path": pusher.Path(), "url": url})
+}
+
+/**
+ * @api {post} /api/v1/gb28181/stop 停止 GB28181 实时视频
+ * @apiGroup gb28181
+ * @apiName GB28181Stop
+ * @apiDescription 停止通道的实时视频(BYE), 断开其播放者
+ * @apiParam {String} deviceId 设备ID
+ * @apiParam {String} channelId 通道ID
+ * @apiUse simpleSuccess
+ */
+func (h *APIHandler) GB28181Stop(c *gin.Context) {
+	type Form struct {
+		DeviceID  string `form:"deviceId" binding:"required"`
+		ChannelID string `form:"channelId" binding:"required"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	pusher := rtsp.GetServer().GetPusher(gb28181.StreamPath(form.DeviceID, form.ChannelID))
+	if pusher == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, "live view not found")
+		return
+	}
+	pusher.Stop()
+	c.IndentedJSON(200, "OK")
+}
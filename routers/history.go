@@ -0,0 +1,317 @@
+package routers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+	"github.com/snowlyg/EasyDarwin/models"
+	"github.com/snowlyg/EasyDarwin/rtsp"
+)
+
+const historySampleInterval = 5 * time.Second
+
+// historyCollector samples pushers and players every historySampleInterval
+// and saves minute stats per path, see models.Stat. Pushers and players gone
+// since the last sample are counted up to the bytes they stopped with.
+type historyCollector struct {
+	pushers     map[string]*rtsp.Pusher // Pusher ID <-> Pusher at the last sample
+	pusherBytes map[string]int          // Pusher ID <-> InBytes at the last sample
+	players     map[string]*rtsp.Player // Player ID <-> Player at the last sample
+	playerBytes map[string]int          // Player ID <-> OutBytes at the last sample
+	sampledAt   time.Time
+	minute      int64
+	stats       map[string]*models.Stat
+	cpuSamples  int
+	stopCh      chan struct{}
+	doneCh      chan struct{}
+}
+
+var (
+	history     *historyCollector // nil when history_enable is off or stopped
+	historyLock sync.Mutex
+)
+
+// StartHistory starts collecting the history stats, see StopHistory.
+func StartHistory() {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	sec := utils.Conf().Section("stats")
+	if history != nil || !sec.Key("history_enable").MustBool(true) {
+		return
+	}
+	minuteDays := sec.Key("minute_retention_days").MustInt(7)
+	hourDays := sec.Key("hour_retention_days").MustInt(365)
+	history = &historyCollector{
+		pushers:     make(map[string]*rtsp.Pusher),
+		pusherBytes: make(map[string]int),
+		players:     make(map[string]*rtsp.Player),
+		playerBytes: make(map[string]int),
+		sampledAt:   time.Now(),
+		stopCh:      make(chan struct{}),
+		doneCh:      make(chan struct{}),
+	}
+	go history.run(minuteDays, hourDays)
+}
+
+// StopHistory samples the traffic since the last sample and saves the
+// pending minute, before the rtsp server stops on shutdown or restart.
+func StopHistory() {
+	historyLock.Lock()
+	collector := history
+	history = nil
+	historyLock.Unlock()
+	if collector == nil {
+		return
+	}
+	close(collector.stopCh)
+	<-collector.doneCh
+	collector.sample(time.Now())
+	collector.flush()
+}
+
+func (collector *historyCollector) run(minuteDays, hourDays int) {
+	defer close(collector.doneCh)
+	ticker := time.NewTicker(historySampleInterval)
+	defer ticker.Stop()
+	lastDownsample := time.Time{}
+	for {
+		select {
+		case <-collector.stopCh:
+			return
+		case now := <-ticker.C:
+			collector.sample(now)
+			if now.Sub(lastDownsample) >= time.Hour {
+				lastDownsample = now
+				err := models.DownsampleStats(now.AddDate(0, 0, -minuteDays), now.AddDate(0, 0, -hourDays))
+				if err != nil {
+					log.Printf("downsample stats error:%v", err)
+				}
+			}
+		}
+	}
+}
+
+func (collector *historyCollector) stat(path string) *models.Stat {
+	s, ok := collector.stats[path]
+	if !ok {
+		s = &models.Stat{Path: path, Timestamp: collector.minute, Step: models.STAT_STEP_MINUTE}
+		collector.stats[path] = s
+	}
+	return s
+}
+
+func (collector *historyCollector) flush() {
+	for _, s := range collector.stats {
+		if err := models.SaveStat(s); err != nil {
+			log.Printf("save stat error:%v", err)
+			return
+		}
+	}
+}
+
+func (collector *historyCollector) sample(now time.Time) {
+	minute := now.Unix() - now.Unix()%models.STAT_STEP_MINUTE
+	if minute != collector.minute {
+		if collector.stats != nil {
+			collector.flush()
+		}
+		collector.minute = minute
+		collector.stats = make(map[string]*models.Stat)
+		collector.cpuSamples = 0
+	}
+	seconds := int(now.Sub(collector.sampledAt).Round(time.Second) / time.Second)
+	collector.sampledAt = now
+	total := collector.stat("")
+	total.Uptime += seconds
+
+	pushers := rtsp.Instance.GetPushers()
+	pusherMap := make(map[string]*rtsp.Pusher, len(pushers))
+	pusherBytes := make(map[string]int, len(pushers))
+	playerMap := make(map[string]*rtsp.Player)
+	playerBytes := make(map[string]int)
+	playerCnt := 0
+	for path, pusher := range pushers {
+		s := collector.stat(path)
+		s.Uptime += seconds
+		inBytes := pusher.InBytes()
+		pusherMap[pusher.ID()] = pusher
+		pusherBytes[pusher.ID()] = inBytes
+		in := int64(delta(inBytes, collector.pusherBytes[pusher.ID()]))
+		out := int64(0)
+		players := pusher.GetPlayers()
+		for id, player := range players {
+			playerMap[id] = player
+			playerBytes[id] = player.OutBytes
+			out += int64(delta(player.OutBytes, collector.playerBytes[id]))
+		}
+		s.InBytes += in
+		s.OutBytes += out
+		total.InBytes += in
+		total.OutBytes += out
+		if len(players) > s.PeakPlayers {
+			s.PeakPlayers = len(players)
+		}
+		playerCnt += len(players)
+	}
+	for id, pusher := range collector.pushers {
+		// a pusher rebound to a new session counts as the new one only.
+		if _, ok := pusherMap[id]; ok || pusher.ID() != id {
+			continue
+		}
+		in := int64(delta(pusher.InBytes(), collector.pusherBytes[id]))
+		collector.stat(pusher.Path()).InBytes += in
+		total.InBytes += in
+	}
+	for id, player := range collector.players {
+		if _, ok := playerMap[id]; ok {
+			continue
+		}
+		out := int64(delta(player.OutBytes, collector.playerBytes[id]))
+		collector.stat(player.Path).OutBytes += out
+		total.OutBytes += out
+	}
+	collector.pushers = pusherMap
+	collector.pusherBytes = pusherBytes
+	collector.players = playerMap
+	collector.playerBytes = playerBytes
+	if playerCnt > total.PeakPlayers {
+		total.PeakPlayers = playerCnt
+	}
+	if len(pushers) > total.PeakPushers {
+		total.PeakPushers = len(pushers)
+	}
+	if len(cpuData) > 0 && len(memData) > 0 {
+		// only averages cpu and mem, the sample has no traffic.
+		sample := &models.Stat{CPU: cpuData[len(cpuData)-1].Used, Mem: memData[len(memData)-1].Used}
+		models.MergeStat(total, sample, collector.cpuSamples)
+		collector.cpuSamples++
+	}
+}
+
+// delta of a byte counter since the last sample, counters start from zero
+// when pushers or players reconnect.
+func delta(current, last int) int {
+	if current < last {
+		return current
+	}
+	return current - last
+}
+
+func parseHistoryTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.ParseInLocation(utils.DateTimeLayout, s, time.Local)
+}
+
+/**
+ * @api {get} /api/v1/stats/history 获取历史统计
+ * @apiGroup stats
+ * @apiName StatsHistory
+ * @apiParam {String} [path] 推流路径, 为空时返回整个服务器的统计
+ * @apiParam {String} [from] 开始时间, YYYY-MM-DD HH:mm:ss 或 UTC秒, 默认为24小时前
+ * @apiParam {String} [to] 结束时间, YYYY-MM-DD HH:mm:ss 或 UTC秒, 默认为当前时间
+ * @apiParam {Number} [step] 统计间隔, 单位秒, 不小于60, 默认按不超过1440个点自动选择。超过分钟统计保留天数的数据只有小时统计
+ * @apiSuccess (200) {String} path 推流路径
+ * @apiSuccess (200) {Number} step 统计间隔
+ * @apiSuccess (200) {Array} rows 统计数据
+ * @apiSuccess (200) {String} rows.time 开始时间
+ * @apiSuccess (200) {Number} rows.inBytes 入口流量
+ * @apiSuccess (200) {Number} rows.outBytes 出口流量
+ * @apiSuccess (200) {Number} rows.inBitrate 平均入口码率, bit/s
+ * @apiSuccess (200) {Number} rows.outBitrate 平均出口码率, bit/s
+ * @apiSuccess (200) {Number} rows.peakPlayers 最高在线人数
+ * @apiSuccess (200) {Number} rows.peakPushers 最高推流数, 仅服务器统计
+ * @apiSuccess (200) {Number} rows.uptime 在线时长, 单位秒
+ * @apiSuccess (200) {Number} rows.cpu 平均CPU使用率, 仅服务器统计
+ * @apiSuccess (200) {Number} rows.mem 平均内存使用率, 仅服务器统计
+ */
+func (h *APIHandler) StatsHistory(c *gin.Context) {
+	type Form struct {
+		Path string `form:"path"`
+		From string `form:"from"`
+		To   string `form:"to"`
+		Step int64  `form:"step"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	if form.Path != "" && !strings.HasPrefix(form.Path, "/") {
+		form.Path = "/" + form.Path
+	}
+	now := time.Now()
+	to, err := parseHistoryTime(form.To, now)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "invalid to")
+		return
+	}
+	from, err := parseHistoryTime(form.From, to.Add(-24*time.Hour))
+	if err != nil || !from.Before(to) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "invalid from")
+		return
+	}
+	step := form.Step
+	if step <= 0 {
+		step = int64(to.Sub(from).Seconds()) / 1440
+	}
+	if step < models.STAT_STEP_MINUTE {
+		step = models.STAT_STEP_MINUTE
+	}
+	step -= step % models.STAT_STEP_MINUTE
+	stats, err := models.FindStats(form.Path, from, to)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	rows := make([]interface{}, 0)
+	var bucket *models.Stat
+	merged := 0
+	appendBucket := func() {
+		if bucket == nil {
+			return
+		}
+		rows = append(rows, gin.H{
+			"time":        utils.DateTime(time.Unix(bucket.Timestamp, 0)),
+			"inBytes":     bucket.InBytes,
+			"outBytes":    bucket.OutBytes,
+			"inBitrate":   bucket.InBytes * 8 / int64(bucket.Step),
+			"outBitrate":  bucket.OutBytes * 8 / int64(bucket.Step),
+			"peakPlayers": bucket.PeakPlayers,
+			"peakPushers": bucket.PeakPushers,
+			"uptime":      bucket.Uptime,
+			"cpu":         bucket.CPU,
+			"mem":         bucket.Mem,
+		})
+	}
+	for i := range stats {
+		s := &stats[i]
+		ts := s.Timestamp - s.Timestamp%step
+		if bucket == nil || bucket.Timestamp != ts {
+			appendBucket()
+			bucket = &models.Stat{Path: s.Path, Timestamp: ts, Step: int(step)}
+			merged = 0
+		}
+		if s.Step > bucket.Step {
+			// hour stats in buckets shorter than an hour.
+			bucket.Step = s.Step
+		}
+		models.MergeStat(bucket, s, merged)
+		merged++
+	}
+	appendBucket()
+	c.IndentedJSON(200, gin.H{
+		"path": form.Path,
+		"step": step,
+		"rows": rows,
+	})
+}
@@ -0,0 +1,156 @@
+package routers
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+	"github.com/snowlyg/EasyDarwin/rtsp"
+)
+
+// metricsWriter writes the prometheus text exposition format.
+type metricsWriter struct {
+	bytes.Buffer
+}
+
+func (w *metricsWriter) family(name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// labelEscaper escapes label values as the text format defines, other bytes
+// are written as is.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// sample writes one sample, labels are pairs of name and value.
+func (w *metricsWriter) sample(name string, value float64, labels ...string) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	w.WriteByte('\n')
+}
+
+func (w *metricsWriter) counters(name, help, label string, counters map[string]uint64) {
+	w.family(name, "counter", help)
+	keys := make([]string, 0, len(counters))
+	for k := range counters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		w.sample(name, float64(counters[k]), label, k)
+	}
+}
+
+/**
+ * @api {get} /metrics Prometheus 监控指标
+ * @apiGroup stats
+ * @apiName Metrics
+ * @apiDescription 返回 Prometheus 文本格式的监控指标, [http] metrics_auth=1 时需要登录或 API 密钥
+ */
+func (h *APIHandler) Metrics(c *gin.Context) {
+	w := &metricsWriter{}
+
+	w.family("easydarwin_uptime_seconds", "gauge", "Seconds since the server started.")
+	w.sample("easydarwin_uptime_seconds", utils.UpTime().Seconds())
+	if len(cpuData) > 0 {
+		w.family("easydarwin_cpu_usage_ratio", "gauge", "Recent cpu usage of the host.")
+		w.sample("easydarwin_cpu_usage_ratio", cpuData[len(cpuData)-1].Used)
+	}
+	if len(memData) > 0 {
+		w.family("easydarwin_memory_usage_ratio", "gauge", "Recent memory usage of the host.")
+		w.sample("easydarwin_memory_usage_ratio", memData[len(memData)-1].Used)
+	}
+
+	pushers := rtsp.Instance.GetPushers()
+	paths := make([]string, 0, len(pushers))
+	for path := range pushers {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	w.family("easydarwin_pushers", "gauge", "Number of pushers.")
+	w.sample("easydarwin_pushers", float64(len(pushers)))
+
+	w.family("easydarwin_pusher_in_bytes_total", "counter", "Bytes received from the pusher of path.")
+	for _, path := range paths {
+		w.sample("easydarwin_pusher_in_bytes_total", float64(pushers[path].InBytes()), "path", path)
+	}
+	w.family("easydarwin_pusher_out_bytes_total", "counter", "Bytes sent to the pusher of path.")
+	for _, path := range paths {
+		w.sample("easydarwin_pusher_out_bytes_total", float64(pushers[path].OutBytes()), "path", path)
+	}
+
+	w.family("easydarwin_pusher_healthy", "gauge", "Whether the video of path is flowing, 0 when stalled.")
+	for _, path := range paths {
+		healthy, _ := pushers[path].Health()
+		value := 0.0
+		if healthy {
+			value = 1
+		}
+		w.sample("easydarwin_pusher_healthy", value, "path", path)
+	}
+
+	players := make(map[string]map[string]*rtsp.Player, len(paths))
+	for _, path := range paths {
+		players[path] = pushers[path].GetPlayers()
+	}
+	w.family("easydarwin_players", "gauge", "Number of players of path.")
+	for _, path := range paths {
+		w.sample("easydarwin_players", float64(len(players[path])), "path", path)
+	}
+	w.counters("easydarwin_player_out_bytes_total", "Bytes sent to the players of path.", "path", rtsp.Instance.PlayerOutBytes())
+	w.family("easydarwin_player_queue_packets", "gauge", "Packets waiting in the queues of the players of path.")
+	for _, path := range paths {
+		queued := 0
+		for _, player := range players[path] {
+			queued += player.QueueLen()
+		}
+		w.sample("easydarwin_player_queue_packets", float64(queued), "path", path)
+	}
+	w.family("easydarwin_player_queue_max_packets", "gauge", "Longest player queue of path.")
+	for _, path := range paths {
+		max := 0
+		for _, player := range players[path] {
+			if l := player.QueueLen(); l > max {
+				max = l
+			}
+		}
+		w.sample("easydarwin_player_queue_max_packets", float64(max), "path", path)
+	}
+
+	w.counters("easydarwin_player_dropped_packets_total", "Packets dropped as player queues exceed player_queue_limit.", "path", rtsp.Instance.DroppedPackets())
+	w.counters("easydarwin_rtsp_client_reconnects_total", "Reconnects of the pull stream of path.", "path", rtsp.Instance.Reconnects())
+	w.counters("easydarwin_rtsp_session_timeouts_total", "RTSP sessions of path reaped by session_timeout.", "path", rtsp.Instance.SessionTimeouts())
+
+	w.family("easydarwin_rtsp_requests_total", "counter", "RTSP requests handled, by method and response status.")
+	requests := rtsp.Instance.RequestCounts()
+	stats := make([]rtsp.RequestStat, 0, len(requests))
+	for stat := range requests {
+		stats = append(stats, stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Method != stats[j].Method {
+			return stats[i].Method < stats[j].Method
+		}
+		return stats[i].Status < stats[j].Status
+	})
+	for _, stat := range stats {
+		w.sample("easydarwin_rtsp_requests_total", float64(requests[stat]), "method", strings.ToUpper(stat.Method), "status", strconv.Itoa(stat.Status))
+	}
+
+	c.Data(200, "text/plain; version=0.0.4; charset=utf-8", w.Bytes())
+}
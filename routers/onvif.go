@@ -0,0 +1,201 @@
+package routers
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/snowlyg/EasyDarwin/extend/db"
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+	"github.com/snowlyg/EasyDarwin/models"
+	"github.com/snowlyg/EasyDarwin/onvif"
+)
+
+/**
+ * @apiDefine onvif ONVIF 设备
+ */
+
+/**
+ * @api {get} /api/v1/onvif/discover 搜索 ONVIF 设备
+ * @apiGroup onvif
+ * @apiName OnvifDiscover
+ * @apiDescription 在局域网内发送 WS-Discovery 组播探测, 返回应答的网络摄像机
+ * @apiParam {String} [address] 单播探测的设备地址, 如 192.168.2.64, 用于探测其他网段的设备, 为空时组播探测
+ * @apiParam {Number} [timeout] 等待应答的时间, 单位秒, 默认为配置 onvif.discover_timeout
+ * @apiSuccess (200) {Array} devices 设备列表
+ * @apiSuccess (200) {String} devices.uuid 设备标识
+ * @apiSuccess (200) {String} devices.ip 设备IP
+ * @apiSuccess (200) {Array} devices.xaddrs 设备服务地址, 导入时使用
+ * @apiSuccess (200) {String} devices.name 名称
+ * @apiSuccess (200) {String} devices.hardware 型号
+ */
+func (h *APIHandler) OnvifDiscover(c *gin.Context) {
+	type Form struct {
+		Address string `form:"address"`
+		Timeout int    `form:"timeout"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	timeout := form.Timeout
+	if timeout <= 0 {
+		timeout = utils.Conf().Section("onvif").Key("discover_timeout").MustInt(3)
+	}
+	addr := onvif.MULTICAST_ADDR
+	if form.Address != "" {
+		addr = form.Address
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, onvif.DISCOVERY_PORT)
+		}
+	}
+	devices, err := onvif.Discover(addr, time.Duration(timeout)*time.Second)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, fmt.Sprintf("discover err:%v", err))
+		return
+	}
+	c.IndentedJSON(200, gin.H{"devices": devices})
+}
+
+/**
+ * @api {get} /api/v1/onvif/profiles 查询 ONVIF 设备的码流
+ * @apiGroup onvif
+ * @apiName OnvifProfiles
+ * @apiDescription 调用设备的 GetProfiles/GetStreamUri, 返回各码流(Profile)的 RTSP 地址
+ * @apiParam {String} xaddr 设备服务地址, 如 http://192.168.1.64/onvif/device_service
+ * @apiParam {String} [username] 设备用户名
+ * @apiParam {String} [password] 设备密码
+ * @apiSuccess (200) {Array} profiles 码流列表
+ * @apiSuccess (200) {String} profiles.token 码流标识, 导入时使用
+ * @apiSuccess (200) {String} profiles.name 名称
+ * @apiSuccess (200) {String} profiles.encoding 视频编码
+ * @apiSuccess (200) {Number} profiles.width 宽
+ * @apiSuccess (200) {Number} profiles.height 高
+ * @apiSuccess (200) {String} profiles.streamUri RTSP 地址
+ */
+func (h *APIHandler) OnvifProfiles(c *gin.Context) {
+	type Form struct {
+		XAddr    string `form:"xaddr" binding:"required"`
+		Username string `form:"username"`
+		Password string `form:"password"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	profiles, err := onvifClient(form.XAddr, form.Username, form.Password).Profiles()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadGateway, fmt.Sprintf("onvif err:%v", err))
+		return
+	}
+	c.IndentedJSON(200, gin.H{"profiles": profiles})
+}
+
+/**
+ * @api {post} /api/v1/onvif/import 导入 ONVIF 设备
+ * @apiGroup onvif
+ * @apiName OnvifImport
+ * @apiDescription 查询设备码流的 RTSP 地址并添加为拉流(同 /api/v1/stream/add), RTSP 地址带上设备用户名密码,
+ * 同时保存设备地址与用户名密码用于云台控制。转推 PATH 为 /onvif/{设备IP}/{码流标识}。已添加过的地址不会重复添加
+ * @apiParam {String} xaddr 设备服务地址, 如 http://192.168.1.64/onvif/device_service
+ * @apiParam {String} [username] 设备用户名
+ * @apiParam {String} [password] 设备密码
+ * @apiParam {String} [profile] 只导入该码流, 为空时导入全部码流
+ * @apiParam {String=TCP,UDP} [transType=TCP] 拉流传输模式
+ * @apiParam {Boolean} [start=false] 导入后是否启动拉流
+ * @apiSuccess (200) {Array} streams 导入的拉流
+ */
+func (h *APIHandler) OnvifImport(c *gin.Context) {
+	type Form struct {
+		XAddr     string `form:"xaddr" binding:"required"`
+		Username  string `form:"username"`
+		Password  string `form:"password"`
+		Profile   string `form:"profile"`
+		TransType string `form:"transType"`
+		Start     bool   `form:"start"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	xaddr, err := url.Parse(form.XAddr)
+	if err != nil || xaddr.Hostname() == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "xaddr must be a http url")
+		return
+	}
+	profiles, err := onvifClient(form.XAddr, form.Username, form.Password).Profiles()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadGateway, fmt.Sprintf("onvif err:%v", err))
+		return
+	}
+	streams := make([]models.Stream, 0)
+	for _, profile := range profiles {
+		if form.Profile != "" && profile.Token != form.Profile {
+			continue
+		}
+		streamURL, err := url.Parse(profile.StreamURI)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadGateway, fmt.Sprintf("profile %s got invalid stream uri %s", profile.Token, profile.StreamURI))
+			return
+		}
+		if streamURL.User == nil && form.Username != "" {
+			streamURL.User = url.UserPassword(form.Username, form.Password)
+		}
+		stream := models.Stream{}
+		if !db.SQLite.Where("url = ?", streamURL.String()).First(&stream).RecordNotFound() {
+			// imported already, or added by url before.
+			if stream.OnvifXAddr == "" {
+				db.SQLite.Model(&stream).Updates(models.Stream{OnvifXAddr: form.XAddr, OnvifUsername: form.Username, OnvifPassword: form.Password, OnvifProfile: profile.Token})
+			}
+			streams = append(streams, stream)
+			continue
+		}
+		stream = models.Stream{
+			URL:           streamURL.String(),
+			RealURl:       streamURL.String(),
+			CustomPath:    onvifStreamPath(xaddr.Hostname(), profile.Token),
+			TransType:     form.TransType,
+			Status:        false,
+			OnvifXAddr:    form.XAddr,
+			OnvifUsername: form.Username,
+			OnvifPassword: form.Password,
+			OnvifProfile:  profile.Token,
+		}
+		if err := db.SQLite.Create(&stream).Error; err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, fmt.Sprintf("save stream err:%v", err))
+			return
+		}
+		audit(c, models.AUDIT_ONVIF_IMPORT, fmt.Sprint(stream.ID), nil, stream)
+		if form.Start {
+			if err := startStream(fmt.Sprint(stream.ID)); err != nil {
+				log.Printf("start imported stream %s err:%v", stream.CustomPath, err)
+			} else {
+				stream = models.GetStream(fmt.Sprint(stream.ID))
+			}
+		}
+		streams = append(streams, stream)
+	}
+	if form.Profile != "" && len(streams) == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, fmt.Sprintf("profile %s not found", form.Profile))
+		return
+	}
+	c.IndentedJSON(200, gin.H{"streams": streams})
+}
+
+func onvifClient(xaddr, username, password string) *onvif.Client {
+	timeout := utils.Conf().Section("onvif").Key("request_timeout").MustInt(10)
+	return onvif.NewClient(xaddr, username, password, time.Duration(timeout)*time.Second)
+}
+
+var pathUnsafeRex = regexp.MustCompile(`[^0-9A-Za-z_.-]`)
+
+// onvifStreamPath is the path imported profiles are pushed to,
+// /onvif/{host}/{profile token}.
+func onvifStreamPath(host, token string) string {
+	return fmt.Sprintf("/onvif/%s/%s", pathUnsafeRex.ReplaceAllString(host, "_"), pathUnsafeRex.ReplaceAllString(token, "_"))
+}
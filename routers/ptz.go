@@ -0,0 +1,261 @@
+package routers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+	"github.com/snowlyg/EasyDarwin/models"
+	"github.com/snowlyg/EasyDarwin/onvif"
+)
+
+// ptzCamera is the ptz service of the ONVIF device of a stream, looked up
+// once as long as the stream keeps the same device. The client is not
+// shared, it keeps the digest challenge of its requests.
+type ptzCamera struct {
+	client  *onvif.Client
+	xaddr   string // ptz service url
+	profile string
+}
+
+var ptzCameras = struct {
+	sync.Mutex
+	m    map[string]*ptzCamera // device xaddr, credentials and profile <-> camera
+	last map[string]time.Time  // device xaddr <-> time of the last command
+}{m: make(map[string]*ptzCamera), last: make(map[string]time.Time)}
+
+// ptzCameraOf returns the ptz service of the stream, with the first profile
+// of the device if the stream has none.
+func ptzCameraOf(stream *models.Stream) (*ptzCamera, error) {
+	key := fmt.Sprintf("%s\n%s\n%s\n%s", stream.OnvifXAddr, stream.OnvifUsername, stream.OnvifPassword, stream.OnvifProfile)
+	client := onvifClient(stream.OnvifXAddr, stream.OnvifUsername, stream.OnvifPassword)
+	ptzCameras.Lock()
+	camera := ptzCameras.m[key]
+	ptzCameras.Unlock()
+	if camera != nil {
+		return &ptzCamera{client: client, xaddr: camera.xaddr, profile: camera.profile}, nil
+	}
+	xaddr, err := client.PTZXAddr()
+	if err != nil {
+		return nil, err
+	}
+	profile := stream.OnvifProfile
+	if profile == "" {
+		mediaXAddr, err := client.MediaXAddr()
+		if err != nil {
+			return nil, err
+		}
+		profiles, err := client.GetProfiles(mediaXAddr)
+		if err != nil {
+			return nil, err
+		}
+		if len(profiles) == 0 {
+			return nil, fmt.Errorf("%s has no profile", stream.OnvifXAddr)
+		}
+		profile = profiles[0].Token
+	}
+	camera = &ptzCamera{client: client, xaddr: xaddr, profile: profile}
+	ptzCameras.Lock()
+	ptzCameras.m[key] = camera
+	ptzCameras.Unlock()
+	return camera, nil
+}
+
+// allowPTZ lets a command to the device through once per ptz_interval, so
+// that a dashboard repeating moves does not flood the camera. It returns how
+// long to wait otherwise.
+func allowPTZ(xaddr string) (time.Duration, bool) {
+	interval := time.Duration(utils.Conf().Section("onvif").Key("ptz_interval").MustInt(200)) * time.Millisecond
+	ptzCameras.Lock()
+	defer ptzCameras.Unlock()
+	now := time.Now()
+	if wait := ptzCameras.last[xaddr].Add(interval).Sub(now); wait > 0 {
+		return wait, false
+	}
+	ptzCameras.last[xaddr] = now
+	return 0, true
+}
+
+// ptzStream returns the camera of the stream of id, limited by allowPTZ
+// unless it is a stop. The error response is sent if it fails.
+func ptzStream(c *gin.Context, id string, limited bool) (*ptzCamera, bool) {
+	stream := models.GetStream(id)
+	if stream.ID == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, "stream not found")
+		return nil, false
+	}
+	if stream.OnvifXAddr == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "stream has no onvif device")
+		return nil, false
+	}
+	path := stream.CustomPath
+	if path == "" {
+		if u, err := url.Parse(stream.URL); err == nil {
+			path = u.Path
+		}
+	}
+	// who may watch the stream may steer its camera.
+	if user := CurrentUser(c); user == nil || !user.HasPermission(models.PERMISSION_PLAY, path) {
+		c.AbortWithStatusJSON(http.StatusForbidden, "Forbidden")
+		return nil, false
+	}
+	if limited {
+		if wait, ok := allowPTZ(stream.OnvifXAddr); !ok {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, "too many ptz commands")
+			return nil, false
+		}
+	}
+	camera, err := ptzCameraOf(&stream)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadGateway, fmt.Sprintf("onvif err:%v", err))
+		return nil, false
+	}
+	return camera, true
+}
+
+/**
+ * @apiDefine ptz 云台控制
+ */
+
+/**
+ * @api {post} /api/v1/ptz/move 云台转动
+ * @apiGroup ptz
+ * @apiName PTZMove
+ * @apiDescription 以指定速度持续转动拉流对应的摄像机(ONVIF ContinuousMove), 直到 stop 或超时。
+ * 需要拉流的播放权限, 同一摄像机每 onvif.ptz_interval 毫秒只接受一个命令, 过快返回 429
+ * @apiParam {String} id 拉流的ID
+ * @apiParam {Number} [pan=0] 水平速度, -1 ~ 1, 正数向右
+ * @apiParam {Number} [tilt=0] 垂直速度, -1 ~ 1, 正数向上
+ * @apiParam {Number} [zoom=0] 变倍速度, -1 ~ 1, 正数放大
+ * @apiParam {Number} [timeout=0] 持续时间, 单位秒, 0 表示直到 stop
+ * @apiUse simpleSuccess
+ */
+func (h *APIHandler) PTZMove(c *gin.Context) {
+	type Form struct {
+		ID      string  `form:"id" binding:"required"`
+		Pan     float64 `form:"pan"`
+		Tilt    float64 `form:"tilt"`
+		Zoom    float64 `form:"zoom"`
+		Timeout float64 `form:"timeout"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	for _, v := range []float64{form.Pan, form.Tilt, form.Zoom} {
+		if v < -1 || v > 1 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, "pan, tilt and zoom should be between -1 and 1")
+			return
+		}
+	}
+	if form.Pan == 0 && form.Tilt == 0 && form.Zoom == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "pan, tilt or zoom is required")
+		return
+	}
+	if form.Timeout < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "timeout should not be negative")
+		return
+	}
+	camera, ok := ptzStream(c, form.ID, true)
+	if !ok {
+		return
+	}
+	timeout := time.Duration(form.Timeout * float64(time.Second))
+	if err := camera.client.ContinuousMove(camera.xaddr, camera.profile, form.Pan, form.Tilt, form.Zoom, timeout); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadGateway, fmt.Sprintf("onvif err:%v", err))
+		return
+	}
+	c.IndentedJSON(200, "OK")
+}
+
+/**
+ * @api {post} /api/v1/ptz/stop 云台停止
+ * @apiGroup ptz
+ * @apiName PTZStop
+ * @apiDescription 停止摄像机的转动与变倍(ONVIF Stop), 不受命令频率限制
+ * @apiParam {String} id 拉流的ID
+ * @apiUse simpleSuccess
+ */
+func (h *APIHandler) PTZStop(c *gin.Context) {
+	type Form struct {
+		ID string `form:"id" binding:"required"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	camera, ok := ptzStream(c, form.ID, false)
+	if !ok {
+		return
+	}
+	if err := camera.client.Stop(camera.xaddr, camera.profile); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadGateway, fmt.Sprintf("onvif err:%v", err))
+		return
+	}
+	c.IndentedJSON(200, "OK")
+}
+
+/**
+ * @api {get} /api/v1/ptz/preset 查询预置位
+ * @apiGroup ptz
+ * @apiName PTZPresets
+ * @apiParam {String} id 拉流的ID
+ * @apiSuccess (200) {Array} presets 预置位列表
+ * @apiSuccess (200) {String} presets.token 预置位标识
+ * @apiSuccess (200) {String} presets.name 名称
+ */
+func (h *APIHandler) PTZPresets(c *gin.Context) {
+	type Form struct {
+		ID string `form:"id" binding:"required"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	camera, ok := ptzStream(c, form.ID, false)
+	if !ok {
+		return
+	}
+	presets, err := camera.client.GetPresets(camera.xaddr, camera.profile)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadGateway, fmt.Sprintf("onvif err:%v", err))
+		return
+	}
+	c.IndentedJSON(200, gin.H{"presets": presets})
+}
+
+/**
+ * @api {post} /api/v1/ptz/preset 转到预置位
+ * @apiGroup ptz
+ * @apiName PTZGotoPreset
+ * @apiDescription 摄像机转到预置位(ONVIF GotoPreset), 受命令频率限制
+ * @apiParam {String} id 拉流的ID
+ * @apiParam {String} preset 预置位标识
+ * @apiUse simpleSuccess
+ */
+func (h *APIHandler) PTZGotoPreset(c *gin.Context) {
+	type Form struct {
+		ID     string `form:"id" binding:"required"`
+		Preset string `form:"preset" binding:"required"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	camera, ok := ptzStream(c, form.ID, true)
+	if !ok {
+		return
+	}
+	if err := camera.client.GotoPreset(camera.xaddr, camera.profile, form.Preset); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadGateway, fmt.Sprintf("onvif err:%v", err))
+		return
+	}
+	c.IndentedJSON(200, "OK")
+}
@@ -2,10 +2,14 @@ package routers
 
 import (
 	"bytes"
+	"io/ioutil"
 	"log"
 	"math"
+	"mime"
+	"net/http"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strconv"
@@ -186,3 +190,49 @@ func (h *APIHandler) RecordFiles(c *gin.Context) {
 	pr.Slice(form.Start, form.Limit)
 	c.IndentedJSON(200, pr)
 }
+
+// RecordToken guards the /record playback files with signed urls when
+// token_auth_enable is set. Tokens are signed over the directory of the
+// requested file, and playlists are rewritten so that every segment carries
+// the same token.
+func RecordToken(mp4Path string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sec := utils.Conf().Section("rtsp")
+		urlPath := c.Request.URL.Path
+		if sec.Key("token_auth_enable").MustInt(0) == 0 || !strings.HasPrefix(urlPath, "/record/") {
+			c.Next()
+			return
+		}
+		query := c.Request.URL.Query()
+		secret := sec.Key("token_secret").MustString("")
+		if err := utils.CheckURLToken(secret, utils.TOKEN_ACTION_PLAY, path.Dir(urlPath), query.Get("token"), query.Get("expires"), c.ClientIP()); err != nil {
+			log.Printf("check record token of %s err:%v", urlPath, err)
+			c.AbortWithStatusJSON(http.StatusForbidden, "Forbidden")
+			return
+		}
+		if !strings.HasSuffix(strings.ToLower(urlPath), ".m3u8") {
+			c.Next()
+			return
+		}
+		file := filepath.Join(mp4Path, filepath.FromSlash(path.Clean(strings.TrimPrefix(urlPath, "/record"))))
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			c.Next()
+			return
+		}
+		lines := strings.Split(string(data), "\n")
+		for i, line := range lines {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if strings.Contains(line, "?") {
+				lines[i] = line + "&" + c.Request.URL.RawQuery
+			} else {
+				lines[i] = line + "?" + c.Request.URL.RawQuery
+			}
+		}
+		c.Data(http.StatusOK, mime.TypeByExtension(".m3u8"), []byte(strings.Join(lines, "\n")))
+		c.Abort()
+	}
+}
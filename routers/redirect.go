@@ -0,0 +1,49 @@
+package routers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/snowlyg/EasyDarwin/models"
+	"github.com/snowlyg/EasyDarwin/rtsp"
+)
+
+/**
+ * @api {post} /api/v1/players/redirect 重定向播放者
+ * @apiGroup stats
+ * @apiName PlayersRedirect
+ * @apiDescription 向推流路径下的所有播放者发送 RTSP REDIRECT 并断开会话, 播放者改为从目标服务器拉流。目标地址不带路径时使用原推流路径
+ * @apiParam {String} path 推流路径
+ * @apiParam {String} url 目标 RTSP 地址, 如 rtsp://192.168.1.2:554
+ * @apiSuccess (200) {Number} redirected 重定向的播放者数
+ */
+func (h *APIHandler) PlayersRedirect(c *gin.Context) {
+	type Form struct {
+		Path string `form:"path" binding:"required"`
+		URL  string `form:"url" binding:"required"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	if !strings.HasPrefix(form.Path, "/") {
+		form.Path = "/" + form.Path
+	}
+	location, err := url.Parse(form.URL)
+	if err != nil || location.Scheme != "rtsp" || location.Host == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "url must be a rtsp url")
+		return
+	}
+	if location.Path == "" || location.Path == "/" {
+		location.Path = form.Path
+	}
+	if rtsp.Instance.GetPusher(form.Path) == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, "pusher not found")
+		return
+	}
+	n := rtsp.Instance.RedirectPlayers(form.Path, location.String())
+	audit(c, models.AUDIT_PLAYERS_REDIRECT, form.Path, nil, gin.H{"url": location.String(), "redirected": n})
+	c.IndentedJSON(200, gin.H{"redirected": n})
+}
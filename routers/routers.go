@@ -6,6 +6,7 @@ import (
 	"mime"
 	"net/http"
 	"path/filepath"
+	"strings"
 
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-contrib/static"
@@ -14,6 +15,7 @@ import (
 	"github.com/snowlyg/EasyDarwin/extend/db"
 	"github.com/snowlyg/EasyDarwin/extend/sessions"
 	"github.com/snowlyg/EasyDarwin/extend/utils"
+	"github.com/snowlyg/EasyDarwin/models"
 	validator "gopkg.in/go-playground/validator.v8"
 )
 
@@ -92,12 +94,86 @@ func Errors() gin.HandlerFunc {
 	}
 }
 
-func NeedLogin() gin.HandlerFunc {
+const (
+	userKey   = "user"
+	apiKeyKey = "apikey"
+)
+
+// CurrentUser returns the user NeedLogin authenticated.
+func CurrentUser(c *gin.Context) *models.User {
+	if user, ok := c.Get(userKey); ok {
+		return user.(*models.User)
+	}
+	return nil
+}
+
+// CurrentAPIKey returns the api key of the request, nil if the user logged in
+// with a session.
+func CurrentAPIKey(c *gin.Context) *models.APIKey {
+	if key, ok := c.Get(apiKeyKey); ok {
+		return key.(*models.APIKey)
+	}
+	return nil
+}
+
+func bearerToken(c *gin.Context) string {
+	auth := c.GetHeader("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// NeedLogin rejects anonymous requests, and requests of users whose role is
+// not granted every one of permissions on all paths.
+// Besides the login session, an api key is accepted with "Authorization: Bearer <key>",
+// read-only keys are limited to GET requests without admin permission.
+func NeedLogin(permissions ...string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if sessions.Default(c).Get("uid") == nil {
+		var uid interface{}
+		var key *models.APIKey
+		if token := bearerToken(c); token != "" {
+			var err error
+			if key, err = models.FindAPIKey(token); err != nil {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, "Unauthorized")
+				return
+			}
+			uid = key.UserID
+		} else {
+			uid = sessions.Default(c).Get("uid")
+		}
+		if uid == nil {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, "Unauthorized")
 			return
 		}
+		var user models.User
+		if db.SQLite.First(&user, "id = ?", uid).RecordNotFound() || user.Disabled {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		if key != nil && key.Scope == models.APIKEY_SCOPE_READONLY {
+			if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+				c.AbortWithStatusJSON(http.StatusForbidden, "Forbidden")
+				return
+			}
+			for _, permission := range permissions {
+				if permission == models.PERMISSION_ADMIN {
+					c.AbortWithStatusJSON(http.StatusForbidden, "Forbidden")
+					return
+				}
+			}
+		}
+		for _, permission := range permissions {
+			if !user.HasPermission(permission, models.PATH_ALL) {
+				c.AbortWithStatusJSON(http.StatusForbidden, "Forbidden")
+				return
+			}
+		}
+		if key != nil {
+			key.Touch(c.ClientIP())
+			c.Set(apiKeyKey, key)
+		}
+		c.Set(userKey, &user)
 		c.Next()
 	}
 }
@@ -131,27 +207,84 @@ func Init() (err error) {
 		api.GET("/defaultlogininfo", API.DefaultLoginInfo)
 		api.GET("/modifypassword", NeedLogin(), API.ModifyPassword)
 		api.GET("/serverinfo", API.GetServerInfo)
-		api.GET("/restart", NeedLogin(), API.Restart)
+		api.GET("/restart", NeedLogin(models.PERMISSION_ADMIN), API.Restart)
 
 		api.GET("/pushers", NeedLogin(), API.Pushers)
 		api.GET("/players", NeedLogin(), API.Players)
+		api.GET("/pushers/locate", NeedLogin(), API.LocatePusher)
+		api.GET("/feed", NeedLogin(), API.Feed)
+		api.GET("/stats/history", NeedLogin(), API.StatsHistory)
+		api.GET("/snapshot", NeedLogin(), API.Snapshot)
+
+		api.GET("/stream/add", NeedLogin(models.PERMISSION_ADMIN), API.StreamAdd)
+		api.GET("/stream/start", NeedLogin(models.PERMISSION_ADMIN), API.StreamStart)
+		api.GET("/stream/stop", NeedLogin(models.PERMISSION_ADMIN), API.StreamStop)
+		api.POST("/stream/startAll", NeedLogin(models.PERMISSION_ADMIN), API.StreamStartAll)
+		api.POST("/stream/stopAll", NeedLogin(models.PERMISSION_ADMIN), API.StreamStopAll)
+		api.GET("/stream/del", NeedLogin(models.PERMISSION_ADMIN), API.StreamDel)
+		api.GET("/stream/sign", NeedLogin(models.PERMISSION_ADMIN), API.StreamSign)
+
+		api.GET("/onvif/discover", NeedLogin(models.PERMISSION_ADMIN), API.OnvifDiscover)
+		api.GET("/onvif/profiles", NeedLogin(models.PERMISSION_ADMIN), API.OnvifProfiles)
+		api.POST("/onvif/import", NeedLogin(models.PERMISSION_ADMIN), API.OnvifImport)
+
+		api.POST("/ptz/move", NeedLogin(), API.PTZMove)
+		api.POST("/ptz/stop", NeedLogin(), API.PTZStop)
+		api.GET("/ptz/preset", NeedLogin(), API.PTZPresets)
+		api.POST("/ptz/preset", NeedLogin(), API.PTZGotoPreset)
+
+		api.GET("/gb28181/devices", NeedLogin(models.PERMISSION_ADMIN), API.GB28181Devices)
+		api.POST("/gb28181/catalog", NeedLogin(models.PERMISSION_ADMIN), API.GB28181Catalog)
+		api.POST("/gb28181/play", NeedLogin(models.PERMISSION_ADMIN), API.GB28181Play)
+		api.POST("/gb28181/stop", NeedLogin(models.PERMISSION_ADMIN), API.GB28181Stop)
+
+		api.GET("/roles", NeedLogin(models.PERMISSION_ADMIN), API.Roles)
+		api.GET("/role/save", NeedLogin(models.PERMISSION_ADMIN), API.RoleSave)
+		api.GET("/role/del", NeedLogin(models.PERMISSION_ADMIN), API.RoleDel)
+		api.GET("/grants", NeedLogin(models.PERMISSION_ADMIN), API.Grants)
+		api.GET("/grant/save", NeedLogin(models.PERMISSION_ADMIN), API.GrantSave)
+		api.GET("/grant/del", NeedLogin(models.PERMISSION_ADMIN), API.GrantDel)
+		api.GET("/user/role", NeedLogin(models.PERMISSION_ADMIN), API.UserRole)
 
-		api.GET("/stream/add", NeedLogin(), API.StreamAdd)
-		api.GET("/stream/start", NeedLogin(), API.StreamStart)
-		api.GET("/stream/stop", NeedLogin(), API.StreamStop)
-		api.POST("/stream/startAll", NeedLogin(), API.StreamStartAll)
-		api.POST("/stream/stopAll", NeedLogin(), API.StreamStopAll)
-		api.GET("/stream/del", NeedLogin(), API.StreamDel)
+		api.GET("/users", NeedLogin(models.PERMISSION_ADMIN), API.Users)
+		api.POST("/users", NeedLogin(models.PERMISSION_ADMIN), API.UserCreate)
+		api.PUT("/users/:id", NeedLogin(models.PERMISSION_ADMIN), API.UserUpdate)
+		api.DELETE("/users/:id", NeedLogin(models.PERMISSION_ADMIN), API.UserDelete)
+		api.POST("/users/:id/password", NeedLogin(models.PERMISSION_ADMIN), API.UserResetPassword)
+		api.POST("/users/:id/enable", NeedLogin(models.PERMISSION_ADMIN), API.UserEnable)
+		api.POST("/users/:id/disable", NeedLogin(models.PERMISSION_ADMIN), API.UserDisable)
+
+		api.GET("/apikeys", NeedLogin(), API.APIKeys)
+		api.POST("/apikeys", NeedLogin(), API.APIKeyCreate)
+		api.DELETE("/apikeys/:id", NeedLogin(), API.APIKeyRevoke)
+
+		api.GET("/audit", NeedLogin(models.PERMISSION_ADMIN), API.AuditLogs)
+
+		api.GET("/config", NeedLogin(models.PERMISSION_ADMIN), API.Config)
+		api.PUT("/config", NeedLogin(models.PERMISSION_ADMIN), API.ConfigUpdate)
+
+		api.POST("/players/redirect", NeedLogin(models.PERMISSION_ADMIN), API.PlayersRedirect)
 
 		api.GET("/record/folders", NeedLogin(), API.RecordFolders)
 		api.GET("/record/files", NeedLogin(), API.RecordFiles)
 	}
 
+	feed.start()
+	StartHistory()
+
+	{
+		if utils.Conf().Section("http").Key("metrics_auth").MustBool(false) {
+			Router.GET("/metrics", sessionHandle, NeedLogin(), API.Metrics)
+		} else {
+			Router.GET("/metrics", API.Metrics)
+		}
+	}
+
 	{
 
 		mp4Path := utils.Conf().Section("rtsp").Key("m3u8_dir_path").MustString("")
 		if len(mp4Path) != 0 {
-			Router.Use(static.Serve("/record", static.LocalFile(mp4Path, true)))
+			Router.Use(RecordToken(mp4Path), static.Serve("/record", static.LocalFile(mp4Path, true)))
 		}
 
 	}
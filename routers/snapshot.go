@@ -0,0 +1,50 @@
+package routers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+	"github.com/snowlyg/EasyDarwin/rtsp"
+)
+
+/**
+ * @api {get} /api/v1/snapshot 获取直播截图
+ * @apiGroup stats
+ * @apiName Snapshot
+ * @apiDescription 将推流最近的关键帧解码为 JPEG 图片, 结果缓存 snapshot_interval 秒。需要开启 gop_cache_enable 并配置 ffmpeg_path
+ * @apiParam {String} path 推流路径
+ * @apiParam {Boolean} [refresh] 是否忽略缓存重新截图
+ * @apiSuccess (200) {File} image JPEG 图片
+ */
+func (h *APIHandler) Snapshot(c *gin.Context) {
+	type Form struct {
+		Path    string `form:"path" binding:"required"`
+		Refresh bool   `form:"refresh"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	if !strings.HasPrefix(form.Path, "/") {
+		form.Path = "/" + form.Path
+	}
+	maxAge := time.Duration(utils.Conf().Section("rtsp").Key("snapshot_interval").MustInt(60)) * time.Second
+	if form.Refresh {
+		maxAge = 0
+	}
+	snapshot, err := rtsp.Instance.Snapshot(form.Path, maxAge)
+	if err != nil {
+		if rtsp.Instance.GetPusher(form.Path) == nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, err.Error())
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Last-Modified", snapshot.Time.UTC().Format(http.TimeFormat))
+	c.Data(http.StatusOK, "image/jpeg", snapshot.Image)
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/snowlyg/EasyDarwin/extend/db"
 	"github.com/snowlyg/EasyDarwin/models"
 	"log"
+	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -44,6 +45,17 @@ import (
  * @apiSuccess (200) {Number} rows.outBytes 出口流量
  * @apiSuccess (200) {String} rows.startAt 开始时间
  * @apiSuccess (200) {Number} rows.onlines 在线人数
+ * @apiSuccess (200) {String} rows.vcodec 视频编码
+ * @apiSuccess (200) {String} rows.profile 视频编码档次, 如 High
+ * @apiSuccess (200) {String} rows.level 视频编码级别, 如 3.1
+ * @apiSuccess (200) {Number} rows.width 视频宽度
+ * @apiSuccess (200) {Number} rows.height 视频高度
+ * @apiSuccess (200) {Number} rows.bitrate 实时码率, bit/s
+ * @apiSuccess (200) {Number} rows.fps 实时帧率
+ * @apiSuccess (200) {Number} rows.gop 关键帧间隔(帧数)
+ * @apiSuccess (200) {Boolean} rows.healthy 是否健康, 视频停止超过 stall_timeout 秒或超过 keyframe_timeout 秒没有关键帧时为 false
+ * @apiSuccess (200) {String} rows.unhealthyReason 不健康的原因
+ * @apiSuccess (200) {String} rows.snapshot 截图地址
  */
 func (h *APIHandler) Pushers(c *gin.Context) {
 	form := utils.NewPageForm()
@@ -97,6 +109,17 @@ func (h *APIHandler) Pushers(c *gin.Context) {
 				elems["outBytes"] = pusher.OutBytes()
 				elems["startAt"] = utils.DateTime(pusher.StartAt())
 				elems["onlines"] = len(pusher.GetPlayers())
+				stats := pusher.Stats()
+				elems["vcodec"] = stats.VCodec
+				elems["profile"] = stats.Profile
+				elems["level"] = stats.Level
+				elems["width"] = stats.Width
+				elems["height"] = stats.Height
+				elems["bitrate"] = stats.Bitrate
+				elems["fps"] = stats.FPS
+				elems["gop"] = stats.GOP
+				elems["healthy"], elems["unhealthyReason"] = pusher.Health()
+				elems["snapshot"] = "/api/v1/snapshot?path=" + pusher.Path()
 			}
 		}
 
@@ -128,6 +151,8 @@ func (h *APIHandler) Pushers(c *gin.Context) {
  * @apiSuccess (200) {Number} rows.inBytes 入口流量
  * @apiSuccess (200) {Number} rows.outBytes 出口流量
  * @apiSuccess (200) {String} rows.startAt 开始时间
+ * @apiSuccess (200) {Number} rows.queueLen 待发送的包数
+ * @apiSuccess (200) {Number} rows.dropped 因超出 player_queue_limit 丢弃的包数
  */
 func (h *APIHandler) Players(c *gin.Context) {
 	form := utils.NewPageForm()
@@ -156,6 +181,8 @@ func (h *APIHandler) Players(c *gin.Context) {
 			"inBytes":   player.InBytes,
 			"outBytes":  player.OutBytes,
 			"startAt":   utils.DateTime(player.StartAt),
+			"queueLen":  player.QueueLen(),
+			"dropped":   player.DroppedPackets(),
 		})
 	}
 	pr := utils.NewPageResult(_players)
@@ -165,3 +192,39 @@ func (h *APIHandler) Players(c *gin.Context) {
 	pr.Slice(form.Start, form.Limit)
 	c.IndentedJSON(200, pr)
 }
+
+/**
+ * @api {get} /api/v1/pushers/locate 查询推流所在节点
+ * @apiGroup stats
+ * @apiName LocatePusher
+ * @apiDescription 需要登录, 集群中的其他节点或负载均衡可以通过只读 API 密钥(Authorization: Bearer {key})调用
+ * @apiParam {String} path 推流路径
+ * @apiSuccess (200) {String} path 推流路径
+ * @apiSuccess (200) {String} node 推流所在节点地址, 为空表示没有节点在推该路径
+ * @apiSuccess (200) {Boolean} local 是否为本节点
+ * @apiSuccess (200) {String} url 播放地址
+ */
+func (h *APIHandler) LocatePusher(c *gin.Context) {
+	type Form struct {
+		Path string `form:"path" binding:"required"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	if !strings.HasPrefix(form.Path, "/") {
+		form.Path = "/" + form.Path
+	}
+	server := rtsp.GetServer()
+	node := server.LocatePusher(form.Path)
+	if node == "" {
+		c.AbortWithStatusJSON(http.StatusNotFound, fmt.Sprintf("pusher[%s] not found", form.Path))
+		return
+	}
+	c.IndentedJSON(200, gin.H{
+		"path":  form.Path,
+		"node":  node,
+		"local": server.IsLocalNode(node),
+		"url":   fmt.Sprintf("rtsp://%s%s", node, form.Path),
+	})
+}
@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"path"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/snowlyg/EasyDarwin/extend/db"
+	"github.com/snowlyg/EasyDarwin/extend/utils"
 	"github.com/snowlyg/EasyDarwin/models"
 	"github.com/snowlyg/EasyDarwin/rtsp"
 )
@@ -23,6 +25,10 @@ import (
  * @apiParam {String=TCP,UDP} [transType=TCP] 拉流传输模式
  * @apiParam {Number} [idleTimeout] 拉流时的超时时间
  * @apiParam {Number} [heartbeatInterval] 拉流时的心跳间隔，毫秒为单位。如果心跳间隔不为0，那拉流时会向源地址以该间隔发送OPTION请求用来心跳保活
+ * @apiParam {String} [onvifXAddr] 摄像机的 ONVIF 设备服务地址, 用于云台控制
+ * @apiParam {String} [onvifUsername] 摄像机的 ONVIF 用户名
+ * @apiParam {String} [onvifPassword] 摄像机的 ONVIF 密码
+ * @apiParam {String} [onvifProfile] 云台控制使用的码流标识, 为空时使用第一个码流
  * @apiSuccess (200) {String} ID	拉流的ID。后续可以通过该ID来停止拉流
  */
 func (h *APIHandler) StreamAdd(c *gin.Context) {
@@ -33,6 +39,10 @@ func (h *APIHandler) StreamAdd(c *gin.Context) {
 		TransType         string `form:"transType"`
 		IdleTimeout       int    `form:"idleTimeout"`
 		HeartbeatInterval int    `form:"heartbeatInterval"`
+		OnvifXAddr        string `form:"onvifXAddr"`
+		OnvifUsername     string `form:"onvifUsername"`
+		OnvifPassword     string `form:"onvifPassword"`
+		OnvifProfile      string `form:"onvifProfile"`
 	}
 	var form Form
 	err := c.Bind(&form)
@@ -52,10 +62,16 @@ func (h *APIHandler) StreamAdd(c *gin.Context) {
 			IdleTimeout:       form.IdleTimeout,
 			HeartbeatInterval: form.HeartbeatInterval,
 			Status:            false,
+			OnvifXAddr:        form.OnvifXAddr,
+			OnvifUsername:     form.OnvifUsername,
+			OnvifPassword:     form.OnvifPassword,
+			OnvifProfile:      form.OnvifProfile,
 		}
 		db.SQLite.Create(&stream)
+		audit(c, models.AUDIT_STREAM_ADD, fmt.Sprint(stream.ID), nil, stream)
 		c.IndentedJSON(200, stream)
 	} else {
+		before := oldStream
 		oldStream.URL = form.URL
 		oldStream.RealURl = form.URL
 		oldStream.CustomPath = form.CustomPath
@@ -63,7 +79,14 @@ func (h *APIHandler) StreamAdd(c *gin.Context) {
 		oldStream.TransType = form.TransType
 		oldStream.HeartbeatInterval = form.HeartbeatInterval
 		oldStream.Status = false
+		if form.OnvifXAddr != "" {
+			oldStream.OnvifXAddr = form.OnvifXAddr
+			oldStream.OnvifUsername = form.OnvifUsername
+			oldStream.OnvifPassword = form.OnvifPassword
+			oldStream.OnvifProfile = form.OnvifProfile
+		}
 		db.SQLite.Save(oldStream)
+		audit(c, models.AUDIT_STREAM_UPDATE, fmt.Sprint(oldStream.ID), before, oldStream)
 		c.IndentedJSON(200, oldStream)
 	}
 
@@ -99,6 +122,7 @@ func (h *APIHandler) StreamStart(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("start pull to push err:%v", err))
 		return
 	}
+	audit(c, models.AUDIT_STREAM_START, form.ID, nil, nil)
 
 	c.IndentedJSON(200, "OK")
 	return
@@ -177,6 +201,7 @@ func (h *APIHandler) StreamStartAll(c *gin.Context) {
 			log.Printf("stop pull to push err:%v", err)
 			continue
 		}
+		audit(c, models.AUDIT_STREAM_START, id, nil, nil)
 	}
 
 	c.IndentedJSON(200, "OK")
@@ -235,6 +260,7 @@ func (h *APIHandler) StreamStop(c *gin.Context) {
 
 	isStop := stopStream(form.ID)
 	if isStop {
+		audit(c, models.AUDIT_STREAM_STOP, form.ID, nil, nil)
 		c.IndentedJSON(200, "OK")
 		return
 	}
@@ -288,7 +314,9 @@ func (h *APIHandler) StreamStopAll(c *gin.Context) {
 
 	ids := strings.Split(strings.Replace(form.Ids, "\"", "", -1), ",")
 	for _, id := range ids {
-		stopStream(id)
+		if stopStream(id) {
+			audit(c, models.AUDIT_STREAM_STOP, id, nil, nil)
+		}
 	}
 
 	c.IndentedJSON(200, "OK")
@@ -319,5 +347,76 @@ func (h *APIHandler) StreamDel(c *gin.Context) {
 	stream := models.GetStream(form.ID)
 
 	db.SQLite.Unscoped().Delete(stream)
+	audit(c, models.AUDIT_STREAM_DEL, form.ID, stream, nil)
+
+}
 
+/**
+ * @api {get} /api/v1/stream/sign 生成带签名的播放/推流地址
+ * @apiGroup stream
+ * @apiName StreamSign
+ * @apiParam {String=play,publish} action 地址的用途，play 为播放(DESCRIBE/SETUP/PLAY)，publish 为推流(ANNOUNCE/RECORD)，录像回放只能为 play
+ * @apiParam {String} path 推流路径，录像回放时为录像文件所在目录，如 /record/test/20200101，签名对该目录下所有文件有效
+ * @apiParam {Number} [expiresIn=3600] 有效期，单位秒
+ * @apiParam {String} [ip] 限定可以使用该地址的客户端IP
+ * @apiSuccess (200) {String} token 签名
+ * @apiSuccess (200) {Number} expires 过期时间，UTC秒
+ * @apiSuccess (200) {String} url 带签名的地址
+ */
+func (h *APIHandler) StreamSign(c *gin.Context) {
+	type Form struct {
+		Action    string `form:"action" binding:"required"`
+		Path      string `form:"path" binding:"required"`
+		ExpiresIn int64  `form:"expiresIn"`
+		IP        string `form:"ip"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	secret := utils.Conf().Section("rtsp").Key("token_secret").MustString("")
+	if secret == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "token_secret not configured")
+		return
+	}
+	form.Path = path.Clean("/" + form.Path)
+	if form.Action != utils.TOKEN_ACTION_PLAY && form.Action != utils.TOKEN_ACTION_PUBLISH {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "action should be play or publish")
+		return
+	}
+	if form.Action != utils.TOKEN_ACTION_PLAY && strings.HasPrefix(form.Path, "/record/") {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "record playback can only be signed for play")
+		return
+	}
+	if form.ExpiresIn <= 0 {
+		form.ExpiresIn = 3600
+	}
+	expires := time.Now().Unix() + form.ExpiresIn
+	token := utils.URLToken(secret, form.Action, form.Path, expires, form.IP)
+	query := fmt.Sprintf("token=%s&expires=%d", token, expires)
+
+	hostname := utils.GetRequestHostname(c.Request)
+	var url string
+	if strings.HasPrefix(form.Path, "/record/") {
+		scheme := "http"
+		if c.Request.TLS != nil {
+			scheme = "https"
+		}
+		url = fmt.Sprintf("%s://%s%s/out.m3u8?%s", scheme, c.Request.Host, form.Path, query)
+	} else {
+		port := rtsp.GetServer().TCPPort
+		url = fmt.Sprintf("rtsp://%s:%d%s?%s", hostname, port, form.Path, query)
+		if port == 554 {
+			url = fmt.Sprintf("rtsp://%s%s?%s", hostname, form.Path, query)
+		}
+	}
+	audit(c, models.AUDIT_STREAM_SIGN, form.Path, nil, gin.H{
+		"expires": expires,
+		"ip":      form.IP,
+	})
+	c.IndentedJSON(200, gin.H{
+		"token":   token,
+		"expires": expires,
+		"url":     url,
+	})
 }
@@ -85,13 +85,20 @@ func (h *APIHandler) ModifyPassword(c *gin.Context) {
 	}
 	sess := sessions.Default(c)
 	var user models.User
-	db.SQLite.First(&user, sess.Get("uid"))
-	if user.ID != "" && strings.EqualFold(form.OldPassword, user.Password) {
-		db.SQLite.Model(&user).Update("password", form.NewPassword)
-	} else {
+	db.SQLite.First(&user, "id = ?", sess.Get("uid"))
+	if user.ID == "" || !user.CheckPassword(form.OldPassword) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, "原密码不正确")
 		return
 	}
+	if err := user.SetPassword(form.NewPassword); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	db.SQLite.Model(&user).Updates(map[string]interface{}{
+		"password":   user.Password,
+		"digest_ha1": user.DigestHA1,
+	})
+	audit(c, models.AUDIT_MODIFY_PASSWORD, user.Username, nil, nil)
 	token, _ := sess.RenewID()
 	c.IndentedJSON(http.StatusOK, gin.H{
 		"token": token,
@@ -129,6 +136,7 @@ func (h *APIHandler) GetServerInfo(c *gin.Context) {
  */
 func (h *APIHandler) Restart(c *gin.Context) {
 	log.Println("Restart...")
+	audit(c, models.AUDIT_RESTART, "", nil, nil)
 	c.JSON(http.StatusOK, "OK")
 	go func() {
 		select {
@@ -170,10 +178,24 @@ func (h *APIHandler) Login(c *gin.Context) {
 		c.AbortWithStatusJSON(401, "用户名或密码错误")
 		return
 	}
-	if !strings.EqualFold(user.Password, form.Password) {
+	if !user.CheckPassword(form.Password) {
 		c.AbortWithStatusJSON(401, "用户名或密码错误")
 		return
 	}
+	if user.Disabled {
+		c.AbortWithStatusJSON(401, "用户已被禁用")
+		return
+	}
+	updates := map[string]interface{}{
+		"last_login_at": utils.DateTime(time.Now()),
+		"last_login_ip": c.ClientIP(),
+	}
+	if user.DigestHA1 == "" && models.DigestEnabled() {
+		user.SetDigestHA1(form.Password)
+		updates["digest_ha1"] = user.DigestHA1
+	}
+	db.SQLite.Model(&user).Updates(updates)
+	models.AddAuditLog(&user, c.ClientIP(), models.AUDIT_LOGIN, user.Username, nil, nil)
 	sess := sessions.Default(c)
 	sess.Set("uid", user.ID)
 	sess.Set("uname", user.Username)
@@ -192,9 +214,16 @@ func (h *APIHandler) UserInfo(c *gin.Context) {
 	sess := sessions.Default(c)
 	uid := sess.Get("uid")
 	if uid != nil {
+		var user models.User
+		db.SQLite.First(&user, "id = ?", uid)
+		roles := []string{}
+		if user.Role != "" {
+			roles = append(roles, user.Role)
+		}
 		c.IndentedJSON(200, gin.H{
-			"id":   uid,
-			"name": sess.Get("uname"),
+			"id":    uid,
+			"name":  sess.Get("uname"),
+			"roles": roles,
 		})
 	} else {
 		c.IndentedJSON(200, nil)
@@ -219,7 +248,7 @@ func (h *APIHandler) DefaultLoginInfo(c *gin.Context) {
 	defUser := sec.Key("default_username").MustString("admin")
 	defPass := sec.Key("default_password").MustString("admin")
 	db.SQLite.First(&user, "username = ?", defUser)
-	if utils.MD5(defPass) != user.Password {
+	if !user.CheckPassword(utils.MD5(defPass)) {
 		defPass = ""
 	}
 	c.JSON(200, gin.H{
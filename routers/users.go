@@ -0,0 +1,255 @@
+package routers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/snowlyg/EasyDarwin/extend/db"
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+	"github.com/snowlyg/EasyDarwin/models"
+)
+
+/**
+ * @apiDefine user 用户管理
+ */
+
+/**
+ * @apiDefine userRow
+ * @apiSuccess (200) {String} id
+ * @apiSuccess (200) {String} username 用户名
+ * @apiSuccess (200) {String} role 角色
+ * @apiSuccess (200) {Boolean} disabled 是否禁用
+ * @apiSuccess (200) {String} lastLoginAt 最后登录时间
+ * @apiSuccess (200) {String} lastLoginIP 最后登录IP
+ * @apiSuccess (200) {String} createdAt 创建时间
+ */
+
+/**
+ * @api {get} /api/v1/users 获取用户列表
+ * @apiGroup user
+ * @apiName Users
+ * @apiUse pageParam
+ * @apiUse pageSuccess
+ */
+func (h *APIHandler) Users(c *gin.Context) {
+	form := utils.NewPageForm()
+	if err := c.Bind(form); err != nil {
+		return
+	}
+	users := make([]models.User, 0)
+	query := db.SQLite
+	if form.Q != "" {
+		query = query.Where("username like ?", "%"+form.Q+"%")
+	}
+	if err := query.Find(&users).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	pr := utils.NewPageResult(users)
+	if form.Sort != "" {
+		pr.Sort(form.Sort, form.Order)
+	}
+	pr.Slice(form.Start, form.Limit)
+	c.IndentedJSON(200, pr)
+}
+
+/**
+ * @api {post} /api/v1/users 新增用户
+ * @apiGroup user
+ * @apiName UserCreate
+ * @apiParam {String} username 用户名
+ * @apiParam {String} password 密码(经过md5加密,32位长度,不带中划线,不区分大小写)
+ * @apiParam {String} [role] 角色
+ * @apiUse userRow
+ */
+func (h *APIHandler) UserCreate(c *gin.Context) {
+	type Form struct {
+		Username string `form:"username" binding:"required"`
+		Password string `form:"password" binding:"required"`
+		Role     string `form:"role"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	form.Username = strings.TrimSpace(form.Username)
+	if !db.SQLite.First(&models.User{}, "username = ?", form.Username).RecordNotFound() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("用户[%s]已存在", form.Username))
+		return
+	}
+	if !checkRole(c, form.Role) {
+		return
+	}
+	user := models.User{
+		Username: form.Username,
+		Role:     form.Role,
+	}
+	if err := user.SetPassword(form.Password); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := db.SQLite.Create(&user).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.IndentedJSON(200, user)
+}
+
+/**
+ * @api {put} /api/v1/users/:id 修改用户
+ * @apiGroup user
+ * @apiName UserUpdate
+ * @apiParam {String} id 用户ID
+ * @apiParam {String} [role] 角色
+ * @apiParam {Boolean} [disabled] 是否禁用
+ * @apiUse userRow
+ */
+func (h *APIHandler) UserUpdate(c *gin.Context) {
+	type Form struct {
+		Role     *string `form:"role"`
+		Disabled *bool   `form:"disabled"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	user, ok := findUser(c)
+	if !ok {
+		return
+	}
+	updates := make(map[string]interface{})
+	if form.Role != nil {
+		if !checkRole(c, *form.Role) {
+			return
+		}
+		updates["role"] = *form.Role
+	}
+	if form.Disabled != nil {
+		if *form.Disabled && !checkNotSelf(c, user) {
+			return
+		}
+		updates["disabled"] = *form.Disabled
+	}
+	if len(updates) > 0 && !updateUser(c, user, updates) {
+		return
+	}
+	c.IndentedJSON(200, user)
+}
+
+/**
+ * @api {delete} /api/v1/users/:id 删除用户
+ * @apiGroup user
+ * @apiName UserDelete
+ * @apiParam {String} id 用户ID
+ * @apiUse simpleSuccess
+ */
+func (h *APIHandler) UserDelete(c *gin.Context) {
+	user, ok := findUser(c)
+	if !ok || !checkNotSelf(c, user) || !updateUser(c, user, nil) {
+		return
+	}
+	c.IndentedJSON(200, "OK")
+}
+
+/**
+ * @api {post} /api/v1/users/:id/password 重置用户密码
+ * @apiGroup user
+ * @apiName UserResetPassword
+ * @apiParam {String} id 用户ID
+ * @apiParam {String} password 新密码(经过md5加密,32位长度,不带中划线,不区分大小写)
+ * @apiUse simpleSuccess
+ */
+func (h *APIHandler) UserResetPassword(c *gin.Context) {
+	type Form struct {
+		Password string `form:"password" binding:"required"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	user, ok := findUser(c)
+	if !ok {
+		return
+	}
+	if err := user.SetPassword(form.Password); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	db.SQLite.Model(user).Updates(map[string]interface{}{
+		"password":   user.Password,
+		"digest_ha1": user.DigestHA1,
+	})
+	c.IndentedJSON(200, "OK")
+}
+
+/**
+ * @api {post} /api/v1/users/:id/enable 启用用户
+ * @apiGroup user
+ * @apiName UserEnable
+ * @apiParam {String} id 用户ID
+ * @apiUse simpleSuccess
+ */
+func (h *APIHandler) UserEnable(c *gin.Context) {
+	user, ok := findUser(c)
+	if !ok {
+		return
+	}
+	db.SQLite.Model(user).Update("disabled", false)
+	c.IndentedJSON(200, "OK")
+}
+
+/**
+ * @api {post} /api/v1/users/:id/disable 禁用用户
+ * @apiGroup user
+ * @apiName UserDisable
+ * @apiParam {String} id 用户ID
+ * @apiUse simpleSuccess
+ */
+func (h *APIHandler) UserDisable(c *gin.Context) {
+	user, ok := findUser(c)
+	if !ok || !checkNotSelf(c, user) || !updateUser(c, user, map[string]interface{}{"disabled": true}) {
+		return
+	}
+	c.IndentedJSON(200, "OK")
+}
+
+func findUser(c *gin.Context) (*models.User, bool) {
+	var user models.User
+	if db.SQLite.First(&user, "id = ?", c.Param("id")).RecordNotFound() {
+		c.AbortWithStatusJSON(http.StatusNotFound, "用户不存在")
+		return nil, false
+	}
+	return &user, true
+}
+
+func checkRole(c *gin.Context, role string) bool {
+	if role != "" && db.SQLite.First(&models.Role{}, "name = ?", role).RecordNotFound() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("角色[%s]不存在", role))
+		return false
+	}
+	return true
+}
+
+func checkNotSelf(c *gin.Context, user *models.User) bool {
+	if current := CurrentUser(c); current != nil && current.ID == user.ID {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "不能禁用或删除当前登录用户")
+		return false
+	}
+	return true
+}
+
+// updateUser applies updates to user or deletes it, see models.UpdateUser.
+func updateUser(c *gin.Context, user *models.User, updates map[string]interface{}) bool {
+	err := models.UpdateUser(user, updates)
+	switch {
+	case err == models.ErrLastAdmin:
+		c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
+		return false
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+		return false
+	}
+	return true
+}
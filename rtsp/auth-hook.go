@@ -0,0 +1,113 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+)
+
+const (
+	AUTH_ACTION_PUBLISH = "publish"
+	AUTH_ACTION_PLAY    = "play"
+)
+
+// AuthHook asks an external http service whether a client may publish or
+// play a path. The service answers 2xx to accept, 401 to ask for
+// credentials and anything else to reject.
+type AuthHook struct {
+	SessionLogger
+	OnPublish string
+	OnPlay    string
+	CacheTTL  time.Duration
+	client    *http.Client
+	cache     map[string]time.Time // accepted request key <-> expire time
+	cacheLock sync.Mutex
+}
+
+type AuthHookRequest struct {
+	Action string `json:"action"`
+	ID     string `json:"id"`
+	Path   string `json:"path"`
+	URL    string `json:"url"`
+	IP     string `json:"ip"`
+	User   string `json:"user"`
+	Token  string `json:"token"`
+}
+
+// NewAuthHook returns nil when neither on_publish nor on_play is configured.
+func NewAuthHook() *AuthHook {
+	sec := utils.Conf().Section("rtsp")
+	onPublish := sec.Key("on_publish").MustString("")
+	onPlay := sec.Key("on_play").MustString("")
+	if onPublish == "" && onPlay == "" {
+		return nil
+	}
+	hook := &AuthHook{
+		SessionLogger: SessionLogger{log.New(os.Stdout, "[AuthHook]", log.LstdFlags|log.Lshortfile)},
+		OnPublish:     onPublish,
+		OnPlay:        onPlay,
+		CacheTTL:      time.Duration(sec.Key("auth_hook_cache").MustInt(60)) * time.Second,
+		client:        &http.Client{Timeout: time.Duration(sec.Key("auth_hook_timeout").MustInt(5)) * time.Second},
+		cache:         make(map[string]time.Time),
+	}
+	if !utils.Debug {
+		hook.logger.SetOutput(utils.GetLogWriter())
+	}
+	return hook
+}
+
+// Check returns the RTSP status code to answer the client with.
+func (hook *AuthHook) Check(req *AuthHookRequest) int {
+	url := hook.OnPlay
+	if req.Action == AUTH_ACTION_PUBLISH {
+		url = hook.OnPublish
+	}
+	if url == "" {
+		return 200
+	}
+	key := strings.Join([]string{req.Action, req.Path, req.IP, req.User, req.Token}, "|")
+	now := time.Now()
+	hook.cacheLock.Lock()
+	expire, ok := hook.cache[key]
+	if ok && now.After(expire) {
+		delete(hook.cache, key)
+		ok = false
+	}
+	hook.cacheLock.Unlock()
+	if ok {
+		return 200
+	}
+
+	body, _ := json.Marshal(req)
+	resp, err := hook.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		hook.logger.Printf("on_%s[%s] path[%s] err:%v", req.Action, url, req.Path, err)
+		return 403
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		if hook.CacheTTL > 0 {
+			hook.cacheLock.Lock()
+			for k, v := range hook.cache {
+				if now.After(v) {
+					delete(hook.cache, k)
+				}
+			}
+			hook.cache[key] = now.Add(hook.CacheTTL)
+			hook.cacheLock.Unlock()
+		}
+		return 200
+	case resp.StatusCode == http.StatusUnauthorized:
+		return 401
+	}
+	hook.logger.Printf("on_%s[%s] path[%s] rejected, %s", req.Action, url, req.Path, resp.Status)
+	return 403
+}
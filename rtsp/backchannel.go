@@ -0,0 +1,170 @@
+package rtsp
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/snowlyg/EasyDarwin/extend/db"
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+	"github.com/snowlyg/EasyDarwin/models"
+)
+
+// ONVIF_BACKCHANNEL is the feature tag of the ONVIF audio backchannel, see
+// ONVIF Streaming Specification 5.3. A client requiring it is described the
+// sendonly media too, which it sends to the camera, talk audio mostly.
+const ONVIF_BACKCHANNEL = "www.onvif.org/ver20/backchannel"
+
+// requiresTag tells whether the Require headers have the feature tag.
+func requiresTag(header Header, tag string) bool {
+	for _, require := range header.Values("Require") {
+		for _, t := range strings.Split(require, ",") {
+			if strings.TrimSpace(t) == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasBackchannel tells whether one of the tracks is a backchannel.
+func hasBackchannel(tracks []*Track) bool {
+	for _, track := range tracks {
+		if track.Backchannel {
+			return true
+		}
+	}
+	return false
+}
+
+// stripBackchannel removes the media of the backchannel tracks from the sdp,
+// for the players not requiring ONVIF_BACKCHANNEL.
+func stripBackchannel(sdpRaw string, tracks []*Track) string {
+	if !hasBackchannel(tracks) {
+		return sdpRaw
+	}
+	var b strings.Builder
+	index := -1
+	for _, line := range strings.SplitAfter(sdpRaw, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "m=") {
+			index++
+		}
+		if index >= 0 && index < len(tracks) && tracks[index].Backchannel {
+			continue
+		}
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
+// checkBackchannel tells whether the player may talk on the backchannel,
+// sending to the source of the stream is a publish on the path: the signed
+// url must grant the publish action, the digest user PERMISSION_PUBLISH and
+// the auth hook is asked for AUTH_ACTION_PUBLISH. res is filled when not.
+func (session *Session) checkBackchannel(res *Response) bool {
+	forbidden := false
+	switch {
+	case session.tokenAction != "":
+		forbidden = session.tokenAction != utils.TOKEN_ACTION_PUBLISH
+	case session.authorizationEnable:
+		var user models.User
+		err := db.SQLite.Where("Username = ?", session.Username).First(&user).Error
+		forbidden = err != nil || !user.HasPermission(models.PERMISSION_PUBLISH, session.Path)
+	}
+	if forbidden {
+		session.logger.Printf("backchannel of %s forbidden, user[%s] token[%s]", session.Path, session.Username, session.tokenAction)
+		res.StatusCode = 403
+		res.Status = "Forbidden"
+		return false
+	}
+	u, err := url.Parse(session.URL)
+	if err != nil {
+		res.StatusCode = 500
+		res.Status = "Invalid URL"
+		return false
+	}
+	return session.checkAuthHook(AUTH_ACTION_PUBLISH, u, res)
+}
+
+// ClaimBackchannel makes the player session the talker of the backchannel,
+// the camera takes one talker at a time. It is released when the session
+// stops.
+func (pusher *Pusher) ClaimBackchannel(session *Session) bool {
+	pusher.backchannelLock.Lock()
+	defer pusher.backchannelLock.Unlock()
+	if talker := pusher.backchannelTalker; talker != nil && talker != session && !talker.Stoped() {
+		return false
+	}
+	pusher.backchannelTalker = session
+	return true
+}
+
+// SendBackchannel forwards the backchannel pack of the talker to the source
+// of the stream.
+func (pusher *Pusher) SendBackchannel(session *Session, pack *RTPPack) error {
+	pusher.backchannelLock.RLock()
+	talker := pusher.backchannelTalker
+	pusher.backchannelLock.RUnlock()
+	if talker != session {
+		return fmt.Errorf("%v is not the backchannel talker", session)
+	}
+	client := pusher.RTSPClient
+	if client == nil {
+		return fmt.Errorf("%v has no backchannel", pusher)
+	}
+	return client.SendBackchannel(pack)
+}
+
+// forwardBackchannel is the RTPHandle of the players requiring
+// ONVIF_BACKCHANNEL, the packs of the backchannel tracks go to the pusher.
+func (session *Session) forwardBackchannel(pack *RTPPack) {
+	if pack.Track < 0 || pack.Track >= len(session.Tracks) || !session.Tracks[pack.Track].Backchannel {
+		return
+	}
+	pusher := session.Pusher
+	if pusher == nil {
+		return
+	}
+	if err := pusher.SendBackchannel(session, pack); err != nil {
+		session.logger.Printf("send backchannel error, %v", err)
+	}
+}
+
+// SendBackchannel sends pack to the source on the backchannel track, over the
+// rtsp connection or to the server ports of the track.
+func (client *RTSPClient) SendBackchannel(pack *RTPPack) (err error) {
+	if pack.Track < 0 || pack.Track >= len(client.Tracks) || !client.Tracks[pack.Track].Backchannel {
+		return fmt.Errorf("%v got no backchannel track[%d]", client, pack.Track)
+	}
+	track := client.Tracks[pack.Track]
+	if client.TransType == TRANS_TYPE_UDP {
+		udpServer := client.UDPServer
+		if udpServer == nil {
+			return fmt.Errorf("%v use udp transport but udp server not found", client)
+		}
+		n, err := udpServer.SendRTP(pack)
+		client.OutBytes += n
+		return err
+	}
+	channel := track.RTPChannel
+	if pack.Type.IsControl() {
+		channel = track.RTCPChannel
+	}
+	if channel < 0 {
+		return fmt.Errorf("%v not set up", track)
+	}
+	buf := interleavedFrame(channel, pack)
+	client.connWLock.Lock()
+	defer client.connWLock.Unlock()
+	if client.Stoped {
+		return fmt.Errorf("%v stoped", client)
+	}
+	if _, err = client.connRW.Write(buf); err != nil {
+		return
+	}
+	if err = client.connRW.Flush(); err != nil {
+		return
+	}
+	client.OutBytes += len(buf)
+	return
+}
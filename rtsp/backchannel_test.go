@@ -0,0 +1,152 @@
+package rtsp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+)
+
+func TestRequiresTag(t *testing.T) {
+	tests := []struct {
+		require []string
+		want    bool
+	}{
+		{nil, false},
+		{[]string{ONVIF_BACKCHANNEL}, true},
+		{[]string{"implicit-play, " + ONVIF_BACKCHANNEL}, true},
+		{[]string{"implicit-play", " " + ONVIF_BACKCHANNEL + " "}, true},
+		{[]string{ONVIF_BACKCHANNEL + "2"}, false},
+		{[]string{"www.onvif.org/ver20"}, false},
+	}
+	for _, tt := range tests {
+		header := make(Header)
+		for _, require := range tt.require {
+			header.Add("Require", require)
+		}
+		if got := requiresTag(header, ONVIF_BACKCHANNEL); got != tt.want {
+			t.Errorf("requiresTag(%q) = %v, want %v", tt.require, got, tt.want)
+		}
+	}
+}
+
+func TestStripBackchannel(t *testing.T) {
+	tracks := NewTracks(testTrackONVIFSDP)
+	if got := stripBackchannel(testTrackONVIFSDP, tracks); got != testTrackONVIFSDP {
+		t.Errorf("sdp without backchannel changed:\n%s", got)
+	}
+	tracks[2].Backchannel = true
+	got := stripBackchannel(testTrackONVIFSDP, tracks)
+	if strings.Contains(got, "PCMU") || strings.Contains(got, "sendonly") || strings.Contains(got, "trackID=11") {
+		t.Errorf("backchannel media kept:\n%s", got)
+	}
+	// the session lines and the other media are kept in order.
+	stripped := NewTracks(got)
+	if len(stripped) != 3 || stripped[0].Codec != "h264" || stripped[1].Codec != "pcma" || stripped[2].AVType != "application" {
+		t.Errorf("stripped tracks %v", stripped)
+	}
+	if !strings.HasPrefix(got, "v=0\r\n") || !strings.Contains(got, "a=control:rtsp://192.168.1.64/Streaming/Channels/101/\r\n") {
+		t.Errorf("session lines lost:\n%s", got)
+	}
+}
+
+func TestClaimBackchannel(t *testing.T) {
+	pusher := &Pusher{}
+	a, b := &Session{ID: "a"}, &Session{ID: "b"}
+	if !pusher.ClaimBackchannel(a) {
+		t.Fatal("first talker rejected")
+	}
+	if !pusher.ClaimBackchannel(a) {
+		t.Error("talker rejected again")
+	}
+	if pusher.ClaimBackchannel(b) {
+		t.Error("second talker accepted")
+	}
+	if err := pusher.SendBackchannel(b, &RTPPack{}); err == nil {
+		t.Error("pack of another player sent")
+	}
+	// released when the talker stops.
+	a.stoped = true
+	if !pusher.ClaimBackchannel(b) {
+		t.Error("talker not released")
+	}
+	if pusher.ClaimBackchannel(&Session{ID: "c"}) {
+		t.Error("third talker accepted")
+	}
+}
+
+func TestCheckBackchannel(t *testing.T) {
+	var actions []string
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req AuthHookRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		actions = append(actions, req.Action)
+		if req.Path != "/live/open" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer hook.Close()
+
+	newSession := func(path, tokenAction string, authHook *AuthHook) *Session {
+		return &Session{
+			SessionLogger: SessionLogger{log.New(ioutil.Discard, "", 0)},
+			Server:        &Server{authHook: authHook},
+			URL:           "rtsp://127.0.0.1" + path,
+			Path:          path,
+			tokenAction:   tokenAction,
+		}
+	}
+	authHook := &AuthHook{
+		SessionLogger: SessionLogger{log.New(ioutil.Discard, "", 0)},
+		OnPublish:     hook.URL,
+		client:        http.DefaultClient,
+		cache:         make(map[string]time.Time),
+	}
+	tests := []struct {
+		name    string
+		session *Session
+		status  int
+	}{
+		{"no auth", newSession("/live/a", "", nil), 200},
+		{"play token", newSession("/live/a", utils.TOKEN_ACTION_PLAY, nil), 403},
+		{"publish token", newSession("/live/a", utils.TOKEN_ACTION_PUBLISH, nil), 200},
+		{"hook accepts", newSession("/live/open", "", authHook), 200},
+		{"hook rejects", newSession("/live/a", "", authHook), 403},
+		{"play token before hook", newSession("/live/open", utils.TOKEN_ACTION_PLAY, authHook), 403},
+	}
+	for _, tt := range tests {
+		res := NewResponse(200, "OK", "1", "", "")
+		ok := tt.session.checkBackchannel(res)
+		if res.StatusCode != tt.status || ok != (tt.status == 200) {
+			t.Errorf("%s: checkBackchannel = %v, %d", tt.name, ok, res.StatusCode)
+		}
+	}
+	if len(actions) != 2 || actions[0] != AUTH_ACTION_PUBLISH || actions[1] != AUTH_ACTION_PUBLISH {
+		t.Errorf("auth hook asked for %q, want publish twice", actions)
+	}
+}
+
+func TestBackchannelTokenAction(t *testing.T) {
+	session := &Session{}
+	describe := NewRequest(DESCRIBE, "rtsp://127.0.0.1/live/a", "1")
+	if action := session.tokenActionOf(describe); action != utils.TOKEN_ACTION_PLAY {
+		t.Errorf("DESCRIBE needs %s", action)
+	}
+	describe.Header.Set("Require", ONVIF_BACKCHANNEL)
+	if action := session.tokenActionOf(describe); action != utils.TOKEN_ACTION_PUBLISH {
+		t.Errorf("DESCRIBE of the backchannel needs %s", action)
+	}
+	// the talker goes on with its publish token.
+	session.tokenAction = utils.TOKEN_ACTION_PUBLISH
+	for _, method := range []string{SETUP, PLAY} {
+		if action := session.tokenActionOf(NewRequest(method, "rtsp://127.0.0.1/live/a", "2")); action != utils.TOKEN_ACTION_PUBLISH {
+			t.Errorf("%s of the talker needs %s", method, action)
+		}
+	}
+}
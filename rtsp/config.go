@@ -0,0 +1,48 @@
+package rtsp
+
+import (
+	"sync/atomic"
+
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+)
+
+// debugLog caches debug_log_enable, read for every packet. It is loaded by
+// Start and ApplyConfig.
+var debugLog int32
+
+func debugLogEnabled() bool {
+	return atomic.LoadInt32(&debugLog) != 0
+}
+
+func loadDebugLog() {
+	if utils.Conf().Section("rtsp").Key("debug_log_enable").MustInt(0) != 0 {
+		atomic.StoreInt32(&debugLog, 1)
+	} else {
+		atomic.StoreInt32(&debugLog, 0)
+	}
+}
+
+// ApplyConfig applies the settings which can be changed without restarting
+// the listeners to the running pushers and players, gop_cache_enable,
+// player_queue_limit and debug_log_enable. New sessions always read the
+// current config.
+func (server *Server) ApplyConfig() {
+	loadDebugLog()
+	sec := utils.Conf().Section("rtsp")
+	gopCacheEnable := sec.Key("gop_cache_enable").MustBool(true)
+	queueLimit := sec.Key("player_queue_limit").MustInt(0)
+	for _, pusher := range server.GetPushers() {
+		pusher.gopCacheLock.Lock()
+		pusher.gopCacheEnable = gopCacheEnable
+		if !gopCacheEnable {
+			pusher.gopCache = make([]*RTPPack, 0)
+		}
+		pusher.gopCacheLock.Unlock()
+		for _, player := range pusher.GetPlayers() {
+			player.cond.L.Lock()
+			player.queueLimit = queueLimit
+			player.cond.L.Unlock()
+		}
+	}
+	server.logger.Printf("config applied, gop_cache_enable=%v, player_queue_limit=%d, debug_log_enable=%v", gopCacheEnable, queueLimit, debugLogEnabled())
+}
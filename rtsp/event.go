@@ -0,0 +1,89 @@
+package rtsp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+)
+
+const (
+	EVENT_PUSHER_ADD     = "pusher.add"
+	EVENT_PUSHER_REMOVE  = "pusher.remove"
+	EVENT_PLAYER_ADD     = "player.add"
+	EVENT_PLAYER_REMOVE  = "player.remove"
+	EVENT_RECORD_SEGMENT = "record.segment"
+	EVENT_PUSHER_STALL   = "pusher.stall"
+	EVENT_PUSHER_RECOVER = "pusher.recover"
+)
+
+// Event describes a stream or player lifecycle change, see EVENT_*.
+type Event struct {
+	Type string                 `json:"event"`
+	Time utils.DateTime         `json:"time"`
+	Path string                 `json:"path"`
+	ID   string                 `json:"id,omitempty"`
+	Data map[string]interface{} `json:"data,omitempty"`
+}
+
+func NewEvent(typ, path, id string, data map[string]interface{}) *Event {
+	return &Event{
+		Type: typ,
+		Time: utils.DateTime(time.Now()),
+		Path: path,
+		ID:   id,
+		Data: data,
+	}
+}
+
+type eventHandles struct {
+	handles map[int]func(*Event)
+	nextID  int
+	lock    sync.RWMutex
+}
+
+// AddEventHandle registers h to be called for every event emitted by the
+// server. h must not block. The returned func unregisters h.
+func (server *Server) AddEventHandle(h func(*Event)) (remove func()) {
+	server.events.lock.Lock()
+	if server.events.handles == nil {
+		server.events.handles = make(map[int]func(*Event))
+	}
+	id := server.events.nextID
+	server.events.nextID++
+	server.events.handles[id] = h
+	server.events.lock.Unlock()
+	return func() {
+		server.events.lock.Lock()
+		delete(server.events.handles, id)
+		server.events.lock.Unlock()
+	}
+}
+
+func (server *Server) Emit(event *Event) {
+	server.events.lock.RLock()
+	defer server.events.lock.RUnlock()
+	for _, h := range server.events.handles {
+		h(event)
+	}
+}
+
+func pusherEvent(typ string, pusher *Pusher) *Event {
+	return NewEvent(typ, pusher.Path(), pusher.ID(), map[string]interface{}{
+		"source":    pusher.Source(),
+		"transType": pusher.TransType(),
+		"inBytes":   pusher.InBytes(),
+		"outBytes":  pusher.OutBytes(),
+		"startAt":   utils.DateTime(pusher.StartAt()),
+	})
+}
+
+func playerEvent(typ string, player *Player) *Event {
+	return NewEvent(typ, player.Path, player.ID, map[string]interface{}{
+		"pusherId":   player.Pusher.ID(),
+		"transType":  player.TransType.String(),
+		"remoteAddr": player.RemoteAddr(),
+		"outBytes":   player.OutBytes,
+		"startAt":    utils.DateTime(player.StartAt),
+	})
+}
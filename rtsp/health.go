@@ -0,0 +1,63 @@
+package rtsp
+
+import (
+	"time"
+
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+)
+
+// Health returns whether the stream is healthy, and why not, see monitorHealth.
+func (pusher *Pusher) Health() (healthy bool, reason string) {
+	pusher.healthLock.RLock()
+	defer pusher.healthLock.RUnlock()
+	return pusher.unhealthyReason == "", pusher.unhealthyReason
+}
+
+// monitorHealth marks the pushers whose video stalls beyond stall_timeout, or
+// without key frame beyond keyframe_timeout, unhealthy until the stream
+// recovers. Pulled streams are restarted when stall_restart_pull is set.
+func (server *Server) monitorHealth(stop chan struct{}) {
+	sec := utils.Conf().Section("rtsp")
+	stallTimeout := time.Duration(sec.Key("stall_timeout").MustInt(10)) * time.Second
+	keyFrameTimeout := time.Duration(sec.Key("keyframe_timeout").MustInt(0)) * time.Second
+	restartPull := sec.Key("stall_restart_pull").MustBool(true)
+	if stallTimeout <= 0 && keyFrameTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			for _, pusher := range server.GetPushers() {
+				server.checkHealth(pusher, now, stallTimeout, keyFrameTimeout, restartPull)
+			}
+		}
+	}
+}
+
+func (server *Server) checkHealth(pusher *Pusher, now time.Time, stallTimeout, keyFrameTimeout time.Duration, restartPull bool) {
+	reason := pusher.stats.checkHealth(now, stallTimeout, keyFrameTimeout)
+	pusher.healthLock.Lock()
+	old := pusher.unhealthyReason
+	pusher.unhealthyReason = reason
+	pusher.healthLock.Unlock()
+	switch {
+	case old == "" && reason != "":
+		server.logger.Printf("%v unhealthy, %s", pusher, reason)
+		server.Emit(NewEvent(EVENT_PUSHER_STALL, pusher.Path(), pusher.ID(), map[string]interface{}{
+			"reason": reason,
+			"source": pusher.Source(),
+		}))
+		if restartPull && pusher.RTSPClient != nil {
+			server.logger.Printf("%v restart pull stream[%s]", pusher, pusher.RTSPClient.URL)
+			// the pull stream daemon reconnects it.
+			go pusher.RTSPClient.Stop()
+		}
+	case old != "" && reason == "":
+		server.logger.Printf("%v recovered", pusher)
+		server.Emit(NewEvent(EVENT_PUSHER_RECOVER, pusher.Path(), pusher.ID(), nil))
+	}
+}
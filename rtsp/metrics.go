@@ -0,0 +1,121 @@
+package rtsp
+
+import (
+	"sync"
+)
+
+// RequestStat is the key of the rtsp request counters.
+type RequestStat struct {
+	Method string
+	Status int
+}
+
+// counters lasting longer than pushers and players, they are reset only when
+// the process restarts.
+type serverMetrics struct {
+	requests       map[RequestStat]uint64
+	droppedPackets map[string]uint64 // Path <-> packets dropped by player queue limit
+	reconnects     map[string]uint64 // Path <-> pull stream reconnects
+	timeouts       map[string]uint64 // Path <-> sessions reaped by session_timeout
+	playerOutBytes map[string]uint64 // Path <-> bytes sent to the players removed
+	lock           sync.Mutex
+}
+
+func (m *serverMetrics) add(counters *map[string]uint64, path string, n uint64) {
+	m.lock.Lock()
+	if *counters == nil {
+		*counters = make(map[string]uint64)
+	}
+	(*counters)[path] += n
+	m.lock.Unlock()
+}
+
+func (m *serverMetrics) copy(counters *map[string]uint64) map[string]uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ret := make(map[string]uint64, len(*counters))
+	for k, v := range *counters {
+		ret[k] = v
+	}
+	return ret
+}
+
+// requestMethods are the methods counted by name, the others are counted as
+// OTHER so that clients cannot grow the counters without bound.
+var requestMethods = map[string]bool{
+	"OPTIONS": true, "DESCRIBE": true, "ANNOUNCE": true, "SETUP": true, "PLAY": true, "PAUSE": true,
+	"RECORD": true, "TEARDOWN": true, "GET_PARAMETER": true, "SET_PARAMETER": true,
+}
+
+func (server *Server) countRequest(method string, status int) {
+	if !requestMethods[method] {
+		method = "OTHER"
+	}
+	m := &server.metrics
+	m.lock.Lock()
+	if m.requests == nil {
+		m.requests = make(map[RequestStat]uint64)
+	}
+	m.requests[RequestStat{method, status}]++
+	m.lock.Unlock()
+}
+
+func (server *Server) countDroppedPackets(path string, n int) {
+	server.metrics.add(&server.metrics.droppedPackets, path, uint64(n))
+}
+
+// CountReconnect counts a restart of the pull stream of path.
+func (server *Server) CountReconnect(path string) {
+	server.metrics.add(&server.metrics.reconnects, path, 1)
+}
+
+func (server *Server) countSessionTimeout(path string) {
+	server.metrics.add(&server.metrics.timeouts, path, 1)
+}
+
+func (server *Server) countPlayerOutBytes(path string, n int) {
+	server.metrics.add(&server.metrics.playerOutBytes, path, uint64(n))
+}
+
+func (server *Server) RequestCounts() map[RequestStat]uint64 {
+	m := &server.metrics
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ret := make(map[RequestStat]uint64, len(m.requests))
+	for k, v := range m.requests {
+		ret[k] = v
+	}
+	return ret
+}
+
+func (server *Server) DroppedPackets() map[string]uint64 {
+	return server.metrics.copy(&server.metrics.droppedPackets)
+}
+
+func (server *Server) Reconnects() map[string]uint64 {
+	return server.metrics.copy(&server.metrics.reconnects)
+}
+
+func (server *Server) SessionTimeouts() map[string]uint64 {
+	return server.metrics.copy(&server.metrics.timeouts)
+}
+
+// PlayerOutBytes returns the bytes sent to the players of each path, those
+// removed included. The players of a pusher are summed under its players
+// lock, so that a player removed meanwhile is counted once.
+func (server *Server) PlayerOutBytes() map[string]uint64 {
+	m := &server.metrics
+	ret := m.copy(&m.playerOutBytes)
+	for path, pusher := range server.GetPushers() {
+		pusher.playersLock.RLock()
+		m.lock.Lock()
+		n := m.playerOutBytes[path]
+		m.lock.Unlock()
+		for _, player := range pusher.players {
+			n += uint64(player.OutBytes)
+		}
+		pusher.playersLock.RUnlock()
+		ret[path] = n
+	}
+	return ret
+}
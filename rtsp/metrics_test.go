@@ -0,0 +1,57 @@
+package rtsp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func TestCountRequest(t *testing.T) {
+	server := &Server{}
+	server.countRequest("DESCRIBE", 200)
+	server.countRequest("DESCRIBE", 200)
+	server.countRequest("FOO", 501)
+	server.countRequest("BAR\x00", 501)
+	server.countRequest("describe", 501)
+	want := map[RequestStat]uint64{{"DESCRIBE", 200}: 2, {"OTHER", 501}: 3}
+	got := server.RequestCounts()
+	if len(got) != len(want) {
+		t.Fatalf("RequestCounts = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("RequestCounts = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestPlayerOutBytes(t *testing.T) {
+	server := &Server{pushers: make(map[string]*Pusher)}
+	logger := log.New(ioutil.Discard, "", 0)
+	pusher := &Pusher{Session: &Session{ID: "pusher", Path: "/live/a", Server: server, SessionLogger: SessionLogger{logger}}, players: make(map[string]*Player)}
+	server.pushers["/live/a"] = pusher
+	players := make([]*Player, 3)
+	for i := range players {
+		players[i] = &Player{Session: &Session{ID: fmt.Sprint(i), Path: "/live/a", Server: server, SessionLogger: SessionLogger{logger}}, Pusher: pusher}
+		players[i].OutBytes = 100 * (i + 1)
+		pusher.players[players[i].ID] = players[i]
+	}
+	check := func(when string, want uint64) {
+		t.Helper()
+		if got := server.PlayerOutBytes(); got["/live/a"] != want {
+			t.Errorf("%s: PlayerOutBytes = %v, want %d", when, got, want)
+		}
+	}
+	check("players", 600)
+	// the bytes of a player stay counted once it leaves.
+	pusher.RemovePlayer(players[2])
+	pusher.RemovePlayer(players[2])
+	check("a player removed", 600)
+	players[0].OutBytes += 50
+	check("a player sending", 650)
+	pusher.ClearPlayer()
+	check("players cleared", 650)
+	delete(server.pushers, "/live/a")
+	check("pusher removed", 650)
+}
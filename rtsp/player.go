@@ -14,6 +14,7 @@ type Player struct {
 	queueLimit           int
 	dropPacketWhenPaused bool
 	paused               bool
+	dropped              int
 }
 
 func NewPlayer(session *Session, pusher *Pusher) (player *Player) {
@@ -48,7 +49,9 @@ func (player *Player) QueueRTP(pack *RTPPack) *Player {
 	player.queue = append(player.queue, pack)
 	if oldLen := len(player.queue); player.queueLimit > 0 && oldLen > player.queueLimit {
 		player.queue = player.queue[1:]
-		if player.debugLogEnable {
+		player.dropped++
+		player.Pusher.Server().countDroppedPackets(player.Pusher.Path(), 1)
+		if debugLogEnabled() {
 			len := len(player.queue)
 			logger.Printf("Player %s, QueueRTP, exceeds limit(%d), drop %d old packets, current queue.len=%d\n", player.String(), player.queueLimit, oldLen-len, len)
 		}
@@ -58,10 +61,25 @@ func (player *Player) QueueRTP(pack *RTPPack) *Player {
 	return player
 }
 
+// QueueLen returns the count of packets waiting to be sent.
+func (player *Player) QueueLen() int {
+	player.cond.L.Lock()
+	defer player.cond.L.Unlock()
+	return len(player.queue)
+}
+
+// DroppedPackets returns the count of packets dropped as the queue exceeds
+// player_queue_limit.
+func (player *Player) DroppedPackets() int {
+	player.cond.L.Lock()
+	defer player.cond.L.Unlock()
+	return player.dropped
+}
+
 func (player *Player) Start() {
 	logger := player.logger
 	timer := time.Unix(0, 0)
-	for !player.Stoped {
+	for !player.Stoped() {
 		var pack *RTPPack
 		player.cond.L.Lock()
 		if len(player.queue) == 0 {
@@ -77,7 +95,7 @@ func (player *Player) Start() {
 			continue
 		}
 		if pack == nil {
-			if !player.Stoped {
+			if !player.Stoped() {
 				logger.Printf("player not stoped, but queue take out nil pack")
 			}
 			continue
@@ -86,7 +104,7 @@ func (player *Player) Start() {
 			logger.Println(err)
 		}
 		elapsed := time.Now().Sub(timer)
-		if player.debugLogEnable && elapsed >= 30*time.Second {
+		if debugLogEnabled() && elapsed >= 30*time.Second {
 			logger.Printf("Player %s, Send a package.type:%d, queue.len=%d\n", player.String(), pack.Type, queueLen)
 			timer = time.Now()
 		}
@@ -0,0 +1,57 @@
+package rtsp
+
+import (
+	"sync"
+)
+
+// PusherSource starts the stream of path when a player asks for it, for the
+// sources sending media only on request, GB28181 devices e.g. It returns
+// nil if path is not one of its streams. The pusher returned is added to the
+// server already.
+type PusherSource func(path string) (*Pusher, error)
+
+type pusherSources struct {
+	sources map[int]PusherSource
+	nextID  int
+	lock    sync.RWMutex
+}
+
+// AddPusherSource registers source to be asked for the paths without pusher.
+// The returned func unregisters it.
+func (server *Server) AddPusherSource(source PusherSource) (remove func()) {
+	server.pusherSources.lock.Lock()
+	if server.pusherSources.sources == nil {
+		server.pusherSources.sources = make(map[int]PusherSource)
+	}
+	id := server.pusherSources.nextID
+	server.pusherSources.nextID++
+	server.pusherSources.sources[id] = source
+	server.pusherSources.lock.Unlock()
+	return func() {
+		server.pusherSources.lock.Lock()
+		delete(server.pusherSources.sources, id)
+		server.pusherSources.lock.Unlock()
+	}
+}
+
+// demandPusher asks the sources for the stream of path, nil if none of them
+// has it.
+func (server *Server) demandPusher(path string) *Pusher {
+	server.pusherSources.lock.RLock()
+	sources := make([]PusherSource, 0, len(server.pusherSources.sources))
+	for _, source := range server.pusherSources.sources {
+		sources = append(sources, source)
+	}
+	server.pusherSources.lock.RUnlock()
+	for _, source := range sources {
+		pusher, err := source(path)
+		if err != nil {
+			server.logger.Printf("start stream[%s] on demand err:%v", path, err)
+			continue
+		}
+		if pusher != nil {
+			return pusher
+		}
+	}
+	return nil
+}
@@ -14,13 +14,18 @@ type Pusher struct {
 	*RTSPClient
 	players           map[string]*Player //SessionID <-> Player
 	playersLock       sync.RWMutex
-	gopCacheEnable    bool
+	gopCacheEnable    bool // guarded by gopCacheLock
 	gopCache          []*RTPPack
 	gopCacheLock      sync.RWMutex
 	UDPServer         *UDPServer
 	spsppsInSTAPaPack bool
 	cond              *sync.Cond
 	queue             []*RTPPack
+	stats             *streamStats
+	unhealthyReason   string
+	healthLock        sync.RWMutex
+	backchannelTalker *Session // the player sending the backchannel
+	backchannelLock   sync.RWMutex
 }
 
 func (pusher *Pusher) String() string {
@@ -46,7 +51,7 @@ func (pusher *Pusher) SDPRaw() string {
 
 func (pusher *Pusher) Stoped() bool {
 	if pusher.Session != nil {
-		return pusher.Session.Stoped
+		return pusher.Session.Stoped()
 	}
 	return pusher.RTSPClient.Stoped
 }
@@ -75,32 +80,22 @@ func (pusher *Pusher) Logger() *log.Logger {
 	return pusher.RTSPClient.logger
 }
 
-func (pusher *Pusher) VCodec() string {
+// Tracks returns the media of the stream in the order of its sdp.
+func (pusher *Pusher) Tracks() []*Track {
 	if pusher.Session != nil {
-		return pusher.Session.VCodec
+		return pusher.Session.Tracks
 	}
-	return pusher.RTSPClient.VCodec
+	return pusher.RTSPClient.Tracks
 }
 
-func (pusher *Pusher) ACodec() string {
-	if pusher.Session != nil {
-		return pusher.Session.ACodec
-	}
-	return pusher.RTSPClient.ACodec
-}
-
-func (pusher *Pusher) AControl() string {
-	if pusher.Session != nil {
-		return pusher.Session.AControl
-	}
-	return pusher.RTSPClient.AControl
+// VCodec returns the codec of the first video track.
+func (pusher *Pusher) VCodec() string {
+	return trackCodec(pusher.Tracks(), "video")
 }
 
-func (pusher *Pusher) VControl() string {
-	if pusher.Session != nil {
-		return pusher.Session.VControl
-	}
-	return pusher.RTSPClient.VControl
+// ACodec returns the codec of the first audio track.
+func (pusher *Pusher) ACodec() string {
+	return trackCodec(pusher.Tracks(), "audio")
 }
 
 func (pusher *Pusher) URL() string {
@@ -160,6 +155,7 @@ func NewClientPusher(client *RTSPClient) (pusher *Pusher) {
 		players:        make(map[string]*Player),
 		gopCacheEnable: utils.Conf().Section("rtsp").Key("gop_cache_enable").MustBool(true),
 		gopCache:       make([]*RTPPack, 0),
+		stats:          newStreamStats(),
 
 		cond:  sync.NewCond(&sync.Mutex{}),
 		queue: make([]*RTPPack, 0),
@@ -182,6 +178,7 @@ func NewPusher(session *Session) (pusher *Pusher) {
 		players:        make(map[string]*Player),
 		gopCacheEnable: utils.Conf().Section("rtsp").Key("gop_cache_enable").MustBool(true),
 		gopCache:       make([]*RTPPack, 0),
+		stats:          newStreamStats(),
 
 		cond:  sync.NewCond(&sync.Mutex{}),
 		queue: make([]*RTPPack, 0),
@@ -253,8 +250,24 @@ func (pusher *Pusher) QueueRTP(pack *RTPPack) *Pusher {
 	return pusher
 }
 
+// Stats returns the codec, resolution, bitrate, fps and gop of the stream.
+func (pusher *Pusher) Stats() StreamStats {
+	stats := pusher.stats.get()
+	if stats.VCodec == "" {
+		// not started yet.
+		stats.VCodec = strings.ToLower(pusher.VCodec())
+	}
+	return stats
+}
+
 func (pusher *Pusher) Start() {
 	logger := pusher.Logger()
+	pusher.stats.start(pusher.SDPRaw())
+	// key frames and the gop cache are of the first video track.
+	videoTrack := -1
+	if track := firstTrack(pusher.Tracks(), "video"); track != nil {
+		videoTrack = track.Index
+	}
 	for !pusher.Stoped() {
 		var pack *RTPPack
 		pusher.cond.L.Lock()
@@ -273,12 +286,25 @@ func (pusher *Pusher) Start() {
 			continue
 		}
 
-		if pusher.gopCacheEnable && pack.Type == RTP_TYPE_VIDEO {
+		var rtp *RTPInfo
+		keyFrame := false
+		isVideo := pack.Type == RTP_TYPE_VIDEO && pack.Track == videoTrack
+		if isVideo {
+			if rtp = ParseRTP(pack.Buffer.Bytes()); rtp != nil && len(rtp.Payload) > 0 {
+				keyFrame = pusher.shouldSequenceStart(rtp)
+			} else {
+				rtp = nil
+			}
+		}
+		pusher.stats.add(pack, rtp, keyFrame)
+		if isVideo {
 			pusher.gopCacheLock.Lock()
-			if rtp := ParseRTP(pack.Buffer.Bytes()); rtp != nil && pusher.shouldSequenceStart(rtp) {
-				pusher.gopCache = make([]*RTPPack, 0)
+			if pusher.gopCacheEnable {
+				if keyFrame {
+					pusher.gopCache = make([]*RTPPack, 0)
+				}
+				pusher.gopCache = append(pusher.gopCache, pack)
 			}
-			pusher.gopCache = append(pusher.gopCache, pack)
 			pusher.gopCacheLock.Unlock()
 		}
 		pusher.BroadcastRTP(pack)
@@ -320,22 +346,25 @@ func (pusher *Pusher) HasPlayer(player *Player) bool {
 
 func (pusher *Pusher) AddPlayer(player *Player) *Pusher {
 	logger := pusher.Logger()
-	if pusher.gopCacheEnable {
-		pusher.gopCacheLock.RLock()
-		for _, pack := range pusher.gopCache {
-			player.QueueRTP(pack)
-			pusher.AddOutputBytes(pack.Buffer.Len())
-		}
-		pusher.gopCacheLock.RUnlock()
+	pusher.gopCacheLock.RLock()
+	for _, pack := range pusher.gopCache {
+		player.QueueRTP(pack)
+		pusher.AddOutputBytes(pack.Buffer.Len())
 	}
+	pusher.gopCacheLock.RUnlock()
 
+	added := false
 	pusher.playersLock.Lock()
 	if _, ok := pusher.players[player.ID]; !ok {
 		pusher.players[player.ID] = player
 		go player.Start()
 		logger.Printf("%v start, now player size[%d]", player, len(pusher.players))
+		added = true
 	}
 	pusher.playersLock.Unlock()
+	if added {
+		pusher.Server().Emit(playerEvent(EVENT_PLAYER_ADD, player))
+	}
 	return pusher
 }
 
@@ -346,9 +375,17 @@ func (pusher *Pusher) RemovePlayer(player *Player) *Pusher {
 		pusher.playersLock.Unlock()
 		return pusher
 	}
+	_, removed := pusher.players[player.ID]
 	delete(pusher.players, player.ID)
+	if removed {
+		// under the lock, see Server.PlayerOutBytes.
+		pusher.Server().countPlayerOutBytes(pusher.Path(), player.OutBytes)
+	}
 	logger.Printf("%v end, now player size[%d]\n", player, len(pusher.players))
 	pusher.playersLock.Unlock()
+	if removed {
+		pusher.Server().Emit(playerEvent(EVENT_PLAYER_REMOVE, player))
+	}
 	return pusher
 }
 
@@ -359,11 +396,16 @@ func (pusher *Pusher) ClearPlayer() {
 	for k, v := range pusher.players {
 		//v.Stop()
 		players[k] = v
+		pusher.Server().countPlayerOutBytes(pusher.Path(), v.OutBytes)
 	}
 	pusher.players = make(map[string]*Player)
 	pusher.playersLock.Unlock()
+	for _, v := range players {
+		pusher.Server().Emit(playerEvent(EVENT_PLAYER_REMOVE, v))
+	}
 	go func() { // do not block
 		for _, v := range players {
+			v.PlayNotify("end-of-stream")
 			v.Stop()
 		}
 	}()
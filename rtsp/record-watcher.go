@@ -0,0 +1,100 @@
+package rtsp
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recordWatcher polls the m3u8 playlist written by ffmpeg and emits an
+// EVENT_RECORD_SEGMENT for every ts segment ffmpeg finishes.
+type recordWatcher struct {
+	server   *Server
+	pusher   *Pusher
+	m3u8Path string
+	interval time.Duration
+	seen     int
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+}
+
+func newRecordWatcher(server *Server, pusher *Pusher, m3u8Path string, interval time.Duration) *recordWatcher {
+	w := &recordWatcher{
+		server:   server,
+		pusher:   pusher,
+		m3u8Path: m3u8Path,
+		interval: interval,
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Stop waits for a final scan, call it after ffmpeg exited so the last
+// segment is reported too.
+func (w *recordWatcher) Stop() {
+	close(w.stopCh)
+	<-w.doneCh
+}
+
+func (w *recordWatcher) run() {
+	defer close(w.doneCh)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stopCh:
+			w.scan()
+			return
+		case <-ticker.C:
+			w.scan()
+		}
+	}
+}
+
+func (w *recordWatcher) scan() {
+	f, err := os.Open(w.m3u8Path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	dir := filepath.Dir(w.m3u8Path)
+	index := 0
+	duration := 0.0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#EXTINF:") {
+			val := strings.TrimPrefix(line, "#EXTINF:")
+			if i := strings.Index(val, ","); i >= 0 {
+				val = val[:i]
+			}
+			duration, _ = strconv.ParseFloat(val, 64)
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		index++
+		if index <= w.seen {
+			continue
+		}
+		w.seen = index
+		file := filepath.Join(dir, line)
+		size := int64(0)
+		if info, err := os.Stat(file); err == nil {
+			size = info.Size()
+		}
+		w.server.Emit(NewEvent(EVENT_RECORD_SEGMENT, w.pusher.Path(), w.pusher.ID(), map[string]interface{}{
+			"file":     file,
+			"playlist": w.m3u8Path,
+			"duration": duration,
+			"size":     size,
+			"sequence": index,
+		}))
+	}
+}
@@ -0,0 +1,179 @@
+package rtsp
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+)
+
+const (
+	// delete or refresh a key only while it still holds our node address.
+	redisUnregisterScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) end return 0`
+	redisRefreshScript    = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) end return 0`
+)
+
+type RedisRegistryOptions struct {
+	Addr      string
+	Password  string
+	DB        int
+	KeyPrefix string
+	TTL       int // seconds
+}
+
+// RedisRegistryEvent is published on the "<KeyPrefix>events" channel every
+// time a node claims or releases a path.
+type RedisRegistryEvent struct {
+	Action string `json:"action"` // "add" or "remove"
+	Path   string `json:"path"`
+	Node   string `json:"node"`
+}
+
+// RedisRegistry stores path -> node in redis keys that expire unless the
+// owning node keeps refreshing them, so a crashed node frees its paths.
+type RedisRegistry struct {
+	SessionLogger
+	RedisClient *redis.Client
+	node        string
+	keyPrefix   string
+	ttl         time.Duration
+	paths       map[string]bool
+	pathsLock   sync.Mutex
+	stopCh      chan struct{}
+}
+
+func NewRedisRegistry(node string, options RedisRegistryOptions) (*RedisRegistry, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     options.Addr,
+		Password: options.Password,
+		DB:       options.DB,
+	})
+	if err := client.Ping().Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	if options.TTL <= 0 {
+		options.TTL = 30
+	}
+	r := &RedisRegistry{
+		SessionLogger: SessionLogger{log.New(os.Stdout, "[RedisRegistry]", log.LstdFlags|log.Lshortfile)},
+		RedisClient:   client,
+		node:          node,
+		keyPrefix:     options.KeyPrefix,
+		ttl:           time.Duration(options.TTL) * time.Second,
+		paths:         make(map[string]bool),
+		stopCh:        make(chan struct{}),
+	}
+	if !utils.Debug {
+		r.logger.SetOutput(utils.GetLogWriter())
+	}
+	go r.keepalive()
+	return r, nil
+}
+
+func (r *RedisRegistry) Node() string {
+	return r.node
+}
+
+func (r *RedisRegistry) Register(path string) (owner string, err error) {
+	ok, err := r.RedisClient.SetNX(r.keyPrefix+path, r.node, r.ttl).Result()
+	if err != nil {
+		return
+	}
+	if !ok {
+		owner, err = r.RedisClient.Get(r.keyPrefix + path).Result()
+		if err == redis.Nil {
+			// expired between SETNX and GET, try once more.
+			return r.Register(path)
+		}
+		if err != nil || owner != r.node {
+			return
+		}
+	}
+	r.pathsLock.Lock()
+	r.paths[path] = true
+	r.pathsLock.Unlock()
+	r.publish("add", path)
+	return r.node, nil
+}
+
+func (r *RedisRegistry) Unregister(path string) error {
+	r.pathsLock.Lock()
+	delete(r.paths, path)
+	r.pathsLock.Unlock()
+	if err := r.RedisClient.Eval(redisUnregisterScript, []string{r.keyPrefix + path}, r.node).Err(); err != nil {
+		return err
+	}
+	r.publish("remove", path)
+	return nil
+}
+
+func (r *RedisRegistry) Lookup(path string) (string, error) {
+	owner, err := r.RedisClient.Get(r.keyPrefix + path).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return owner, err
+}
+
+func (r *RedisRegistry) Close() error {
+	close(r.stopCh)
+	r.pathsLock.Lock()
+	paths := make([]string, 0, len(r.paths))
+	for path := range r.paths {
+		paths = append(paths, path)
+	}
+	r.pathsLock.Unlock()
+	for _, path := range paths {
+		if err := r.Unregister(path); err != nil {
+			r.logger.Printf("unregister path[%s] err:%v", path, err)
+		}
+	}
+	return r.RedisClient.Close()
+}
+
+func (r *RedisRegistry) publish(action, path string) {
+	msg, _ := json.Marshal(RedisRegistryEvent{Action: action, Path: path, Node: r.node})
+	if err := r.RedisClient.Publish(r.keyPrefix+"events", string(msg)).Err(); err != nil {
+		r.logger.Printf("publish %s path[%s] err:%v", action, path, err)
+	}
+}
+
+func (r *RedisRegistry) keepalive() {
+	ticker := time.NewTicker(r.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case <-ticker.C:
+			r.pathsLock.Lock()
+			paths := make([]string, 0, len(r.paths))
+			for path := range r.paths {
+				paths = append(paths, path)
+			}
+			r.pathsLock.Unlock()
+			for _, path := range paths {
+				n, err := r.RedisClient.Eval(redisRefreshScript, []string{r.keyPrefix + path}, r.node, int64(r.ttl/time.Millisecond)).Int64()
+				if err != nil {
+					r.logger.Printf("refresh path[%s] err:%v", path, err)
+					continue
+				}
+				if n == 0 {
+					// the key expired, claim it again unless another node took it over.
+					if ok, _ := r.RedisClient.SetNX(r.keyPrefix+path, r.node, r.ttl).Result(); ok {
+						continue
+					}
+					r.logger.Printf("path[%s] lost, now owned by another node", path)
+					r.pathsLock.Lock()
+					delete(r.paths, path)
+					r.pathsLock.Unlock()
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package rtsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis serves the commands of RedisRegistry over RESP, keys expire as
+// in redis.
+type fakeRedis struct {
+	listener net.Listener
+	keys     map[string]fakeRedisKey
+	events   []RedisRegistryEvent
+	lock     sync.Mutex
+}
+
+type fakeRedisKey struct {
+	value   string
+	expires time.Time
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{listener: listener, keys: make(map[string]fakeRedisKey)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return r
+}
+
+func (r *fakeRedis) Addr() string {
+	return r.listener.Addr().String()
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for {
+		args, err := readRESP(br)
+		if err != nil {
+			return
+		}
+		r.lock.Lock()
+		reply := r.do(args)
+		r.lock.Unlock()
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func readRESP(br *bufio.Reader) ([]string, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("not an array: %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = br.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func (r *fakeRedis) get(key string) (string, bool) {
+	k, ok := r.keys[key]
+	if ok && !k.expires.IsZero() && time.Now().After(k.expires) {
+		delete(r.keys, key)
+		return "", false
+	}
+	return k.value, ok
+}
+
+func (r *fakeRedis) do(args []string) string {
+	switch strings.ToLower(args[0]) {
+	case "ping":
+		return "+PONG\r\n"
+	case "get":
+		if value, ok := r.get(args[1]); ok {
+			return bulk(value)
+		}
+		return "$-1\r\n"
+	case "set":
+		var ttl time.Duration
+		nx := false
+		for i := 3; i < len(args); i++ {
+			switch strings.ToLower(args[i]) {
+			case "nx":
+				nx = true
+			case "ex", "px":
+				n, _ := strconv.Atoi(args[i+1])
+				ttl = time.Duration(n) * time.Millisecond
+				if strings.ToLower(args[i]) == "ex" {
+					ttl = time.Duration(n) * time.Second
+				}
+				i++
+			}
+		}
+		if _, ok := r.get(args[1]); ok && nx {
+			return "$-1\r\n"
+		}
+		key := fakeRedisKey{value: args[2]}
+		if ttl > 0 {
+			key.expires = time.Now().Add(ttl)
+		}
+		r.keys[args[1]] = key
+		return "+OK\r\n"
+	case "eval":
+		// only the scripts of RedisRegistry, both guarded by the owner.
+		key, node := args[3], args[4]
+		if value, ok := r.get(key); !ok || value != node {
+			return ":0\r\n"
+		}
+		switch args[1] {
+		case redisUnregisterScript:
+			delete(r.keys, key)
+		case redisRefreshScript:
+			ms, _ := strconv.Atoi(args[5])
+			r.keys[key] = fakeRedisKey{value: node, expires: time.Now().Add(time.Duration(ms) * time.Millisecond)}
+		default:
+			return "-ERR unknown script\r\n"
+		}
+		return ":1\r\n"
+	case "publish":
+		var event RedisRegistryEvent
+		if err := json.Unmarshal([]byte(args[2]), &event); err != nil {
+			return "-ERR bad event\r\n"
+		}
+		r.events = append(r.events, event)
+		return ":0\r\n"
+	}
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+}
+
+// expire drops key as redis does when its ttl runs out.
+func (r *fakeRedis) expire(key string) {
+	r.lock.Lock()
+	delete(r.keys, key)
+	r.lock.Unlock()
+}
+
+func (r *fakeRedis) value(key string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	value, _ := r.get(key)
+	return value
+}
+
+func (r *fakeRedis) Events() []RedisRegistryEvent {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]RedisRegistryEvent(nil), r.events...)
+}
+
+func newTestRedisRegistry(t *testing.T, server *fakeRedis, node string, ttl int) *RedisRegistry {
+	r, err := NewRedisRegistry(node, RedisRegistryOptions{Addr: server.Addr(), KeyPrefix: "test:", TTL: ttl})
+	if err != nil {
+		t.Fatalf("NewRedisRegistry err: %v", err)
+	}
+	return r
+}
+
+func TestRedisRegistry(t *testing.T) {
+	server := newFakeRedis(t)
+	a := newTestRedisRegistry(t, server, "10.0.0.1:554", 30)
+	b := newTestRedisRegistry(t, server, "10.0.0.2:554", 30)
+	defer b.Close()
+
+	if owner, err := a.Register("/live/a"); err != nil || owner != a.Node() {
+		t.Fatalf("a.Register = %q, %v", owner, err)
+	}
+	// registering again keeps the path.
+	if owner, err := a.Register("/live/a"); err != nil || owner != a.Node() {
+		t.Errorf("a.Register again = %q, %v", owner, err)
+	}
+	if owner, err := b.Register("/live/a"); err != nil || owner != a.Node() {
+		t.Errorf("b.Register of a path of a = %q, %v", owner, err)
+	}
+	for _, r := range []*RedisRegistry{a, b} {
+		if owner, err := r.Lookup("/live/a"); err != nil || owner != a.Node() {
+			t.Errorf("Lookup = %q, %v", owner, err)
+		}
+		if owner, err := r.Lookup("/live/none"); err != nil || owner != "" {
+			t.Errorf("Lookup of no pusher = %q, %v", owner, err)
+		}
+	}
+
+	// only the owner releases a path.
+	if err := b.Unregister("/live/a"); err != nil {
+		t.Fatal(err)
+	}
+	if owner, _ := b.Lookup("/live/a"); owner != a.Node() {
+		t.Errorf("after b.Unregister, owner = %q", owner)
+	}
+	if err := a.Unregister("/live/a"); err != nil {
+		t.Fatal(err)
+	}
+	if owner, _ := b.Lookup("/live/a"); owner != "" {
+		t.Errorf("after a.Unregister, owner = %q", owner)
+	}
+	if owner, err := b.Register("/live/a"); err != nil || owner != b.Node() {
+		t.Errorf("b.Register of a path released = %q, %v", owner, err)
+	}
+
+	// closing releases the paths of the node.
+	if _, err := a.Register("/live/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if owner, _ := b.Lookup("/live/c"); owner != "" {
+		t.Errorf("after a.Close, owner = %q", owner)
+	}
+
+	want := []RedisRegistryEvent{
+		{"add", "/live/a", a.Node()},
+		{"add", "/live/a", a.Node()},
+		{"remove", "/live/a", b.Node()},
+		{"remove", "/live/a", a.Node()},
+		{"add", "/live/a", b.Node()},
+		{"add", "/live/c", a.Node()},
+		{"remove", "/live/c", a.Node()},
+	}
+	if events := server.Events(); fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Errorf("events = %v, want %v", events, want)
+	}
+}
+
+func TestRedisRegistryExpiry(t *testing.T) {
+	server := newFakeRedis(t)
+	a := newTestRedisRegistry(t, server, "10.0.0.1:554", 1)
+	b := newTestRedisRegistry(t, server, "10.0.0.2:554", 1)
+	defer b.Close()
+
+	if _, err := a.Register("/live/a"); err != nil {
+		t.Fatal(err)
+	}
+	// the keepalive refreshes the key past its ttl.
+	time.Sleep(1500 * time.Millisecond)
+	if owner, _ := b.Register("/live/a"); owner != a.Node() {
+		t.Fatalf("after the ttl, owner = %q, want the key refreshed", owner)
+	}
+
+	// a key expired between two refreshes is claimed again.
+	server.expire("test:/live/a")
+	time.Sleep(500 * time.Millisecond)
+	if value := server.value("test:/live/a"); value != a.Node() {
+		t.Fatalf("after the key expired, owner = %q, want it claimed again", value)
+	}
+
+	// a node that stops refreshing, as a crashed one, frees its paths.
+	close(a.stopCh)
+	a.RedisClient.Close()
+	time.Sleep(1200 * time.Millisecond)
+	if owner, _ := b.Lookup("/live/a"); owner != "" {
+		t.Errorf("after the node stopped, owner = %q", owner)
+	}
+	if owner, err := b.Register("/live/a"); err != nil || owner != b.Node() {
+		t.Errorf("b.Register after the node stopped = %q, %v", owner, err)
+	}
+}
+
+func TestRedisRegistryLost(t *testing.T) {
+	server := newFakeRedis(t)
+	a := newTestRedisRegistry(t, server, "10.0.0.1:554", 1)
+	defer a.Close()
+
+	if _, err := a.Register("/live/a"); err != nil {
+		t.Fatal(err)
+	}
+	// another node took the path over while the key was gone.
+	server.lock.Lock()
+	server.keys["test:/live/a"] = fakeRedisKey{value: "10.0.0.2:554"}
+	server.lock.Unlock()
+	time.Sleep(500 * time.Millisecond)
+	a.pathsLock.Lock()
+	kept := a.paths["/live/a"]
+	a.pathsLock.Unlock()
+	if kept {
+		t.Error("path lost to another node still refreshed")
+	}
+	if value := server.value("test:/live/a"); value != "10.0.0.2:554" {
+		t.Errorf("owner = %q", value)
+	}
+}
@@ -0,0 +1,70 @@
+package rtsp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+)
+
+// Registry records which node owns a pusher path, so several servers can
+// share one path namespace and route players to the right node.
+type Registry interface {
+	// Node returns the address other nodes and players use to reach this node.
+	Node() string
+	// Register claims path for this node and returns the current owner.
+	// The owner differs from Node() when another node already publishes path.
+	Register(path string) (owner string, err error)
+	// Unregister releases path if this node owns it.
+	Unregister(path string) error
+	// Lookup returns the node owning path, or "" if nobody publishes it.
+	Lookup(path string) (owner string, err error)
+	Close() error
+}
+
+// localRegistry is used by single node deployments, the server's own pusher
+// map is the only source of truth.
+type localRegistry struct {
+	node string
+}
+
+func (r *localRegistry) Node() string {
+	return r.node
+}
+
+func (r *localRegistry) Register(path string) (string, error) {
+	return r.node, nil
+}
+
+func (r *localRegistry) Unregister(path string) error {
+	return nil
+}
+
+func (r *localRegistry) Lookup(path string) (string, error) {
+	return "", nil
+}
+
+func (r *localRegistry) Close() error {
+	return nil
+}
+
+func NewRegistry(port int) (Registry, error) {
+	sec := utils.Conf().Section("cluster")
+	node := sec.Key("node_addr").MustString("")
+	if node == "" {
+		node = fmt.Sprintf("%s:%d", utils.LocalIP(), port)
+	}
+	switch strings.ToLower(sec.Key("registry").MustString("local")) {
+	case "redis":
+		return NewRedisRegistry(node, RedisRegistryOptions{
+			Addr:      sec.Key("redis_addr").MustString("127.0.0.1:6379"),
+			Password:  sec.Key("redis_password").MustString(""),
+			DB:        sec.Key("redis_db").MustInt(0),
+			KeyPrefix: sec.Key("redis_key_prefix").MustString("easydarwin:pusher:"),
+			TTL:       sec.Key("redis_ttl").MustInt(30),
+		})
+	case "", "local":
+		return &localRegistry{node: node}, nil
+	}
+	return nil, fmt.Errorf("unknown registry type[%s]", sec.Key("registry").String())
+}
@@ -15,6 +15,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pixelbender/go-sdp/sdp"
@@ -36,30 +37,22 @@ type RTSPClient struct {
 	Session              string
 	Seq                  int
 	connRW               *bufio.ReadWriter
+	connWLock            sync.Mutex
 	InBytes              int
 	OutBytes             int
 	TransType            TransType
 	StartAt              time.Time
 	Sdp                  *sdp.Session
-	AControl             string
-	VControl             string
-	ACodec               string
-	VCodec               string
+	Tracks               []*Track
 	OptionIntervalMillis int64
 	SDPRaw               string
 
-	debugLogEnable bool
-	lastRtpSN      uint16
+	lastRtpSN uint16
+	msgReader *MessageReader
 
 	Agent    string
 	authLine string
 
-	//tcp channels
-	aRTPChannel        int
-	aRTPControlChannel int
-	vRTPChannel        int
-	vRTPControlChannel int
-
 	UDPServer   *UDPServer
 	RTPHandles  []func(*RTPPack)
 	StopHandles []func()
@@ -74,7 +67,6 @@ func NewRTSPClient(server *Server, rawUrl string, sendOptionMillis int64, agent,
 	if err != nil {
 		return
 	}
-	debugLogEnable := utils.Conf().Section("rtsp").Key("debug_log_enable").MustInt(0)
 	client = &RTSPClient{
 		Server:               server,
 		Stoped:               false,
@@ -82,14 +74,9 @@ func NewRTSPClient(server *Server, rawUrl string, sendOptionMillis int64, agent,
 		ID:                   shortid.MustGenerate(),
 		Path:                 rUrl.Path,
 		TransType:            TRANS_TYPE_TCP,
-		vRTPChannel:          0,
-		vRTPControlChannel:   1,
-		aRTPChannel:          2,
-		aRTPControlChannel:   3,
 		OptionIntervalMillis: sendOptionMillis,
 		StartAt:              time.Now(),
 		Agent:                agent,
-		debugLogEnable:       debugLogEnable != 0,
 		CustomPath:           customPath,
 	}
 	client.logger = log.New(os.Stdout, fmt.Sprintf("[%s]", client.ID), log.LstdFlags|log.Lshortfile)
@@ -154,33 +141,18 @@ func BasicAuth(URL string) (string, error) {
 func (client *RTSPClient) checkAuth(method string, resp *Response) (string, error) {
 	if resp.StatusCode == 401 {
 
-		// need auth.
-		AuthHeaders := resp.Header["WWW-Authenticate"]
-		auths, ok := AuthHeaders.([]string)
-
-		if ok {
-			for _, authLine := range auths {
-
-				if strings.IndexAny(authLine, "Digest") == 0 {
-					// realm="HipcamRealServer",
-					// nonce="3b27a446bfa49b0c48c3edb83139543d"
-					client.authLine = authLine
-					return DigestAuth(authLine, method, client.URL)
-				} else if strings.IndexAny(authLine, "Basic") == 0 {
-					return BasicAuth(client.URL)
-				}
-
-			}
-			return "", fmt.Errorf("auth error")
-		} else {
-			authLine, _ := AuthHeaders.(string)
-			if strings.IndexAny(authLine, "Digest") == 0 {
+		// need auth, servers may offer several schemes.
+		for _, authLine := range resp.Header.Values("WWW-Authenticate") {
+			if strings.HasPrefix(authLine, "Digest") {
+				// realm="HipcamRealServer",
+				// nonce="3b27a446bfa49b0c48c3edb83139543d"
 				client.authLine = authLine
 				return DigestAuth(authLine, method, client.URL)
-			} else if strings.IndexAny(authLine, "Basic") == 0 {
+			} else if strings.HasPrefix(authLine, "Basic") {
 				return BasicAuth(client.URL)
 			}
 		}
+		return "", fmt.Errorf("auth error")
 	}
 	return "", nil
 }
@@ -223,6 +195,7 @@ func (client *RTSPClient) requestStream(timeout time.Duration) (err error) {
 	}
 	client.Conn = &timeoutConn
 	client.connRW = bufio.NewReadWriter(bufio.NewReaderSize(&timeoutConn, networkBuffer), bufio.NewWriterSize(&timeoutConn, networkBuffer))
+	client.msgReader = NewMessageReader(client.connRW.Reader)
 
 	headers := make(map[string]string)
 	headers["Require"] = "implicit-play"
@@ -251,22 +224,20 @@ func (client *RTSPClient) requestStream(timeout time.Duration) (err error) {
 	// In the typical case, there is one media stream each for audio and video.
 	headers = make(map[string]string)
 	headers["Accept"] = "application/sdp"
-	resp, err = client.Request("DESCRIBE", headers)
+	backchannel := utils.Conf().Section("rtsp").Key("pull_backchannel").MustBool(false)
+	if backchannel {
+		headers["Require"] = ONVIF_BACKCHANNEL
+	}
+	resp, err = client.describe(headers)
+	if err != nil && backchannel && resp != nil && resp.StatusCode >= 400 {
+		// the source has no backchannel, 551 by the spec, but sources
+		// answer any error to a Require they do not know.
+		backchannel = false
+		delete(headers, "Require")
+		resp, err = client.describe(headers)
+	}
 	if err != nil {
-		if resp != nil {
-			authorization, _ := client.checkAuth("DESCRIBE", resp)
-			if len(authorization) > 0 {
-				headers := make(map[string]string)
-				headers["Authorization"] = authorization
-				headers["Accept"] = "application/sdp"
-				resp, err = client.Request("DESCRIBE", headers)
-			}
-			if err != nil {
-				return err
-			}
-		} else {
-			return err
-		}
+		return err
 	}
 	_sdp, err := sdp.ParseString(resp.Body)
 	if err != nil {
@@ -274,79 +245,57 @@ func (client *RTSPClient) requestStream(timeout time.Duration) (err error) {
 	}
 	client.Sdp = _sdp
 	client.SDPRaw = resp.Body
+	client.Tracks = NewTracks(resp.Body)
+	for _, track := range client.Tracks {
+		// ONVIF marks the backchannel sendonly, it is sent by the client.
+		track.Backchannel = backchannel && track.Direction == "sendonly"
+	}
+	backchannel = hasBackchannel(client.Tracks)
 	session := ""
-	for _, media := range _sdp.Media {
-		switch media.Type {
-		case "video":
-			client.VControl = media.Attributes.Get("control")
-			client.VCodec = media.Format[0].Name
-			var _url = ""
-			if strings.Index(strings.ToLower(client.VControl), "rtsp://") == 0 {
-				_url = client.VControl
-			} else {
-				_url = strings.TrimRight(client.URL, "/") + "/" + strings.TrimLeft(client.VControl, "/")
-			}
-			headers = make(map[string]string)
-			if client.TransType == TRANS_TYPE_TCP {
-				headers["Transport"] = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", client.vRTPChannel, client.vRTPControlChannel)
-			} else {
-				if client.UDPServer == nil {
-					client.UDPServer = &UDPServer{RTSPClient: client}
-				}
-				//RTP/AVP;unicast;client_port=64864-64865
-				err = client.UDPServer.SetupVideo()
-				if err != nil {
-					client.logger.Printf("Setup video err.%v", err)
-					return err
-				}
-				headers["Transport"] = fmt.Sprintf("RTP/AVP/UDP;unicast;client_port=%d-%d", client.UDPServer.VPort, client.UDPServer.VControlPort)
-				client.Conn.timeout = 0 //	UDP ignore timeout
-			}
-			if session != "" {
-				headers["Session"] = session
-			}
-			client.logger.Printf("Parse DESCRIBE response, VIDEO VControl:%s, VCode:%s, url:%s,Session:%s,vRTPChannel:%d,vRTPControlChannel:%d", client.VControl, client.VCodec, _url, session, client.vRTPChannel, client.vRTPControlChannel)
-			resp, err = client.RequestWithPath("SETUP", _url, headers, true)
-			if err != nil {
-				return err
-			}
-			session, _ = resp.Header["Session"].(string)
-		case "audio":
-			client.AControl = media.Attributes.Get("control")
-			client.VCodec = media.Format[0].Name
-			var _url = ""
-			if strings.Index(strings.ToLower(client.AControl), "rtsp://") == 0 {
-				_url = client.AControl
-			} else {
-				_url = strings.TrimRight(client.URL, "/") + "/" + strings.TrimLeft(client.AControl, "/")
-			}
-			headers = make(map[string]string)
-			if client.TransType == TRANS_TYPE_TCP {
-				headers["Transport"] = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", client.aRTPChannel, client.aRTPControlChannel)
-			} else {
-				if client.UDPServer == nil {
-					client.UDPServer = &UDPServer{RTSPClient: client}
-				}
-				err = client.UDPServer.SetupAudio()
-				if err != nil {
-					client.logger.Printf("Setup audio err.%v", err)
-					return err
-				}
-				headers["Transport"] = fmt.Sprintf("RTP/AVP/UDP;unicast;client_port=%d-%d", client.UDPServer.APort, client.UDPServer.AControlPort)
-				client.Conn.timeout = 0 //	UDP ignore timeout
-			}
-			if session != "" {
-				headers["Session"] = session
+	for _, track := range client.Tracks {
+		if track.Control == "" {
+			client.logger.Printf("Parse DESCRIBE response, %v without control, skipped", track)
+			continue
+		}
+		_url := track.ControlURL(client.URL)
+		headers = make(map[string]string)
+		if backchannel {
+			headers["Require"] = ONVIF_BACKCHANNEL
+		}
+		var udpTrack *UDPTrack
+		if client.TransType == TRANS_TYPE_TCP {
+			track.RTPChannel, track.RTCPChannel = 2*track.Index, 2*track.Index+1
+			headers["Transport"] = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", track.RTPChannel, track.RTCPChannel)
+		} else {
+			if client.UDPServer == nil {
+				client.UDPServer = NewUDPServer(nil, client)
 			}
-			client.logger.Printf("Parse DESCRIBE response, AUDIO AControl:%s, ACodec:%s, url:%s,Session:%s, aRTPChannel:%d,aRTPControlChannel:%d", client.AControl, client.ACodec, _url, session, client.aRTPChannel, client.aRTPControlChannel)
-			resp, err = client.RequestWithPath("SETUP", _url, headers, true)
+			//RTP/AVP;unicast;client_port=64864-64865
+			udpTrack, err = client.UDPServer.SetupTrack(track)
 			if err != nil {
+				client.logger.Printf("Setup %s err.%v", track.AVType, err)
 				return err
 			}
-			session, _ = resp.Header["Session"].(string)
+			headers["Transport"] = fmt.Sprintf("RTP/AVP/UDP;unicast;client_port=%d-%d", udpTrack.Port, udpTrack.ControlPort)
+			client.Conn.timeout = 0 //	UDP ignore timeout
+		}
+		if session != "" {
+			headers["Session"] = session
+		}
+		client.logger.Printf("Parse DESCRIBE response, %v, control:%s, url:%s,Session:%s,RTPChannel:%d,RTCPChannel:%d", track, track.Control, _url, session, track.RTPChannel, track.RTCPChannel)
+		resp, err = client.RequestWithPath("SETUP", _url, headers, true)
+		if err != nil {
+			return err
+		}
+		session = resp.Header.Get("Session")
+		if udpTrack != nil && track.Backchannel {
+			client.setBackchannelRemote(udpTrack, resp.Header.Get("Transport"))
 		}
 	}
 	headers = make(map[string]string)
+	if backchannel {
+		headers["Require"] = ONVIF_BACKCHANNEL
+	}
 	if session != "" {
 		headers["Session"] = session
 	}
@@ -357,6 +306,36 @@ func (client *RTSPClient) requestStream(timeout time.Duration) (err error) {
 	return nil
 }
 
+// describe sends DESCRIBE, again with the credentials when it is
+// unauthorized.
+func (client *RTSPClient) describe(headers map[string]string) (resp *Response, err error) {
+	resp, err = client.Request("DESCRIBE", headers)
+	if err != nil && resp != nil {
+		authorization, _ := client.checkAuth("DESCRIBE", resp)
+		if len(authorization) > 0 {
+			headers["Authorization"] = authorization
+			resp, err = client.Request("DESCRIBE", headers)
+		}
+	}
+	return
+}
+
+// setBackchannelRemote sets where the backchannel of the udp track is sent,
+// the server ports of the SETUP response Transport ts.
+func (client *RTSPClient) setBackchannelRemote(t *UDPTrack, ts string) {
+	ports := ParseServerPorts(ts)
+	if ports == nil {
+		client.logger.Printf("SETUP %v got no server ports, %s", t.Track, ts)
+		return
+	}
+	host, _, _ := net.SplitHostPort(client.Conn.RemoteAddr().String())
+	ip := net.ParseIP(host)
+	t.RemoteAddr = &net.UDPAddr{IP: ip, Port: ports.RTPPort}
+	if ports.RTCPPort > 0 {
+		t.RemoteControlAddr = &net.UDPAddr{IP: ip, Port: ports.RTCPPort}
+	}
+}
+
 func (client *RTSPClient) startStream() {
 	startTime := time.Now()
 	loggerTime := time.Now().Add(-10 * time.Second)
@@ -409,38 +388,18 @@ func (client *RTSPClient) startStream() {
 			//ch <- append(header, content...)
 			rtpBuf := bytes.NewBuffer(content)
 
-			var pack *RTPPack
-			switch channel {
-			case client.aRTPChannel:
-				pack = &RTPPack{
-					Type:   RTP_TYPE_AUDIO,
-					Buffer: rtpBuf,
-				}
-			case client.aRTPControlChannel:
-				pack = &RTPPack{
-					Type:   RTP_TYPE_AUDIOCONTROL,
-					Buffer: rtpBuf,
-				}
-			case client.vRTPChannel:
-				pack = &RTPPack{
-					Type:   RTP_TYPE_VIDEO,
-					Buffer: rtpBuf,
-				}
-			case client.vRTPControlChannel:
-				pack = &RTPPack{
-					Type:   RTP_TYPE_VIDEOCONTROL,
-					Buffer: rtpBuf,
-				}
-			default:
+			track, control := trackOfChannel(client.Tracks, channel)
+			if track == nil {
 				client.logger.Printf("unknow rtp pack type, channel:%v", channel)
-			}
-
-			if pack == nil {
-				client.logger.Printf("session tcp got nil rtp pack")
 				continue
 			}
+			pack := &RTPPack{
+				Type:   track.RTPType(control),
+				Track:  track.Index,
+				Buffer: rtpBuf,
+			}
 
-			if client.debugLogEnable {
+			if debugLogEnabled() {
 				rtp := ParseRTP(pack.Buffer.Bytes())
 				if rtp != nil {
 					rtpSN := uint16(rtp.SequenceNumber)
@@ -463,49 +422,18 @@ func (client *RTSPClient) startStream() {
 			}
 
 		default: // rtsp
-
-			builder := bytes.Buffer{}
-			builder.WriteByte(b)
-			contentLen := 0
-			for !client.Stoped {
-				line, prefix, err := client.connRW.ReadLine()
-				if err != nil {
-					if !client.Stoped {
-						client.logger.Printf("client.connRW.ReadLine err:%v", err)
-					}
-					return
-				}
-				if len(line) == 0 {
-					if contentLen != 0 {
-						content := make([]byte, contentLen)
-						_, err = io.ReadFull(client.connRW, content)
-						if err != nil {
-							if !client.Stoped {
-								err = fmt.Errorf("Read content err.ContentLength:%d", contentLen)
-							}
-							return
-						}
-						builder.Write(content)
-					}
-					client.logger.Printf("<<<[IN]\n%s", builder.String())
-					break
-				}
-				s := string(line)
-				builder.Write(line)
-				if !prefix {
-					builder.WriteString("\r\n")
-				}
-
-				if strings.Index(s, "Content-Length:") == 0 {
-					splits := strings.Split(s, ":")
-					contentLen, err = strconv.Atoi(strings.TrimSpace(splits[1]))
-					if err != nil {
-						if !client.Stoped {
-							client.logger.Printf("strconv.Atoi err:%v, str:%v", err, splits[1])
-						}
-						return
-					}
+			client.connRW.UnreadByte()
+			req, res, err := client.msgReader.Read()
+			if err != nil {
+				if !client.Stoped {
+					client.logger.Printf("read rtsp message err:%v", err)
 				}
+				return
+			}
+			if req != nil {
+				client.logger.Printf("<<<[IN]\n%s", req)
+			} else {
+				client.logger.Printf("<<<[IN]\n%s", res)
 			}
 		}
 	}
@@ -535,9 +463,11 @@ func (client *RTSPClient) Stop() {
 		h()
 	}
 	if client.Conn != nil {
+		client.connWLock.Lock()
 		client.connRW.Flush()
 		client.Conn.Close()
 		client.Conn = nil
+		client.connWLock.Unlock()
 	}
 	if client.UDPServer != nil {
 		client.UDPServer.Stop()
@@ -560,114 +490,35 @@ func (client *RTSPClient) RequestWithPath(method string, path string, headers ma
 		headers["Session"] = client.Session
 	}
 	client.Seq++
-	cseq := client.Seq
-	builder := bytes.Buffer{}
-	builder.WriteString(fmt.Sprintf("%s %s RTSP/1.0\r\n", method, path))
-	builder.WriteString(fmt.Sprintf("CSeq: %d\r\n", cseq))
+	req := NewRequest(method, path, strconv.Itoa(client.Seq))
 	for k, v := range headers {
-		builder.WriteString(fmt.Sprintf("%s: %s\r\n", k, v))
+		req.Header.Set(k, v)
 	}
-	builder.WriteString(fmt.Sprintf("\r\n"))
-	s := builder.String()
+	s := req.String()
 	logger.Printf("[OUT]>>>\n%s", s)
+	client.connWLock.Lock()
 	_, err = client.connRW.WriteString(s)
+	if err == nil {
+		err = client.connRW.Flush()
+	}
+	client.connWLock.Unlock()
 	if err != nil {
 		return
 	}
-	client.connRW.Flush()
 
 	if !needResp {
 		return nil, nil
 	}
-	lineCount := 0
-	statusCode := 200
-	status := ""
-	sid := ""
-	contentLen := 0
-	respHeader := make(map[string]interface{})
-	var line []byte
-	builder.Reset()
-	for !client.Stoped {
-		isPrefix := false
-		if line, isPrefix, err = client.connRW.ReadLine(); err != nil {
-			return
-		}
-		s := string(line)
-
-		// 获取重定向地址
-		if strings.Contains(s, "Location: ") {
-			client.NewURL = strings.Replace(s, "Location: ", "", -1)
-		}
-
-		builder.Write(line)
-		if !isPrefix {
-			builder.WriteString("\r\n")
-		}
-		if len(line) == 0 {
-			body := ""
-			if contentLen > 0 {
-				content := make([]byte, contentLen)
-				_, err = io.ReadFull(client.connRW, content)
-				if err != nil {
-					err = fmt.Errorf("Read content err.ContentLength:%d", contentLen)
-					return
-				}
-				body = string(content)
-				builder.Write(content)
-			}
-			resp = NewResponse(statusCode, status, strconv.Itoa(cseq), sid, body)
-			resp.Header = respHeader
-			logger.Printf("<<<[IN]\n%s", builder.String())
-
-			if !(statusCode >= 200 && statusCode <= 300) {
-				err = fmt.Errorf("Response StatusCode is :%d", statusCode)
-				return
-			}
-			return
-		}
-		if lineCount == 0 {
-			splits := strings.Split(s, " ")
-			if len(splits) < 3 {
-				err = fmt.Errorf("StatusCode Line error:%s", s)
-				return
-			}
-			statusCode, err = strconv.Atoi(splits[1])
-			if err != nil {
-				return
-			}
-			status = splits[2]
-		}
-		lineCount++
-		splits := strings.Split(s, ":")
-		if len(splits) == 2 {
-			if val, ok := respHeader[splits[0]]; ok {
-				if slice, ok2 := val.([]string); ok2 {
-					slice = append(slice, strings.TrimSpace(splits[1]))
-					respHeader[splits[0]] = slice
-				} else {
-					str, _ := val.(string)
-					slice := []string{str, strings.TrimSpace(splits[1])}
-					respHeader[splits[0]] = slice
-				}
-			} else {
-				respHeader[splits[0]] = strings.TrimSpace(splits[1])
-			}
-		}
-		if strings.Index(s, "Session:") == 0 {
-			splits := strings.Split(s, ":")
-			sid = strings.TrimSpace(splits[1])
-		}
-		if strings.Index(s, "Content-Length:") == 0 {
-			splits := strings.Split(s, ":")
-			contentLen, err = strconv.Atoi(strings.TrimSpace(splits[1]))
-			if err != nil {
-				return
-			}
-		}
-
+	if resp, err = client.msgReader.ReadResponse(); err != nil {
+		return
 	}
-	if client.Stoped {
-		err = fmt.Errorf("Client Stoped.")
+	logger.Printf("<<<[IN]\n%s", resp)
+	// 获取重定向地址
+	if location := resp.Header.Get("Location"); location != "" {
+		client.NewURL = location
+	}
+	if !(resp.StatusCode >= 200 && resp.StatusCode <= 300) {
+		err = fmt.Errorf("Response StatusCode is :%d", resp.StatusCode)
 	}
 	return
 }
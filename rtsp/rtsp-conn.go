@@ -0,0 +1,303 @@
+package rtsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+	"github.com/teris-io/shortid"
+)
+
+// Connection is a RTSP control connection. It carries the requests of one or
+// more sessions, told apart by the Session header, and the interleaved rtp of
+// the tcp ones. A udp session outlives its connection until session_timeout,
+// the client resumes it on a new connection by its Session header.
+type Connection struct {
+	SessionLogger
+	ID        string
+	Server    *Server
+	Conn      *RichConn
+	connRW    *bufio.ReadWriter
+	connWLock sync.Mutex
+
+	sessions     []*Session // sessions bound to the connection
+	current      *Session   // session of the requests without Session header
+	sessionsLock sync.RWMutex
+
+	Stoped bool
+}
+
+func (conn *Connection) String() string {
+	return fmt.Sprintf("conn[%s][%s]", conn.ID, conn.Conn.RemoteAddr().String())
+}
+
+func NewConnection(server *Server, netConn net.Conn) *Connection {
+	networkBuffer := utils.Conf().Section("rtsp").Key("network_buffer").MustInt(204800)
+	timeoutMillis := utils.Conf().Section("rtsp").Key("timeout").MustInt(0)
+	timeoutTCPConn := &RichConn{netConn, time.Duration(timeoutMillis) * time.Millisecond}
+	conn := &Connection{
+		ID:       shortid.MustGenerate(),
+		Server:   server,
+		Conn:     timeoutTCPConn,
+		connRW:   bufio.NewReadWriter(bufio.NewReaderSize(timeoutTCPConn, networkBuffer), bufio.NewWriterSize(timeoutTCPConn, networkBuffer)),
+		sessions: make([]*Session, 0),
+	}
+	conn.logger = log.New(os.Stdout, fmt.Sprintf("[%s]", conn.ID), log.LstdFlags|log.Lshortfile)
+	if !utils.Debug {
+		conn.logger.SetOutput(utils.GetLogWriter())
+	}
+	// the session of the first requests, most clients use a single one.
+	conn.newSession()
+	return conn
+}
+
+func (conn *Connection) newSession() *Session {
+	session := NewSession(conn.Server, conn)
+	conn.Server.addSession(session)
+	conn.sessionsLock.Lock()
+	conn.sessions = append(conn.sessions, session)
+	conn.current = session
+	conn.sessionsLock.Unlock()
+	return session
+}
+
+// bind moves session to the connection, it was detached from its old one.
+func (conn *Connection) bind(session *Session) {
+	session.setConnection(conn)
+	conn.sessionsLock.Lock()
+	conn.sessions = append(conn.sessions, session)
+	conn.sessionsLock.Unlock()
+}
+
+// unbind removes session, the connection is closed when it has no session.
+func (conn *Connection) unbind(session *Session) {
+	conn.sessionsLock.Lock()
+	for i, s := range conn.sessions {
+		if s == session {
+			conn.sessions = append(conn.sessions[:i], conn.sessions[i+1:]...)
+			break
+		}
+	}
+	if conn.current == session {
+		conn.current = nil
+	}
+	empty := len(conn.sessions) == 0
+	conn.sessionsLock.Unlock()
+	if empty {
+		conn.Stop()
+	}
+}
+
+// Sessions returns the sessions bound to the connection.
+func (conn *Connection) Sessions() []*Session {
+	conn.sessionsLock.RLock()
+	defer conn.sessionsLock.RUnlock()
+	return append([]*Session{}, conn.sessions...)
+}
+
+// write writes b to the connection, a whole message or rtp frame at a time.
+func (conn *Connection) write(b []byte) (err error) {
+	conn.connWLock.Lock()
+	defer conn.connWLock.Unlock()
+	if conn.Stoped {
+		return fmt.Errorf("%v closed", conn)
+	}
+	if _, err = conn.connRW.Write(b); err != nil {
+		return
+	}
+	return conn.connRW.Flush()
+}
+
+// Stop closes the connection, the sessions bound to it are left to Start.
+func (conn *Connection) Stop() {
+	conn.connWLock.Lock()
+	defer conn.connWLock.Unlock()
+	if conn.Stoped {
+		return
+	}
+	conn.Stoped = true
+	conn.connRW.Flush()
+	conn.Conn.Close()
+}
+
+// detach is called when the connection is gone, the udp sessions set up are
+// kept for the client to resume them, the others are stopped.
+func (conn *Connection) detach() {
+	conn.Stop()
+	for _, session := range conn.Sessions() {
+		if session.TransType == TRANS_TYPE_UDP && session.established && session.SessionTimeout > 0 {
+			session.setConnection(nil)
+			conn.logger.Printf("%v detached, resumable in %v", session, session.SessionTimeout)
+			continue
+		}
+		session.Stop()
+	}
+	conn.sessionsLock.Lock()
+	conn.sessions = nil
+	conn.current = nil
+	conn.sessionsLock.Unlock()
+}
+
+func (conn *Connection) Start() {
+	defer conn.detach()
+
+	buf1 := make([]byte, 1)
+	buf2 := make([]byte, 2)
+	logger := conn.logger
+	timer := time.Unix(0, 0)
+	reader := NewMessageReader(conn.connRW.Reader)
+
+	for !conn.Stoped {
+		b, err := conn.connRW.ReadByte()
+		if err != nil {
+			logger.Println(conn, err)
+			return
+		}
+		if b == 0x24 { //rtp data
+			if _, err := io.ReadFull(conn.connRW, buf1); err != nil {
+				logger.Println(err)
+				return
+			}
+			if _, err := io.ReadFull(conn.connRW, buf2); err != nil {
+				logger.Println(err)
+				return
+			}
+
+			channel := int(buf1[0])
+			rtpLen := int(binary.BigEndian.Uint16(buf2))
+			rtpBytes := make([]byte, rtpLen)
+			if _, err := io.ReadFull(conn.connRW, rtpBytes); err != nil {
+				logger.Println(err)
+				return
+			}
+
+			session, track, rtpType := conn.channelSession(channel)
+			if session == nil {
+				logger.Printf("unknow rtp pack type, %v", channel)
+				continue
+			}
+			if rtpType == RTP_TYPE_AUDIO || rtpType == RTP_TYPE_VIDEO {
+				elapsed := time.Now().Sub(timer)
+				if elapsed >= 30*time.Second {
+					logger.Printf("Recv an %v RTP package", rtpType)
+					timer = time.Now()
+				}
+			}
+			pack := &RTPPack{
+				Type:   rtpType,
+				Track:  track.Index,
+				Buffer: bytes.NewBuffer(rtpBytes),
+			}
+			session.InBytes += rtpLen + 4
+			session.touch()
+			for _, h := range session.RTPHandles {
+				h(pack)
+			}
+
+		} else { // rtsp cmd
+			conn.connRW.UnreadByte()
+			req, res, err := reader.Read()
+			if err != nil {
+				logger.Println(err)
+				return
+			}
+			if res != nil {
+				// the client answers a request of the server, e.g. PLAY_NOTIFY.
+				continue
+			}
+			session := conn.requestSession(req)
+			if session == nil {
+				conn.sessionNotFound(req)
+				continue
+			}
+			session.InBytes += reader.Size()
+			session.handleRequest(conn, req)
+		}
+	}
+}
+
+// channelSession returns the tcp session and track of an interleaved
+// channel, and the type of its packs.
+func (conn *Connection) channelSession(channel int) (*Session, *Track, RTPType) {
+	conn.sessionsLock.RLock()
+	defer conn.sessionsLock.RUnlock()
+	for _, session := range conn.sessions {
+		if session.TransType != TRANS_TYPE_TCP {
+			continue
+		}
+		if track, control := trackOfChannel(session.Tracks, channel); track != nil {
+			return session, track, track.RTPType(control)
+		}
+	}
+	return nil, nil, 0
+}
+
+// requestSession returns the session a request is for, nil if its Session
+// header is unknown. Without Session header it is the current session, or
+// a new one when the current one is set up already and the request starts
+// another stream by DESCRIBE or ANNOUNCE. Lenient clients send the SETUP of
+// the next tracks without Session header, to the current session too.
+func (conn *Connection) requestSession(req *Request) *Session {
+	id := strings.TrimSpace(strings.Split(req.Header.Get("Session"), ";")[0])
+	if id == "" {
+		conn.sessionsLock.RLock()
+		session := conn.current
+		conn.sessionsLock.RUnlock()
+		switch {
+		case session == nil:
+			session = conn.newSession()
+		case session.established && (req.Method == DESCRIBE || req.Method == ANNOUNCE):
+			session = conn.newSession()
+		}
+		return session
+	}
+	session := conn.Server.GetSession(id)
+	if session == nil || session.Stoped() {
+		return nil
+	}
+	bound := session.Connection()
+	if bound == conn {
+		return session
+	}
+	// only the client of the session controls it from another connection.
+	host, _, _ := net.SplitHostPort(conn.Conn.RemoteAddr().String())
+	if host != session.RemoteHost() {
+		conn.logger.Printf("%v rejected, %v is of %s", conn, session, session.RemoteHost())
+		return nil
+	}
+	if bound == nil {
+		conn.logger.Printf("%v resumed", session)
+		conn.bind(session)
+	}
+	conn.sessionsLock.Lock()
+	pristine := conn.current
+	conn.current = session
+	conn.sessionsLock.Unlock()
+	if pristine != nil && pristine != session && pristine.pristine() {
+		// replaced by the resumed session.
+		pristine.Stop()
+	}
+	return session
+}
+
+func (conn *Connection) sessionNotFound(req *Request) {
+	res := NewResponse(454, "Session Not Found", req.Header.Get("CSeq"), "", "")
+	if IsSupportedVersion(req.Version) {
+		res.Version = req.Version
+	}
+	conn.logger.Printf("<<<\n%s", req)
+	conn.logger.Printf(">>>\n%s", res)
+	if err := conn.write([]byte(res.String())); err != nil {
+		conn.logger.Println(err)
+	}
+	conn.Server.countRequest(req.Method, res.StatusCode)
+}
@@ -0,0 +1,218 @@
+package rtsp
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConnSDP = "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=test\r\nt=0 0\r\n" +
+	"m=video 0 RTP/AVP 96\r\na=rtpmap:96 H264/90000\r\na=control:trackID=0\r\n" +
+	"m=audio 0 RTP/AVP 97\r\na=rtpmap:97 PCMA/8000\r\na=control:trackID=1\r\n"
+
+// newTestServer starts a server on a free port, it is stopped once the
+// pushers are gone as the clients close.
+func newTestServer(t *testing.T) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	server := &Server{
+		SessionLogger:  SessionLogger{log.New(ioutil.Discard, "", 0)},
+		Stoped:         true,
+		TCPPort:        port,
+		pushers:        make(map[string]*Pusher),
+		sessions:       make(map[string]*Session),
+		addPusherCh:    make(chan *Pusher),
+		removePusherCh: make(chan *Pusher),
+	}
+	go server.Start()
+	t.Cleanup(func() {
+		waitFor(t, "pushers removed", func() bool { return len(server.GetPushers()) == 0 })
+		server.Stop()
+	})
+	waitFor(t, "server started", func() bool {
+		conn, err := net.Dial("tcp", server.addr())
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	})
+	return server
+}
+
+func (server *Server) addr() string {
+	return fmt.Sprintf("127.0.0.1:%d", server.TCPPort)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for i := 0; !cond(); i++ {
+		if i == 200 {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *MessageReader
+	cseq   int
+}
+
+// dialTestClient connects to server from the local ip, 127.0.0.x.
+func dialTestClient(t *testing.T, server *Server, ip string) *testClient {
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+	conn, err := dialer.Dial("tcp", server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, reader: NewMessageReader(bufio.NewReader(conn))}
+}
+
+// do sends a request with the Session header if session is set, header are
+// pairs of name and value.
+func (c *testClient) do(method, url, session string, header ...string) *Response {
+	c.t.Helper()
+	c.cseq++
+	req := NewRequest(method, url, strconv.Itoa(c.cseq))
+	if session != "" {
+		req.Header.Set("Session", session)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	if method == ANNOUNCE {
+		req.Header.Set("Content-Type", "application/sdp")
+		req.SetBody(testConnSDP)
+	}
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := req.Write(c.conn); err != nil {
+		c.t.Fatalf("%s %s: %v", method, url, err)
+	}
+	res, err := c.reader.ReadResponse()
+	if err != nil {
+		c.t.Fatalf("%s %s: %v", method, url, err)
+	}
+	return res
+}
+
+// expect sends a request and checks the status of the response, it returns
+// the session id of the response.
+func (c *testClient) expect(status int, method, url, session string, header ...string) string {
+	c.t.Helper()
+	res := c.do(method, url, session, header...)
+	if res.StatusCode != status {
+		c.t.Fatalf("%s %s: %d %s, want %d", method, url, res.StatusCode, res.Status, status)
+	}
+	return strings.TrimSpace(strings.Split(res.Header.Get("Session"), ";")[0])
+}
+
+// publish pushes testConnSDP to path over tcp.
+func (c *testClient) publish(url string) string {
+	c.t.Helper()
+	c.expect(200, ANNOUNCE, url, "")
+	id := c.expect(200, SETUP, url+"/trackID=0", "", "Transport", "RTP/AVP/TCP;unicast;interleaved=0-1;mode=record")
+	c.expect(200, SETUP, url+"/trackID=1", id, "Transport", "RTP/AVP/TCP;unicast;interleaved=2-3;mode=record")
+	c.expect(200, RECORD, url, id)
+	return id
+}
+
+func TestConnectionSessions(t *testing.T) {
+	server := newTestServer(t)
+	url := "rtsp://" + server.addr() + "/live/a"
+	c := dialTestClient(t, server, "127.0.0.1")
+
+	c.expect(200, ANNOUNCE, url, "")
+	pusher := c.expect(200, SETUP, url+"/trackID=0", "", "Transport", "RTP/AVP/TCP;unicast;interleaved=0-1;mode=record")
+	// a lenient client leaves out the Session header of the next tracks.
+	if id := c.expect(200, SETUP, url+"/trackID=1", "", "Transport", "RTP/AVP/TCP;unicast;interleaved=2-3;mode=record"); id != pusher {
+		t.Fatalf("SETUP without Session header got session %s, want %s", id, pusher)
+	}
+	c.expect(200, RECORD, url, pusher)
+
+	// another stream on the same connection.
+	c.expect(200, DESCRIBE, url, "")
+	player := c.expect(200, SETUP, url+"/trackID=0", "", "Transport", "RTP/AVP/TCP;unicast;interleaved=4-5")
+	if player == pusher {
+		t.Fatalf("DESCRIBE of a set up session got the same session %s", player)
+	}
+	c.expect(200, PLAY, url, player)
+	if p := server.GetPusher("/live/a"); p == nil || len(p.GetPlayers()) != 1 {
+		t.Fatalf("pusher %v, want a player", p)
+	}
+	// told apart by the Session header.
+	if id := c.expect(200, GET_PARAMETER, url, pusher); id != pusher {
+		t.Errorf("GET_PARAMETER of %s answered by %s", pusher, id)
+	}
+	if id := c.expect(200, GET_PARAMETER, url, player); id != player {
+		t.Errorf("GET_PARAMETER of %s answered by %s", player, id)
+	}
+
+	// the connection outlives a session, and closes with the last one.
+	c.expect(200, TEARDOWN, url, player)
+	c.expect(200, GET_PARAMETER, url, pusher)
+	c.expect(200, TEARDOWN, url, pusher)
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if req, res, err := c.reader.Read(); err == nil {
+		t.Errorf("connection open after its last session, read %v %v", req, res)
+	}
+}
+
+func TestConnectionResume(t *testing.T) {
+	server := newTestServer(t)
+	url := "rtsp://" + server.addr() + "/live/a"
+	dialTestClient(t, server, "127.0.0.1").publish(url)
+
+	rtp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rtp.Close()
+	port := rtp.LocalAddr().(*net.UDPAddr).Port
+	a := dialTestClient(t, server, "127.0.0.1")
+	a.expect(200, DESCRIBE, url, "")
+	id := a.expect(200, SETUP, url+"/trackID=0", "", "Transport", fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d", port, port+1))
+	a.expect(200, PLAY, url, id)
+	a.conn.Close()
+	waitFor(t, "session detached", func() bool {
+		session := server.GetSession(id)
+		return session != nil && session.Connection() == nil
+	})
+
+	// only the host of the session resumes it.
+	other := dialTestClient(t, server, "127.0.0.2")
+	other.expect(454, GET_PARAMETER, url, id)
+	if session := server.GetSession(id); session == nil || session.Connection() != nil {
+		t.Fatalf("session %v taken by another host", session)
+	}
+
+	b := dialTestClient(t, server, "127.0.0.1")
+	b.expect(200, GET_PARAMETER, url, id)
+	session := server.GetSession(id)
+	if session == nil || session.Connection() == nil || session.RemoteAddr() != b.conn.LocalAddr().String() {
+		t.Fatalf("session %v not resumed by %v", session, b.conn.LocalAddr())
+	}
+	// the pristine session of the new connection is replaced by the resumed
+	// one, the connection stays open.
+	for _, s := range server.GetSessions() {
+		if s != session && s.RemoteAddr() == b.conn.LocalAddr().String() {
+			t.Errorf("pristine %v kept", s)
+		}
+	}
+	b.expect(200, GET_PARAMETER, url, id)
+	if p := server.GetPusher("/live/a"); p == nil || !p.HasPlayer(session.Player) {
+		t.Errorf("resumed player not playing")
+	}
+}
@@ -0,0 +1,254 @@
+package rtsp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Limits of the messages read by MessageReader.
+const (
+	MaxMessageLineLength = 8192
+	MaxMessageHeaders    = 128
+	MaxMessageBodySize   = 1 << 20
+)
+
+var (
+	ErrMessageLineTooLong    = errors.New("rtsp message line too long")
+	ErrMessageTooManyHeaders = errors.New("rtsp message has too many headers")
+	ErrMessageBodyTooLarge   = errors.New("rtsp message body too large")
+)
+
+// headerKeys are the keys textproto.CanonicalMIMEHeaderKey gets wrong.
+var headerKeys = map[string]string{
+	"Cseq":             "CSeq",
+	"Www-Authenticate": "WWW-Authenticate",
+	"Rtp-Info":         "RTP-Info",
+	"Rtcp-Interval":    "RTCP-Interval",
+}
+
+// CanonicalHeaderKey returns the canonical form of a header key, e.g.
+// cseq is CSeq and content-length is Content-Length.
+func CanonicalHeaderKey(key string) string {
+	key = textproto.CanonicalMIMEHeaderKey(key)
+	if k, ok := headerKeys[key]; ok {
+		return k
+	}
+	return key
+}
+
+// Header is the header of a RTSP message, keys are canonical and a key
+// may have several values.
+type Header map[string][]string
+
+// Get returns the first value of key, empty if there is none.
+func (h Header) Get(key string) string {
+	if values := h[CanonicalHeaderKey(key)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Values returns all the values of key.
+func (h Header) Values(key string) []string {
+	return h[CanonicalHeaderKey(key)]
+}
+
+// Set replaces the values of key.
+func (h Header) Set(key, value string) {
+	h[CanonicalHeaderKey(key)] = []string{value}
+}
+
+// Add appends a value to key.
+func (h Header) Add(key, value string) {
+	key = CanonicalHeaderKey(key)
+	h[key] = append(h[key], value)
+}
+
+func (h Header) Del(key string) {
+	delete(h, CanonicalHeaderKey(key))
+}
+
+// ContentLength returns -1 if Content-Length is invalid.
+func (h Header) ContentLength() int {
+	v := h.Get("Content-Length")
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// Write writes the header lines, CSeq first and the others sorted, and the
+// empty line ending the header.
+func (h Header) Write(w io.Writer) error {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		if key != "CSeq" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if _, ok := h["CSeq"]; ok {
+		keys = append([]string{"CSeq"}, keys...)
+	}
+	for _, key := range keys {
+		for _, value := range h[key] {
+			// no header injection.
+			value = strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+			if _, err := fmt.Fprintf(w, "%s: %s\r\n", key, value); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// MessageReader reads RTSP requests and responses from a stream which may
+// also carry interleaved rtp frames, the caller reads those itself.
+type MessageReader struct {
+	r    *bufio.Reader
+	size int
+}
+
+func NewMessageReader(r *bufio.Reader) *MessageReader {
+	return &MessageReader{r: r}
+}
+
+// Size returns the bytes of the last message read.
+func (mr *MessageReader) Size() int {
+	return mr.size
+}
+
+func (mr *MessageReader) readLine() (string, error) {
+	var line []byte
+	for {
+		frag, err := mr.r.ReadSlice('\n')
+		if len(line)+len(frag) > MaxMessageLineLength {
+			return "", ErrMessageLineTooLong
+		}
+		line = append(line, frag...)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return "", err
+		}
+	}
+	mr.size += len(line)
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// Read reads the next message, exactly one of req and res is not nil when
+// err is nil. Empty lines between messages are skipped.
+func (mr *MessageReader) Read() (req *Request, res *Response, err error) {
+	mr.size = 0
+	line := ""
+	for line == "" {
+		if line, err = mr.readLine(); err != nil {
+			return
+		}
+	}
+	header, err := mr.readHeader()
+	if err != nil {
+		return
+	}
+	body, err := mr.readBody(header)
+	if err != nil {
+		return
+	}
+	if strings.HasPrefix(line, "RTSP/") {
+		// Status-Line = RTSP-Version SP Status-Code SP Reason-Phrase
+		items := strings.SplitN(line, " ", 3)
+		if len(items) < 2 {
+			return nil, nil, fmt.Errorf("invalid rtsp status line: %q", line)
+		}
+		code, err := strconv.Atoi(items[1])
+		if err != nil || code < 100 || code > 999 {
+			return nil, nil, fmt.Errorf("invalid rtsp status code: %q", line)
+		}
+		res = &Response{Version: items[0], StatusCode: code, Header: header, Body: body}
+		if len(items) == 3 {
+			res.Status = items[2]
+		}
+		return nil, res, nil
+	}
+	// Request-Line = Method SP Request-URI SP RTSP-Version
+	items := strings.Fields(line)
+	if len(items) != 3 || !strings.HasPrefix(items[2], "RTSP/") {
+		return nil, nil, fmt.Errorf("invalid rtsp request line: %q", line)
+	}
+	req = &Request{Method: items[0], URL: items[1], Version: items[2], Header: header, Body: body}
+	return req, nil, nil
+}
+
+// ReadResponse reads the next message, which must be a response.
+func (mr *MessageReader) ReadResponse() (*Response, error) {
+	req, res, err := mr.Read()
+	if err != nil {
+		return nil, err
+	}
+	if req != nil {
+		return nil, fmt.Errorf("unexpected rtsp request %s %s", req.Method, req.URL)
+	}
+	return res, nil
+}
+
+func (mr *MessageReader) readHeader() (Header, error) {
+	header := make(Header)
+	lastKey := ""
+	for count := 0; ; count++ {
+		line, err := mr.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			return header, nil
+		}
+		if count >= MaxMessageHeaders {
+			return nil, ErrMessageTooManyHeaders
+		}
+		if (line[0] == ' ' || line[0] == '\t') && lastKey != "" {
+			// folded value of the last header, RFC 2326 4.2.
+			values := header[lastKey]
+			values[len(values)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		items := strings.SplitN(line, ":", 2)
+		key := strings.TrimSpace(items[0])
+		if len(items) < 2 || key == "" || strings.ContainsAny(key, " \t") {
+			// tolerated, some devices send junk lines.
+			continue
+		}
+		lastKey = CanonicalHeaderKey(key)
+		header.Add(lastKey, strings.TrimSpace(items[1]))
+	}
+}
+
+func (mr *MessageReader) readBody(header Header) (string, error) {
+	n := header.ContentLength()
+	if n < 0 {
+		return "", fmt.Errorf("invalid Content-Length: %q", header.Get("Content-Length"))
+	}
+	if n > MaxMessageBodySize {
+		return "", ErrMessageBodyTooLarge
+	}
+	if n == 0 {
+		return "", nil
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(mr.r, body); err != nil {
+		return "", err
+	}
+	mr.size += n
+	return string(body), nil
+}
@@ -0,0 +1,282 @@
+package rtsp
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalHeaderKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"cseq", "CSeq"},
+		{"CSEQ", "CSeq"},
+		{"content-length", "Content-Length"},
+		{"www-authenticate", "WWW-Authenticate"},
+		{"rtp-info", "RTP-Info"},
+		{"RTCP-INTERVAL", "RTCP-Interval"},
+		{"session", "Session"},
+	}
+	for _, tt := range tests {
+		if got := CanonicalHeaderKey(tt.key); got != tt.want {
+			t.Errorf("CanonicalHeaderKey(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestHeader(t *testing.T) {
+	h := make(Header)
+	h.Add("transport", "a")
+	h.Add("Transport", "b")
+	if got := h.Get("TRANSPORT"); got != "a" {
+		t.Errorf("Get = %q, want the first value", got)
+	}
+	if got := h.Values("transport"); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("Values = %q", got)
+	}
+	h.Set("transport", "c")
+	if got := h.Values("Transport"); !reflect.DeepEqual(got, []string{"c"}) {
+		t.Errorf("Values after Set = %q", got)
+	}
+	h.Del("TRANSPORT")
+	if got := h.Get("transport"); got != "" {
+		t.Errorf("Get after Del = %q", got)
+	}
+
+	var b strings.Builder
+	h = Header{"Session": {"1\r\nInjected: x"}, "CSeq": {"2"}, "Accept": {"application/sdp"}}
+	if err := h.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	if want := "CSeq: 2\r\nAccept: application/sdp\r\nSession: 1  Injected: x\r\n\r\n"; b.String() != want {
+		t.Errorf("Write = %q, want %q", b.String(), want)
+	}
+}
+
+func TestMessageReaderRead(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		req  *Request
+		res  *Response
+	}{
+		{
+			name: "request",
+			raw:  "OPTIONS rtsp://example.com/live RTSP/1.0\r\nCSeq: 1\r\nUser-Agent: test\r\n\r\n",
+			req: &Request{Method: "OPTIONS", URL: "rtsp://example.com/live", Version: "RTSP/1.0",
+				Header: Header{"CSeq": {"1"}, "User-Agent": {"test"}}},
+		},
+		{
+			name: "request with body",
+			raw:  "ANNOUNCE rtsp://example.com/live RTSP/1.0\r\nCSeq: 2\r\nContent-Length: 4\r\n\r\nv=0\nrest",
+			req: &Request{Method: "ANNOUNCE", URL: "rtsp://example.com/live", Version: "RTSP/1.0",
+				Header: Header{"CSeq": {"2"}, "Content-Length": {"4"}}, Body: "v=0\n"},
+		},
+		{
+			name: "empty lines before the message",
+			raw:  "\r\n\r\nPLAY rtsp://example.com/live RTSP/2.0\r\ncseq: 3\r\n\r\n",
+			req: &Request{Method: "PLAY", URL: "rtsp://example.com/live", Version: "RTSP/2.0",
+				Header: Header{"CSeq": {"3"}}},
+		},
+		{
+			name: "case-insensitive and repeated keys",
+			raw:  "SETUP rtsp://example.com/live RTSP/1.0\r\nCSEQ: 4\r\ntransport: RTP/AVP;unicast\r\nTRANSPORT: RTP/AVP/TCP\r\n\r\n",
+			req: &Request{Method: "SETUP", URL: "rtsp://example.com/live", Version: "RTSP/1.0",
+				Header: Header{"CSeq": {"4"}, "Transport": {"RTP/AVP;unicast", "RTP/AVP/TCP"}}},
+		},
+		{
+			name: "folded header",
+			raw:  "SETUP rtsp://example.com/live RTSP/1.0\r\nCSeq: 5\r\nTransport: RTP/AVP;\r\n  unicast;\r\n\tclient_port=1-2\r\n\r\n",
+			req: &Request{Method: "SETUP", URL: "rtsp://example.com/live", Version: "RTSP/1.0",
+				Header: Header{"CSeq": {"5"}, "Transport": {"RTP/AVP; unicast; client_port=1-2"}}},
+		},
+		{
+			name: "junk header lines are skipped",
+			raw:  "OPTIONS * RTSP/1.0\r\nCSeq: 6\r\nno colon\r\n: no key\r\nbad key: x\r\n\r\n",
+			req: &Request{Method: "OPTIONS", URL: "*", Version: "RTSP/1.0",
+				Header: Header{"CSeq": {"6"}}},
+		},
+		{
+			name: "lf line endings",
+			raw:  "OPTIONS * RTSP/1.0\nCSeq: 7\n\n",
+			req: &Request{Method: "OPTIONS", URL: "*", Version: "RTSP/1.0",
+				Header: Header{"CSeq": {"7"}}},
+		},
+		{
+			name: "response",
+			raw:  "RTSP/1.0 200 OK\r\nCSeq: 1\r\nPublic: OPTIONS, DESCRIBE\r\n\r\n",
+			res: &Response{Version: "RTSP/1.0", StatusCode: 200, Status: "OK",
+				Header: Header{"CSeq": {"1"}, "Public": {"OPTIONS, DESCRIBE"}}},
+		},
+		{
+			name: "response reason with spaces",
+			raw:  "RTSP/1.0 454 Session Not Found\r\nCSeq: 2\r\n\r\n",
+			res: &Response{Version: "RTSP/1.0", StatusCode: 454, Status: "Session Not Found",
+				Header: Header{"CSeq": {"2"}}},
+		},
+		{
+			name: "response without reason",
+			raw:  "RTSP/1.0 401\r\nWWW-Authenticate: Digest realm=\"x\"\r\nwww-authenticate: Basic realm=\"x\"\r\n\r\n",
+			res: &Response{Version: "RTSP/1.0", StatusCode: 401,
+				Header: Header{"WWW-Authenticate": {`Digest realm="x"`, `Basic realm="x"`}}},
+		},
+		{
+			name: "response with body",
+			raw:  "RTSP/1.0 200 OK\r\nCSeq: 3\r\nContent-Length: 5\r\n\r\nv=0\r\n",
+			res: &Response{Version: "RTSP/1.0", StatusCode: 200, Status: "OK",
+				Header: Header{"CSeq": {"3"}, "Content-Length": {"5"}}, Body: "v=0\r\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := NewMessageReader(bufio.NewReader(strings.NewReader(tt.raw)))
+			req, res, err := mr.Read()
+			if err != nil {
+				t.Fatalf("Read err: %v", err)
+			}
+			if !reflect.DeepEqual(req, tt.req) {
+				t.Errorf("req = %+v, want %+v", req, tt.req)
+			}
+			if !reflect.DeepEqual(res, tt.res) {
+				t.Errorf("res = %+v, want %+v", res, tt.res)
+			}
+		})
+	}
+}
+
+func TestMessageReaderReadErrors(t *testing.T) {
+	manyHeaders := strings.Repeat("X-Header: x\r\n", MaxMessageHeaders+1)
+	tests := []struct {
+		name string
+		raw  string
+		err  error  // if not nil, the error expected
+		msg  string // otherwise a part of the error message
+	}{
+		{name: "eof", raw: "", msg: "EOF"},
+		{name: "truncated header", raw: "OPTIONS * RTSP/1.0\r\nCSeq: 1\r\n", msg: "EOF"},
+		{name: "truncated body", raw: "ANNOUNCE * RTSP/1.0\r\nContent-Length: 10\r\n\r\nv=0", msg: "EOF"},
+		{name: "request line too long", raw: "OPTIONS " + strings.Repeat("a", MaxMessageLineLength) + " RTSP/1.0\r\n\r\n", err: ErrMessageLineTooLong},
+		{name: "header line too long", raw: "OPTIONS * RTSP/1.0\r\nX: " + strings.Repeat("a", MaxMessageLineLength) + "\r\n\r\n", err: ErrMessageLineTooLong},
+		{name: "too many headers", raw: "OPTIONS * RTSP/1.0\r\n" + manyHeaders + "\r\n", err: ErrMessageTooManyHeaders},
+		{name: "body too large", raw: "ANNOUNCE * RTSP/1.0\r\nContent-Length: 1048577\r\n\r\n", err: ErrMessageBodyTooLarge},
+		{name: "negative content length", raw: "ANNOUNCE * RTSP/1.0\r\nContent-Length: -1\r\n\r\n", msg: "invalid Content-Length"},
+		{name: "invalid content length", raw: "ANNOUNCE * RTSP/1.0\r\nContent-Length: ten\r\n\r\n", msg: "invalid Content-Length"},
+		{name: "request line without version", raw: "OPTIONS *\r\n\r\n", msg: "invalid rtsp request line"},
+		{name: "request line of http", raw: "GET / HTTP/1.1\r\n\r\n", msg: "invalid rtsp request line"},
+		{name: "status line without code", raw: "RTSP/1.0\r\n\r\n", msg: "invalid rtsp status line"},
+		{name: "status code not a number", raw: "RTSP/1.0 OK\r\n\r\n", msg: "invalid rtsp status code"},
+		{name: "status code out of range", raw: "RTSP/1.0 1000 Too Big\r\n\r\n", msg: "invalid rtsp status code"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := NewMessageReader(bufio.NewReader(strings.NewReader(tt.raw)))
+			_, _, err := mr.Read()
+			if err == nil {
+				t.Fatal("Read got no error")
+			}
+			if tt.err != nil && err != tt.err {
+				t.Errorf("err = %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && !strings.Contains(err.Error(), tt.msg) {
+				t.Errorf("err = %v, want it to contain %q", err, tt.msg)
+			}
+		})
+	}
+}
+
+func TestMessageReaderLimits(t *testing.T) {
+	// one header over the limit fails, the limits themselves are allowed.
+	raw := "OPTIONS * RTSP/1.0\r\n" + strings.Repeat("X-Header: x\r\n", MaxMessageHeaders) +
+		"X-Long: " + strings.Repeat("a", MaxMessageLineLength-len("X-Long: \r\n")) + "\r\n\r\n"
+	mr := NewMessageReader(bufio.NewReader(strings.NewReader(raw)))
+	if _, _, err := mr.Read(); err != ErrMessageTooManyHeaders {
+		t.Errorf("%d headers and a long one: err = %v, want %v", MaxMessageHeaders, err, ErrMessageTooManyHeaders)
+	}
+
+	raw = "OPTIONS * RTSP/1.0\r\n" + strings.Repeat("X-Header: x\r\n", MaxMessageHeaders-1) +
+		"X-Long: " + strings.Repeat("a", MaxMessageLineLength-len("X-Long: \r\n")) + "\r\n\r\n"
+	mr = NewMessageReader(bufio.NewReader(strings.NewReader(raw)))
+	req, _, err := mr.Read()
+	if err != nil {
+		t.Fatalf("%d headers with a line of %d bytes: %v", MaxMessageHeaders, MaxMessageLineLength, err)
+	}
+	if len(req.Header) != 2 || len(req.Header.Values("X-Header")) != MaxMessageHeaders-1 {
+		t.Errorf("header = %d keys, %d X-Header", len(req.Header), len(req.Header.Values("X-Header")))
+	}
+	if mr.Size() != len(raw) {
+		t.Errorf("Size = %d, want %d", mr.Size(), len(raw))
+	}
+
+	body := strings.Repeat("b", MaxMessageBodySize)
+	raw = "ANNOUNCE * RTSP/1.0\r\nContent-Length: 1048576\r\n\r\n" + body
+	mr = NewMessageReader(bufio.NewReader(strings.NewReader(raw)))
+	if req, _, err = mr.Read(); err != nil {
+		t.Fatalf("body of %d bytes: %v", MaxMessageBodySize, err)
+	}
+	if req.Body != body {
+		t.Errorf("body of %d bytes, want %d", len(req.Body), len(body))
+	}
+}
+
+func TestMessageReaderSequence(t *testing.T) {
+	raw := "RTSP/1.0 200 OK\r\nCSeq: 1\r\nContent-Length: 3\r\n\r\nabc" +
+		"GET_PARAMETER rtsp://example.com/live RTSP/1.0\r\nCSeq: 2\r\n\r\n"
+	mr := NewMessageReader(bufio.NewReader(strings.NewReader(raw)))
+	res, err := mr.ReadResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Body != "abc" || mr.Size() != len("RTSP/1.0 200 OK\r\nCSeq: 1\r\nContent-Length: 3\r\n\r\nabc") {
+		t.Errorf("first message body %q size %d", res.Body, mr.Size())
+	}
+	if _, err := mr.ReadResponse(); err == nil || !strings.Contains(err.Error(), "unexpected rtsp request") {
+		t.Errorf("ReadResponse of a request: err = %v", err)
+	}
+}
+
+func FuzzMessageReader(f *testing.F) {
+	f.Add("OPTIONS rtsp://example.com/live RTSP/1.0\r\nCSeq: 1\r\n\r\n")
+	f.Add("RTSP/1.0 200 OK\r\nCSeq: 1\r\nContent-Length: 3\r\n\r\nabc")
+	f.Add("SETUP * RTSP/1.0\r\nTransport: a;\r\n b\r\ntransport: c\r\n\r\n")
+	f.Add("ANNOUNCE * RTSP/1.0\r\nContent-Length: -1\r\n\r\n")
+	f.Fuzz(func(t *testing.T, raw string) {
+		mr := NewMessageReader(bufio.NewReader(strings.NewReader(raw)))
+		for i := 0; i < 8; i++ {
+			req, res, err := mr.Read()
+			if err != nil {
+				return
+			}
+			if (req == nil) == (res == nil) {
+				t.Fatalf("req %v and res %v", req, res)
+			}
+			if mr.Size() > len(raw) {
+				t.Fatalf("size %d of a message of %d bytes", mr.Size(), len(raw))
+			}
+			var header Header
+			if req != nil {
+				header = req.Header
+				if len(req.Body) > MaxMessageBodySize {
+					t.Fatalf("body of %d bytes", len(req.Body))
+				}
+			} else {
+				header = res.Header
+				if res.StatusCode < 100 || res.StatusCode > 999 {
+					t.Fatalf("status code %d", res.StatusCode)
+				}
+			}
+			count := 0
+			for key, values := range header {
+				if key != CanonicalHeaderKey(key) {
+					t.Fatalf("key %q not canonical", key)
+				}
+				count += len(values)
+			}
+			if count > MaxMessageHeaders {
+				t.Fatalf("%d headers", count)
+			}
+		}
+	})
+}
@@ -0,0 +1,243 @@
+package rtsp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Parameter is a parameter of a session read by GET_PARAMETER and written by
+// SET_PARAMETER in text/parameters bodies, Set is nil for read-only ones.
+// Check validates a value for Set, SET_PARAMETER checks every line of the
+// body before it sets any.
+type Parameter struct {
+	Name  string
+	Get   func(session *Session) (string, error)
+	Check func(session *Session, value string) error
+	Set   func(session *Session, value string) error
+}
+
+var (
+	parameters     = make(map[string]*Parameter)
+	parametersLock sync.RWMutex
+)
+
+// RegisterParameter adds or replaces a parameter.
+func RegisterParameter(param *Parameter) {
+	parametersLock.Lock()
+	parameters[strings.ToLower(param.Name)] = param
+	parametersLock.Unlock()
+}
+
+func getParameter(name string) *Parameter {
+	parametersLock.RLock()
+	defer parametersLock.RUnlock()
+	return parameters[strings.ToLower(name)]
+}
+
+var (
+	errNoStream = fmt.Errorf("no stream")
+	errNoPlayer = fmt.Errorf("not a player")
+)
+
+// pusherParameter reads a parameter of the stream the session pushes or plays.
+func pusherParameter(name string, get func(pusher *Pusher) string) *Parameter {
+	return &Parameter{
+		Name: name,
+		Get: func(session *Session) (string, error) {
+			if session.Pusher == nil {
+				return "", errNoStream
+			}
+			return get(session.Pusher), nil
+		},
+	}
+}
+
+func init() {
+	RegisterParameter(pusherParameter("bitrate", func(pusher *Pusher) string {
+		return strconv.Itoa(pusher.Stats().Bitrate)
+	}))
+	RegisterParameter(pusherParameter("fps", func(pusher *Pusher) string {
+		return strconv.FormatFloat(pusher.Stats().FPS, 'f', 2, 64)
+	}))
+	RegisterParameter(pusherParameter("vcodec", func(pusher *Pusher) string {
+		return pusher.Stats().VCodec
+	}))
+	RegisterParameter(pusherParameter("resolution", func(pusher *Pusher) string {
+		stats := pusher.Stats()
+		return fmt.Sprintf("%dx%d", stats.Width, stats.Height)
+	}))
+	RegisterParameter(pusherParameter("viewers", func(pusher *Pusher) string {
+		return strconv.Itoa(len(pusher.GetPlayers()))
+	}))
+	RegisterParameter(pusherParameter("uptime", func(pusher *Pusher) string {
+		return strconv.Itoa(int(time.Since(pusher.StartAt()).Seconds()))
+	}))
+	RegisterParameter(pusherParameter("healthy", func(pusher *Pusher) string {
+		healthy, _ := pusher.Health()
+		return strconv.FormatBool(healthy)
+	}))
+	// a player may lower the queue limit of player_queue_limit for itself, to
+	// drop packets rather than lag behind on a slow link.
+	RegisterParameter(&Parameter{
+		Name: "queue_limit",
+		Get: func(session *Session) (string, error) {
+			player := session.Player
+			if player == nil {
+				return "", errNoPlayer
+			}
+			player.cond.L.Lock()
+			defer player.cond.L.Unlock()
+			return strconv.Itoa(player.queueLimit), nil
+		},
+		Check: func(session *Session, value string) error {
+			_, err := parseQueueLimit(session.Player, value)
+			return err
+		},
+		Set: func(session *Session, value string) error {
+			player := session.Player
+			limit, err := parseQueueLimit(player, value)
+			if err != nil {
+				return err
+			}
+			player.cond.L.Lock()
+			player.queueLimit = limit
+			player.cond.L.Unlock()
+			return nil
+		},
+	})
+	RegisterParameter(&Parameter{
+		Name: "bytes_received",
+		Get: func(session *Session) (string, error) {
+			return strconv.Itoa(session.InBytes), nil
+		},
+	})
+	RegisterParameter(&Parameter{
+		Name: "bytes_sent",
+		Get: func(session *Session) (string, error) {
+			return strconv.Itoa(session.OutBytes), nil
+		},
+	})
+}
+
+// parseQueueLimit parses a queue_limit of player, which is not over its
+// current one.
+func parseQueueLimit(player *Player, value string) (int, error) {
+	if player == nil {
+		return 0, errNoPlayer
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("queue_limit %q not a positive number", value)
+	}
+	player.cond.L.Lock()
+	defer player.cond.L.Unlock()
+	if player.queueLimit > 0 && limit > player.queueLimit {
+		return 0, fmt.Errorf("queue_limit %d over %d", limit, player.queueLimit)
+	}
+	return limit, nil
+}
+
+// parameterLines splits a text/parameters body into its non-empty lines.
+func parameterLines(body string) []string {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(body, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// handleGetParameter answers the parameters named in the body, an empty body
+// is a keep-alive.
+func (session *Session) handleGetParameter(req *Request, res *Response) {
+	lines := parameterLines(req.Body)
+	if len(lines) == 0 {
+		return
+	}
+	body := strings.Builder{}
+	for _, name := range lines {
+		name = strings.TrimSuffix(name, ":")
+		param := getParameter(name)
+		if param == nil {
+			res.StatusCode = 451
+			res.Status = "Parameter Not Understood"
+			res.SetBody(name + "\r\n")
+			res.Header.Set("Content-Type", "text/parameters")
+			return
+		}
+		value, err := param.Get(session)
+		if err != nil {
+			session.logger.Printf("GET_PARAMETER %s err:%v", param.Name, err)
+			res.StatusCode = 451
+			res.Status = "Parameter Not Understood"
+			res.Header.Set("Content-Type", "text/parameters")
+			res.SetBody(name + "\r\n")
+			return
+		}
+		body.WriteString(fmt.Sprintf("%s: %s\r\n", param.Name, value))
+	}
+	res.Header.Set("Content-Type", "text/parameters")
+	res.SetBody(body.String())
+}
+
+// handleSetParameter sets the "name: value" lines of the body, none is set
+// unless all of them are writable and pass Check, the last line of a name
+// wins. An empty body is a keep-alive.
+func (session *Session) handleSetParameter(req *Request, res *Response) {
+	type assignment struct {
+		param *Parameter
+		value string
+	}
+	assignments := make([]assignment, 0)
+	assigned := make(map[*Parameter]int) // index in assignments
+	for _, line := range parameterLines(req.Body) {
+		items := strings.SplitN(line, ":", 2)
+		name := strings.TrimSpace(items[0])
+		param := getParameter(name)
+		if len(items) < 2 || param == nil {
+			res.StatusCode = 451
+			res.Status = "Parameter Not Understood"
+			res.Header.Set("Content-Type", "text/parameters")
+			res.SetBody(name + "\r\n")
+			return
+		}
+		if param.Set == nil {
+			res.StatusCode = 458
+			res.Status = "Parameter Is Read-Only"
+			res.Header.Set("Content-Type", "text/parameters")
+			res.SetBody(name + "\r\n")
+			return
+		}
+		value := strings.TrimSpace(items[1])
+		if param.Check != nil {
+			if err := param.Check(session, value); err != nil {
+				session.logger.Printf("SET_PARAMETER %s err:%v", param.Name, err)
+				res.StatusCode = 451
+				res.Status = "Parameter Not Understood"
+				res.Header.Set("Content-Type", "text/parameters")
+				res.SetBody(param.Name + "\r\n")
+				return
+			}
+		}
+		if i, ok := assigned[param]; ok {
+			assignments[i].value = value
+			continue
+		}
+		assigned[param] = len(assignments)
+		assignments = append(assignments, assignment{param, value})
+	}
+	for _, a := range assignments {
+		if err := a.param.Set(session, a.value); err != nil {
+			session.logger.Printf("SET_PARAMETER %s err:%v", a.param.Name, err)
+			res.StatusCode = 451
+			res.Status = "Parameter Not Understood"
+			res.Header.Set("Content-Type", "text/parameters")
+			res.SetBody(a.param.Name + "\r\n")
+			return
+		}
+	}
+}
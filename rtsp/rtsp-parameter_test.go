@@ -0,0 +1,95 @@
+package rtsp
+
+import (
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+)
+
+func newTestParameterSession(queueLimit int) *Session {
+	session := &Session{SessionLogger: SessionLogger{log.New(ioutil.Discard, "", 0)}, InBytes: 42}
+	session.Player = &Player{Session: session, cond: sync.NewCond(&sync.Mutex{}), queueLimit: queueLimit}
+	return session
+}
+
+func TestParameters(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		queueLimit int
+		noPlayer   bool
+		status     int
+		reason     string
+		resBody    string
+		wantLimit  int
+	}{
+		{"keep-alive", GET_PARAMETER, "", 0, false, 200, "OK", "", 0},
+		{"get", GET_PARAMETER, "bytes_received\r\nQueue_Limit:\r\n", 100, false, 200, "OK", "bytes_received: 42\r\nqueue_limit: 100\r\n", 100},
+		{"get unknown", GET_PARAMETER, "bytes_received\r\nfoo\r\n", 0, false, 451, "Parameter Not Understood", "foo\r\n", 0},
+		{"get failing", GET_PARAMETER, "queue_limit\r\n", 0, true, 451, "Parameter Not Understood", "queue_limit\r\n", 0},
+		{"set keep-alive", SET_PARAMETER, "\r\n", 100, false, 200, "OK", "", 100},
+		{"set", SET_PARAMETER, "queue_limit: 50\r\n", 100, false, 200, "OK", "", 50},
+		{"set unlimited", SET_PARAMETER, "queue_limit: 5000\r\n", 0, false, 200, "OK", "", 5000},
+		{"set over the limit", SET_PARAMETER, "queue_limit: 200\r\n", 100, false, 451, "Parameter Not Understood", "queue_limit\r\n", 100},
+		{"set invalid", SET_PARAMETER, "queue_limit: -1\r\n", 100, false, 451, "Parameter Not Understood", "queue_limit\r\n", 100},
+		{"set no player", SET_PARAMETER, "queue_limit: 50\r\n", 0, true, 451, "Parameter Not Understood", "queue_limit\r\n", 0},
+		{"set read-only", SET_PARAMETER, "queue_limit: 50\r\nbytes_sent: 1\r\n", 100, false, 458, "Parameter Is Read-Only", "bytes_sent\r\n", 100},
+		{"set unknown", SET_PARAMETER, "foo: 1\r\n", 100, false, 451, "Parameter Not Understood", "foo\r\n", 100},
+		{"set no value", SET_PARAMETER, "queue_limit\r\n", 100, false, 451, "Parameter Not Understood", "queue_limit\r\n", 100},
+	}
+	for _, tt := range tests {
+		session := newTestParameterSession(tt.queueLimit)
+		player := session.Player
+		if tt.noPlayer {
+			session.Player = nil
+		}
+		req := &Request{Method: tt.method, Header: make(Header), Body: tt.body}
+		res := NewResponse(200, "OK", "1", "", "")
+		if tt.method == GET_PARAMETER {
+			session.handleGetParameter(req, res)
+		} else {
+			session.handleSetParameter(req, res)
+		}
+		if res.StatusCode != tt.status || res.Status != tt.reason || res.Body != tt.resBody {
+			t.Errorf("%s: %d %s %q, want %d %s %q", tt.name, res.StatusCode, res.Status, res.Body, tt.status, tt.reason, tt.resBody)
+		}
+		if player.queueLimit != tt.wantLimit {
+			t.Errorf("%s: queue limit %d, want %d", tt.name, player.queueLimit, tt.wantLimit)
+		}
+	}
+}
+
+func TestSetParameterChecksAll(t *testing.T) {
+	notes := make(map[*Session]string)
+	RegisterParameter(&Parameter{
+		Name: "test_note",
+		Set: func(session *Session, value string) error {
+			notes[session] = value
+			return nil
+		},
+	})
+	tests := []struct {
+		name      string
+		body      string
+		status    int
+		note      string
+		wantLimit int
+	}{
+		{"all valid", "test_note: a\r\nqueue_limit: 50\r\n", 200, "a", 50},
+		{"a later line invalid", "test_note: a\r\nqueue_limit: 200\r\n", 451, "", 100},
+		{"a later line read-only", "test_note: a\r\nbytes_sent: 1\r\n", 458, "", 100},
+		{"the last line of a name wins", "queue_limit: 50\r\nqueue_limit: 80\r\n", 200, "", 80},
+		{"a name invalid once", "queue_limit: 200\r\nqueue_limit: 80\r\n", 451, "", 100},
+	}
+	for _, tt := range tests {
+		session := newTestParameterSession(100)
+		req := &Request{Method: SET_PARAMETER, Header: make(Header), Body: tt.body}
+		res := NewResponse(200, "OK", "1", "", "")
+		session.handleSetParameter(req, res)
+		if res.StatusCode != tt.status || notes[session] != tt.note || session.Player.queueLimit != tt.wantLimit {
+			t.Errorf("%s: %d, note %q, queue limit %d", tt.name, res.StatusCode, notes[session], session.Player.queueLimit)
+		}
+	}
+}
@@ -1,17 +1,22 @@
 package rtsp
 
 import (
+	"bytes"
 	"fmt"
-	"log"
-	"regexp"
+	"io"
 	"strconv"
-	"strings"
 )
 
 const (
-	RTSP_VERSION = "RTSP/1.0"
+	RTSP_VERSION   = "RTSP/1.0"
+	RTSP_VERSION_2 = "RTSP/2.0" // RFC 7826
 )
 
+// IsSupportedVersion tells if the server speaks the rtsp version.
+func IsSupportedVersion(version string) bool {
+	return version == RTSP_VERSION || version == RTSP_VERSION_2
+}
+
 const (
 	// Client to server for presentation and stream objects; recommended
 	DESCRIBE = "DESCRIBE"
@@ -35,65 +40,54 @@ const (
 	SET_PARAMETER = "SET_PARAMETER"
 	// Client to server for presentation and stream objects; required
 	TEARDOWN = "TEARDOWN"
-	DATA     = "DATA"
+	// Server to client for presentation and stream objects; RTSP 2.0 only
+	PLAY_NOTIFY = "PLAY_NOTIFY"
+	DATA        = "DATA"
 )
 
 type Request struct {
 	Method  string
 	URL     string
 	Version string
-	Header  map[string]string
-	Content string
+	Header  Header
 	Body    string
 }
 
-func NewRequest(content string) *Request {
-	lines := strings.Split(strings.TrimSpace(content), "\r\n")
-	if len(lines) == 0 {
-		return nil
-	}
-	items := regexp.MustCompile("\\s+").Split(strings.TrimSpace(lines[0]), -1)
-	if len(items) < 3 {
-		return nil
-	}
-	if !strings.HasPrefix(items[2], "RTSP") {
-		log.Printf("invalid rtsp request, line[0] %s", lines[0])
-		return nil
+// NewRequest returns a request of RTSP_VERSION with CSeq.
+func NewRequest(method, url, cSeq string) *Request {
+	req := &Request{
+		Method:  method,
+		URL:     url,
+		Version: RTSP_VERSION,
+		Header:  make(Header),
 	}
-	header := make(map[string]string)
-	for i := 1; i < len(lines); i++ {
-		line := strings.TrimSpace(lines[i])
-		headerItems := regexp.MustCompile(":\\s+").Split(line, 2)
-		if len(headerItems) < 2 {
-			continue
-		}
-		header[headerItems[0]] = headerItems[1]
+	req.Header.Set("CSeq", cSeq)
+	return req
+}
+
+func (r *Request) Write(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "%s %s %s\r\n", r.Method, r.URL, r.Version); err != nil {
+		return err
 	}
-	return &Request{
-		Method:  items[0],
-		URL:     items[1],
-		Version: items[2],
-		Header:  header,
-		Content: content,
-		Body:    "",
+	if err := r.Header.Write(w); err != nil {
+		return err
 	}
+	_, err := io.WriteString(w, r.Body)
+	return err
 }
 
 func (r *Request) String() string {
-	str := fmt.Sprintf("%s %s %s\r\n", r.Method, r.URL, r.Version)
-	for key, value := range r.Header {
-		str += fmt.Sprintf("%s: %s\r\n", key, value)
-	}
-	str += "\r\n"
-	str += r.Body
-	return str
+	buf := bytes.Buffer{}
+	r.Write(&buf)
+	return buf.String()
 }
 
-func (r *Request) GetContentLength() int {
-	v, err := strconv.ParseInt(r.Header["Content-Length"], 10, 64)
-	if err != nil {
-		return 0
+// SetBody sets the body and its Content-Length.
+func (r *Request) SetBody(body string) {
+	r.Body = body
+	if len(body) > 0 {
+		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
 	} else {
-		return int(v)
+		r.Header.Del("Content-Length")
 	}
 }
@@ -1,7 +1,9 @@
 package rtsp
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"strconv"
 )
 
@@ -9,7 +11,7 @@ type Response struct {
 	Version    string
 	StatusCode int
 	Status     string
-	Header     map[string]interface{}
+	Header     Header
 	Body       string
 }
 
@@ -18,34 +20,38 @@ func NewResponse(statusCode int, status, cSeq, sid, body string) *Response {
 		Version:    RTSP_VERSION,
 		StatusCode: statusCode,
 		Status:     status,
-		Header:     map[string]interface{}{"CSeq": cSeq, "Session": sid},
-		Body:       body,
+		Header:     make(Header),
 	}
-	len := len(body)
-	if len > 0 {
-		res.Header["Content-Length"] = strconv.Itoa(len)
-	} else {
-		delete(res.Header, "Content-Length")
+	res.Header.Set("CSeq", cSeq)
+	if sid != "" {
+		res.Header.Set("Session", sid)
 	}
+	res.SetBody(body)
 	return res
 }
 
-func (r *Response) String() string {
-	str := fmt.Sprintf("%s %d %s\r\n", r.Version, r.StatusCode, r.Status)
-	for key, value := range r.Header {
-		str += fmt.Sprintf("%s: %s\r\n", key, value)
+func (r *Response) Write(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "%s %d %s\r\n", r.Version, r.StatusCode, r.Status); err != nil {
+		return err
+	}
+	if err := r.Header.Write(w); err != nil {
+		return err
 	}
-	str += "\r\n"
-	str += r.Body
-	return str
+	_, err := io.WriteString(w, r.Body)
+	return err
+}
+
+func (r *Response) String() string {
+	buf := bytes.Buffer{}
+	r.Write(&buf)
+	return buf.String()
 }
 
 func (r *Response) SetBody(body string) {
-	len := len(body)
 	r.Body = body
-	if len > 0 {
-		r.Header["Content-Length"] = strconv.Itoa(len)
+	if len(body) > 0 {
+		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
 	} else {
-		delete(r.Header, "Content-Length")
+		r.Header.Del("Content-Length")
 	}
 }
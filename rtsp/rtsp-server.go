@@ -22,8 +22,19 @@ type Server struct {
 	Stoped         bool
 	pushers        map[string]*Pusher // Path <-> Pusher
 	pushersLock    sync.RWMutex
+	sessions       map[string]*Session // ID <-> Session
+	sessionsLock   sync.RWMutex
 	addPusherCh    chan *Pusher
 	removePusherCh chan *Pusher
+	registry       Registry // guarded by pushersLock
+	events         eventHandles
+	pusherSources  pusherSources
+	metrics        serverMetrics
+	snapshots      snapshotCache
+	webHook        *WebHook
+	authHook       *AuthHook
+	removeWebHook  func()
+	stopCh         chan struct{} // closed when the server stops
 }
 
 var Instance *Server = &Server{
@@ -31,6 +42,7 @@ var Instance *Server = &Server{
 	Stoped:         true,
 	TCPPort:        utils.Conf().Section("rtsp").Key("port").MustInt(554),
 	pushers:        make(map[string]*Pusher),
+	sessions:       make(map[string]*Session),
 	addPusherCh:    make(chan *Pusher),
 	removePusherCh: make(chan *Pusher),
 }
@@ -41,6 +53,13 @@ func GetServer() *Server {
 
 func (server *Server) Start() (err error) {
 	logger := server.logger
+	sec := utils.Conf().Section("rtsp")
+	if sec.Key("token_auth_enable").MustInt(0) != 0 && sec.Key("token_secret").MustString("") == "" {
+		// tokens signed with an empty secret can be forged.
+		return fmt.Errorf("token_auth_enable is set without token_secret")
+	}
+	// the config may have been edited before a restart.
+	loadDebugLog()
 	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", server.TCPPort))
 	if err != nil {
 		return
@@ -49,6 +68,21 @@ func (server *Server) Start() (err error) {
 	if err != nil {
 		return
 	}
+	registry, err := NewRegistry(server.TCPPort)
+	if err != nil {
+		listener.Close()
+		return
+	}
+	server.pushersLock.Lock()
+	server.registry = registry
+	server.pushersLock.Unlock()
+	logger.Printf("pusher registry node[%s]", registry.Node())
+	server.authHook = NewAuthHook()
+	if webHook := NewWebHook(); webHook != nil {
+		server.webHook = webHook
+		server.removeWebHook = server.AddEventHandle(webHook.Handle)
+		logger.Printf("webhook enabled, %v", webHook.URLs)
+	}
 
 	localRecord := utils.Conf().Section("rtsp").Key("save_stream_to_local").MustInt(0)
 	ffmpeg := utils.Conf().Section("rtsp").Key("ffmpeg_path").MustString("")
@@ -67,6 +101,7 @@ func (server *Server) Start() (err error) {
 
 	go func() { // save to local.
 		pusher2ffmpegMap := make(map[*Pusher]*exec.Cmd)
+		pusher2watcherMap := make(map[*Pusher]*recordWatcher)
 		if SaveStreamToLocal {
 			logger.Printf("Prepare to save stream to local....")
 			defer logger.Printf("End save stream to local....")
@@ -106,6 +141,7 @@ func (server *Server) Start() (err error) {
 							logger.Printf("Start ffmpeg err:%v", err)
 						}
 						pusher2ffmpegMap[pusher] = cmd
+						pusher2watcherMap[pusher] = newRecordWatcher(server, pusher, m3u8path, time.Second)
 						logger.Printf("add ffmpeg [%v] to pull stream from pusher[%v]", cmd, pusher)
 						f.Close()
 					} else {
@@ -131,6 +167,10 @@ func (server *Server) Start() (err error) {
 							logger.Printf("process:%v terminate.", proc)
 						}
 						delete(pusher2ffmpegMap, pusher)
+						if watcher, ok := pusher2watcherMap[pusher]; ok {
+							watcher.Stop()
+							delete(pusher2watcherMap, pusher)
+						}
 						logger.Printf("delete ffmpeg from pull stream from pusher[%v]", pusher)
 					} else {
 						for _, cmd := range pusher2ffmpegMap {
@@ -141,6 +181,10 @@ func (server *Server) Start() (err error) {
 							}
 						}
 						pusher2ffmpegMap = make(map[*Pusher]*exec.Cmd)
+						for _, watcher := range pusher2watcherMap {
+							watcher.Stop()
+						}
+						pusher2watcherMap = make(map[*Pusher]*recordWatcher)
 						logger.Printf("removePusherChan closed")
 					}
 				}
@@ -150,6 +194,10 @@ func (server *Server) Start() (err error) {
 
 	server.Stoped = false
 	server.TCPListener = listener
+	server.stopCh = make(chan struct{})
+	go server.monitorHealth(server.stopCh)
+	go server.refreshSnapshots(server.stopCh)
+	go server.reapSessions(server.stopCh)
 	logger.Println("rtsp server start on", server.TCPPort)
 	networkBuffer := utils.Conf().Section("rtsp").Key("network_buffer").MustInt(1048576)
 
@@ -168,8 +216,7 @@ func (server *Server) Start() (err error) {
 			}
 		}
 
-		session := NewSession(server, conn)
-		go session.Start()
+		go NewConnection(server, conn).Start()
 	}
 	return
 }
@@ -184,7 +231,24 @@ func (server *Server) Stop() {
 	}
 	server.pushersLock.Lock()
 	server.pushers = make(map[string]*Pusher)
+	registry := server.registry
+	server.registry = nil
 	server.pushersLock.Unlock()
+	server.authHook = nil
+	if server.stopCh != nil {
+		close(server.stopCh)
+		server.stopCh = nil
+	}
+	if server.webHook != nil {
+		server.removeWebHook()
+		server.webHook.Stop()
+		server.webHook = nil
+	}
+	if registry != nil {
+		if err := registry.Close(); err != nil {
+			logger.Printf("close pusher registry err:%v", err)
+		}
+	}
 
 	close(server.addPusherCh)
 	close(server.removePusherCh)
@@ -192,6 +256,18 @@ func (server *Server) Stop() {
 
 func (server *Server) AddPusher(pusher *Pusher) bool {
 	logger := server.logger
+	if server.GetPusher(pusher.Path()) != nil {
+		return false
+	}
+	if registry := server.getRegistry(); registry != nil {
+		owner, err := registry.Register(pusher.Path())
+		if err != nil {
+			logger.Printf("register path[%s] err:%v", pusher.Path(), err)
+		} else if owner != registry.Node() {
+			logger.Printf("%v rejected, path owned by node[%s]", pusher, owner)
+			return false
+		}
+	}
 	added := false
 	server.pushersLock.Lock()
 	_, ok := server.pushers[pusher.Path()]
@@ -206,6 +282,7 @@ func (server *Server) AddPusher(pusher *Pusher) bool {
 	if added {
 		go pusher.Start()
 		server.addPusherCh <- pusher
+		server.Emit(pusherEvent(EVENT_PUSHER_ADD, pusher))
 	}
 	return added
 }
@@ -238,10 +315,23 @@ func (server *Server) RemovePusher(pusher *Pusher) {
 	}
 	server.pushersLock.Unlock()
 	if removed {
+		if registry := server.getRegistry(); registry != nil {
+			if err := registry.Unregister(pusher.Path()); err != nil {
+				logger.Printf("unregister path[%s] err:%v", pusher.Path(), err)
+			}
+		}
 		server.removePusherCh <- pusher
+		server.Emit(pusherEvent(EVENT_PUSHER_REMOVE, pusher))
 	}
 }
 
+// getRegistry returns the pusher registry, nil when the server is stopped.
+func (server *Server) getRegistry() Registry {
+	server.pushersLock.RLock()
+	defer server.pushersLock.RUnlock()
+	return server.registry
+}
+
 func (server *Server) GetPusher(path string) (pusher *Pusher) {
 	server.pushersLock.RLock()
 	pusher = server.pushers[path]
@@ -249,6 +339,32 @@ func (server *Server) GetPusher(path string) (pusher *Pusher) {
 	return
 }
 
+// LocatePusher returns the node publishing path. It is empty when no node
+// publishes path, or the local node address when this server does.
+func (server *Server) LocatePusher(path string) (node string) {
+	registry := server.getRegistry()
+	if registry == nil {
+		if server.GetPusher(path) != nil {
+			node = fmt.Sprintf("%s:%d", utils.LocalIP(), server.TCPPort)
+		}
+		return
+	}
+	if server.GetPusher(path) != nil {
+		return registry.Node()
+	}
+	node, err := registry.Lookup(path)
+	if err != nil {
+		server.logger.Printf("lookup path[%s] err:%v", path, err)
+	}
+	return
+}
+
+// IsLocalNode reports whether node is this server's registry address.
+func (server *Server) IsLocalNode(node string) bool {
+	registry := server.getRegistry()
+	return registry == nil || registry.Node() == node
+}
+
 func (server *Server) GetPushers() (pushers map[string]*Pusher) {
 	pushers = make(map[string]*Pusher)
 	server.pushersLock.RLock()
@@ -265,3 +381,19 @@ func (server *Server) GetPusherSize() (size int) {
 	server.pushersLock.RUnlock()
 	return
 }
+
+// RedirectPlayers sends REDIRECT to the players of path and stops them, the
+// players connect to location instead. Returns the count of players.
+func (server *Server) RedirectPlayers(path, location string) int {
+	pusher := server.GetPusher(path)
+	if pusher == nil {
+		return 0
+	}
+	players := pusher.GetPlayers()
+	for _, player := range players {
+		player.Redirect(location)
+		player.Stop()
+	}
+	server.logger.Printf("redirect %d players of %s to %s", len(players), path, location)
+	return len(players)
+}
@@ -1,12 +1,11 @@
 package rtsp
 
 import (
-	"bufio"
 	"bytes"
 	"crypto/md5"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/url"
@@ -15,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/snowlyg/EasyDarwin/extend/db"
@@ -26,6 +26,7 @@ import (
 
 type RTPPack struct {
 	Type   RTPType
+	Track  int // index of the track in the sdp of the stream
 	Buffer *bytes.Buffer
 }
 
@@ -53,6 +54,8 @@ const (
 	RTP_TYPE_VIDEO
 	RTP_TYPE_AUDIOCONTROL
 	RTP_TYPE_VIDEOCONTROL
+	RTP_TYPE_DATA // application and other media, e.g. ONVIF metadata
+	RTP_TYPE_DATACONTROL
 )
 
 func (rt RTPType) String() string {
@@ -65,10 +68,19 @@ func (rt RTPType) String() string {
 		return "audio control"
 	case RTP_TYPE_VIDEOCONTROL:
 		return "video control"
+	case RTP_TYPE_DATA:
+		return "data"
+	case RTP_TYPE_DATACONTROL:
+		return "data control"
 	}
 	return "unknow"
 }
 
+// IsControl reports whether the pack is rtcp.
+func (rt RTPType) IsControl() bool {
+	return rt == RTP_TYPE_AUDIOCONTROL || rt == RTP_TYPE_VIDEOCONTROL || rt == RTP_TYPE_DATACONTROL
+}
+
 type TransType int
 
 const (
@@ -92,25 +104,28 @@ type Session struct {
 	SessionLogger
 	ID        string
 	Server    *Server
-	Conn      *RichConn
-	connRW    *bufio.ReadWriter
-	connWLock sync.RWMutex
 	Type      SessionType
 	TransType TransType
+	Version   string // negotiated by the first request, RTSP_VERSION or RTSP_VERSION_2
 	Path      string
 	URL       string
 	SDPRaw    string
-	SDPMap    map[string]*SDPInfo
+	Tracks    []*Track
 
 	authorizationEnable bool
 	nonce               string
+	Username            string
+	tokenAuthEnable     bool
+	tokenSecret         string
+	tokenAction         string // granted by the signed url, see checkURLToken
 	closeOld            bool
-	debugLogEnable      bool
-
-	AControl string
-	VControl string
-	ACodec   string
-	VCodec   string
+	notifyCSeq          int         // CSeq of requests sent to the client
+	activeAt            int64       // unix nano of the last refresh, see touch
+	established         bool        // SETUP succeeded
+	backchannel         bool        // the player requires ONVIF_BACKCHANNEL
+	conn                *Connection // nil when detached, see Connection
+	connLock            sync.RWMutex
+	remoteAddr          string
 
 	// stats info
 	InBytes  int
@@ -118,13 +133,10 @@ type Session struct {
 	StartAt  time.Time
 	Timeout  int
 
-	Stoped bool
+	SessionTimeout time.Duration // advertised in the Session header, see reapSessions
 
-	//tcp channels
-	aRTPChannel        int
-	aRTPControlChannel int
-	vRTPChannel        int
-	vRTPControlChannel int
+	stoped    bool
+	stateLock sync.RWMutex // guards stoped and TransType, read by reapSessions
 
 	Pusher      *Pusher
 	Player      *Player
@@ -134,31 +146,26 @@ type Session struct {
 }
 
 func (session *Session) String() string {
-	return fmt.Sprintf("session[%v][%v][%s][%s][%s]", session.Type, session.TransType, session.Path, session.ID, session.Conn.RemoteAddr().String())
+	return fmt.Sprintf("session[%v][%v][%s][%s][%s]", session.Type, session.TransType, session.Path, session.ID, session.RemoteAddr())
 }
 
-func NewSession(server *Server, conn net.Conn) *Session {
-	networkBuffer := utils.Conf().Section("rtsp").Key("network_buffer").MustInt(204800)
-	timeoutMillis := utils.Conf().Section("rtsp").Key("timeout").MustInt(0)
-	timeoutTCPConn := &RichConn{conn, time.Duration(timeoutMillis) * time.Millisecond}
+func NewSession(server *Server, conn *Connection) *Session {
 	authorizationEnable := utils.Conf().Section("rtsp").Key("authorization_enable").MustInt(0)
 	closeOld := utils.Conf().Section("rtsp").Key("close_old").MustInt(0)
-	debugLogEnable := utils.Conf().Section("rtsp").Key("debug_log_enable").MustInt(0)
+	tokenAuthEnable := utils.Conf().Section("rtsp").Key("token_auth_enable").MustInt(0)
 	session := &Session{
 		ID:                  shortid.MustGenerate(),
 		Server:              server,
-		Conn:                timeoutTCPConn,
-		connRW:              bufio.NewReadWriter(bufio.NewReaderSize(timeoutTCPConn, networkBuffer), bufio.NewWriterSize(timeoutTCPConn, networkBuffer)),
+		conn:                conn,
+		remoteAddr:          conn.Conn.RemoteAddr().String(),
 		StartAt:             time.Now(),
 		Timeout:             utils.Conf().Section("rtsp").Key("timeout").MustInt(0),
+		SessionTimeout:      sessionTimeout(),
 		authorizationEnable: authorizationEnable != 0,
-		debugLogEnable:      debugLogEnable != 0,
+		tokenAuthEnable:     tokenAuthEnable != 0,
+		tokenSecret:         utils.Conf().Section("rtsp").Key("token_secret").MustString(""),
 		RTPHandles:          make([]func(*RTPPack), 0),
 		StopHandles:         make([]func(), 0),
-		vRTPChannel:         -1,
-		vRTPControlChannel:  -1,
-		aRTPChannel:         -1,
-		aRTPControlChannel:  -1,
 		closeOld:            closeOld != 0,
 	}
 
@@ -169,18 +176,30 @@ func NewSession(server *Server, conn net.Conn) *Session {
 	return session
 }
 
+// Stoped reports whether the session is stopped.
+func (session *Session) Stoped() bool {
+	session.stateLock.RLock()
+	defer session.stateLock.RUnlock()
+	return session.stoped
+}
+
 func (session *Session) Stop() {
-	if session.Stoped {
+	// stopped by its connection and reapSessions at once, only one runs the
+	// stop handles.
+	session.stateLock.Lock()
+	if session.stoped {
+		session.stateLock.Unlock()
 		return
 	}
-	session.Stoped = true
+	session.stoped = true
+	session.stateLock.Unlock()
+	session.Server.removeSession(session)
 	for _, h := range session.StopHandles {
 		h()
 	}
-	if session.Conn != nil {
-		session.connRW.Flush()
-		session.Conn.Close()
-		session.Conn = nil
+	if conn := session.Connection(); conn != nil {
+		session.setConnection(nil)
+		conn.unbind(session)
 	}
 	if session.UDPClient != nil {
 		session.UDPClient.Stop()
@@ -188,126 +207,24 @@ func (session *Session) Stop() {
 	}
 }
 
-func (session *Session) Start() {
-	defer session.Stop()
-
-	buf1 := make([]byte, 1)
-	buf2 := make([]byte, 2)
-	logger := session.logger
-	timer := time.Unix(0, 0)
-
-	for !session.Stoped {
-		if _, err := io.ReadFull(session.connRW, buf1); err != nil {
-			logger.Println(session, err)
-			return
-		}
-		if buf1[0] == 0x24 { //rtp data
-			if _, err := io.ReadFull(session.connRW, buf1); err != nil {
-				logger.Println(err)
-				return
-			}
-			if _, err := io.ReadFull(session.connRW, buf2); err != nil {
-				logger.Println(err)
-				return
-			}
-
-			channel := int(buf1[0])
-			rtpLen := int(binary.BigEndian.Uint16(buf2))
-			rtpBytes := make([]byte, rtpLen)
-			if _, err := io.ReadFull(session.connRW, rtpBytes); err != nil {
-				logger.Println(err)
-				return
-			}
-
-			rtpBuf := bytes.NewBuffer(rtpBytes)
-
-			var pack *RTPPack
-			switch channel {
-			case session.aRTPChannel:
-				pack = &RTPPack{
-					Type:   RTP_TYPE_AUDIO,
-					Buffer: rtpBuf,
-				}
-				elapsed := time.Now().Sub(timer)
-				if elapsed >= 30*time.Second {
-					logger.Println("Recv an audio RTP package")
-					timer = time.Now()
-				}
-			case session.aRTPControlChannel:
-				pack = &RTPPack{
-					Type:   RTP_TYPE_AUDIOCONTROL,
-					Buffer: rtpBuf,
-				}
-			case session.vRTPChannel:
-				pack = &RTPPack{
-					Type:   RTP_TYPE_VIDEO,
-					Buffer: rtpBuf,
-				}
-				elapsed := time.Now().Sub(timer)
-				if elapsed >= 30*time.Second {
-					logger.Println("Recv an video RTP package")
-					timer = time.Now()
-				}
-			case session.vRTPControlChannel:
-				pack = &RTPPack{
-					Type:   RTP_TYPE_VIDEOCONTROL,
-					Buffer: rtpBuf,
-				}
-			default:
-				logger.Printf("unknow rtp pack type, %v", channel)
-			}
-
-			if pack == nil {
-				logger.Printf("session tcp got nil rtp pack")
-				continue
-			}
-
-			session.InBytes += rtpLen + 4
-			for _, h := range session.RTPHandles {
-				h(pack)
-			}
-
-		} else { // rtsp cmd
-			reqBuf := bytes.NewBuffer(nil)
-			reqBuf.Write(buf1)
-			for !session.Stoped {
-				if line, isPrefix, err := session.connRW.ReadLine(); err != nil {
-					logger.Println(err)
-					return
-				} else {
-					reqBuf.Write(line)
-					if !isPrefix {
-						reqBuf.WriteString("\r\n")
-					}
-					if len(line) == 0 {
-						req := NewRequest(reqBuf.String())
-						if req == nil {
-							break
-						}
-						session.InBytes += reqBuf.Len()
-						contentLen := req.GetContentLength()
-						session.InBytes += contentLen
-						if contentLen > 0 {
-							bodyBuf := make([]byte, contentLen)
-							if n, err := io.ReadFull(session.connRW, bodyBuf); err != nil {
-								logger.Println(err)
-								return
-							} else if n != contentLen {
-								logger.Printf("read rtsp request body failed, expect size[%d], got size[%d]", contentLen, n)
-								return
-							}
-							req.Body = string(bodyBuf)
-						}
-						session.handleRequest(req)
-						break
-					}
-				}
-			}
-		}
+// ErrAuthForbidden is returned by CheckAuth when the credentials are valid
+// but the user's role is not granted the method on the path.
+var ErrAuthForbidden = errors.New("CheckAuth error : permission denied")
+
+// methodPermission maps a RTSP method to the permission it needs.
+func methodPermission(method string) string {
+	switch method {
+	case ANNOUNCE, RECORD:
+		return models.PERMISSION_PUBLISH
+	case DESCRIBE, PLAY:
+		return models.PERMISSION_PLAY
 	}
+	return ""
 }
 
-func CheckAuth(authLine string, method string, sessionNonce string) error {
+// CheckAuth verifies a digest Authorization header and the user's
+// permission on path, and returns the user name.
+func CheckAuth(authLine string, method string, path string, sessionNonce string) (string, error) {
 	realmRex := regexp.MustCompile(`realm="(.*?)"`)
 	nonceRex := regexp.MustCompile(`nonce="(.*?)"`)
 	usernameRex := regexp.MustCompile(`username="(.*?)"`)
@@ -323,59 +240,71 @@ func CheckAuth(authLine string, method string, sessionNonce string) error {
 	if len(result1) == 2 {
 		realm = result1[1]
 	} else {
-		return fmt.Errorf("CheckAuth error : no realm found")
+		return "", fmt.Errorf("CheckAuth error : no realm found")
 	}
 	result1 = nonceRex.FindStringSubmatch(authLine)
 	if len(result1) == 2 {
 		nonce = result1[1]
 	} else {
-		return fmt.Errorf("CheckAuth error : no nonce found")
+		return "", fmt.Errorf("CheckAuth error : no nonce found")
 	}
 	if sessionNonce != nonce {
-		return fmt.Errorf("CheckAuth error : sessionNonce not same as nonce")
+		return "", fmt.Errorf("CheckAuth error : sessionNonce not same as nonce")
 	}
 
 	result1 = usernameRex.FindStringSubmatch(authLine)
 	if len(result1) == 2 {
 		username = result1[1]
 	} else {
-		return fmt.Errorf("CheckAuth error : username not found")
+		return "", fmt.Errorf("CheckAuth error : username not found")
 	}
 
 	result1 = responseRex.FindStringSubmatch(authLine)
 	if len(result1) == 2 {
 		response = result1[1]
 	} else {
-		return fmt.Errorf("CheckAuth error : response not found")
+		return "", fmt.Errorf("CheckAuth error : response not found")
 	}
 
 	result1 = uriRex.FindStringSubmatch(authLine)
 	if len(result1) == 2 {
 		uri = result1[1]
 	} else {
-		return fmt.Errorf("CheckAuth error : uri not found")
+		return "", fmt.Errorf("CheckAuth error : uri not found")
 	}
 	var user models.User
 	err := db.SQLite.Where("Username = ?", username).First(&user).Error
 	if err != nil {
-		return fmt.Errorf("CheckAuth error : user not exists")
+		return "", fmt.Errorf("CheckAuth error : user not exists")
+	}
+	if user.Disabled {
+		return "", fmt.Errorf("CheckAuth error : user disabled")
+	}
+	if realm != models.DIGEST_REALM {
+		return "", fmt.Errorf("CheckAuth error : realm[%s] not supported", realm)
+	}
+	if user.DigestHA1 == "" {
+		return "", fmt.Errorf("CheckAuth error : digest of user[%s] not stored, log in once to store it", username)
 	}
-	md5UserRealmPwd := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s:%s:%s", username, realm, user.Password))))
+	md5UserRealmPwd := user.DigestHA1
 	md5MethodURL := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s:%s", method, uri))))
 	myResponse := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s:%s:%s", md5UserRealmPwd, nonce, md5MethodURL))))
 	if myResponse != response {
-		return fmt.Errorf("CheckAuth error : response not equal")
+		return "", fmt.Errorf("CheckAuth error : response not equal")
 	}
-	return nil
+	if permission := methodPermission(method); permission != "" && !user.HasPermission(permission, path) {
+		return username, ErrAuthForbidden
+	}
+	return username, nil
 }
 
-func (session *Session) handleRequest(req *Request) {
+func (session *Session) handleRequest(conn *Connection, req *Request) {
 	//if session.Timeout > 0 {
 	//	session.Conn.SetDeadline(time.Now().Add(time.Duration(session.Timeout) * time.Second))
 	//}
 	logger := session.logger
 	logger.Printf("<<<\n%s", req)
-	res := NewResponse(200, "OK", req.Header["CSeq"], session.ID, "")
+	res := NewResponse(200, "OK", req.Header.Get("CSeq"), session.sessionHeader(), "")
 	defer func() {
 		if p := recover(); p != nil {
 			logger.Printf("handleRequest err ocurs:%v", p)
@@ -384,12 +313,14 @@ func (session *Session) handleRequest(req *Request) {
 		}
 		logger.Printf(">>>\n%s", res)
 		outBytes := []byte(res.String())
-		session.connWLock.Lock()
-		session.connRW.Write(outBytes)
-		session.connRW.Flush()
-		session.connWLock.Unlock()
+		if err := conn.write(outBytes); err != nil {
+			logger.Println(err)
+		}
 		session.OutBytes += len(outBytes)
+		session.Server.countRequest(req.Method, res.StatusCode)
 		switch req.Method {
+		case "SETUP":
+			session.established = res.StatusCode == 200 || session.established
 		case "PLAY", "RECORD":
 			switch session.Type {
 			case SESSEION_TYPE_PLAYER:
@@ -407,36 +338,55 @@ func (session *Session) handleRequest(req *Request) {
 				return
 			}
 		}
-		if res.StatusCode != 200 && res.StatusCode != 401 {
+		if res.StatusCode != 200 && res.StatusCode != 401 && req.Method != GET_PARAMETER && req.Method != SET_PARAMETER {
 			logger.Printf("Response request error[%d]. stop session.", res.StatusCode)
 			session.Stop()
 		}
 	}()
+	session.touch()
+	if !session.negotiateVersion(req, res) {
+		return
+	}
+	if session.tokenAuthEnable {
+		if action := session.tokenActionOf(req); action != "" && action != session.tokenAction {
+			if !session.checkURLToken(req.URL, action, res) {
+				return
+			}
+		}
+	}
 	if req.Method != "OPTIONS" {
-		if session.authorizationEnable {
-			authLine := req.Header["Authorization"]
+		if session.authorizationEnable && session.tokenAction == "" {
+			authLine := req.Header.Get("Authorization")
 			authFailed := true
 			if authLine != "" {
-				err := CheckAuth(authLine, req.Method, session.nonce)
+				path := session.Path
+				if req.Method == ANNOUNCE || req.Method == DESCRIBE {
+					if u, err := url.Parse(req.URL); err == nil {
+						path = u.Path
+					}
+				}
+				username, err := CheckAuth(authLine, req.Method, path, session.nonce)
 				if err == nil {
 					authFailed = false
+					session.Username = username
+				} else if err == ErrAuthForbidden {
+					logger.Printf("%v, user[%s] %s %s", err, username, req.Method, path)
+					res.StatusCode = 403
+					res.Status = "Forbidden"
+					return
 				} else {
 					logger.Printf("%v", err)
 				}
 			}
 			if authFailed {
-				res.StatusCode = 401
-				res.Status = "Unauthorized"
-				nonce := fmt.Sprintf("%x", md5.Sum([]byte(shortid.MustGenerate())))
-				session.nonce = nonce
-				res.Header["WWW-Authenticate"] = fmt.Sprintf(`Digest realm="EasyDarwin", nonce="%s", algorithm="MD5"`, nonce)
+				session.unauthorized(res)
 				return
 			}
 		}
 	}
 	switch req.Method {
 	case "OPTIONS":
-		res.Header["Public"] = "DESCRIBE, SETUP, TEARDOWN, PLAY, PAUSE, OPTIONS, ANNOUNCE, RECORD"
+		res.Header.Set("Public", "DESCRIBE, SETUP, TEARDOWN, PLAY, PAUSE, OPTIONS, ANNOUNCE, RECORD, GET_PARAMETER, SET_PARAMETER")
 	case "ANNOUNCE":
 		session.Type = SESSION_TYPE_PUSHER
 		session.URL = req.URL
@@ -448,20 +398,14 @@ func (session *Session) handleRequest(req *Request) {
 			return
 		}
 		session.Path = url.Path
+		if !session.checkAuthHook(AUTH_ACTION_PUBLISH, url, res) {
+			return
+		}
 
 		session.SDPRaw = req.Body
-		session.SDPMap = ParseSDP(req.Body)
-		sdp, ok := session.SDPMap["audio"]
-		if ok {
-			session.AControl = sdp.Control
-			session.ACodec = sdp.Codec
-			logger.Printf("audio codec[%s]\n", session.ACodec)
-		}
-		sdp, ok = session.SDPMap["video"]
-		if ok {
-			session.VControl = sdp.Control
-			session.VCodec = sdp.Codec
-			logger.Printf("video codec[%s]\n", session.VCodec)
+		session.Tracks = NewTracks(req.Body)
+		for _, track := range session.Tracks {
+			logger.Printf("%v control[%s]\n", track, track.Control)
 		}
 		addPusher := false
 		if session.closeOld {
@@ -515,173 +459,121 @@ func (session *Session) handleRequest(req *Request) {
 			return
 		}
 		session.Path = url.Path
+		if !session.checkAuthHook(AUTH_ACTION_PLAY, url, res) {
+			return
+		}
 		pusher := session.Server.GetPusher(session.Path)
+		if pusher == nil {
+			if node := session.Server.LocatePusher(session.Path); node != "" && !session.Server.IsLocalNode(node) {
+				// published by another node in the cluster, send the player there.
+				url.User = nil
+				url.Host = node
+				res.StatusCode = 302
+				res.Status = "Moved Temporarily"
+				res.Header.Set("Location", url.String())
+				return
+			}
+			pusher = session.Server.demandPusher(session.Path)
+		}
 		if pusher == nil {
 			res.StatusCode = 404
 			res.Status = "NOT FOUND"
 			return
 		}
+		sdpRaw := pusher.SDPRaw()
+		session.backchannel = requiresTag(req.Header, ONVIF_BACKCHANNEL)
+		if !session.backchannel {
+			sdpRaw = stripBackchannel(sdpRaw, pusher.Tracks())
+		} else if !hasBackchannel(pusher.Tracks()) {
+			res.StatusCode = 551
+			res.Status = "Option Not Supported"
+			res.Header.Set("Unsupported", ONVIF_BACKCHANNEL)
+			return
+		}
 		session.Player = NewPlayer(session, pusher)
 		session.Pusher = pusher
-		session.AControl = pusher.AControl()
-		session.VControl = pusher.VControl()
-		session.ACodec = pusher.ACodec()
-		session.VCodec = pusher.VCodec()
-		session.Conn.timeout = 0
-		res.SetBody(session.Pusher.SDPRaw())
+		session.Tracks = copyTracks(pusher.Tracks())
+		if session.backchannel {
+			session.RTPHandles = append(session.RTPHandles, session.forwardBackchannel)
+		}
+		conn.Conn.timeout = 0
+		res.Header.Set("Content-Type", "application/sdp")
+		res.SetBody(sdpRaw)
 	case "SETUP":
-		ts := req.Header["Transport"]
-		// control字段可能是`stream=1`字样，也可能是rtsp://...字样。即control可能是url的path，也可能是整个url
-		// 例1：
-		// a=control:streamid=1
-		// 例2：
-		// a=control:rtsp://192.168.1.64/trackID=1
-		// 例3：
-		// a=control:?ctype=video
-		setupUrl, err := url.Parse(req.URL)
-		if err != nil {
+		// error status. SETUP without ANNOUNCE or DESCRIBE.
+		if session.Pusher == nil {
 			res.StatusCode = 500
-			res.Status = "Invalid URL"
+			res.Status = "Error Status"
 			return
 		}
-		if setupUrl.Port() == "" {
-			setupUrl.Host = fmt.Sprintf("%s:554", setupUrl.Host)
+		track, err := findTrack(session.Tracks, req.URL)
+		if err == nil && track.Backchannel && !session.backchannel {
+			err = fmt.Errorf("backchannel %s not required", req.URL)
 		}
-		setupPath := setupUrl.String()
-
-		// error status. SETUP without ANNOUNCE or DESCRIBE.
-		if session.Pusher == nil {
+		if err != nil {
 			res.StatusCode = 500
-			res.Status = "Error Status"
+			res.Status = fmt.Sprintf("SETUP got UnKown control:%s", req.URL)
+			logger.Printf("SETUP %v", err)
 			return
 		}
-		//setupPath = setupPath[strings.LastIndex(setupPath, "/")+1:]
-		vPath := ""
-		if strings.Index(strings.ToLower(session.VControl), "rtsp://") == 0 {
-			vControlUrl, err := url.Parse(session.VControl)
-			if err != nil {
-				res.StatusCode = 500
-				res.Status = "Invalid VControl"
-				return
-			}
-			if vControlUrl.Port() == "" {
-				vControlUrl.Host = fmt.Sprintf("%s:554", vControlUrl.Host)
-			}
-			vPath = vControlUrl.String()
-		} else {
-			vPath = session.VControl
+		ts, ok := SelectTransport(SplitTransports(req.Header.Values("Transport")))
+		if !ok {
+			res.StatusCode = 461
+			res.Status = "Unsupported Transport"
+			logger.Printf("SETUP %v, no transport supported in %q", track, req.Header.Values("Transport"))
+			return
 		}
-
-		aPath := ""
-		if strings.Index(strings.ToLower(session.AControl), "rtsp://") == 0 {
-			aControlUrl, err := url.Parse(session.AControl)
-			if err != nil {
-				res.StatusCode = 500
-				res.Status = "Invalid AControl"
-				return
-			}
-			if aControlUrl.Port() == "" {
-				aControlUrl.Host = fmt.Sprintf("%s:554", aControlUrl.Host)
-			}
-			aPath = aControlUrl.String()
-		} else {
-			aPath = session.AControl
+		if track.Backchannel && !session.checkBackchannel(res) {
+			return
+		}
+		if track.Backchannel && !session.Pusher.ClaimBackchannel(session) {
+			res.StatusCode = 453
+			res.Status = "Not Enough Bandwidth"
+			logger.Printf("SETUP %v, talked by another player", track)
+			return
 		}
 
-		mtcp := regexp.MustCompile("interleaved=(\\d+)(-(\\d+))?")
-		mudp := regexp.MustCompile("client_port=(\\d+)(-(\\d+))?")
-
-		if tcpMatchs := mtcp.FindStringSubmatch(ts); tcpMatchs != nil {
-			session.TransType = TRANS_TYPE_TCP
-			if setupPath == aPath || aPath != "" && strings.LastIndex(setupPath, aPath) == len(setupPath)-len(aPath) {
-				session.aRTPChannel, _ = strconv.Atoi(tcpMatchs[1])
-				session.aRTPControlChannel, _ = strconv.Atoi(tcpMatchs[3])
-			} else if setupPath == vPath || vPath != "" && strings.LastIndex(setupPath, vPath) == len(setupPath)-len(vPath) {
-				session.vRTPChannel, _ = strconv.Atoi(tcpMatchs[1])
-				session.vRTPControlChannel, _ = strconv.Atoi(tcpMatchs[3])
-			} else {
-				res.StatusCode = 500
-				res.Status = fmt.Sprintf("SETUP [TCP] got UnKown control:%s", setupPath)
-				logger.Printf("SETUP [TCP] got UnKown control:%s", setupPath)
-			}
-			logger.Printf("Parse SETUP req.TRANSPORT:TCP.Session.Type:%d,control:%s, AControl:%s,VControl:%s", session.Type, setupPath, aPath, vPath)
-		} else if udpMatchs := mudp.FindStringSubmatch(ts); udpMatchs != nil {
-			session.TransType = TRANS_TYPE_UDP
+		if tcpMatchs := interleavedRex.FindStringSubmatch(ts); tcpMatchs != nil {
+			session.setTransType(TRANS_TYPE_TCP)
+			track.RTPChannel, _ = strconv.Atoi(tcpMatchs[1])
+			track.RTCPChannel, _ = strconv.Atoi(tcpMatchs[3])
+			logger.Printf("Parse SETUP req.TRANSPORT:TCP.Session.Type:%d,%v,channels:%d-%d", session.Type, track, track.RTPChannel, track.RTCPChannel)
+		} else if udpPorts := ParseTransportPorts(ts); udpPorts != nil {
+			session.setTransType(TRANS_TYPE_UDP)
 			// no need for tcp timeout.
-			session.Conn.timeout = 0
-			if session.Type == SESSEION_TYPE_PLAYER && session.UDPClient == nil {
-				session.UDPClient = &UDPClient{
-					Session: session,
-				}
-			}
-			if session.Type == SESSION_TYPE_PUSHER && session.Pusher.UDPServer == nil {
-				session.Pusher.UDPServer = &UDPServer{
-					Session: session,
-				}
-			}
-			logger.Printf("Parse SETUP req.TRANSPORT:UDP.Session.Type:%d,control:%s, AControl:%s,VControl:%s", session.Type, setupPath, aPath, vPath)
-			if setupPath == aPath || aPath != "" && strings.LastIndex(setupPath, aPath) == len(setupPath)-len(aPath) {
-				if session.Type == SESSEION_TYPE_PLAYER {
-					session.UDPClient.APort, _ = strconv.Atoi(udpMatchs[1])
-					session.UDPClient.AControlPort, _ = strconv.Atoi(udpMatchs[3])
-					if err := session.UDPClient.SetupAudio(); err != nil {
-						res.StatusCode = 500
-						res.Status = fmt.Sprintf("udp client setup audio error, %v", err)
-						return
-					}
+			conn.Conn.timeout = 0
+			logger.Printf("Parse SETUP req.TRANSPORT:UDP.Session.Type:%d,%v,ports:%d-%d", session.Type, track, udpPorts.RTPPort, udpPorts.RTCPPort)
+			switch session.Type {
+			case SESSEION_TYPE_PLAYER:
+				if session.UDPClient == nil {
+					session.UDPClient = NewUDPClient(session)
 				}
-				if session.Type == SESSION_TYPE_PUSHER {
-					if err := session.Pusher.UDPServer.SetupAudio(); err != nil {
-						res.StatusCode = 500
-						res.Status = fmt.Sprintf("udp server setup audio error, %v", err)
-						return
-					}
-					tss := strings.Split(ts, ";")
-					idx := -1
-					for i, val := range tss {
-						if val == udpMatchs[0] {
-							idx = i
-						}
-					}
-					tail := append([]string{}, tss[idx+1:]...)
-					tss = append(tss[:idx+1], fmt.Sprintf("server_port=%d-%d", session.Pusher.UDPServer.APort, session.Pusher.UDPServer.AControlPort))
-					tss = append(tss, tail...)
-					ts = strings.Join(tss, ";")
+				if err := session.UDPClient.SetupTrack(track, udpPorts.RTPPort, udpPorts.RTCPPort); err != nil {
+					res.StatusCode = 500
+					res.Status = fmt.Sprintf("udp client setup %s error, %v", track.AVType, err)
+					return
 				}
-			} else if setupPath == vPath || vPath != "" && strings.LastIndex(setupPath, vPath) == len(setupPath)-len(vPath) {
-				if session.Type == SESSEION_TYPE_PLAYER {
-					session.UDPClient.VPort, _ = strconv.Atoi(udpMatchs[1])
-					session.UDPClient.VControlPort, _ = strconv.Atoi(udpMatchs[3])
-					if err := session.UDPClient.SetupVideo(); err != nil {
-						res.StatusCode = 500
-						res.Status = fmt.Sprintf("udp client setup video error, %v", err)
-						return
-					}
+				rtpPort, rtcpPort := session.UDPClient.LocalPorts(track.Index)
+				ts = insertTransportParam(ts, udpPorts.Param, serverPortsParam(session.Version, rtpPort, rtcpPort))
+			case SESSION_TYPE_PUSHER:
+				if session.Pusher.UDPServer == nil {
+					session.Pusher.UDPServer = NewUDPServer(session, nil)
 				}
-
-				if session.Type == SESSION_TYPE_PUSHER {
-					if err := session.Pusher.UDPServer.SetupVideo(); err != nil {
-						res.StatusCode = 500
-						res.Status = fmt.Sprintf("udp server setup video error, %v", err)
-						return
-					}
-					tss := strings.Split(ts, ";")
-					idx := -1
-					for i, val := range tss {
-						if val == udpMatchs[0] {
-							idx = i
-						}
-					}
-					tail := append([]string{}, tss[idx+1:]...)
-					tss = append(tss[:idx+1], fmt.Sprintf("server_port=%d-%d", session.Pusher.UDPServer.VPort, session.Pusher.UDPServer.VControlPort))
-					tss = append(tss, tail...)
-					ts = strings.Join(tss, ";")
+				udpTrack, err := session.Pusher.UDPServer.SetupTrack(track)
+				if err != nil {
+					res.StatusCode = 500
+					res.Status = fmt.Sprintf("udp server setup %s error, %v", track.AVType, err)
+					return
 				}
-			} else {
-				logger.Printf("SETUP [UDP] got UnKown control:%s", setupPath)
+				ts = insertTransportParam(ts, udpPorts.Param, serverPortsParam(session.Version, udpTrack.Port, udpTrack.ControlPort))
 			}
 		}
-		res.Header["Transport"] = ts
+		res.Header.Set("Transport", ts)
+		if session.Version == RTSP_VERSION_2 {
+			// live streams can not seek.
+			res.Header.Set("Accept-Ranges", "npt")
+			res.Header.Set("Media-Properties", "No-Seeking, Time-Progressing, Time-Duration=0.0")
+		}
 	case "PLAY":
 		// error status. PLAY without ANNOUNCE or DESCRIBE.
 		if session.Pusher == nil {
@@ -689,7 +581,11 @@ func (session *Session) handleRequest(req *Request) {
 			res.Status = "Error Status"
 			return
 		}
-		res.Header["Range"] = req.Header["Range"]
+		if rangeHeader := req.Header.Get("Range"); rangeHeader != "" {
+			res.Header.Set("Range", rangeHeader)
+		} else if session.Version == RTSP_VERSION_2 {
+			res.Header.Set("Range", "npt=now-")
+		}
 	case "RECORD":
 		// error status. RECORD without ANNOUNCE or DESCRIBE.
 		if session.Pusher == nil {
@@ -704,7 +600,184 @@ func (session *Session) handleRequest(req *Request) {
 			return
 		}
 		session.Player.Pause(true)
+	case GET_PARAMETER:
+		session.handleGetParameter(req, res)
+	case SET_PARAMETER:
+		session.handleSetParameter(req, res)
+	}
+}
+
+// negotiateVersion answers in the version of the first request of the
+// session, later requests must keep to it.
+func (session *Session) negotiateVersion(req *Request, res *Response) bool {
+	if session.Version == "" && IsSupportedVersion(req.Version) {
+		session.Version = req.Version
+	}
+	if session.Version != "" {
+		res.Version = session.Version
+	}
+	if req.Version != session.Version {
+		res.StatusCode = 505
+		res.Status = "RTSP Version Not Supported"
+		return false
+	}
+	if session.Version != RTSP_VERSION_2 {
+		return true
 	}
+	// requests sent before the Session id is known, see RFC 7826 18.33.
+	if id := req.Header.Get("Pipelined-Requests"); id != "" {
+		res.Header.Set("Pipelined-Requests", id)
+	}
+	if len(req.Header.Values("Supported")) > 0 {
+		res.Header.Set("Supported", "play.basic")
+	}
+	// no feature tags but play.basic are supported.
+	for _, require := range req.Header.Values("Require") {
+		for _, tag := range strings.Split(require, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" && tag != "play.basic" && tag != ONVIF_BACKCHANNEL {
+				res.StatusCode = 551
+				res.Status = "Option Not Supported"
+				res.Header.Add("Unsupported", tag)
+			}
+		}
+	}
+	return res.StatusCode != 551
+}
+
+// PlayNotify sends a PLAY_NOTIFY request to RTSP 2.0 players, e.g. with
+// reason end-of-stream before the session stops as the pusher is gone.
+func (session *Session) PlayNotify(reason string) {
+	if session.Version != RTSP_VERSION_2 || session.Type != SESSEION_TYPE_PLAYER || session.Stoped() {
+		return
+	}
+	session.sendRequest(PLAY_NOTIFY, func(header Header) {
+		header.Set("Notify-Reason", reason)
+	})
+}
+
+// Redirect sends a REDIRECT request to the client, which should connect to
+// location instead. The caller stops the session.
+func (session *Session) Redirect(location string) {
+	if session.Stoped() {
+		return
+	}
+	session.sendRequest(REDIRECT, func(header Header) {
+		header.Set("Location", location)
+		if session.Version == RTSP_VERSION_2 {
+			header.Set("Terminate-Reason", "Server-Admin")
+		}
+	})
+}
+
+// sendRequest sends a request of the server to the client on the session
+// connection, the response is ignored by Start.
+func (session *Session) sendRequest(method string, setHeader func(header Header)) {
+	conn := session.Connection()
+	if conn == nil {
+		return
+	}
+	session.notifyCSeq++
+	req := NewRequest(method, session.URL, strconv.Itoa(session.notifyCSeq))
+	if session.Version != "" {
+		req.Version = session.Version
+	}
+	req.Header.Set("Session", session.ID)
+	setHeader(req.Header)
+	session.logger.Printf(">>>\n%s", req)
+	outBytes := []byte(req.String())
+	if err := conn.write(outBytes); err != nil {
+		session.logger.Println(err)
+		return
+	}
+	session.OutBytes += len(outBytes)
+}
+
+func (session *Session) unauthorized(res *Response) {
+	res.StatusCode = 401
+	res.Status = "Unauthorized"
+	if session.authorizationEnable {
+		nonce := fmt.Sprintf("%x", md5.Sum([]byte(shortid.MustGenerate())))
+		session.nonce = nonce
+		res.Header.Set("WWW-Authenticate", fmt.Sprintf(`Digest realm="%s", nonce="%s", algorithm="MD5"`, models.DIGEST_REALM, nonce))
+	}
+}
+
+// tokenActionOf returns the action a signed url must grant for the request,
+// empty for the methods which need none. SETUP is a publish after ANNOUNCE,
+// the player requiring ONVIF_BACKCHANNEL publishes too, see checkBackchannel.
+func (session *Session) tokenActionOf(req *Request) string {
+	switch req.Method {
+	case ANNOUNCE, RECORD:
+		return utils.TOKEN_ACTION_PUBLISH
+	case DESCRIBE:
+		if requiresTag(req.Header, ONVIF_BACKCHANNEL) {
+			return utils.TOKEN_ACTION_PUBLISH
+		}
+		return utils.TOKEN_ACTION_PLAY
+	case PLAY, SETUP:
+		if session.tokenAction == utils.TOKEN_ACTION_PUBLISH {
+			return utils.TOKEN_ACTION_PUBLISH
+		}
+		return utils.TOKEN_ACTION_PLAY
+	}
+	return ""
+}
+
+// checkURLToken verifies the token and expires query parameters of a signed
+// url for action, a valid token stands in for digest authorization for the
+// session.
+func (session *Session) checkURLToken(rawURL, action string, res *Response) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		res.StatusCode = 500
+		res.Status = "Invalid URL"
+		return false
+	}
+	query := u.Query()
+	token := query.Get("token")
+	if token == "" {
+		session.unauthorized(res)
+		return false
+	}
+	ip := session.RemoteHost()
+	if err := utils.CheckURLToken(session.tokenSecret, action, u.Path, token, query.Get("expires"), ip); err != nil {
+		session.logger.Printf("check %s url token of %s err:%v", action, u.Path, err)
+		res.StatusCode = 403
+		res.Status = "Forbidden"
+		return false
+	}
+	session.tokenAction = action
+	return true
+}
+
+// checkAuthHook asks the configured on_publish/on_play service whether the
+// request is allowed, and fills res with 401 or 403 when it is not.
+func (session *Session) checkAuthHook(action string, u *url.URL, res *Response) bool {
+	hook := session.Server.authHook
+	if hook == nil {
+		return true
+	}
+	ip := session.RemoteHost()
+	code := hook.Check(&AuthHookRequest{
+		Action: action,
+		ID:     session.ID,
+		Path:   u.Path,
+		URL:    session.URL,
+		IP:     ip,
+		User:   session.Username,
+		Token:  u.Query().Get("token"),
+	})
+	switch code {
+	case 200:
+		return true
+	case 401:
+		session.unauthorized(res)
+	default:
+		res.StatusCode = 403
+		res.Status = "Forbidden"
+	}
+	session.logger.Printf("%s %s rejected by auth hook, %d", action, u.Path, code)
+	return false
 }
 
 func (session *Session) SendRTP(pack *RTPPack) (err error) {
@@ -721,61 +794,81 @@ func (session *Session) SendRTP(pack *RTPPack) (err error) {
 		err = session.UDPClient.SendRTP(pack)
 		return
 	}
-	switch pack.Type {
-	case RTP_TYPE_AUDIO:
-		bufChannel := make([]byte, 2)
-		bufChannel[0] = 0x24
-		bufChannel[1] = byte(session.aRTPChannel)
-		session.connWLock.Lock()
-		session.connRW.Write(bufChannel)
-		bufLen := make([]byte, 2)
-		binary.BigEndian.PutUint16(bufLen, uint16(pack.Buffer.Len()))
-		session.connRW.Write(bufLen)
-		session.connRW.Write(pack.Buffer.Bytes())
-		session.connRW.Flush()
-		session.connWLock.Unlock()
-		session.OutBytes += pack.Buffer.Len() + 4
-	case RTP_TYPE_AUDIOCONTROL:
-		bufChannel := make([]byte, 2)
-		bufChannel[0] = 0x24
-		bufChannel[1] = byte(session.aRTPControlChannel)
-		session.connWLock.Lock()
-		session.connRW.Write(bufChannel)
-		bufLen := make([]byte, 2)
-		binary.BigEndian.PutUint16(bufLen, uint16(pack.Buffer.Len()))
-		session.connRW.Write(bufLen)
-		session.connRW.Write(pack.Buffer.Bytes())
-		session.connRW.Flush()
-		session.connWLock.Unlock()
-		session.OutBytes += pack.Buffer.Len() + 4
-	case RTP_TYPE_VIDEO:
-		bufChannel := make([]byte, 2)
-		bufChannel[0] = 0x24
-		bufChannel[1] = byte(session.vRTPChannel)
-		session.connWLock.Lock()
-		session.connRW.Write(bufChannel)
-		bufLen := make([]byte, 2)
-		binary.BigEndian.PutUint16(bufLen, uint16(pack.Buffer.Len()))
-		session.connRW.Write(bufLen)
-		session.connRW.Write(pack.Buffer.Bytes())
-		session.connRW.Flush()
-		session.connWLock.Unlock()
-		session.OutBytes += pack.Buffer.Len() + 4
-	case RTP_TYPE_VIDEOCONTROL:
-		bufChannel := make([]byte, 2)
-		bufChannel[0] = 0x24
-		bufChannel[1] = byte(session.vRTPControlChannel)
-		session.connWLock.Lock()
-		session.connRW.Write(bufChannel)
-		bufLen := make([]byte, 2)
-		binary.BigEndian.PutUint16(bufLen, uint16(pack.Buffer.Len()))
-		session.connRW.Write(bufLen)
-		session.connRW.Write(pack.Buffer.Bytes())
-		session.connRW.Flush()
-		session.connWLock.Unlock()
-		session.OutBytes += pack.Buffer.Len() + 4
-	default:
-		err = fmt.Errorf("session tcp send rtp got unkown pack type[%v]", pack.Type)
+	if pack.Track < 0 || pack.Track >= len(session.Tracks) {
+		err = fmt.Errorf("session tcp send rtp got unkown track[%d]", pack.Track)
+		return
+	}
+	track := session.Tracks[pack.Track]
+	channel := track.RTPChannel
+	if pack.Type.IsControl() {
+		channel = track.RTCPChannel
+	}
+	if channel < 0 {
+		// the track is not set up by the player.
+		return
 	}
+	err = session.writeInterleaved(channel, pack)
 	return
 }
+
+// writeInterleaved sends pack on the tcp channel, a '$' frame of RFC 2326 10.12.
+func (session *Session) writeInterleaved(channel int, pack *RTPPack) error {
+	conn := session.Connection()
+	if conn == nil {
+		return fmt.Errorf("session tcp send rtp got no connection")
+	}
+	buf := interleavedFrame(channel, pack)
+	if err := conn.write(buf); err != nil {
+		return err
+	}
+	session.OutBytes += len(buf)
+	return nil
+}
+
+// interleavedFrame returns pack framed for the tcp channel.
+func interleavedFrame(channel int, pack *RTPPack) []byte {
+	buf := make([]byte, 4+pack.Buffer.Len())
+	buf[0] = 0x24
+	buf[1] = byte(channel)
+	binary.BigEndian.PutUint16(buf[2:], uint16(pack.Buffer.Len()))
+	copy(buf[4:], pack.Buffer.Bytes())
+	return buf
+}
+
+// Connection returns the connection the session is bound to, nil when it is
+// detached waiting to be resumed.
+func (session *Session) Connection() *Connection {
+	session.connLock.RLock()
+	defer session.connLock.RUnlock()
+	return session.conn
+}
+
+func (session *Session) setConnection(conn *Connection) {
+	session.connLock.Lock()
+	session.conn = conn
+	if conn != nil {
+		session.remoteAddr = conn.Conn.RemoteAddr().String()
+	}
+	session.connLock.Unlock()
+}
+
+// RemoteAddr returns the address of the connection of the client, the last
+// one when the session is detached.
+func (session *Session) RemoteAddr() string {
+	session.connLock.RLock()
+	defer session.connLock.RUnlock()
+	return session.remoteAddr
+}
+
+// RemoteHost returns the ip of the client.
+func (session *Session) RemoteHost() string {
+	session.connLock.RLock()
+	defer session.connLock.RUnlock()
+	host, _, _ := net.SplitHostPort(session.remoteAddr)
+	return host
+}
+
+// pristine reports whether the session has not handled any request.
+func (session *Session) pristine() bool {
+	return atomic.LoadInt64(&session.activeAt) == 0
+}
@@ -0,0 +1,145 @@
+package rtsp
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// TransportPorts are the udp ports of a Transport header, given by
+// client_port in RTSP 1.0 or dest_addr in RTSP 2.0.
+type TransportPorts struct {
+	Param    string // the matched parameter
+	RTPPort  int
+	RTCPPort int
+}
+
+var (
+	interleavedRex = regexp.MustCompile("interleaved=(\\d+)(-(\\d+))?")
+	clientPortRex  = regexp.MustCompile("client_port=(\\d+)(-(\\d+))?")
+	serverPortRex  = regexp.MustCompile("server_port=(\\d+)(-(\\d+))?")
+	// dest_addr="host:port"/"host:port", host is optional.
+	destAddrRex = regexp.MustCompile(`dest_addr="([^"]*)"(/"([^"]*)")?`)
+	srcAddrRex  = regexp.MustCompile(`src_addr="([^"]*)"(/"([^"]*)")?`)
+)
+
+// SplitTransports returns the transport specs of the Transport header
+// values, the alternatives a client offers in the order it prefers them,
+// RFC 7826 18.54. Commas in quoted values do not split.
+func SplitTransports(values []string) []string {
+	specs := make([]string, 0, len(values))
+	for _, value := range values {
+		quoted, start := false, 0
+		for i := 0; i <= len(value); i++ {
+			if i < len(value) && value[i] == '"' {
+				quoted = !quoted
+			}
+			if i == len(value) || (value[i] == ',' && !quoted) {
+				if spec := strings.TrimSpace(value[start:i]); spec != "" {
+					specs = append(specs, spec)
+				}
+				start = i + 1
+			}
+		}
+	}
+	return specs
+}
+
+// SelectTransport returns the first of the transport specs the server can
+// serve, unicast RTP/AVP over tcp with interleaved channels or over udp with
+// client ports, and whether there is one.
+func SelectTransport(specs []string) (string, bool) {
+	for _, spec := range specs {
+		params := strings.Split(spec, ";")
+		protocol := strings.ToUpper(strings.TrimSpace(params[0]))
+		multicast := false
+		for _, param := range params[1:] {
+			multicast = multicast || strings.EqualFold(strings.TrimSpace(param), "multicast")
+		}
+		if multicast {
+			continue
+		}
+		switch protocol {
+		case "RTP/AVP/TCP":
+			if interleavedRex.MatchString(spec) {
+				return spec, true
+			}
+		case "RTP/AVP", "RTP/AVP/UDP":
+			// some clients leave out the lower transport of interleaved.
+			if interleavedRex.MatchString(spec) || ParseTransportPorts(spec) != nil {
+				return spec, true
+			}
+		}
+	}
+	return "", false
+}
+
+// ParseTransportPorts returns nil when neither client_port nor dest_addr is
+// in the Transport header ts.
+func ParseTransportPorts(ts string) *TransportPorts {
+	if matches := clientPortRex.FindStringSubmatch(ts); matches != nil {
+		rtpPort, _ := strconv.Atoi(matches[1])
+		rtcpPort, _ := strconv.Atoi(matches[3])
+		return &TransportPorts{Param: matches[0], RTPPort: rtpPort, RTCPPort: rtcpPort}
+	}
+	if matches := destAddrRex.FindStringSubmatch(ts); matches != nil {
+		rtpPort := addrPort(matches[1])
+		if rtpPort == 0 {
+			return nil
+		}
+		return &TransportPorts{Param: matches[0], RTPPort: rtpPort, RTCPPort: addrPort(matches[3])}
+	}
+	return nil
+}
+
+// ParseServerPorts returns the udp ports of the server in the Transport
+// header of a SETUP response, nil if there is no server_port or src_addr.
+func ParseServerPorts(ts string) *TransportPorts {
+	if matches := serverPortRex.FindStringSubmatch(ts); matches != nil {
+		rtpPort, _ := strconv.Atoi(matches[1])
+		rtcpPort, _ := strconv.Atoi(matches[3])
+		return &TransportPorts{Param: matches[0], RTPPort: rtpPort, RTCPPort: rtcpPort}
+	}
+	if matches := srcAddrRex.FindStringSubmatch(ts); matches != nil {
+		rtpPort := addrPort(matches[1])
+		if rtpPort == 0 {
+			return nil
+		}
+		return &TransportPorts{Param: matches[0], RTPPort: rtpPort, RTCPPort: addrPort(matches[3])}
+	}
+	return nil
+}
+
+func addrPort(addr string) int {
+	i := strings.LastIndex(addr, ":")
+	if i < 0 {
+		return 0
+	}
+	port, _ := strconv.Atoi(addr[i+1:])
+	return port
+}
+
+// serverPortsParam is server_port in RTSP 1.0, src_addr in RTSP 2.0.
+func serverPortsParam(version string, rtpPort, rtcpPort int) string {
+	if version == RTSP_VERSION_2 {
+		return fmt.Sprintf(`src_addr=":%d"/":%d"`, rtpPort, rtcpPort)
+	}
+	return fmt.Sprintf("server_port=%d-%d", rtpPort, rtcpPort)
+}
+
+// insertTransportParam inserts param after the parameter after of the
+// Transport header ts.
+func insertTransportParam(ts, after, param string) string {
+	tss := strings.Split(ts, ";")
+	idx := len(tss) - 1
+	for i, val := range tss {
+		if strings.TrimSpace(val) == after {
+			idx = i
+		}
+	}
+	tail := append([]string{}, tss[idx+1:]...)
+	tss = append(tss[:idx+1], param)
+	tss = append(tss, tail...)
+	return strings.Join(tss, ";")
+}
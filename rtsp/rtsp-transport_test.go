@@ -0,0 +1,64 @@
+package rtsp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitTransports(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   []string
+	}{
+		{[]string{"RTP/AVP;unicast;client_port=5000-5001"}, []string{"RTP/AVP;unicast;client_port=5000-5001"}},
+		{[]string{"RTP/AVP/TCP;interleaved=0-1, RTP/AVP;unicast;client_port=5000-5001"}, []string{"RTP/AVP/TCP;interleaved=0-1", "RTP/AVP;unicast;client_port=5000-5001"}},
+		{[]string{`RTP/AVP;dest_addr="a,b:5000"/"a,b:5001",RTP/AVP/TCP;interleaved=2-3`}, []string{`RTP/AVP;dest_addr="a,b:5000"/"a,b:5001"`, "RTP/AVP/TCP;interleaved=2-3"}},
+		{[]string{"RTP/AVP;multicast", "RTP/AVP/TCP;interleaved=0-1"}, []string{"RTP/AVP;multicast", "RTP/AVP/TCP;interleaved=0-1"}},
+		{[]string{" , ,"}, []string{}},
+		{nil, []string{}},
+	}
+	for _, tt := range tests {
+		if got := SplitTransports(tt.values); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SplitTransports(%q) = %q, want %q", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestSelectTransport(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+		ok     bool
+	}{
+		{"RTP/AVP;unicast;client_port=5000-5001", "RTP/AVP;unicast;client_port=5000-5001", true},
+		{"RTP/AVP/TCP;unicast;interleaved=0-1", "RTP/AVP/TCP;unicast;interleaved=0-1", true},
+		{"RTP/AVP;unicast;interleaved=0-1", "RTP/AVP;unicast;interleaved=0-1", true},
+		{"RTP/SAVP;unicast;client_port=5000-5001, rtp/avp/udp;unicast;client_port=5002-5003", "rtp/avp/udp;unicast;client_port=5002-5003", true},
+		{"RTP/AVP;multicast;client_port=5000-5001, RTP/AVP/TCP;interleaved=0-1", "RTP/AVP/TCP;interleaved=0-1", true},
+		{`RTP/AVP/TCP;unicast, RTP/AVP;unicast;dest_addr=":5000"/":5001"`, `RTP/AVP;unicast;dest_addr=":5000"/":5001"`, true},
+		{"RTP/AVP/TCP;unicast;client_port=5000-5001", "", false},
+		{"RTP/AVP;unicast", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := SelectTransport(SplitTransports([]string{tt.header}))
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("SelectTransport(%q) = %q, %v, want %q, %v", tt.header, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestInsertTransportParam(t *testing.T) {
+	tests := []struct {
+		ts, after, param, want string
+	}{
+		{"RTP/AVP;unicast;client_port=5000-5001;mode=play", "client_port=5000-5001", "server_port=6000-6001", "RTP/AVP;unicast;client_port=5000-5001;server_port=6000-6001;mode=play"},
+		{"RTP/AVP; unicast; client_port=5000-5001", "client_port=5000-5001", "server_port=6000-6001", "RTP/AVP; unicast; client_port=5000-5001;server_port=6000-6001"},
+		{"RTP/AVP;unicast", "client_port=5000-5001", "server_port=6000-6001", "RTP/AVP;unicast;server_port=6000-6001"},
+	}
+	for _, tt := range tests {
+		if got := insertTransportParam(tt.ts, tt.after, tt.param); got != tt.want {
+			t.Errorf("insertTransportParam(%q) = %q, want %q", tt.ts, got, tt.want)
+		}
+	}
+}
@@ -7,11 +7,14 @@ import (
 	"strings"
 )
 
+// SDPInfo is a media of a sdp, Index is its order in the sdp.
 type SDPInfo struct {
-	AVType             string
+	Index              int
+	AVType             string // audio, video, application...
 	Codec              string
 	TimeScale          int
 	Control            string
+	Direction          string // sendonly, recvonly, sendrecv or inactive, empty if not given
 	Rtpmap             int
 	Config             []byte
 	SpropParameterSets [][]byte
@@ -20,8 +23,9 @@ type SDPInfo struct {
 	IndexLength        int
 }
 
-func ParseSDP(sdpRaw string) map[string]*SDPInfo {
-	sdpMap := make(map[string]*SDPInfo)
+// ParseSDP returns the media of the sdp in order, Codec is lower case.
+func ParseSDP(sdpRaw string) []*SDPInfo {
+	infos := make([]*SDPInfo, 0)
 	var info *SDPInfo
 	for _, line := range strings.Split(sdpRaw, "\n") {
 		line = strings.TrimSpace(line)
@@ -31,10 +35,9 @@ func ParseSDP(sdpRaw string) map[string]*SDPInfo {
 			switch typeval[0] {
 			case "m":
 				if len(fields) > 0 {
-					switch fields[0] {
-					case "audio", "video":
-						sdpMap[fields[0]] = &SDPInfo{AVType: fields[0]}
-						info = sdpMap[fields[0]]
+					info = &SDPInfo{Index: len(infos), AVType: fields[0]}
+					infos = append(infos, info)
+					if len(fields) > 1 {
 						mfields := strings.Split(fields[1], " ")
 						if len(mfields) >= 3 {
 							info.PayloadType, _ = strconv.Atoi(mfields[2])
@@ -44,6 +47,10 @@ func ParseSDP(sdpRaw string) map[string]*SDPInfo {
 
 			case "a":
 				if info != nil {
+					switch fields[0] {
+					case "sendonly", "recvonly", "sendrecv", "inactive":
+						info.Direction = fields[0]
+					}
 					for _, field := range fields {
 						keyval := strings.SplitN(field, ":", 2)
 						if len(keyval) >= 2 {
@@ -66,6 +73,10 @@ func ParseSDP(sdpRaw string) map[string]*SDPInfo {
 								info.Codec = "h264"
 							case "H265":
 								info.Codec = "h265"
+							default:
+								if info.Codec == "" && strings.HasPrefix(fields[0], "rtpmap:") {
+									info.Codec = strings.ToLower(key)
+								}
 							}
 							if i, err := strconv.Atoi(keyval[1]); err == nil {
 								info.TimeScale = i
@@ -85,6 +96,10 @@ func ParseSDP(sdpRaw string) map[string]*SDPInfo {
 										info.SizeLength, _ = strconv.Atoi(val)
 									case "indexlength":
 										info.IndexLength, _ = strconv.Atoi(val)
+									case "sprop-vps", "sprop-sps", "sprop-pps":
+										// h265 parameter sets, see RFC 7798.
+										val, _ := base64.StdEncoding.DecodeString(val)
+										info.SpropParameterSets = append(info.SpropParameterSets, val)
 									case "sprop-parameter-sets":
 										fields := strings.Split(val, ",")
 										for _, field := range fields {
@@ -101,5 +116,15 @@ func ParseSDP(sdpRaw string) map[string]*SDPInfo {
 			}
 		}
 	}
-	return sdpMap
+	return infos
+}
+
+// FindSDP returns the first media of avType, nil if there is none.
+func FindSDP(infos []*SDPInfo, avType string) *SDPInfo {
+	for _, info := range infos {
+		if info.AVType == avType {
+			return info
+		}
+	}
+	return nil
 }
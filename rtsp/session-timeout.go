@@ -0,0 +1,110 @@
+package rtsp
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+)
+
+// sessionTimeout is the session_timeout advertised in the Session header,
+// sessions not refreshed within it are reaped. 0 disables the reaping.
+func sessionTimeout() time.Duration {
+	return time.Duration(utils.Conf().Section("rtsp").Key("session_timeout").MustInt(60)) * time.Second
+}
+
+// sessionHeader is the Session header value, "<id>;timeout=<seconds>".
+func (session *Session) sessionHeader() string {
+	if session.SessionTimeout <= 0 {
+		return session.ID
+	}
+	return fmt.Sprintf("%s;timeout=%d", session.ID, int(session.SessionTimeout.Seconds()))
+}
+
+// touch refreshes the session, on RTSP requests, interleaved data, udp rtp
+// of pushers and RTCP receiver reports of udp players.
+func (session *Session) touch() {
+	atomic.StoreInt64(&session.activeAt, time.Now().UnixNano())
+}
+
+// LastActiveAt returns when the session was refreshed the last time, see
+// touch.
+func (session *Session) LastActiveAt() time.Time {
+	if activeAt := atomic.LoadInt64(&session.activeAt); activeAt > 0 {
+		return time.Unix(0, activeAt)
+	}
+	return session.StartAt
+}
+
+func (session *Session) setTransType(transType TransType) {
+	session.stateLock.Lock()
+	session.TransType = transType
+	session.stateLock.Unlock()
+}
+
+// reapable reports whether the session is only kept alive by refreshes, as
+// a udp one or one detached from its connection. The others are stopped
+// with their connection.
+func (session *Session) reapable() bool {
+	session.stateLock.RLock()
+	udp := session.TransType == TRANS_TYPE_UDP
+	session.stateLock.RUnlock()
+	return udp || session.Connection() == nil
+}
+
+func (server *Server) addSession(session *Session) {
+	server.sessionsLock.Lock()
+	server.sessions[session.ID] = session
+	server.sessionsLock.Unlock()
+}
+
+func (server *Server) removeSession(session *Session) {
+	server.sessionsLock.Lock()
+	delete(server.sessions, session.ID)
+	server.sessionsLock.Unlock()
+}
+
+// GetSession returns the session of id, detached ones included.
+func (server *Server) GetSession(id string) *Session {
+	server.sessionsLock.RLock()
+	defer server.sessionsLock.RUnlock()
+	return server.sessions[id]
+}
+
+// GetSessions returns the sessions of the rtsp connections, detached ones
+// included.
+func (server *Server) GetSessions() (sessions []*Session) {
+	server.sessionsLock.RLock()
+	defer server.sessionsLock.RUnlock()
+	sessions = make([]*Session, 0, len(server.sessions))
+	for _, session := range server.sessions {
+		sessions = append(sessions, session)
+	}
+	return
+}
+
+// reapSessions stops the udp and detached sessions not refreshed within
+// their SessionTimeout, so that dead udp players no longer hold their
+// sockets. Tcp interleaved sessions may send no request for long, they end
+// with their connection.
+func (server *Server) reapSessions(stop chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			for _, session := range server.GetSessions() {
+				idle := now.Sub(session.LastActiveAt())
+				if session.SessionTimeout <= 0 || idle <= session.SessionTimeout || session.Stoped() || !session.reapable() {
+					continue
+				}
+				server.logger.Printf("%v timeout, idle %v", session, idle.Truncate(time.Second))
+				server.countSessionTimeout(session.Path)
+				go session.Stop()
+			}
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package rtsp
+
+import "testing"
+
+func TestSessionReapable(t *testing.T) {
+	tests := []struct {
+		name      string
+		transType TransType
+		conn      *Connection
+		want      bool
+	}{
+		{"tcp", TRANS_TYPE_TCP, &Connection{}, false},
+		{"udp", TRANS_TYPE_UDP, &Connection{}, true},
+		{"tcp detached", TRANS_TYPE_TCP, nil, true},
+		{"udp detached", TRANS_TYPE_UDP, nil, true},
+	}
+	for _, tt := range tests {
+		session := &Session{conn: tt.conn}
+		session.setTransType(tt.transType)
+		if got := session.reapable(); got != tt.want {
+			t.Errorf("%s: reapable = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package rtsp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+)
+
+// SnapshotDecoder decodes a key frame, an annex-b byte stream of h264 or
+// h265 NALUs, into a JPEG image scaled to width, 0 keeps the original size.
+type SnapshotDecoder interface {
+	Snapshot(codec string, frame []byte, width int) ([]byte, error)
+}
+
+var (
+	snapshotDecoder     SnapshotDecoder
+	snapshotDecoderLock sync.RWMutex
+)
+
+// SetSnapshotDecoder replaces the decoder of snapshots, by default ffmpeg_path
+// is used.
+func SetSnapshotDecoder(decoder SnapshotDecoder) {
+	snapshotDecoderLock.Lock()
+	snapshotDecoder = decoder
+	snapshotDecoderLock.Unlock()
+}
+
+func getSnapshotDecoder() SnapshotDecoder {
+	snapshotDecoderLock.RLock()
+	decoder := snapshotDecoder
+	snapshotDecoderLock.RUnlock()
+	if decoder != nil {
+		return decoder
+	}
+	if ffmpeg := utils.Conf().Section("rtsp").Key("ffmpeg_path").MustString(""); ffmpeg != "" {
+		return &FFmpegDecoder{Path: ffmpeg}
+	}
+	return nil
+}
+
+// FFmpegDecoder decodes snapshots with an ffmpeg process.
+type FFmpegDecoder struct {
+	Path    string
+	Timeout time.Duration
+}
+
+func (decoder *FFmpegDecoder) Snapshot(codec string, frame []byte, width int) ([]byte, error) {
+	format := codec
+	if codec == "h265" {
+		format = "hevc"
+	}
+	timeout := decoder.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	args := []string{"-hide_banner", "-loglevel", "error", "-f", format, "-i", "pipe:0", "-frames:v", "1"}
+	if width > 0 {
+		args = append(args, "-vf", fmt.Sprintf("scale=%d:-2", width))
+	}
+	args = append(args, "-f", "image2pipe", "-c:v", "mjpeg", "-q:v", "5", "pipe:1")
+	cmd := exec.CommandContext(ctx, decoder.Path, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(frame)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg snapshot err:%v, %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("ffmpeg snapshot got no image, %s", strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+var annexBStartCode = []byte{0, 0, 0, 1}
+
+func isKeyFrameNALU(codec string, nalu []byte) bool {
+	switch codec {
+	case "h264":
+		return nalu[0]&0x1F == 5
+	case "h265":
+		typ := (nalu[0] >> 1) & 0x3F
+		return typ >= 16 && typ <= 21
+	}
+	return false
+}
+
+func isParameterSetNALU(codec string, nalu []byte) bool {
+	switch codec {
+	case "h264":
+		return nalu[0]&0x1F == 7
+	case "h265":
+		return (nalu[0]>>1)&0x3F == 33
+	}
+	return false
+}
+
+// depacketizer reassembles the NALUs of rtp payloads, see RFC 6184 and RFC 7798.
+type depacketizer struct {
+	codec string
+	fu    []byte // fragmented NALU in progress
+}
+
+func (d *depacketizer) push(payload []byte) (nalus [][]byte) {
+	switch d.codec {
+	case "h264":
+		if len(payload) < 1 {
+			return
+		}
+		switch typ := payload[0] & 0x1F; {
+		case typ >= 1 && typ <= 23:
+			nalus = append(nalus, payload)
+		case typ == 24: // STAP-A
+			nalus = append(nalus, splitAggregation(payload[1:])...)
+		case typ == 28: // FU-A
+			if len(payload) < 2 {
+				return
+			}
+			if payload[1]&0x80 != 0 {
+				d.fu = []byte{payload[0]&0xE0 | payload[1]&0x1F}
+			}
+			if d.fu != nil {
+				d.fu = append(d.fu, payload[2:]...)
+				if payload[1]&0x40 != 0 {
+					nalus = append(nalus, d.fu)
+					d.fu = nil
+				}
+			}
+		}
+	case "h265":
+		if len(payload) < 3 {
+			return
+		}
+		switch typ := (payload[0] >> 1) & 0x3F; {
+		case typ < 48:
+			nalus = append(nalus, payload)
+		case typ == 48: // AP
+			nalus = append(nalus, splitAggregation(payload[2:])...)
+		case typ == 49: // FU
+			fuType := payload[2] & 0x3F
+			if payload[2]&0x80 != 0 {
+				d.fu = []byte{payload[0]&0x81 | fuType<<1, payload[1]}
+			}
+			if d.fu != nil {
+				d.fu = append(d.fu, payload[3:]...)
+				if payload[2]&0x40 != 0 {
+					nalus = append(nalus, d.fu)
+					d.fu = nil
+				}
+			}
+		}
+	}
+	return
+}
+
+func splitAggregation(data []byte) (nalus [][]byte) {
+	for len(data) > 2 {
+		size := int(data[0])<<8 | int(data[1])
+		data = data[2:]
+		if size == 0 || size > len(data) {
+			return
+		}
+		nalus = append(nalus, data[:size])
+		data = data[size:]
+	}
+	return
+}
+
+// KeyFrame returns the latest key frame in the gop cache as an annex-b byte
+// stream, parameter sets from the sdp are prepended if not sent in-band.
+func (pusher *Pusher) KeyFrame() (codec string, frame []byte, err error) {
+	codec = strings.ToLower(pusher.VCodec())
+	if codec != "h264" && codec != "h265" {
+		return codec, nil, fmt.Errorf("unsupported video codec[%s]", codec)
+	}
+	pusher.gopCacheLock.RLock()
+	if !pusher.gopCacheEnable {
+		pusher.gopCacheLock.RUnlock()
+		return codec, nil, fmt.Errorf("gop cache disabled")
+	}
+	payloads := make([][]byte, 0, len(pusher.gopCache))
+	for _, pack := range pusher.gopCache {
+		payloads = append(payloads, append([]byte{}, pack.Buffer.Bytes()...))
+	}
+	pusher.gopCacheLock.RUnlock()
+
+	d := &depacketizer{codec: codec}
+	nalus := make([][]byte, 0)
+	hasKey, hasParameterSet := false, false
+	keyTS := 0
+	for _, payload := range payloads {
+		rtp := ParseRTP(payload)
+		if rtp == nil {
+			continue
+		}
+		if hasKey && rtp.Timestamp != keyTS {
+			break
+		}
+		for _, nalu := range d.push(rtp.Payload) {
+			if len(nalu) == 0 {
+				continue
+			}
+			if isParameterSetNALU(codec, nalu) {
+				hasParameterSet = true
+			}
+			if isKeyFrameNALU(codec, nalu) {
+				hasKey = true
+				keyTS = rtp.Timestamp
+			}
+			nalus = append(nalus, nalu)
+		}
+	}
+	if !hasKey {
+		return codec, nil, fmt.Errorf("no key frame cached")
+	}
+	buf := bytes.Buffer{}
+	if !hasParameterSet {
+		if info := FindSDP(ParseSDP(pusher.SDPRaw()), "video"); info != nil {
+			for _, nalu := range info.SpropParameterSets {
+				buf.Write(annexBStartCode)
+				buf.Write(nalu)
+			}
+		}
+	}
+	for _, nalu := range nalus {
+		buf.Write(annexBStartCode)
+		buf.Write(nalu)
+	}
+	return codec, buf.Bytes(), nil
+}
+
+// Snapshot is a JPEG image of a stream.
+type Snapshot struct {
+	Path  string
+	Image []byte
+	Time  time.Time
+}
+
+type snapshotCache struct {
+	snapshots map[string]*Snapshot // Path <-> Snapshot
+	lock      sync.RWMutex
+}
+
+// Snapshot returns the cached snapshot of path if younger than maxAge,
+// otherwise decodes the latest key frame of the pusher.
+func (server *Server) Snapshot(path string, maxAge time.Duration) (*Snapshot, error) {
+	server.snapshots.lock.RLock()
+	snapshot := server.snapshots.snapshots[path]
+	server.snapshots.lock.RUnlock()
+	if snapshot != nil && time.Since(snapshot.Time) < maxAge {
+		return snapshot, nil
+	}
+	pusher := server.GetPusher(path)
+	if pusher == nil {
+		if snapshot != nil {
+			return snapshot, nil
+		}
+		return nil, fmt.Errorf("pusher[%s] not found", path)
+	}
+	return server.takeSnapshot(pusher)
+}
+
+func (server *Server) takeSnapshot(pusher *Pusher) (*Snapshot, error) {
+	decoder := getSnapshotDecoder()
+	if decoder == nil {
+		return nil, fmt.Errorf("no snapshot decoder, ffmpeg_path not configured")
+	}
+	codec, frame, err := pusher.KeyFrame()
+	if err != nil {
+		return nil, err
+	}
+	width := utils.Conf().Section("rtsp").Key("snapshot_width").MustInt(0)
+	image, err := decoder.Snapshot(codec, frame, width)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{
+		Path:  pusher.Path(),
+		Image: image,
+		Time:  time.Now(),
+	}
+	server.snapshots.lock.Lock()
+	if server.snapshots.snapshots == nil {
+		server.snapshots.snapshots = make(map[string]*Snapshot)
+	}
+	server.snapshots.snapshots[snapshot.Path] = snapshot
+	server.snapshots.lock.Unlock()
+	return snapshot, nil
+}
+
+// refreshSnapshots takes snapshots of every pusher each snapshot_interval
+// seconds, and drops the snapshots of pushers gone.
+func (server *Server) refreshSnapshots(stop chan struct{}) {
+	interval := utils.Conf().Section("rtsp").Key("snapshot_interval").MustInt(60)
+	if interval <= 0 || getSnapshotDecoder() == nil {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			pushers := server.GetPushers()
+			for _, pusher := range pushers {
+				if codec := strings.ToLower(pusher.VCodec()); codec != "h264" && codec != "h265" {
+					continue
+				}
+				if _, err := server.takeSnapshot(pusher); err != nil {
+					server.logger.Printf("%v snapshot err:%v", pusher, err)
+				}
+			}
+			server.snapshots.lock.Lock()
+			for path := range server.snapshots.snapshots {
+				if _, ok := pushers[path]; !ok {
+					delete(server.snapshots.snapshots, path)
+				}
+			}
+			server.snapshots.lock.Unlock()
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package rtsp
+
+import (
+	"fmt"
+)
+
+type SPSInfo struct {
+	Codec   string
+	Profile string
+	Level   string
+	Width   int
+	Height  int
+}
+
+var h264Profiles = map[uint]string{
+	66:  "Baseline",
+	77:  "Main",
+	88:  "Extended",
+	100: "High",
+	110: "High 10",
+	122: "High 4:2:2",
+	244: "High 4:4:4",
+	44:  "CAVLC 4:4:4",
+}
+
+var h265Profiles = map[uint]string{
+	1: "Main",
+	2: "Main 10",
+	3: "Main Still Picture",
+	4: "Range Extensions",
+}
+
+// bitReader reads the exp-golomb coded RBSP of a NALU. Reads past the end
+// or of an invalid code fail, and so do all the reads after them.
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+	err  error
+}
+
+// newBitReader removes the emulation prevention bytes (0x000003) of rbsp.
+func newBitReader(nalu []byte) *bitReader {
+	rbsp := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return &bitReader{data: rbsp}
+}
+
+var errSPSTruncated = fmt.Errorf("sps truncated")
+
+func (r *bitReader) bit() (uint, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.pos >= len(r.data)*8 {
+		r.err = errSPSTruncated
+		return 0, r.err
+	}
+	b := (r.data[r.pos/8] >> (7 - uint(r.pos%8))) & 1
+	r.pos++
+	return uint(b), nil
+}
+
+func (r *bitReader) bits(n int) (v uint, err error) {
+	for i := 0; i < n; i++ {
+		var b uint
+		if b, err = r.bit(); err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return
+}
+
+func (r *bitReader) skip(n int) error {
+	if r.err != nil {
+		return r.err
+	}
+	if r.pos+n > len(r.data)*8 {
+		r.err = errSPSTruncated
+		return r.err
+	}
+	r.pos += n
+	return nil
+}
+
+// ue reads an unsigned exp-golomb code.
+func (r *bitReader) ue() (uint, error) {
+	zeros := 0
+	for {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			r.err = fmt.Errorf("invalid exp-golomb code")
+			return 0, r.err
+		}
+	}
+	v, err := r.bits(zeros)
+	if err != nil {
+		return 0, err
+	}
+	return (1<<uint(zeros) - 1) + v, nil
+}
+
+// uemax reads an unsigned exp-golomb code of at most max.
+func (r *bitReader) uemax(name string, max uint) (uint, error) {
+	v, err := r.ue()
+	if err == nil && v > max {
+		r.err = fmt.Errorf("sps %s %d over %d", name, v, max)
+		err = r.err
+	}
+	return v, err
+}
+
+// se reads a signed exp-golomb code.
+func (r *bitReader) se() (int, error) {
+	v, err := r.ue()
+	if v%2 == 1 {
+		return int(v+1) / 2, err
+	}
+	return -int(v / 2), err
+}
+
+// maxSPSSize bounds the decoded width and height, far over any level.
+const maxSPSSize = 1 << 16
+
+// cropSize returns size cropped by the offsets of both sides in units.
+func cropSize(size int, units int, offsets ...uint) (int, error) {
+	for _, offset := range offsets {
+		if offset > maxSPSSize {
+			return 0, fmt.Errorf("sps crop %d over %d", offset, maxSPSSize)
+		}
+		size -= int(offset) * units
+	}
+	if size <= 0 {
+		return 0, fmt.Errorf("sps cropped to %d", size)
+	}
+	return size, nil
+}
+
+// ParseSPS parses a h264 or h265 sps NALU, including its NALU header.
+func ParseSPS(codec string, nalu []byte) (*SPSInfo, error) {
+	switch codec {
+	case "h264":
+		return parseH264SPS(nalu)
+	case "h265":
+		return parseH265SPS(nalu)
+	}
+	return nil, fmt.Errorf("unsupported codec[%s]", codec)
+}
+
+// see ITU-T H.264 7.3.2.1.1, the bounds are of 7.4.2.1.1
+func parseH264SPS(nalu []byte) (*SPSInfo, error) {
+	if len(nalu) < 4 || nalu[0]&0x1F != 7 {
+		return nil, fmt.Errorf("not a h264 sps")
+	}
+	r := newBitReader(nalu[1:])
+	profileIDC, _ := r.bits(8)
+	r.skip(8) // constraint flags
+	levelIDC, _ := r.bits(8)
+	r.uemax("seq_parameter_set_id", 31)
+	chromaFormatIDC := uint(1)
+	separateColourPlane := uint(0)
+	switch profileIDC {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormatIDC, _ = r.uemax("chroma_format_idc", 3)
+		if chromaFormatIDC == 3 {
+			separateColourPlane, _ = r.bit()
+		}
+		r.uemax("bit_depth_luma_minus8", 6)
+		r.uemax("bit_depth_chroma_minus8", 6)
+		r.bit() // qpprime_y_zero_transform_bypass_flag
+		// seq_scaling_matrix_present_flag
+		if flag, _ := r.bit(); flag == 1 {
+			count := 8
+			if chromaFormatIDC == 3 {
+				count = 12
+			}
+			for i := 0; i < count && r.err == nil; i++ {
+				if present, _ := r.bit(); present == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for j := 0; j < size && r.err == nil; j++ {
+					if next != 0 {
+						delta, _ := r.se()
+						next = (last + delta%256 + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	r.uemax("log2_max_frame_num_minus4", 12)
+	pocType, _ := r.uemax("pic_order_cnt_type", 2)
+	switch pocType {
+	case 0:
+		r.uemax("log2_max_pic_order_cnt_lsb_minus4", 12)
+	case 1:
+		r.bit() // delta_pic_order_always_zero_flag
+		r.se()  // offset_for_non_ref_pic
+		r.se()  // offset_for_top_to_bottom_field
+		n, _ := r.uemax("num_ref_frames_in_pic_order_cnt_cycle", 255)
+		for i := uint(0); i < n && r.err == nil; i++ {
+			r.se()
+		}
+	}
+	r.ue()  // max_num_ref_frames
+	r.bit() // gaps_in_frame_num_value_allowed_flag
+	widthInMbs, _ := r.uemax("pic_width_in_mbs_minus1", maxSPSSize/16)
+	heightInMapUnits, _ := r.uemax("pic_height_in_map_units_minus1", maxSPSSize/16)
+	frameMbsOnly, _ := r.bit()
+	if frameMbsOnly == 0 {
+		r.bit() // mb_adaptive_frame_field_flag
+	}
+	r.bit() // direct_8x8_inference_flag
+	cropping, err := r.bit()
+	if err != nil {
+		return nil, err
+	}
+	width := int(widthInMbs+1) * 16
+	height := int(2-frameMbsOnly) * int(heightInMapUnits+1) * 16
+	if cropping == 1 {
+		left, _ := r.ue()
+		right, _ := r.ue()
+		top, _ := r.ue()
+		bottom, err := r.ue()
+		if err != nil {
+			return nil, err
+		}
+		cropX, cropY := 1, 2-int(frameMbsOnly)
+		if separateColourPlane == 0 && chromaFormatIDC != 0 {
+			if chromaFormatIDC == 1 || chromaFormatIDC == 2 {
+				cropX = 2
+			}
+			if chromaFormatIDC == 1 {
+				cropY *= 2
+			}
+		}
+		if width, err = cropSize(width, cropX, left, right); err != nil {
+			return nil, err
+		}
+		if height, err = cropSize(height, cropY, top, bottom); err != nil {
+			return nil, err
+		}
+	}
+	profile, ok := h264Profiles[profileIDC]
+	if !ok {
+		profile = fmt.Sprintf("%d", profileIDC)
+	}
+	return &SPSInfo{
+		Codec:   "h264",
+		Profile: profile,
+		Level:   fmt.Sprintf("%d.%d", levelIDC/10, levelIDC%10),
+		Width:   width,
+		Height:  height,
+	}, nil
+}
+
+// see ITU-T H.265 7.3.2.2, the bounds are of 7.4.3.2.1
+func parseH265SPS(nalu []byte) (*SPSInfo, error) {
+	if len(nalu) < 4 || (nalu[0]>>1)&0x3F != 33 {
+		return nil, fmt.Errorf("not a h265 sps")
+	}
+	r := newBitReader(nalu[2:])
+	r.skip(4) // sps_video_parameter_set_id
+	maxSubLayersMinus1, _ := r.bits(3)
+	if maxSubLayersMinus1 > 6 {
+		return nil, fmt.Errorf("sps sps_max_sub_layers_minus1 %d over 6", maxSubLayersMinus1)
+	}
+	r.skip(1) // sps_temporal_id_nesting_flag
+	// profile_tier_level
+	r.skip(3) // general_profile_space, general_tier_flag
+	profileIDC, _ := r.bits(5)
+	r.skip(32 + 4 + 43 + 1)
+	levelIDC, _ := r.bits(8)
+	subLayerProfilePresent := make([]uint, maxSubLayersMinus1)
+	subLayerLevelPresent := make([]uint, maxSubLayersMinus1)
+	for i := uint(0); i < maxSubLayersMinus1; i++ {
+		subLayerProfilePresent[i], _ = r.bit()
+		subLayerLevelPresent[i], _ = r.bit()
+	}
+	if maxSubLayersMinus1 > 0 {
+		for i := maxSubLayersMinus1; i < 8; i++ {
+			r.skip(2) // reserved_zero_2bits
+		}
+	}
+	for i := uint(0); i < maxSubLayersMinus1; i++ {
+		if subLayerProfilePresent[i] == 1 {
+			r.skip(88)
+		}
+		if subLayerLevelPresent[i] == 1 {
+			r.skip(8)
+		}
+	}
+	r.uemax("sps_seq_parameter_set_id", 15)
+	chromaFormatIDC, _ := r.uemax("chroma_format_idc", 3)
+	if chromaFormatIDC == 3 {
+		r.bit() // separate_colour_plane_flag
+	}
+	width, _ := r.uemax("pic_width_in_luma_samples", maxSPSSize)
+	height, _ := r.uemax("pic_height_in_luma_samples", maxSPSSize)
+	conformanceWindow, err := r.bit()
+	if err != nil {
+		return nil, err
+	}
+	w, h := int(width), int(height)
+	if conformanceWindow == 1 {
+		left, _ := r.ue()
+		right, _ := r.ue()
+		top, _ := r.ue()
+		bottom, err := r.ue()
+		if err != nil {
+			return nil, err
+		}
+		subWidth, subHeight := 1, 1
+		switch chromaFormatIDC {
+		case 1:
+			subWidth, subHeight = 2, 2
+		case 2:
+			subWidth = 2
+		}
+		if w, err = cropSize(w, subWidth, left, right); err != nil {
+			return nil, err
+		}
+		if h, err = cropSize(h, subHeight, top, bottom); err != nil {
+			return nil, err
+		}
+	}
+	profile, ok := h265Profiles[profileIDC]
+	if !ok {
+		profile = fmt.Sprintf("%d", profileIDC)
+	}
+	return &SPSInfo{
+		Codec:   "h265",
+		Profile: profile,
+		Level:   fmt.Sprintf("%d.%d", levelIDC/30, levelIDC%30/3),
+		Width:   w,
+		Height:  h,
+	}, nil
+}
+
+// SPSFromRTP returns the sps NALU carried by a single NALU or an aggregation
+// packet, nil if there is none.
+func SPSFromRTP(codec string, payload []byte) []byte {
+	if len(payload) < 2 {
+		return nil
+	}
+	switch codec {
+	case "h264":
+		switch payload[0] & 0x1F {
+		case 7:
+			return payload
+		case 24: // STAP-A
+			return spsFromAggregation(payload[1:], func(nalu []byte) bool { return nalu[0]&0x1F == 7 })
+		}
+	case "h265":
+		switch (payload[0] >> 1) & 0x3F {
+		case 33:
+			return payload
+		case 48: // AP
+			return spsFromAggregation(payload[2:], func(nalu []byte) bool { return (nalu[0]>>1)&0x3F == 33 })
+		}
+	}
+	return nil
+}
+
+func spsFromAggregation(data []byte, isSPS func([]byte) bool) []byte {
+	for len(data) > 2 {
+		size := int(data[0])<<8 | int(data[1])
+		data = data[2:]
+		if size == 0 || size > len(data) {
+			return nil
+		}
+		if isSPS(data[:size]) {
+			return data[:size]
+		}
+		data = data[size:]
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package rtsp
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+// spsWriter writes the exp-golomb coded fields of crafted SPS.
+type spsWriter struct {
+	data []byte
+	n    int // bits
+}
+
+func (w *spsWriter) bits(n int, v uint) *spsWriter {
+	for i := n - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		w.data[len(w.data)-1] |= byte((v>>uint(i))&1) << uint(7-w.n%8)
+		w.n++
+	}
+	return w
+}
+
+func (w *spsWriter) ue(v uint) *spsWriter {
+	v++
+	size := 0
+	for x := v; x > 1; x >>= 1 {
+		size++
+	}
+	return w.bits(size, 0).bits(size+1, v)
+}
+
+// bytes ends the rbsp with its stop bit.
+func (w *spsWriter) bytes() []byte {
+	return w.bits(1, 1).data
+}
+
+// h264SPS is a baseline sps of pic_order_cnt_type 1 with n offsets in the
+// cycle, then of the given size in macroblocks.
+func h264SPS(n uint, widthInMbs, heightInMbs uint) []byte {
+	w := (&spsWriter{}).bits(8, 0x67).bits(8, 66).bits(8, 0).bits(8, 30)
+	w.ue(0).ue(0) // seq_parameter_set_id, log2_max_frame_num_minus4
+	w.ue(1)       // pic_order_cnt_type
+	w.bits(1, 0).ue(0).ue(0)
+	w.ue(n)
+	for i := uint(0); i < n && i < 16; i++ {
+		w.ue(1)
+	}
+	w.ue(1).bits(1, 0)
+	w.ue(widthInMbs - 1).ue(heightInMbs - 1)
+	w.bits(1, 1).bits(1, 1) // frame_mbs_only_flag, direct_8x8_inference_flag
+	w.bits(1, 0)            // frame_cropping_flag
+	return w.bytes()
+}
+
+// h265SPS is a main sps of the given size, cropped by left in chroma units.
+func h265SPS(width, height, left uint) []byte {
+	w := (&spsWriter{}).bits(8, 0x42).bits(8, 0x01)
+	w.bits(4, 0).bits(3, 0).bits(1, 1)
+	w.bits(3, 0).bits(5, 1).bits(32, 0).bits(32, 0).bits(16, 0).bits(8, 120)
+	w.ue(0).ue(1) // sps_seq_parameter_set_id, chroma_format_idc
+	w.ue(width).ue(height)
+	w.bits(1, 1).ue(left).ue(0).ue(0).ue(0)
+	return w.bytes()
+}
+
+func b64(s string) []byte {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestParseSPS(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec string
+		nalu  []byte
+		want  SPSInfo
+		err   string
+	}{
+		{"h264 baseline", "h264", b64("Z0IAHpWoLQSZ"), SPSInfo{"h264", "Baseline", "3.0", 720, 576}, ""},
+		{"h264 main", "h264", b64("Z00AH5WoFAFuQA=="), SPSInfo{"h264", "Main", "3.1", 1280, 720}, ""},
+		{"h264 high", "h264", b64("Z2QAH6zZQFAFuwEQAAADABAAAAMDwPGDGWA="), SPSInfo{"h264", "High", "3.1", 1280, 720}, ""},
+		// 1088 lines cropped to 1080, with emulation prevention bytes.
+		{"h264 high cropped", "h264", b64("Z2QAKKzZQHgCJ+XARAAAAwAEAAADAPA8YMZY"), SPSInfo{"h264", "High", "4.0", 1920, 1080}, ""},
+		{"h265 main cropped", "h265", b64("QgEBAWAAAAMAsAAAAwAAAwB4oAPAgBDlja5JMvTcBAQEAg=="), SPSInfo{"h265", "Main", "4.0", 1920, 1080}, ""},
+		{"h264 poc cycle", "h264", h264SPS(3, 40, 30), SPSInfo{"h264", "Baseline", "3.0", 640, 480}, ""},
+		{"h264 oversized poc cycle", "h264", h264SPS(0xFFFFFFFE, 40, 30), SPSInfo{}, "num_ref_frames_in_pic_order_cnt_cycle"},
+		{"h264 poc cycle truncated", "h264", h264SPS(255, 40, 30), SPSInfo{}, "sps truncated"},
+		{"h264 oversized width", "h264", h264SPS(0, 1<<20, 30), SPSInfo{}, "pic_width_in_mbs_minus1"},
+		{"h264 truncated", "h264", b64("Z2QAKKzZQHgCJ+XARAAAAwAEAAADAPA8YMZY")[:8], SPSInfo{}, "sps truncated"},
+		{"h265 crop", "h265", h265SPS(640, 480, 8), SPSInfo{"h265", "Main", "4.0", 624, 480}, ""},
+		{"h265 crop underflow", "h265", h265SPS(640, 480, 400), SPSInfo{}, "cropped"},
+		{"h265 truncated", "h265", b64("QgEBAWAAAAMAsAAAAwAAAwB4oAPAgBDlja5JMvTcBAQEAg==")[:16], SPSInfo{}, "sps truncated"},
+		{"h264 not a sps", "h264", b64("aM48gA=="), SPSInfo{}, "not a h264 sps"},
+		{"h265 of h264", "h265", b64("Z0IAHpWoLQSZ"), SPSInfo{}, "not a h265 sps"},
+	}
+	for _, tt := range tests {
+		start := time.Now()
+		got, err := ParseSPS(tt.codec, tt.nalu)
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Errorf("%s: parsed in %v", tt.name, elapsed)
+		}
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: err %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: err %v", tt.name, err)
+			continue
+		}
+		if *got != tt.want {
+			t.Errorf("%s: %+v, want %+v", tt.name, *got, tt.want)
+		}
+	}
+}
+
+func TestParseSPSTruncated(t *testing.T) {
+	for _, s := range []struct{ codec, sps string }{
+		{"h264", "Z2QAKKzZQHgCJ+XARAAAAwAEAAADAPA8YMZY"},
+		{"h265", "QgEBAWAAAAMAsAAAAwAAAwB4oAPAgBDlja5JMvTcBAQEAg=="},
+	} {
+		nalu := b64(s.sps)
+		for i := range nalu {
+			ParseSPS(s.codec, nalu[:i])
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package rtsp
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StreamStats is the live status of a pusher, see Pusher.Stats.
+type StreamStats struct {
+	VCodec  string  `json:"vcodec"`
+	Profile string  `json:"profile"`
+	Level   string  `json:"level"`
+	Width   int     `json:"width"`
+	Height  int     `json:"height"`
+	Bitrate int     `json:"bitrate"` // bits per second of audio and video
+	FPS     float64 `json:"fps"`
+	GOP     int     `json:"gop"` // frames from a key frame to the next one
+}
+
+const streamStatsWindow = time.Second
+
+// streamStats measures a pusher from the rtp packs it receives.
+type streamStats struct {
+	StreamStats
+	codec     string
+	clockRate int
+
+	bytes      int
+	bytesFrom  time.Time
+	frames     int
+	framesFrom uint32 // rtp timestamp
+	lastTS     uint32
+	gopFrames  int
+	seenFrame  bool
+	seenKey    bool
+	lastKeyTS  uint32 // rtp timestamp of the last key frame
+	sps        []byte
+
+	// health, see checkHealth.
+	startAt        time.Time
+	lastPackAt     time.Time
+	lastProgressAt time.Time // the last video pack of a new rtp timestamp
+	lastKeyFrameAt time.Time
+
+	lock sync.RWMutex
+}
+
+func newStreamStats() *streamStats {
+	now := time.Now()
+	return &streamStats{
+		clockRate: 90000,
+		bytesFrom: now,
+		startAt:   now,
+	}
+}
+
+// start measures the stream of the sdp from now on, the sdp of a pull stream
+// is known once the pusher starts only.
+func (stats *streamStats) start(sdpRaw string) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	now := time.Now()
+	stats.bytesFrom = now
+	stats.startAt = now
+	if info := FindSDP(ParseSDP(sdpRaw), "video"); info != nil {
+		stats.codec = strings.ToLower(info.Codec)
+		stats.VCodec = stats.codec
+		if info.TimeScale > 0 {
+			stats.clockRate = info.TimeScale
+		}
+		for _, nalu := range info.SpropParameterSets {
+			stats.updateSPS(nalu)
+		}
+	}
+}
+
+func (stats *streamStats) updateSPS(nalu []byte) {
+	if len(nalu) == 0 || string(nalu) == string(stats.sps) {
+		return
+	}
+	sps, err := ParseSPS(stats.codec, nalu)
+	if err != nil {
+		return
+	}
+	stats.sps = append([]byte{}, nalu...)
+	stats.Profile = sps.Profile
+	stats.Level = sps.Level
+	stats.Width = sps.Width
+	stats.Height = sps.Height
+}
+
+// add counts a pack, rtp is the parsed video pack or nil, keyFrame tells if
+// a new gop starts with it.
+func (stats *streamStats) add(pack *RTPPack, rtp *RTPInfo, keyFrame bool) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	now := time.Now()
+	stats.lastPackAt = now
+	stats.bytes += pack.Buffer.Len()
+	if elapsed := now.Sub(stats.bytesFrom); elapsed >= streamStatsWindow {
+		stats.Bitrate = int(float64(stats.bytes*8) / elapsed.Seconds())
+		stats.bytes = 0
+		stats.bytesFrom = now
+	}
+	if rtp == nil {
+		return
+	}
+	if sps := SPSFromRTP(stats.codec, rtp.Payload); sps != nil {
+		stats.updateSPS(sps)
+	}
+	ts := uint32(rtp.Timestamp)
+	// sps, pps and idr packs of a key frame share its timestamp.
+	if keyFrame && !(stats.seenKey && ts == stats.lastKeyTS) {
+		stats.lastKeyFrameAt = now
+		if stats.seenKey {
+			stats.GOP = stats.gopFrames
+		}
+		stats.seenKey = true
+		stats.lastKeyTS = ts
+		stats.gopFrames = 0
+	}
+	if stats.seenFrame && ts == stats.lastTS {
+		return
+	}
+	// a new frame.
+	stats.lastProgressAt = now
+	stats.gopFrames++
+	if !stats.seenFrame {
+		stats.seenFrame = true
+		stats.framesFrom = ts
+	}
+	stats.lastTS = ts
+	stats.frames++
+	// b-frames go back in time.
+	if span := int32(ts - stats.framesFrom); span >= int32(stats.clockRate) {
+		stats.FPS = float64(stats.frames-1) * float64(stats.clockRate) / float64(span)
+		stats.frames = 1
+		stats.framesFrom = ts
+	}
+}
+
+func (stats *streamStats) get() StreamStats {
+	stats.lock.RLock()
+	defer stats.lock.RUnlock()
+	ret := stats.StreamStats
+	if elapsed := time.Since(stats.bytesFrom); elapsed >= 2*streamStatsWindow {
+		// no packs for a while.
+		ret.Bitrate = int(float64(stats.bytes*8) / elapsed.Seconds())
+	}
+	return ret
+}
+
+// checkHealth returns why the stream is unhealthy, empty if it is healthy.
+// Streams without video only need packs to keep arriving.
+func (stats *streamStats) checkHealth(now time.Time, stallTimeout, keyFrameTimeout time.Duration) string {
+	stats.lock.RLock()
+	defer stats.lock.RUnlock()
+	since := func(t time.Time) time.Duration {
+		if t.IsZero() {
+			t = stats.startAt
+		}
+		return now.Sub(t)
+	}
+	if stallTimeout > 0 {
+		if since(stats.lastPackAt) > stallTimeout {
+			return fmt.Sprintf("no packet for %v", since(stats.lastPackAt).Truncate(time.Second))
+		}
+		if stats.codec != "" && since(stats.lastProgressAt) > stallTimeout {
+			return fmt.Sprintf("video stalled for %v", since(stats.lastProgressAt).Truncate(time.Second))
+		}
+	}
+	if keyFrameTimeout > 0 && stats.codec != "" && since(stats.lastKeyFrameAt) > keyFrameTimeout {
+		return fmt.Sprintf("no key frame for %v", since(stats.lastKeyFrameAt).Truncate(time.Second))
+	}
+	return ""
+}
@@ -0,0 +1,28 @@
+package rtsp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStreamStatsGOP(t *testing.T) {
+	stats := newStreamStats()
+	stats.start("")
+	pack := &RTPPack{Type: RTP_TYPE_VIDEO, Buffer: bytes.NewBuffer(make([]byte, 100))}
+	// key frames of sps, pps and idr packs, then 24 more frames.
+	for gop := 0; gop < 3; gop++ {
+		for frame := 0; frame < 25; frame++ {
+			ts := (gop*25 + frame) * 3600
+			if frame == 0 {
+				for _, nalu := range []byte{0x67, 0x68, 0x65} {
+					stats.add(pack, &RTPInfo{Timestamp: ts, Payload: []byte{nalu, 0}}, true)
+				}
+				continue
+			}
+			stats.add(pack, &RTPInfo{Timestamp: ts, Payload: []byte{0x41, 0}}, false)
+		}
+	}
+	if got := stats.get(); got.GOP != 25 || got.FPS != 25 {
+		t.Errorf("GOP %d, FPS %v, want 25, 25", got.GOP, got.FPS)
+	}
+}
@@ -0,0 +1,166 @@
+package rtsp
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Track is a media of a stream, a m= section of its sdp, and the interleaved
+// channels it is set up on over tcp. Packs refer to it by Index.
+type Track struct {
+	*SDPInfo
+	RTPChannel  int // -1 if not set up over tcp
+	RTCPChannel int
+	Backchannel bool // sent by the player to the source, see ONVIF_BACKCHANNEL
+}
+
+func (track *Track) String() string {
+	return fmt.Sprintf("track[%d][%s][%s]", track.Index, track.AVType, track.Codec)
+}
+
+// NewTracks returns the tracks of a sdp, none of them set up.
+func NewTracks(sdpRaw string) []*Track {
+	infos := ParseSDP(sdpRaw)
+	tracks := make([]*Track, 0, len(infos))
+	for _, info := range infos {
+		tracks = append(tracks, &Track{SDPInfo: info, RTPChannel: -1, RTCPChannel: -1})
+	}
+	return tracks
+}
+
+// copyTracks returns the tracks of the same media, none of them set up.
+func copyTracks(tracks []*Track) []*Track {
+	ret := make([]*Track, 0, len(tracks))
+	for _, track := range tracks {
+		ret = append(ret, &Track{SDPInfo: track.SDPInfo, RTPChannel: -1, RTCPChannel: -1, Backchannel: track.Backchannel})
+	}
+	return ret
+}
+
+// RTPType returns the type of the rtp packs of the track, of the rtcp ones if
+// control.
+func (track *Track) RTPType(control bool) RTPType {
+	switch track.AVType {
+	case "audio":
+		if control {
+			return RTP_TYPE_AUDIOCONTROL
+		}
+		return RTP_TYPE_AUDIO
+	case "video":
+		if control {
+			return RTP_TYPE_VIDEOCONTROL
+		}
+		return RTP_TYPE_VIDEO
+	}
+	if control {
+		return RTP_TYPE_DATACONTROL
+	}
+	return RTP_TYPE_DATA
+}
+
+// ControlURL returns the url of the track to SETUP, the control is relative
+// to base unless it is an url itself.
+func (track *Track) ControlURL(base string) string {
+	if strings.HasPrefix(strings.ToLower(track.Control), "rtsp://") {
+		return track.Control
+	}
+	return strings.TrimRight(base, "/") + "/" + strings.TrimLeft(track.Control, "/")
+}
+
+// normalizeControl gives urls the default port, so that controls compare.
+func normalizeControl(control string) (string, error) {
+	if !strings.HasPrefix(strings.ToLower(control), "rtsp://") {
+		return control, nil
+	}
+	u, err := url.Parse(control)
+	if err != nil {
+		return "", err
+	}
+	if u.Port() == "" {
+		u.Host = fmt.Sprintf("%s:554", u.Host)
+	}
+	return u.String(), nil
+}
+
+// findTrack returns the track of a SETUP url. The control field may be
+// `streamid=1`, `?ctype=video` or a whole url like
+// `rtsp://192.168.1.64/trackID=1`, the url matches the control or ends with
+// it after a `/`, the longest control wins: `.../subtrack1` is not of
+// `track1`.
+func findTrack(tracks []*Track, setupPath string) (*Track, error) {
+	setupPath, err := normalizeControl(setupPath)
+	if err != nil {
+		return nil, err
+	}
+	var suffixed *Track
+	suffixLen := 0
+	for _, track := range tracks {
+		if track.Control == "" {
+			continue
+		}
+		control, err := normalizeControl(track.Control)
+		if err != nil {
+			return nil, fmt.Errorf("invalid control of %v", track)
+		}
+		if setupPath == control {
+			return track, nil
+		}
+		if len(control) > suffixLen && hasControlSuffix(setupPath, control) {
+			suffixed = track
+			suffixLen = len(control)
+		}
+	}
+	if suffixed == nil {
+		return nil, fmt.Errorf("unknown control %s", setupPath)
+	}
+	return suffixed, nil
+}
+
+// hasControlSuffix reports whether setupPath ends with the relative control,
+// at the start of a path segment or of the query.
+func hasControlSuffix(setupPath, control string) bool {
+	if !strings.HasSuffix(setupPath, control) {
+		return false
+	}
+	if strings.HasPrefix(control, "/") || strings.HasPrefix(control, "?") {
+		return true
+	}
+	rest := setupPath[:len(setupPath)-len(control)]
+	return strings.HasSuffix(rest, "/")
+}
+
+// trackOfChannel returns the track set up on an interleaved channel, and
+// whether it is the rtcp channel.
+func trackOfChannel(tracks []*Track, channel int) (track *Track, control bool) {
+	for _, track := range tracks {
+		if track.RTPChannel < 0 {
+			continue
+		}
+		switch channel {
+		case track.RTPChannel:
+			return track, false
+		case track.RTCPChannel:
+			return track, true
+		}
+	}
+	return nil, false
+}
+
+// firstTrack returns the first track of avType, nil if there is none.
+func firstTrack(tracks []*Track, avType string) *Track {
+	for _, track := range tracks {
+		if track.AVType == avType {
+			return track
+		}
+	}
+	return nil
+}
+
+// trackCodec returns the codec of the first track of avType.
+func trackCodec(tracks []*Track, avType string) string {
+	if track := firstTrack(tracks, avType); track != nil {
+		return track.Codec
+	}
+	return ""
+}
@@ -0,0 +1,127 @@
+package rtsp
+
+import "testing"
+
+// an ONVIF camera with a backchannel: two audio tracks and metadata, of
+// absolute controls.
+const testTrackONVIFSDP = "v=0\r\no=- 0 0 IN IP4 192.168.1.64\r\ns=Media Presentation\r\nt=0 0\r\n" +
+	"a=control:rtsp://192.168.1.64/Streaming/Channels/101/\r\n" +
+	"m=video 0 RTP/AVP 96\r\na=rtpmap:96 H264/90000\r\na=control:rtsp://192.168.1.64/Streaming/Channels/101/trackID=1\r\n" +
+	"m=audio 0 RTP/AVP 8\r\na=rtpmap:8 PCMA/8000\r\na=control:rtsp://192.168.1.64:554/Streaming/Channels/101/trackID=2\r\n" +
+	"m=audio 0 RTP/AVP 0\r\na=rtpmap:0 PCMU/8000\r\na=sendonly\r\na=control:rtsp://192.168.1.64/Streaming/Channels/101/trackID=11\r\n" +
+	"m=application 0 RTP/AVP 107\r\na=rtpmap:107 vnd.onvif.metadata/90000\r\na=control:rtsp://192.168.1.64/Streaming/Channels/101/trackID=3\r\n"
+
+// relative controls, of which one is a suffix of another.
+const testTrackRelativeSDP = "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=test\r\nt=0 0\r\n" +
+	"m=video 0 RTP/AVP 96\r\na=rtpmap:96 H265/90000\r\na=control:track1\r\n" +
+	"m=audio 0 RTP/AVP 97\r\na=rtpmap:97 MPEG4-GENERIC/44100/2\r\na=control:subtrack1\r\n" +
+	"m=application 0 RTP/AVP 98\r\na=rtpmap:98 vnd.onvif.metadata/90000\r\na=control:?ctype=app\r\n"
+
+func TestNewTracks(t *testing.T) {
+	tracks := NewTracks(testTrackONVIFSDP)
+	want := []struct {
+		avType string
+		codec  string
+	}{{"video", "h264"}, {"audio", "pcma"}, {"audio", "pcmu"}, {"application", "vnd.onvif.metadata"}}
+	if len(tracks) != len(want) {
+		t.Fatalf("%d tracks, want %d", len(tracks), len(want))
+	}
+	for i, track := range tracks {
+		if track.Index != i || track.AVType != want[i].avType || track.Codec != want[i].codec || track.RTPChannel != -1 || track.RTCPChannel != -1 {
+			t.Errorf("track %d = %v, channels %d-%d", i, track, track.RTPChannel, track.RTCPChannel)
+		}
+	}
+	if first := firstTrack(tracks, "audio"); first != tracks[1] {
+		t.Errorf("first audio = %v", first)
+	}
+	if codec := trackCodec(tracks, "application"); codec != "vnd.onvif.metadata" {
+		t.Errorf("application codec = %s", codec)
+	}
+	types := []RTPType{RTP_TYPE_VIDEO, RTP_TYPE_AUDIO, RTP_TYPE_AUDIO, RTP_TYPE_DATA}
+	controlTypes := []RTPType{RTP_TYPE_VIDEOCONTROL, RTP_TYPE_AUDIOCONTROL, RTP_TYPE_AUDIOCONTROL, RTP_TYPE_DATACONTROL}
+	for i, track := range tracks {
+		if track.RTPType(false) != types[i] || track.RTPType(true) != controlTypes[i] {
+			t.Errorf("%v types %v %v", track, track.RTPType(false), track.RTPType(true))
+		}
+	}
+}
+
+func TestFindTrack(t *testing.T) {
+	onvif := NewTracks(testTrackONVIFSDP)
+	relative := NewTracks(testTrackRelativeSDP)
+	tests := []struct {
+		name   string
+		tracks []*Track
+		url    string
+		want   int // index of the track, -1 for an error
+	}{
+		{"absolute", onvif, "rtsp://192.168.1.64/Streaming/Channels/101/trackID=1", 0},
+		{"absolute of the default port", onvif, "rtsp://192.168.1.64:554/Streaming/Channels/101/trackID=1", 0},
+		{"absolute control of the default port", onvif, "rtsp://192.168.1.64/Streaming/Channels/101/trackID=2", 1},
+		{"second audio", onvif, "rtsp://192.168.1.64/Streaming/Channels/101/trackID=11", 2},
+		{"application", onvif, "rtsp://192.168.1.64/Streaming/Channels/101/trackID=3", 3},
+		{"another port", onvif, "rtsp://192.168.1.64:8554/Streaming/Channels/101/trackID=1", -1},
+		{"unknown", onvif, "rtsp://192.168.1.64/Streaming/Channels/101/trackID=4", -1},
+		{"relative", relative, "rtsp://127.0.0.1/live/a/track1", 0},
+		{"relative suffix of another", relative, "rtsp://127.0.0.1/live/a/subtrack1", 1},
+		{"relative not at a segment", relative, "rtsp://127.0.0.1/live/a/xtrack1", -1},
+		{"ctype", relative, "rtsp://127.0.0.1/live/a?ctype=app", 2},
+		{"ctype after a slash", relative, "rtsp://127.0.0.1/live/a/?ctype=app", 2},
+		{"invalid url", relative, "rtsp://[::1/live/a/track1", -1},
+	}
+	for _, tt := range tests {
+		track, err := findTrack(tt.tracks, tt.url)
+		switch {
+		case tt.want < 0 && err == nil:
+			t.Errorf("%s: findTrack = %v, want an error", tt.name, track)
+		case tt.want >= 0 && err != nil:
+			t.Errorf("%s: findTrack err %v", tt.name, err)
+		case tt.want >= 0 && track.Index != tt.want:
+			t.Errorf("%s: findTrack = %v, want track %d", tt.name, track, tt.want)
+		}
+	}
+}
+
+func TestTrackOfChannel(t *testing.T) {
+	tracks := NewTracks(testTrackONVIFSDP)
+	tracks[0].RTPChannel, tracks[0].RTCPChannel = 0, 1
+	tracks[3].RTPChannel, tracks[3].RTCPChannel = 6, 7
+	tests := []struct {
+		channel int
+		track   *Track
+		control bool
+	}{
+		{0, tracks[0], false},
+		{1, tracks[0], true},
+		{6, tracks[3], false},
+		{7, tracks[3], true},
+		{2, nil, false},
+		{-1, nil, false}, // the channels of the tracks not set up
+	}
+	for _, tt := range tests {
+		track, control := trackOfChannel(tracks, tt.channel)
+		if track != tt.track || control != tt.control {
+			t.Errorf("trackOfChannel(%d) = %v, %v, want %v, %v", tt.channel, track, control, tt.track, tt.control)
+		}
+	}
+
+	// copies share the media, not the channels.
+	copies := copyTracks(tracks)
+	if copies[0].SDPInfo != tracks[0].SDPInfo || copies[0].RTPChannel != -1 {
+		t.Errorf("copy %v channels %d-%d", copies[0], copies[0].RTPChannel, copies[0].RTCPChannel)
+	}
+	if track, _ := trackOfChannel(copies, 0); track != nil {
+		t.Errorf("copies set up on %v", track)
+	}
+}
+
+func TestControlURL(t *testing.T) {
+	tracks := NewTracks(testTrackRelativeSDP)
+	if got := tracks[0].ControlURL("rtsp://127.0.0.1/live/a/"); got != "rtsp://127.0.0.1/live/a/track1" {
+		t.Errorf("ControlURL = %s", got)
+	}
+	onvif := NewTracks(testTrackONVIFSDP)
+	if got := onvif[0].ControlURL("rtsp://other/live"); got != "rtsp://192.168.1.64/Streaming/Channels/101/trackID=1" {
+		t.Errorf("ControlURL of an absolute control = %s", got)
+	}
+}
@@ -1,9 +1,12 @@
 package rtsp
 
 import (
+	"bytes"
 	"fmt"
 	"net"
-	"strings"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/snowlyg/EasyDarwin/extend/utils"
 )
@@ -11,125 +14,83 @@ import (
 type UDPClient struct {
 	*Session
 
-	APort        int
-	AConn        *net.UDPConn
-	AControlPort int
-	AControlConn *net.UDPConn
-	VPort        int
-	VConn        *net.UDPConn
-	VControlPort int
-	VControlConn *net.UDPConn
+	tracks     map[int]*UDPTrack // track index <-> sockets
+	tracksLock sync.RWMutex
 
 	Stoped bool
 }
 
+func NewUDPClient(session *Session) *UDPClient {
+	return &UDPClient{
+		Session: session,
+		tracks:  make(map[int]*UDPTrack),
+	}
+}
+
 func (s *UDPClient) Stop() {
 	if s.Stoped {
 		return
 	}
 	s.Stoped = true
-	if s.AConn != nil {
-		s.AConn.Close()
-		s.AConn = nil
-	}
-	if s.AControlConn != nil {
-		s.AControlConn.Close()
-		s.AControlConn = nil
-	}
-	if s.VConn != nil {
-		s.VConn.Close()
-		s.VConn = nil
-	}
-	if s.VControlConn != nil {
-		s.VControlConn.Close()
-		s.VControlConn = nil
+	s.tracksLock.Lock()
+	for _, t := range s.tracks {
+		t.close()
 	}
+	s.tracksLock.Unlock()
+}
+
+// Track returns the sockets of the track of index, nil if it is not set up.
+func (c *UDPClient) Track(index int) *UDPTrack {
+	c.tracksLock.RLock()
+	defer c.tracksLock.RUnlock()
+	return c.tracks[index]
 }
 
-func (c *UDPClient) SetupAudio() (err error) {
+// SetupTrack sends the rtp and rtcp of track to the ports of the player.
+func (c *UDPClient) SetupTrack(track *Track, rtpPort, rtcpPort int) (err error) {
 	logger := c.logger
+	t := &UDPTrack{Track: track, Port: rtpPort, ControlPort: rtcpPort}
 	defer func() {
 		if err != nil {
 			logger.Println(err)
-			c.Stop()
+			t.close()
 		}
 	}()
-	host := c.Conn.RemoteAddr().String()
-	host = host[:strings.LastIndex(host, ":")]
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", host, c.APort))
-	if err != nil {
+	if t.Conn, err = c.dial(track.AVType, rtpPort); err != nil {
 		return
 	}
-	c.AConn, err = net.DialUDP("udp", nil, addr)
-	if err != nil {
+	if t.ControlConn, err = c.dial(track.AVType+" control", rtcpPort); err != nil {
 		return
 	}
-	networkBuffer := utils.Conf().Section("rtsp").Key("network_buffer").MustInt(1048576)
-	if err := c.AConn.SetReadBuffer(networkBuffer); err != nil {
-		logger.Printf("udp client audio conn set read buffer error, %v", err)
-	}
-	if err := c.AConn.SetWriteBuffer(networkBuffer); err != nil {
-		logger.Printf("udp client audio conn set write buffer error, %v", err)
+	c.tracksLock.Lock()
+	if old := c.tracks[track.Index]; old != nil {
+		old.close()
 	}
-
-	addr, err = net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", host, c.AControlPort))
-	if err != nil {
-		return
-	}
-	c.AControlConn, err = net.DialUDP("udp", nil, addr)
-	if err != nil {
-		return
-	}
-	if err := c.AControlConn.SetReadBuffer(networkBuffer); err != nil {
-		logger.Printf("udp client audio control conn set read buffer error, %v", err)
-	}
-	if err := c.AControlConn.SetWriteBuffer(networkBuffer); err != nil {
-		logger.Printf("udp client audio control conn set write buffer error, %v", err)
+	c.tracks[track.Index] = t
+	c.tracksLock.Unlock()
+	if track.Backchannel {
+		go c.receiveRTP(t)
 	}
+	go c.receiveRTCP(t)
 	return
 }
 
-func (c *UDPClient) SetupVideo() (err error) {
+func (c *UDPClient) dial(media string, port int) (conn *net.UDPConn, err error) {
 	logger := c.logger
-	defer func() {
-		if err != nil {
-			logger.Println(err)
-			c.Stop()
-		}
-	}()
-	host := c.Conn.RemoteAddr().String()
-	host = host[:strings.LastIndex(host, ":")]
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", host, c.VPort))
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(c.RemoteHost(), strconv.Itoa(port)))
 	if err != nil {
 		return
 	}
-
-	c.VConn, err = net.DialUDP("udp", nil, addr)
+	conn, err = net.DialUDP("udp", nil, addr)
 	if err != nil {
 		return
 	}
-
 	networkBuffer := utils.Conf().Section("rtsp").Key("network_buffer").MustInt(1048576)
-	if err := c.VConn.SetReadBuffer(networkBuffer); err != nil {
-		logger.Printf("udp client video conn set read buffer error, %v", err)
-	}
-	if err := c.VConn.SetWriteBuffer(networkBuffer); err != nil {
-		logger.Printf("udp client video conn set write buffer error, %v", err)
-	}
-
-	addr, err = net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", host, c.VControlPort))
-	if err != nil {
-		return
-	}
-	c.VControlConn, err = net.DialUDP("udp", nil, addr)
-	if err != nil {
-		return
+	if err := conn.SetReadBuffer(networkBuffer); err != nil {
+		logger.Printf("udp client %s conn set read buffer error, %v", media, err)
 	}
-	if err := c.VControlConn.SetReadBuffer(networkBuffer); err != nil {
-		logger.Printf("udp client video control conn set read buffer error, %v", err)
-	}
-	if err := c.VControlConn.SetWriteBuffer(networkBuffer); err != nil {
-		logger.Printf("udp client video control conn set write buffer error, %v", err)
+	if err := conn.SetWriteBuffer(networkBuffer); err != nil {
+		logger.Printf("udp client %s conn set write buffer error, %v", media, err)
 	}
 	return
 }
@@ -139,21 +100,15 @@ func (c *UDPClient) SendRTP(pack *RTPPack) (err error) {
 		err = fmt.Errorf("udp client send rtp got nil pack")
 		return
 	}
-
-	var conn *net.UDPConn
-	switch pack.Type {
-	case RTP_TYPE_AUDIO:
-		conn = c.AConn
-	case RTP_TYPE_AUDIOCONTROL:
-		conn = c.AControlConn
-	case RTP_TYPE_VIDEO:
-		conn = c.VConn
-	case RTP_TYPE_VIDEOCONTROL:
-		conn = c.VControlConn
-	default:
-		err = fmt.Errorf("udp client send rtp got unkown pack type[%v]", pack.Type)
+	t := c.Track(pack.Track)
+	if t == nil {
+		// the track is not set up by the player.
 		return
 	}
+	conn := t.Conn
+	if pack.Type.IsControl() {
+		conn = t.ControlConn
+	}
 	if conn == nil {
 		err = fmt.Errorf("udp client send rtp pack type[%v] failed, conn not found", pack.Type)
 		return
@@ -167,3 +122,87 @@ func (c *UDPClient) SendRTP(pack *RTPPack) (err error) {
 	c.Session.OutBytes += n
 	return
 }
+
+// receiveRTCP reads the RTCP packets, receiver reports mostly, sent by the
+// player to the control port, they keep the session alive.
+func (c *UDPClient) receiveRTCP(t *UDPTrack) {
+	logger := c.logger
+	conn := t.ControlConn
+	buf := make([]byte, UDP_BUF_SIZE)
+	timer := time.Unix(0, 0)
+	for !c.Stoped {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if c.Stoped || c.Track(t.Index) != t {
+				return
+			}
+			// e.g. connection refused by icmp when the player is gone.
+			if time.Since(timer) >= 30*time.Second {
+				logger.Printf("udp client read %s rtcp error, %v", t.AVType, err)
+				timer = time.Now()
+			}
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		// RTCP packet type is 200..204, RR is 201.
+		if n >= 8 && buf[0]>>6 == 2 && buf[1] >= 200 && buf[1] <= 204 {
+			c.Session.InBytes += n
+			c.Session.touch()
+			if t.Backchannel {
+				c.handleRTP(t, true, buf[:n])
+			}
+		}
+	}
+}
+
+// receiveRTP reads the backchannel rtp sent by the player.
+func (c *UDPClient) receiveRTP(t *UDPTrack) {
+	logger := c.logger
+	conn := t.Conn
+	buf := make([]byte, UDP_BUF_SIZE)
+	timer := time.Unix(0, 0)
+	for !c.Stoped {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if c.Stoped || c.Track(t.Index) != t {
+				return
+			}
+			if time.Since(timer) >= 30*time.Second {
+				logger.Printf("udp client read %s rtp error, %v", t.AVType, err)
+				timer = time.Now()
+			}
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		c.Session.InBytes += n
+		c.Session.touch()
+		c.handleRTP(t, false, buf[:n])
+	}
+}
+
+func (c *UDPClient) handleRTP(t *UDPTrack, control bool, b []byte) {
+	pack := &RTPPack{
+		Type:   t.RTPType(control),
+		Track:  t.Index,
+		Buffer: bytes.NewBuffer(append([]byte{}, b...)),
+	}
+	for _, h := range c.Session.RTPHandles {
+		h(pack)
+	}
+}
+
+// LocalPorts returns the local rtp and rtcp ports of the track of index,
+// sent to the player as server_port.
+func (c *UDPClient) LocalPorts(index int) (rtpPort, rtcpPort int) {
+	t := c.Track(index)
+	if t == nil {
+		return
+	}
+	if t.Conn != nil {
+		rtpPort = t.Conn.LocalAddr().(*net.UDPAddr).Port
+	}
+	if t.ControlConn != nil {
+		rtcpPort = t.ControlConn.LocalAddr().(*net.UDPAddr).Port
+	}
+	return
+}
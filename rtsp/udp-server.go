@@ -5,29 +5,56 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/snowlyg/EasyDarwin/extend/utils"
 )
 
+// UDPTrack is the udp sockets of a track, rtp on Conn and rtcp on
+// ControlConn. The ports are local for UDPServer and remote for UDPClient.
+type UDPTrack struct {
+	*Track
+	Port        int
+	Conn        *net.UDPConn
+	ControlPort int
+	ControlConn *net.UDPConn
+
+	// the server ports of the source, UDPServer of a RTSPClient sends the
+	// backchannel there.
+	RemoteAddr        *net.UDPAddr
+	RemoteControlAddr *net.UDPAddr
+}
+
+func (t *UDPTrack) close() {
+	if t.Conn != nil {
+		t.Conn.Close()
+		t.Conn = nil
+	}
+	if t.ControlConn != nil {
+		t.ControlConn.Close()
+		t.ControlConn = nil
+	}
+}
+
 type UDPServer struct {
 	*Session
 	*RTSPClient
 
-	APort        int
-	AConn        *net.UDPConn
-	AControlPort int
-	AControlConn *net.UDPConn
-	VPort        int
-	VConn        *net.UDPConn
-	VControlPort int
-	VControlConn *net.UDPConn
+	tracks     map[int]*UDPTrack // track index <-> sockets
+	tracksLock sync.RWMutex
 
 	Stoped bool
 }
 
+func NewUDPServer(session *Session, client *RTSPClient) *UDPServer {
+	return &UDPServer{
+		Session:    session,
+		RTSPClient: client,
+		tracks:     make(map[int]*UDPTrack),
+	}
+}
+
 func (s *UDPServer) AddInputBytes(bytes int) {
 	if s.Session != nil {
 		s.Session.InBytes += bytes
@@ -42,6 +69,7 @@ func (s *UDPServer) AddInputBytes(bytes int) {
 
 func (s *UDPServer) HandleRTP(pack *RTPPack) {
 	if s.Session != nil {
+		s.Session.touch()
 		for _, v := range s.Session.RTPHandles {
 			v(pack)
 		}
@@ -72,207 +100,119 @@ func (s *UDPServer) Stop() {
 		return
 	}
 	s.Stoped = true
-	if s.AConn != nil {
-		s.AConn.Close()
-		s.AConn = nil
-	}
-	if s.AControlConn != nil {
-		s.AControlConn.Close()
-		s.AControlConn = nil
-	}
-	if s.VConn != nil {
-		s.VConn.Close()
-		s.VConn = nil
-	}
-	if s.VControlConn != nil {
-		s.VControlConn.Close()
-		s.VControlConn = nil
+	s.tracksLock.Lock()
+	for _, t := range s.tracks {
+		t.close()
 	}
+	s.tracksLock.Unlock()
 }
 
-func (s *UDPServer) SetupAudio() (err error) {
-	logger := s.Logger()
-	addr, err := net.ResolveUDPAddr("udp", ":0")
-	if err != nil {
-		return
-	}
-	s.AConn, err = net.ListenUDP("udp", addr)
-	if err != nil {
-		return
-	}
-	networkBuffer := utils.Conf().Section("rtsp").Key("network_buffer").MustInt(1048576)
-	if err := s.AConn.SetReadBuffer(networkBuffer); err != nil {
-		logger.Printf("udp server audio conn set read buffer error, %v", err)
-	}
-	if err := s.AConn.SetWriteBuffer(networkBuffer); err != nil {
-		logger.Printf("udp server audio conn set write buffer error, %v", err)
-	}
-	la := s.AConn.LocalAddr().String()
-	strPort := la[strings.LastIndex(la, ":")+1:]
-	s.APort, err = strconv.Atoi(strPort)
-	if err != nil {
-		return
-	}
-	go func() {
-		bufUDP := make([]byte, UDP_BUF_SIZE)
-		logger.Printf("udp server start listen audio port[%d]", s.APort)
-		defer logger.Printf("udp server stop listen audio port[%d]", s.APort)
-		timer := time.Unix(0, 0)
-		for !s.Stoped {
-			if n, _, err := s.AConn.ReadFromUDP(bufUDP); err == nil {
-				elapsed := time.Now().Sub(timer)
-				if elapsed >= 30*time.Second {
-					logger.Printf("Package recv from AConn.len:%d\n", n)
-					timer = time.Now()
-				}
-				rtpBytes := make([]byte, n)
-				s.AddInputBytes(n)
-				copy(rtpBytes, bufUDP)
-				pack := &RTPPack{
-					Type:   RTP_TYPE_AUDIO,
-					Buffer: bytes.NewBuffer(rtpBytes),
-				}
-				s.HandleRTP(pack)
-			} else {
-				logger.Println("udp server read audio pack error", err)
-				continue
-			}
+// Track returns the sockets of the track of index, nil if it is not set up.
+func (s *UDPServer) Track(index int) *UDPTrack {
+	s.tracksLock.RLock()
+	defer s.tracksLock.RUnlock()
+	return s.tracks[index]
+}
+
+// SetupTrack listens on a pair of ports for the rtp and rtcp of track.
+func (s *UDPServer) SetupTrack(track *Track) (t *UDPTrack, err error) {
+	t = &UDPTrack{Track: track}
+	defer func() {
+		if err != nil {
+			t.close()
 		}
 	}()
-	addr, err = net.ResolveUDPAddr("udp", ":0")
-	if err != nil {
+	if t.Conn, t.Port, err = s.listen(track.AVType); err != nil {
 		return
 	}
-	s.AControlConn, err = net.ListenUDP("udp", addr)
-	if err != nil {
+	if t.ControlConn, t.ControlPort, err = s.listen(track.AVType + " control"); err != nil {
 		return
 	}
-	if err := s.AControlConn.SetReadBuffer(networkBuffer); err != nil {
-		logger.Printf("udp server audio control conn set read buffer error, %v", err)
+	s.tracksLock.Lock()
+	if old := s.tracks[track.Index]; old != nil {
+		old.close()
 	}
-	if err := s.AControlConn.SetWriteBuffer(networkBuffer); err != nil {
-		logger.Printf("udp server audio control conn set write buffer error, %v", err)
-	}
-	la = s.AControlConn.LocalAddr().String()
-	strPort = la[strings.LastIndex(la, ":")+1:]
-	s.AControlPort, err = strconv.Atoi(strPort)
-	if err != nil {
-		return
-	}
-	go func() {
-		bufUDP := make([]byte, UDP_BUF_SIZE)
-		logger.Printf("udp server start listen audio control port[%d]", s.AControlPort)
-		defer logger.Printf("udp server stop listen audio control port[%d]", s.AControlPort)
-		for !s.Stoped {
-			if n, _, err := s.AControlConn.ReadFromUDP(bufUDP); err == nil {
-				//logger.Printf("Package recv from AControlConn.len:%d\n", n)
-				rtpBytes := make([]byte, n)
-				s.AddInputBytes(n)
-				copy(rtpBytes, bufUDP)
-				pack := &RTPPack{
-					Type:   RTP_TYPE_AUDIOCONTROL,
-					Buffer: bytes.NewBuffer(rtpBytes),
-				}
-				s.HandleRTP(pack)
-			} else {
-				logger.Println("udp server read audio control pack error", err)
-				continue
-			}
-		}
-	}()
+	s.tracks[track.Index] = t
+	s.tracksLock.Unlock()
+	go s.receive(t, false)
+	go s.receive(t, true)
 	return
 }
 
-func (s *UDPServer) SetupVideo() (err error) {
-	logger := s.Logger()
-	addr, err := net.ResolveUDPAddr("udp", ":0")
-	if err != nil {
+// SendRTP sends pack to the source of a pulled stream, on the backchannel.
+func (s *UDPServer) SendRTP(pack *RTPPack) (n int, err error) {
+	t := s.Track(pack.Track)
+	if t == nil {
+		err = fmt.Errorf("udp server send rtp got unkown track[%d]", pack.Track)
 		return
 	}
-	s.VConn, err = net.ListenUDP("udp", addr)
-	if err != nil {
-		return
-	}
-	networkBuffer := utils.Conf().Section("rtsp").Key("network_buffer").MustInt(1048576)
-	if err := s.VConn.SetReadBuffer(networkBuffer); err != nil {
-		logger.Printf("udp server video conn set read buffer error, %v", err)
-	}
-	if err := s.VConn.SetWriteBuffer(networkBuffer); err != nil {
-		logger.Printf("udp server video conn set write buffer error, %v", err)
+	conn, addr := t.Conn, t.RemoteAddr
+	if pack.Type.IsControl() {
+		conn, addr = t.ControlConn, t.RemoteControlAddr
 	}
-	la := s.VConn.LocalAddr().String()
-	strPort := la[strings.LastIndex(la, ":")+1:]
-	s.VPort, err = strconv.Atoi(strPort)
-	if err != nil {
+	if conn == nil || addr == nil {
+		err = fmt.Errorf("udp server send rtp pack type[%v] failed, remote not found", pack.Type)
 		return
 	}
-	go func() {
-		bufUDP := make([]byte, UDP_BUF_SIZE)
-		logger.Printf("udp server start listen video port[%d]", s.VPort)
-		defer logger.Printf("udp server stop listen video port[%d]", s.VPort)
-		timer := time.Unix(0, 0)
-		for !s.Stoped {
-			if n, _, err := s.VConn.ReadFromUDP(bufUDP); err == nil {
-				elapsed := time.Now().Sub(timer)
-				if elapsed >= 30*time.Second {
-					logger.Printf("Package recv from VConn.len:%d\n", n)
-					timer = time.Now()
-				}
-				rtpBytes := make([]byte, n)
-				s.AddInputBytes(n)
-				copy(rtpBytes, bufUDP)
-				pack := &RTPPack{
-					Type:   RTP_TYPE_VIDEO,
-					Buffer: bytes.NewBuffer(rtpBytes),
-				}
-				s.HandleRTP(pack)
-			} else {
-				logger.Println("udp server read video pack error", err)
-				continue
-			}
-		}
-	}()
+	return conn.WriteToUDP(pack.Buffer.Bytes(), addr)
+}
 
-	addr, err = net.ResolveUDPAddr("udp", ":0")
+func (s *UDPServer) listen(media string) (conn *net.UDPConn, port int, err error) {
+	logger := s.Logger()
+	addr, err := net.ResolveUDPAddr("udp", ":0")
 	if err != nil {
 		return
 	}
-	s.VControlConn, err = net.ListenUDP("udp", addr)
+	conn, err = net.ListenUDP("udp", addr)
 	if err != nil {
 		return
 	}
-	if err := s.VControlConn.SetReadBuffer(networkBuffer); err != nil {
-		logger.Printf("udp server video control conn set read buffer error, %v", err)
-	}
-	if err := s.VControlConn.SetWriteBuffer(networkBuffer); err != nil {
-		logger.Printf("udp server video control conn set write buffer error, %v", err)
+	networkBuffer := utils.Conf().Section("rtsp").Key("network_buffer").MustInt(1048576)
+	if err := conn.SetReadBuffer(networkBuffer); err != nil {
+		logger.Printf("udp server %s conn set read buffer error, %v", media, err)
 	}
-	la = s.VControlConn.LocalAddr().String()
-	strPort = la[strings.LastIndex(la, ":")+1:]
-	s.VControlPort, err = strconv.Atoi(strPort)
-	if err != nil {
-		return
+	if err := conn.SetWriteBuffer(networkBuffer); err != nil {
+		logger.Printf("udp server %s conn set write buffer error, %v", media, err)
 	}
-	go func() {
-		bufUDP := make([]byte, UDP_BUF_SIZE)
-		logger.Printf("udp server start listen video control port[%d]", s.VControlPort)
-		defer logger.Printf("udp server stop listen video control port[%d]", s.VControlPort)
-		for !s.Stoped {
-			if n, _, err := s.VControlConn.ReadFromUDP(bufUDP); err == nil {
-				//logger.Printf("Package recv from VControlConn.len:%d\n", n)
-				rtpBytes := make([]byte, n)
-				s.AddInputBytes(n)
-				copy(rtpBytes, bufUDP)
-				pack := &RTPPack{
-					Type:   RTP_TYPE_VIDEOCONTROL,
-					Buffer: bytes.NewBuffer(rtpBytes),
-				}
-				s.HandleRTP(pack)
-			} else {
-				logger.Println("udp server read video control pack error", err)
-				continue
+	port = conn.LocalAddr().(*net.UDPAddr).Port
+	return
+}
+
+func (s *UDPServer) receive(t *UDPTrack, control bool) {
+	logger := s.Logger()
+	conn, port := t.Conn, t.Port
+	if control {
+		conn, port = t.ControlConn, t.ControlPort
+	}
+	track := t.Track
+	typ := track.RTPType(control)
+	bufUDP := make([]byte, UDP_BUF_SIZE)
+	logger.Printf("udp server start listen %v port[%d]", typ, port)
+	defer logger.Printf("udp server stop listen %v port[%d]", typ, port)
+	timer := time.Unix(0, 0)
+	for !s.Stoped {
+		if n, _, err := conn.ReadFromUDP(bufUDP); err == nil {
+			elapsed := time.Now().Sub(timer)
+			if !control && elapsed >= 30*time.Second {
+				logger.Printf("Package recv from %v conn.len:%d\n", typ, n)
+				timer = time.Now()
+			}
+			rtpBytes := make([]byte, n)
+			s.AddInputBytes(n)
+			copy(rtpBytes, bufUDP)
+			pack := &RTPPack{
+				Type:   typ,
+				Track:  track.Index,
+				Buffer: bytes.NewBuffer(rtpBytes),
 			}
+			s.HandleRTP(pack)
+		} else {
+			if s.Stoped || s.Track(track.Index) != t {
+				// closed, or replaced by a new SETUP of the track.
+				return
+			}
+			logger.Printf("udp server read %v pack error, %v", typ, err)
+			continue
 		}
-	}()
-	return
+	}
 }
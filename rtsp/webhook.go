@@ -0,0 +1,160 @@
+package rtsp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/snowlyg/EasyDarwin/extend/utils"
+)
+
+const (
+	WEBHOOK_EVENT_HEADER     = "X-EasyDarwin-Event"
+	WEBHOOK_TIMESTAMP_HEADER = "X-EasyDarwin-Timestamp"
+	// hex(HMAC-SHA256(secret, timestamp + "." + body)), prefixed with "sha256="
+	WEBHOOK_SIGNATURE_HEADER = "X-EasyDarwin-Signature"
+)
+
+// WebHook posts server events as JSON to the urls in the [webhook] section.
+type WebHook struct {
+	SessionLogger
+	URLs          []string
+	Secret        string
+	Events        map[string]bool // empty means every event
+	Retries       int
+	RetryInterval time.Duration
+	client        *http.Client
+	queue         chan *Event
+	stopCh        chan struct{}
+}
+
+// NewWebHook returns nil when no webhook url is configured.
+func NewWebHook() *WebHook {
+	sec := utils.Conf().Section("webhook")
+	urls := make([]string, 0)
+	for _, u := range strings.Split(sec.Key("url").MustString(""), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+	events := make(map[string]bool)
+	for _, e := range strings.Split(sec.Key("events").MustString(""), ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			events[e] = true
+		}
+	}
+	hook := &WebHook{
+		SessionLogger: SessionLogger{log.New(os.Stdout, "[WebHook]", log.LstdFlags|log.Lshortfile)},
+		URLs:          urls,
+		Secret:        sec.Key("secret").MustString(""),
+		Events:        events,
+		Retries:       sec.Key("retries").MustInt(3),
+		RetryInterval: time.Duration(sec.Key("retry_interval").MustInt(1)) * time.Second,
+		client:        &http.Client{Timeout: time.Duration(sec.Key("timeout").MustInt(5)) * time.Second},
+		queue:         make(chan *Event, sec.Key("queue_size").MustInt(1024)),
+		stopCh:        make(chan struct{}),
+	}
+	if !utils.Debug {
+		hook.logger.SetOutput(utils.GetLogWriter())
+	}
+	go hook.run()
+	return hook
+}
+
+// Handle queues event for delivery, it never blocks the caller.
+func (hook *WebHook) Handle(event *Event) {
+	if len(hook.Events) > 0 && !hook.Events[event.Type] {
+		return
+	}
+	select {
+	case hook.queue <- event:
+	default:
+		hook.logger.Printf("queue full, drop event[%s] path[%s]", event.Type, event.Path)
+	}
+}
+
+func (hook *WebHook) Stop() {
+	close(hook.stopCh)
+}
+
+func (hook *WebHook) run() {
+	for {
+		select {
+		case <-hook.stopCh:
+			return
+		case event := <-hook.queue:
+			body, err := json.Marshal(event)
+			if err != nil {
+				hook.logger.Printf("marshal event[%s] err:%v", event.Type, err)
+				continue
+			}
+			for _, u := range hook.URLs {
+				hook.deliver(u, event.Type, body)
+			}
+		}
+	}
+}
+
+func (hook *WebHook) deliver(url, eventType string, body []byte) {
+	interval := hook.RetryInterval
+	for i := 0; ; i++ {
+		err := hook.post(url, eventType, body)
+		if err == nil {
+			return
+		}
+		if i >= hook.Retries {
+			hook.logger.Printf("post event[%s] to %s failed after %d retries, %v", eventType, url, i, err)
+			return
+		}
+		hook.logger.Printf("post event[%s] to %s err:%v, retry in %v", eventType, url, err, interval)
+		select {
+		case <-hook.stopCh:
+			return
+		case <-time.After(interval):
+		}
+		interval *= 2
+	}
+}
+
+func (hook *WebHook) post(url, eventType string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_EVENT_HEADER, eventType)
+	req.Header.Set(WEBHOOK_TIMESTAMP_HEADER, timestamp)
+	if hook.Secret != "" {
+		req.Header.Set(WEBHOOK_SIGNATURE_HEADER, "sha256="+SignWebHook(hook.Secret, timestamp, body))
+	}
+	resp, err := hook.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("response status %s", resp.Status)
+	}
+	return nil
+}
+
+func SignWebHook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}